@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // Decoders for thumbnails
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"seaside/lib/blobstore"
+	"seaside/lib/db"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Limits on chat attachments
+const (
+	MaxAttachmentSize = 10 << 20 // 10 MB
+	// AttachmentRequestLimit leaves room for the multipart framing around a file
+	AttachmentRequestLimit = MaxAttachmentSize + 64<<10
+
+	maxFileNameLength  = 255
+	thumbnailSize      = 320        // Longest side of a thumbnail, in pixels
+	maxThumbnailPixels = 16_000_000 // Larger images are stored without a thumbnail
+	// thumbnailWorkers bounds how many images are decoded at once; a decoded
+	// image takes up to 8 bytes a pixel
+	thumbnailWorkers = 4
+)
+
+// attachmentTypes maps the content types chat accepts to the extension
+// their files are stored under. Types are sniffed from the content, not
+// taken from the client.
+var attachmentTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+var errImageTooLarge = errors.New("image too large for a thumbnail")
+
+// thumbnailSlots holds a token for each thumbnail being made
+var thumbnailSlots = make(chan struct{}, thumbnailWorkers)
+
+// UploadAttachmentHandler stores an image or PDF for a room's chat. The
+// client then shares it with an "attachment" chat message carrying its ID.
+func (h *ChatHandlers) UploadAttachmentHandler(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid user context"})
+	}
+	roomID := c.Params("id")
+	if ok, err := h.readableRoom(c, userID); !ok {
+		return err
+	}
+	// Only people in the room can share files there; readable is not enough,
+	// as anyone can read the chat of a public room
+	if !h.rooms.HasUser(roomID, userID) {
+		return c.Status(403).JSON(fiber.Map{"error": "Join the room to share files in its chat"})
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Missing file"})
+	}
+	if fileHeader.Size > MaxAttachmentSize {
+		return c.Status(413).JSON(fiber.Map{
+			"error":    "File too large",
+			"max_size": MaxAttachmentSize,
+		})
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Printf("Failed to open upload for room %s: %v", roomID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to read file"})
+	}
+	data, err := io.ReadAll(io.LimitReader(file, MaxAttachmentSize+1))
+	file.Close()
+	if err != nil {
+		log.Printf("Failed to read upload for room %s: %v", roomID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to read file"})
+	}
+	if len(data) > MaxAttachmentSize {
+		return c.Status(413).JSON(fiber.Map{
+			"error":    "File too large",
+			"max_size": MaxAttachmentSize,
+		})
+	}
+
+	contentType := http.DetectContentType(data)
+	extension, ok := attachmentTypes[contentType]
+	if !ok {
+		return c.Status(415).JSON(fiber.Map{"error": "Only images and PDFs can be attached"})
+	}
+
+	id := uuid.New().String()
+	attachment := &db.ChatAttachment{
+		ID:          id,
+		RoomID:      roomID,
+		UserID:      &userID,
+		FileName:    attachmentName(fileHeader.Filename, extension),
+		ContentType: contentType,
+		SizeBytes:   int64(len(data)),
+		StorageKey:  "chat/" + id + extension,
+	}
+
+	ctx := c.UserContext()
+	if err := h.blobs.Put(ctx, attachment.StorageKey, data, contentType); err != nil {
+		log.Printf("Failed to store attachment for room %s: %v", roomID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store file"})
+	}
+
+	// The file is still useful without a thumbnail, so failing to make one is not an error
+	if strings.HasPrefix(contentType, "image/") {
+		thumbnail, width, height, err := makeThumbnail(data)
+		attachment.Width, attachment.Height = width, height
+		if err == nil {
+			key := "chat/" + id + "_thumb.jpg"
+			if err := h.blobs.Put(ctx, key, thumbnail, "image/jpeg"); err != nil {
+				log.Printf("Failed to store thumbnail of attachment %s: %v", id, err)
+			} else {
+				attachment.ThumbnailKey = &key
+			}
+		}
+	}
+
+	if err := h.attachmentRepo.CreateAttachment(attachment); err != nil {
+		log.Printf("Failed to save attachment for room %s: %v", roomID, err)
+		h.blobs.Delete(ctx, attachment.StorageKey)
+		if attachment.ThumbnailKey != nil {
+			h.blobs.Delete(ctx, *attachment.ThumbnailKey)
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store file"})
+	}
+
+	return c.Status(201).JSON(fiber.Map{"attachment": attachment})
+}
+
+// AttachmentHandler sends a file shared in chat. Its random ID is what
+// grants access, so guests in the room can open it too.
+func (h *ChatHandlers) AttachmentHandler(c *fiber.Ctx) error {
+	return h.sendAttachment(c, false)
+}
+
+// AttachmentThumbnailHandler sends the thumbnail of an image shared in chat
+func (h *ChatHandlers) AttachmentThumbnailHandler(c *fiber.Ctx) error {
+	return h.sendAttachment(c, true)
+}
+
+func (h *ChatHandlers) sendAttachment(c *fiber.Ctx, thumbnail bool) error {
+	attachmentID := c.Params("attachmentId")
+	attachment, err := h.attachmentRepo.GetAttachment(attachmentID)
+	if err != nil {
+		if err.Error() == "chat attachment not found" {
+			return c.Status(404).JSON(fiber.Map{"error": "Attachment not found"})
+		}
+		log.Printf("Failed to load attachment %s: %v", attachmentID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load attachment"})
+	}
+
+	key, contentType := attachment.StorageKey, attachment.ContentType
+	if thumbnail {
+		if attachment.ThumbnailKey == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Attachment has no thumbnail"})
+		}
+		key, contentType = *attachment.ThumbnailKey, "image/jpeg"
+	}
+
+	reader, err := h.blobs.Get(c.UserContext(), key)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Attachment file is missing"})
+		}
+		log.Printf("Failed to open attachment %s: %v", attachmentID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load attachment"})
+	}
+
+	// Only images are shown in the page; anything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	return c.SendStream(reader)
+}
+
+// attachmentName cleans up the name a client gave a file. It is only shown
+// to people, files are stored under their ID.
+func attachmentName(name, extension string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "attachment" + extension
+	}
+	for utf8.RuneCountInString(name) > maxFileNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// makeThumbnail returns a JPEG of an image scaled to thumbnailSize on its
+// longest side, and the image's own size. Formats the standard library
+// cannot decode, such as WebP, get no thumbnail and no size.
+func makeThumbnail(data []byte) ([]byte, int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, config.Width, config.Height, errImageTooLarge
+	}
+
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, config.Width, config.Height, err
+	}
+
+	var thumbnail bytes.Buffer
+	if err := jpeg.Encode(&thumbnail, scaleDown(img, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, config.Width, config.Height, err
+	}
+	return thumbnail.Bytes(), config.Width, config.Height, nil
+}
+
+// scaleDown shrinks an image to fit in a square of the given side, averaging
+// the pixels that fall into each output pixel. Transparency becomes white,
+// as JPEG has none.
+func scaleDown(src image.Image, side int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	outWidth, outHeight := width, height
+	if width >= height && width > side {
+		outWidth, outHeight = side, max(1, height*side/width)
+	} else if height > width && height > side {
+		outWidth, outHeight = max(1, width*side/height), side
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < outHeight; y++ {
+		y0 := bounds.Min.Y + y*height/outHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/outHeight)
+		for x := 0; x < outWidth; x++ {
+			x0 := bounds.Min.X + x*width/outWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/outWidth)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			// Colours are premultiplied, so adding the missing alpha paints white underneath
+			white := 0xffff - a/n
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
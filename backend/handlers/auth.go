@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -20,13 +21,15 @@ type AuthHandlers struct {
 	oauth2Service  *auth.OAuth2Service
 }
 
-func NewAuthHandlers(userRepo db.UserRepositoryInterface, jwtUtil *auth.JWTUtil) *AuthHandlers {
+// NewAuthHandlers creates the auth handlers. Their background cleanup stops
+// when ctx is done.
+func NewAuthHandlers(ctx context.Context, userRepo db.UserRepositoryInterface, jwtUtil *auth.JWTUtil) *AuthHandlers {
 	return &AuthHandlers{
 		userRepo:       userRepo,
 		jwtUtil:        jwtUtil,
 		passwordUtil:   auth.NewPasswordUtil(),
 		validationUtil: auth.NewValidationUtil(),
-		stateManager:   auth.NewOAuth2StateManager(),
+		stateManager:   auth.NewOAuth2StateManager(ctx),
 		oauth2Service:  auth.NewOAuth2Service(),
 	}
 }
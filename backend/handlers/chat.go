@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+
+	"seaside/internals/video"
+	"seaside/lib/blobstore"
+	"seaside/lib/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Page sizes for the chat history endpoint
+const (
+	defaultMessagesLimit = 50
+	maxMessagesLimit     = 100
+)
+
+type ChatHandlers struct {
+	rooms          *video.RoomMap
+	roomRepo       db.RoomRepositoryInterface
+	messageRepo    db.ChatMessageRepositoryInterface
+	attachmentRepo db.ChatAttachmentRepositoryInterface
+	moderationRepo db.ChatModerationRepositoryInterface
+	blobs          blobstore.BlobStore
+}
+
+func NewChatHandlers(rooms *video.RoomMap, roomRepo db.RoomRepositoryInterface, messageRepo db.ChatMessageRepositoryInterface, attachmentRepo db.ChatAttachmentRepositoryInterface, moderationRepo db.ChatModerationRepositoryInterface, blobs blobstore.BlobStore) *ChatHandlers {
+	return &ChatHandlers{
+		rooms:          rooms,
+		roomRepo:       roomRepo,
+		messageRepo:    messageRepo,
+		attachmentRepo: attachmentRepo,
+		moderationRepo: moderationRepo,
+		blobs:          blobs,
+	}
+}
+
+// readableRoom checks the caller may read the chat of the room named in the
+// URL. It writes the error response itself and returns false if not.
+func (h *ChatHandlers) readableRoom(c *fiber.Ctx, userID uint) (bool, error) {
+	roomID := c.Params("id")
+
+	// Saved rooms keep their chat as private as the room itself
+	room, err := h.roomRepo.GetRoomByID(roomID)
+	if err != nil && err.Error() != "room not found" {
+		log.Printf("Failed to load room %s: %v", roomID, err)
+		return false, c.Status(500).JSON(fiber.Map{"error": "Failed to load room"})
+	}
+	owner := room != nil && room.OwnerID == userID
+	if room != nil && !owner && room.PrivacyMode == db.RoomPrivacyInvite {
+		return false, c.Status(403).JSON(fiber.Map{"error": "Only the room host can read this chat"})
+	}
+	if info, err := h.rooms.GetRoom(roomID); err == nil && !owner && info.Banned(userID, c.IP()) {
+		return false, c.Status(403).JSON(fiber.Map{"error": "You have been banned from this room"})
+	}
+	return true, nil
+}
+
+// MessagesHandler returns a page of a room's chat history, oldest first.
+// Pass the ID of the oldest message already shown as before to scroll back.
+func (h *ChatHandlers) MessagesHandler(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid user context"})
+	}
+	roomID := c.Params("id")
+	if ok, err := h.readableRoom(c, userID); !ok {
+		return err
+	}
+
+	var before uint64
+	var err error
+	if value := c.Query("before"); value != "" {
+		before, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid before message ID"})
+		}
+	}
+
+	limit := defaultMessagesLimit
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid limit"})
+		}
+		if limit > maxMessagesLimit {
+			limit = maxMessagesLimit
+		}
+	}
+
+	// Ask for one extra message to tell whether there is more to load
+	messages, err := h.messageRepo.GetMessages(roomID, before, limit+1)
+	if err != nil {
+		log.Printf("Failed to load messages of room %s: %v", roomID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load messages"})
+	}
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[1:]
+	}
+
+	return c.JSON(fiber.Map{
+		"messages": messages,
+		"has_more": hasMore,
+	})
+}
+
+// ModerationHandler returns a page of the messages moderation flagged,
+// masked or rejected in a room, newest first. Only the room's owner can
+// read it. Pass the ID of the oldest event already shown as before.
+func (h *ChatHandlers) ModerationHandler(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid user context"})
+	}
+	roomID := c.Params("id")
+
+	room, err := h.roomRepo.GetRoomByID(roomID)
+	if err != nil {
+		if err.Error() == "room not found" {
+			return c.Status(404).JSON(fiber.Map{"error": "Room not found"})
+		}
+		log.Printf("Failed to load room %s: %v", roomID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load room"})
+	}
+	if room.OwnerID != userID {
+		return c.Status(403).JSON(fiber.Map{"error": "Only the room host can do this"})
+	}
+
+	var before uint64
+	if value := c.Query("before"); value != "" {
+		before, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid before event ID"})
+		}
+	}
+
+	limit := defaultMessagesLimit
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid limit"})
+		}
+		if limit > maxMessagesLimit {
+			limit = maxMessagesLimit
+		}
+	}
+
+	// Ask for one extra event to tell whether there is more to load
+	events, err := h.moderationRepo.GetEvents(roomID, before, limit+1)
+	if err != nil {
+		log.Printf("Failed to load moderation events of room %s: %v", roomID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load moderation events"})
+	}
+	hasMore := len(events) > limit
+	if hasMore {
+		events = events[:limit]
+	}
+
+	return c.JSON(fiber.Map{
+		"events":   events,
+		"has_more": hasMore,
+	})
+}
@@ -0,0 +1,687 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"seaside/internals/chat"
+	"seaside/internals/video"
+	"seaside/lib/auth"
+	"seaside/lib/db"
+	"seaside/lib/roomstore"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Invite lifetimes
+const (
+	defaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 7 * 24 * time.Hour
+)
+
+type RoomHandlers struct {
+	rooms          *video.RoomMap
+	roomRepo       db.RoomRepositoryInterface
+	recordingRepo  db.RecordingRepositoryInterface
+	jwtUtil        *auth.JWTUtil
+	validationUtil *auth.ValidationUtil
+}
+
+func NewRoomHandlers(rooms *video.RoomMap, roomRepo db.RoomRepositoryInterface, recordingRepo db.RecordingRepositoryInterface, jwtUtil *auth.JWTUtil) *RoomHandlers {
+	return &RoomHandlers{
+		rooms:          rooms,
+		roomRepo:       roomRepo,
+		recordingRepo:  recordingRepo,
+		jwtUtil:        jwtUtil,
+		validationUtil: auth.NewValidationUtil(),
+	}
+}
+
+type CreateRoomRequest struct {
+	Title           string     `json:"title" validate:"max=100,no_sql_injection"`
+	MaxParticipants int        `json:"max_participants"`                                            // Defaults to the mesh limit
+	PrivacyMode     string     `json:"privacy_mode" validate:"omitempty,oneof=open members invite"` // Defaults to open
+	ExpiresAt       *time.Time `json:"expires_at"`                                                  // Never expires when omitted
+	WaitingRoom     bool       `json:"waiting_room"`                                                // Hold joiners until a host admits them
+}
+
+type UpdateRoomRequest struct {
+	Title           *string `json:"title" validate:"omitempty,max=100,no_sql_injection"`
+	MaxParticipants *int    `json:"max_participants"`
+	PrivacyMode     *string `json:"privacy_mode" validate:"omitempty,oneof=open members invite"` // "members" and "invite" keep guests out
+	WaitingRoom     *bool   `json:"waiting_room"`
+
+	ChatModeration *ChatModerationRequest `json:"chat_moderation"` // Replaces the room's settings; {} restores the defaults
+}
+
+// ChatModerationRequest overrides the server's chat moderation defaults for
+// a room. Empty fields keep the defaults.
+type ChatModerationRequest struct {
+	Disabled        bool     `json:"disabled"`
+	BlockedWords    []string `json:"blocked_words" validate:"max=200,dive,min=1,max=50"` // Added to the server's list
+	ProfanityAction string   `json:"profanity_action" validate:"omitempty,oneof=mask reject flag"`
+	AllowedDomains  []string `json:"allowed_domains" validate:"max=100,dive,hostname_rfc1123"`
+	BlockedDomains  []string `json:"blocked_domains" validate:"max=100,dive,hostname_rfc1123"`
+	LinkAction      string   `json:"link_action" validate:"omitempty,oneof=mask reject flag"`
+	MaxLength       int      `json:"max_length" validate:"min=0,max=10000"`
+	SpamLimit       int      `json:"spam_limit" validate:"min=0,max=100"`
+}
+
+type CreateInviteRequest struct {
+	Role      string `json:"role" validate:"omitempty,oneof=guest co-host"` // Defaults to guest
+	ExpiresIn int    `json:"expires_in" validate:"omitempty,min=60"`        // Seconds, defaults to a day
+}
+
+type LockRoomRequest struct {
+	Locked *bool `json:"locked"` // Defaults to true when omitted
+}
+
+type roomParticipant struct {
+	ID       string    `json:"id"`
+	Host     bool      `json:"host"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type waitingParticipant struct {
+	ID     string `json:"id"`
+	UserID uint   `json:"user_id,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// roomInfo converts a persisted room into the settings kept in the room store
+func roomInfo(room *db.Room) roomstore.RoomInfo {
+	return roomstore.RoomInfo{
+		ID:              room.ID,
+		HostUserID:      room.OwnerID,
+		MaxParticipants: room.MaxParticipants,
+		PrivacyMode:     room.PrivacyMode,
+		WaitingRoom:     room.WaitingRoom,
+		CreatedAt:       room.CreatedAt,
+		ExpiresAt:       room.ExpiresAt,
+		ChatModeration:  chatModeration(room.ChatModeration),
+	}
+}
+
+// chatModeration converts a room's stored moderation settings into those
+// kept in the room store
+func chatModeration(settings *db.ChatModeration) *roomstore.ChatModeration {
+	if settings == nil {
+		return nil
+	}
+	return &roomstore.ChatModeration{
+		Disabled:        settings.Disabled,
+		BlockedWords:    settings.BlockedWords,
+		ProfanityAction: settings.ProfanityAction,
+		AllowedDomains:  settings.AllowedDomains,
+		BlockedDomains:  settings.BlockedDomains,
+		LinkAction:      settings.LinkAction,
+		MaxLength:       settings.MaxLength,
+		SpamLimit:       settings.SpamLimit,
+	}
+}
+
+// LoadRoom restores a persisted room's settings into the room store when
+// someone joins it, e.g. after a restart. It is installed as the
+// video.RoomLoader.
+func (h *RoomHandlers) LoadRoom(roomID string) (*roomstore.RoomInfo, error) {
+	room, err := h.roomRepo.GetRoomByID(roomID)
+	if err != nil {
+		if err.Error() != "room not found" {
+			return nil, err
+		}
+
+		// Only IDs nobody ever saved become anonymous rooms
+		reason, err := h.roomRepo.RetiredRoom(roomID)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			return nil, roomstore.ErrRoomClosed
+		}
+		return nil, nil
+	}
+
+	info := roomInfo(room)
+	bans, err := h.roomRepo.GetBans(roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, ban := range bans {
+		if ban.UserID != nil {
+			info.BannedUserIDs = append(info.BannedUserIDs, *ban.UserID)
+		} else if ban.IP != nil {
+			info.BannedIPs = append(info.BannedIPs, *ban.IP)
+		}
+	}
+	return &info, nil
+}
+
+// SaveBan keeps a ban from a saved room, so it still applies once the room
+// has emptied and is loaded again. Anonymous rooms are not saved and keep
+// their bans only while someone is in them. It is installed as the
+// video.BanSaver.
+func (h *RoomHandlers) SaveBan(roomID string, member roomstore.Member) error {
+	if _, err := h.roomRepo.GetRoomByID(roomID); err != nil {
+		if err.Error() == "room not found" {
+			return nil
+		}
+		return err
+	}
+
+	ban := &db.RoomBan{RoomID: roomID}
+	switch {
+	case member.UserID != 0:
+		ban.UserID = &member.UserID
+	case member.IP != "":
+		ban.IP = &member.IP
+	default:
+		return nil
+	}
+	return h.roomRepo.AddBan(ban)
+}
+
+// SaveRecording stores a finished recording of a room. It is installed as
+// the video.RecordingSaver.
+func (h *RoomHandlers) SaveRecording(file video.RecordingFile) error {
+	recording := &db.Recording{
+		RoomID:        file.RoomID,
+		Session:       file.Session,
+		ParticipantID: file.ParticipantID,
+		Kind:          file.Kind,
+		Format:        file.Format,
+		Path:          file.Path,
+		SizeBytes:     file.Size,
+		StartedAt:     file.StartedAt,
+		EndedAt:       file.EndedAt,
+	}
+	if file.UserID != 0 {
+		recording.UserID = &file.UserID
+	}
+	if file.StartedBy != 0 {
+		recording.StartedBy = &file.StartedBy
+	}
+	return h.recordingRepo.CreateRecording(recording)
+}
+
+// ownedRoom loads the room named in the URL and checks the caller owns it.
+// It writes the error response itself and returns nil if the caller may not
+// manage the room.
+func (h *RoomHandlers) ownedRoom(c *fiber.Ctx) (*db.Room, error) {
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return nil, c.Status(401).JSON(fiber.Map{"error": "Invalid user context"})
+	}
+
+	room, err := h.roomRepo.GetRoomByID(c.Params("id"))
+	if err != nil {
+		if err.Error() == "room not found" {
+			return nil, c.Status(404).JSON(fiber.Map{"error": "Room not found"})
+		}
+		log.Printf("Failed to load room %s: %v", c.Params("id"), err)
+		return nil, c.Status(500).JSON(fiber.Map{"error": "Failed to load room"})
+	}
+
+	if room.OwnerID != userID {
+		return nil, c.Status(403).JSON(fiber.Map{"error": "Only the room host can do this"})
+	}
+
+	return room, nil
+}
+
+// roomResponse combines a room's stored settings with its live state
+func (h *RoomHandlers) roomResponse(room *db.Room) (fiber.Map, error) {
+	locked := false
+	info, err := h.rooms.GetRoom(room.ID)
+	if err == nil {
+		locked = info.Locked
+	} else if !errors.Is(err, roomstore.ErrRoomNotFound) {
+		return nil, err
+	}
+
+	members, err := h.rooms.Members(room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make([]roomParticipant, 0, len(members))
+	for _, member := range members {
+		participants = append(participants, roomParticipant{
+			ID:       member.ID,
+			Host:     member.Host,
+			JoinedAt: member.JoinedAt,
+		})
+	}
+
+	knocks := h.rooms.WaitingList(room.ID)
+	waiting := make([]waitingParticipant, 0, len(knocks))
+	for _, knock := range knocks {
+		waiting = append(waiting, waitingParticipant{ID: knock.ID, UserID: knock.UserID, Name: knock.Name})
+	}
+
+	return fiber.Map{
+		"id":               room.ID,
+		"title":            room.Title,
+		"max_participants": room.MaxParticipants,
+		"privacy_mode":     room.PrivacyMode,
+		"waiting_room":     room.WaitingRoom,
+		"chat_moderation":  room.ChatModeration,
+		"created_at":       room.CreatedAt,
+		"expires_at":       room.ExpiresAt,
+		"locked":           locked,
+		"participants":     participants,
+		"waiting":          waiting,
+	}, nil
+}
+
+// CreateRoomHandler creates a persistent room owned by the caller
+func (h *RoomHandlers) CreateRoomHandler(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid user context"})
+	}
+
+	var req CreateRoomRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+
+	// Validate input
+	if err := h.validationUtil.ValidateStruct(&req); err != nil {
+		errors := h.validationUtil.GetValidationErrors(err)
+		return c.Status(400).JSON(fiber.Map{
+			"error":  "Validation failed",
+			"errors": errors,
+		})
+	}
+
+	if req.MaxParticipants == 0 {
+		req.MaxParticipants = h.rooms.MaxParticipants()
+	}
+	if req.MaxParticipants < 2 || req.MaxParticipants > h.rooms.MaxParticipants() {
+		return c.Status(400).JSON(fiber.Map{
+			"error": fmt.Sprintf("max_participants must be between 2 and %d", h.rooms.MaxParticipants()),
+		})
+	}
+	if req.PrivacyMode == "" {
+		req.PrivacyMode = db.RoomPrivacyOpen
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_at must be in the future"})
+	}
+
+	room := &db.Room{
+		OwnerID:         userID,
+		Title:           h.validationUtil.SanitizeInput(req.Title),
+		MaxParticipants: req.MaxParticipants,
+		PrivacyMode:     req.PrivacyMode,
+		WaitingRoom:     req.WaitingRoom,
+		ExpiresAt:       req.ExpiresAt,
+	}
+
+	// Reserve the ID in the room store first so it is unique among live rooms
+	roomID, err := h.rooms.CreateRoom(roomInfo(room))
+	if err != nil {
+		log.Printf("Failed to create room: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create room"})
+	}
+
+	room.ID = roomID
+	if err := h.roomRepo.CreateRoom(room); err != nil {
+		log.Printf("Failed to save room %s: %v", roomID, err)
+		h.rooms.DeleteRoom(roomID)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create room"})
+	}
+
+	log.Printf("Room created: %s (owner user %d)", roomID, userID)
+
+	response, err := h.roomResponse(room)
+	if err != nil {
+		log.Printf("Failed to load room %s: %v", roomID, err)
+		return c.Status(201).JSON(fiber.Map{"id": roomID})
+	}
+	return c.Status(201).JSON(response)
+}
+
+// ListRoomsHandler lists the rooms owned by the caller
+func (h *RoomHandlers) ListRoomsHandler(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid user context"})
+	}
+
+	rooms, err := h.roomRepo.GetRoomsByOwner(userID)
+	if err != nil {
+		log.Printf("Failed to list rooms: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to list rooms"})
+	}
+
+	response := make([]fiber.Map, 0, len(rooms))
+	for i := range rooms {
+		entry, err := h.roomResponse(&rooms[i])
+		if err != nil {
+			log.Printf("Failed to load room %s: %v", rooms[i].ID, err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to list rooms"})
+		}
+		response = append(response, entry)
+	}
+
+	return c.JSON(fiber.Map{"rooms": response})
+}
+
+// GetRoomHandler returns a room and its participants
+func (h *RoomHandlers) GetRoomHandler(c *fiber.Ctx) error {
+	room, err := h.ownedRoom(c)
+	if room == nil {
+		return err
+	}
+
+	response, err := h.roomResponse(room)
+	if err != nil {
+		log.Printf("Failed to load room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load room"})
+	}
+
+	return c.JSON(response)
+}
+
+// UpdateRoomHandler changes a room's title, size limit, guest policy or chat moderation.
+// Fields left out of the request keep their current value.
+func (h *RoomHandlers) UpdateRoomHandler(c *fiber.Ctx) error {
+	room, err := h.ownedRoom(c)
+	if room == nil {
+		return err
+	}
+
+	var req UpdateRoomRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	// Validate input
+	if err := h.validationUtil.ValidateStruct(&req); err != nil {
+		errors := h.validationUtil.GetValidationErrors(err)
+		return c.Status(400).JSON(fiber.Map{
+			"error":  "Validation failed",
+			"errors": errors,
+		})
+	}
+
+	if req.Title != nil {
+		room.Title = h.validationUtil.SanitizeInput(*req.Title)
+	}
+	if req.MaxParticipants != nil {
+		if *req.MaxParticipants < 2 || *req.MaxParticipants > h.rooms.MaxParticipants() {
+			return c.Status(400).JSON(fiber.Map{
+				"error": fmt.Sprintf("max_participants must be between 2 and %d", h.rooms.MaxParticipants()),
+			})
+		}
+		room.MaxParticipants = *req.MaxParticipants
+	}
+	if req.PrivacyMode != nil {
+		room.PrivacyMode = *req.PrivacyMode
+	}
+	if req.WaitingRoom != nil {
+		room.WaitingRoom = *req.WaitingRoom
+	}
+	if req.ChatModeration != nil {
+		room.ChatModeration = &db.ChatModeration{
+			Disabled:        req.ChatModeration.Disabled,
+			BlockedWords:    req.ChatModeration.BlockedWords,
+			ProfanityAction: req.ChatModeration.ProfanityAction,
+			AllowedDomains:  req.ChatModeration.AllowedDomains,
+			BlockedDomains:  req.ChatModeration.BlockedDomains,
+			LinkAction:      req.ChatModeration.LinkAction,
+			MaxLength:       req.ChatModeration.MaxLength,
+			SpamLimit:       req.ChatModeration.SpamLimit,
+		}
+	}
+
+	if err := h.roomRepo.UpdateRoom(room); err != nil {
+		log.Printf("Failed to update room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update room"})
+	}
+
+	// New joins see the change straight away; people already in the room stay
+	if err := h.rooms.UpdateSettings(roomInfo(room)); err != nil {
+		log.Printf("Failed to update live room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update room"})
+	}
+
+	response, err := h.roomResponse(room)
+	if err != nil {
+		log.Printf("Failed to load room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load room"})
+	}
+	return c.JSON(response)
+}
+
+// CreateInviteHandler issues a signed invite token for a room. Joining with
+// ?invite=<token> admits the holder with the invite's role until it expires,
+// even to invite-only and members-only rooms.
+func (h *RoomHandlers) CreateInviteHandler(c *fiber.Ctx) error {
+	room, err := h.ownedRoom(c)
+	if room == nil {
+		return err
+	}
+
+	var req CreateInviteRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+
+	// Validate input
+	if err := h.validationUtil.ValidateStruct(&req); err != nil {
+		errors := h.validationUtil.GetValidationErrors(err)
+		return c.Status(400).JSON(fiber.Map{
+			"error":  "Validation failed",
+			"errors": errors,
+		})
+	}
+
+	if req.Role == "" {
+		req.Role = auth.RoleGuest
+	}
+	ttl := defaultInviteTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > maxInviteTTL {
+		ttl = maxInviteTTL
+	}
+	// An invite is no use after its room expires
+	expiresAt := time.Now().Add(ttl)
+	if room.ExpiresAt != nil && room.ExpiresAt.Before(expiresAt) {
+		expiresAt = *room.ExpiresAt
+		ttl = time.Until(expiresAt)
+	}
+
+	token, err := h.jwtUtil.GenerateRoomInvite(room.OwnerID, room.ID, req.Role, ttl)
+	if err != nil {
+		log.Printf("Failed to create invite for room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create invite"})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"room_id":    room.ID,
+		"role":       req.Role,
+		"token":      token,
+		"expires_at": expiresAt,
+	})
+}
+
+// LockRoomHandler locks or unlocks a room against new joins
+func (h *RoomHandlers) LockRoomHandler(c *fiber.Ctx) error {
+	room, err := h.ownedRoom(c)
+	if room == nil {
+		return err
+	}
+
+	var req LockRoomRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+
+	locked := true
+	if req.Locked != nil {
+		locked = *req.Locked
+	}
+
+	// The room may not be live yet, e.g. when locking it before anyone joins
+	if _, err := h.rooms.OpenRoom(room.ID); err != nil {
+		log.Printf("Failed to open room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update room"})
+	}
+
+	if err := h.rooms.SetLocked(room.ID, locked); err != nil {
+		log.Printf("Failed to lock room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update room"})
+	}
+
+	return c.JSON(fiber.Map{"id": room.ID, "locked": locked})
+}
+
+// DeleteRoomHandler closes a room, disconnects everyone in it and deletes it
+func (h *RoomHandlers) DeleteRoomHandler(c *fiber.Ctx) error {
+	room, err := h.ownedRoom(c)
+	if room == nil {
+		return err
+	}
+
+	if err := h.roomRepo.DeleteRoom(room.ID); err != nil {
+		log.Printf("Failed to delete room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete room"})
+	}
+
+	chat.CloseRoom(room.ID)
+	if err := h.rooms.DeleteRoom(room.ID); err != nil {
+		log.Printf("Failed to close room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to close room"})
+	}
+
+	// Recording rows go with the room, their files are removed here
+	if err := h.rooms.DeleteRecordings(room.ID); err != nil {
+		log.Printf("Failed to delete recordings of room %s: %v", room.ID, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Room deleted"})
+}
+
+// StartExpiryCleanup deletes expired rooms and the recording files of
+// retired rooms every interval until ctx is done
+func (h *RoomHandlers) StartExpiryCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.cleanupExpiredRooms()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// cleanupExpiredRooms deletes expired rooms and closes them like
+// DeleteRoomHandler does, so they do not live on in the room store
+func (h *RoomHandlers) cleanupExpiredRooms() {
+	rooms, err := h.roomRepo.DeleteExpiredRooms()
+	if err != nil {
+		log.Printf("Failed to clean up expired rooms: %v", err)
+		return
+	}
+
+	for _, room := range rooms {
+		chat.CloseRoom(room.ID)
+		if err := h.rooms.DeleteRoom(room.ID); err != nil {
+			log.Printf("Failed to close expired room %s: %v", room.ID, err)
+		}
+	}
+	if len(rooms) > 0 {
+		log.Printf("Cleaned up %d expired rooms", len(rooms))
+	}
+
+	h.sweepRecordings()
+}
+
+// sweepRecordings removes the recording files of retired rooms from this
+// node. Their rows went with the room, and the room may have been deleted
+// or cleaned up by another node.
+func (h *RoomHandlers) sweepRecordings() {
+	roomIDs, err := h.rooms.RecordedRooms()
+	if err != nil {
+		log.Printf("Failed to list recorded rooms: %v", err)
+		return
+	}
+
+	for _, roomID := range roomIDs {
+		reason, err := h.roomRepo.RetiredRoom(roomID)
+		if err != nil {
+			log.Printf("Failed to check room %s: %v", roomID, err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		if err := h.rooms.DeleteRecordings(roomID); err != nil {
+			log.Printf("Failed to delete recordings of room %s: %v", roomID, err)
+		}
+	}
+}
+
+// ListRecordingsHandler lists a room's recordings, one entry per recorded
+// track. Entries with the same session belong to the same recording.
+func (h *RoomHandlers) ListRecordingsHandler(c *fiber.Ctx) error {
+	room, err := h.ownedRoom(c)
+	if room == nil {
+		return err
+	}
+
+	recordings, err := h.recordingRepo.GetRecordingsByRoom(room.ID)
+	if err != nil {
+		log.Printf("Failed to list recordings of room %s: %v", room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to list recordings"})
+	}
+
+	return c.JSON(fiber.Map{"recordings": recordings})
+}
+
+// DownloadRecordingHandler sends a recorded file as an attachment
+func (h *RoomHandlers) DownloadRecordingHandler(c *fiber.Ctx) error {
+	room, err := h.ownedRoom(c)
+	if room == nil {
+		return err
+	}
+
+	recordingID, err := strconv.ParseUint(c.Params("recordingId"), 10, 32)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid recording ID"})
+	}
+
+	recording, err := h.recordingRepo.GetRecording(room.ID, uint(recordingID))
+	if err != nil {
+		if err.Error() == "recording not found" {
+			return c.Status(404).JSON(fiber.Map{"error": "Recording not found"})
+		}
+		log.Printf("Failed to load recording %d of room %s: %v", recordingID, room.ID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load recording"})
+	}
+
+	if err := c.Download(recording.Path, filepath.Base(recording.Path)); err != nil {
+		log.Printf("Failed to send recording %s: %v", recording.Path, err)
+		return c.Status(404).JSON(fiber.Map{"error": "Recording file is missing"})
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"seaside/lib/config"
+	"seaside/lib/turnserver"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type TurnHandlers struct {
+	server *turnserver.Server // nil when the embedded relay is disabled
+	ice    config.ICEConfig
+}
+
+func NewTurnHandlers(server *turnserver.Server, ice config.ICEConfig) *TurnHandlers {
+	return &TurnHandlers{server: server, ice: ice}
+}
+
+// CredentialsHandler issues time-limited TURN credentials to the signed-in user
+func (h *TurnHandlers) CredentialsHandler(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid user context"})
+	}
+
+	if h.server == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "TURN relay is not enabled"})
+	}
+
+	credentials, err := h.server.Credentials(userID)
+	if err != nil {
+		log.Printf("Failed to issue TURN credentials for user %d: %v", userID, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to issue TURN credentials"})
+	}
+
+	return c.JSON(fiber.Map{
+		"username":   credentials.Username,
+		"password":   credentials.Password,
+		"ttl":        int(time.Until(credentials.ExpiresAt).Seconds()),
+		"expires_at": credentials.ExpiresAt,
+		"uris":       credentials.URIs,
+	})
+}
+
+// ICEServersHandler returns the ICE servers clients should configure their
+// peer connections with. Signed-in users always get TURN credentials; guests
+// only when the deployment allows it.
+func (h *TurnHandlers) ICEServersHandler(c *fiber.Ctx) error {
+	user := "guest"
+	userID, signedIn := c.Locals("userID").(uint)
+	if signedIn {
+		user = strconv.FormatUint(uint64(userID), 10)
+	}
+
+	servers, expiresAt := h.ice.Servers(user, signedIn || h.ice.GuestRelay)
+	return c.JSON(fiber.Map{
+		"ice_servers": servers,
+		"ttl":         int(h.ice.CredentialTTL.Seconds()),
+		"expires_at":  expiresAt,
+	})
+}
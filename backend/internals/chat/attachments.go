@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"seaside/lib/db"
+)
+
+// blobTimeout bounds deleting a file from the blob store
+const blobTimeout = 10 * time.Second
+
+// ErrAttachmentNotFound is returned when a client shares an upload that does
+// not exist or is not theirs to share
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// AttachmentInfo describes a file shared in chat. URLs are relative to the
+// API; anyone holding them can download the file.
+type AttachmentInfo struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType"`
+	Size         int64  `json:"size"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"` // Images only
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+}
+
+// attachmentInfo converts a stored attachment into the wire format
+func attachmentInfo(attachment db.ChatAttachment) *AttachmentInfo {
+	info := &AttachmentInfo{
+		ID:          attachment.ID,
+		Name:        attachment.FileName,
+		ContentType: attachment.ContentType,
+		Size:        attachment.SizeBytes,
+		URL:         "/attachments/" + attachment.ID,
+		Width:       attachment.Width,
+		Height:      attachment.Height,
+	}
+	if attachment.ThumbnailKey != nil {
+		info.ThumbnailURL = info.URL + "/thumbnail"
+	}
+	return info
+}
+
+// PostAttachment shares a file in the chat of the room it was uploaded to,
+// with an optional caption. Only the uploader can share it.
+func (cm *ChatManager) PostAttachment(participant *ChatParticipant, attachmentID, caption string) error {
+	if cm.attachments == nil || participant.UserID == 0 || attachmentID == "" {
+		return ErrAttachmentNotFound
+	}
+
+	attachment, err := cm.attachments.GetAttachment(attachmentID)
+	if err != nil {
+		if err.Error() == "chat attachment not found" {
+			return ErrAttachmentNotFound
+		}
+		log.Printf("[Chat] Error loading attachment %s: %v", attachmentID, err)
+		return ErrNotSaved
+	}
+	if attachment.RoomID != participant.RoomID || attachment.UserID == nil || *attachment.UserID != participant.UserID {
+		return ErrAttachmentNotFound
+	}
+
+	caption, err = cm.moderate(participant, "attachment", strings.TrimSpace(caption))
+	if err != nil {
+		return err
+	}
+
+	cm.postMessage(ChatMessage{
+		Type:       "attachment",
+		Text:       caption,
+		From:       participant.name(),
+		FromID:     participant.ID,
+		UserID:     participant.UserID,
+		Timestamp:  time.Now(),
+		RoomID:     participant.RoomID,
+		Attachment: attachmentInfo(*attachment),
+	})
+	return nil
+}
+
+// removeAttachment deletes a shared file and its thumbnail. Its record goes
+// first: a file without one is no longer served, so blobs that cannot be
+// deleted are only logged.
+func (cm *ChatManager) removeAttachment(attachmentID string) error {
+	if cm.attachments == nil {
+		return nil
+	}
+
+	attachment, err := cm.attachments.GetAttachment(attachmentID)
+	if err != nil {
+		if err.Error() == "chat attachment not found" {
+			return nil // Shared more than once and already deleted
+		}
+		return err
+	}
+	if err := cm.attachments.DeleteAttachment(attachmentID); err != nil {
+		return err
+	}
+	if cm.blobs == nil {
+		return nil
+	}
+
+	keys := []string{attachment.StorageKey}
+	if attachment.ThumbnailKey != nil {
+		keys = append(keys, *attachment.ThumbnailKey)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), blobTimeout)
+	defer cancel()
+	for _, key := range keys {
+		if err := cm.blobs.Delete(ctx, key); err != nil {
+			log.Printf("[Chat] Error deleting %s of attachment %s: %v", key, attachmentID, err)
+		}
+	}
+	return nil
+}
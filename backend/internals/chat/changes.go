@@ -0,0 +1,200 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"seaside/lib/db"
+)
+
+// maxEmojiLength bounds a reaction in bytes; one emoji can combine several
+// code points
+const maxEmojiLength = 32
+
+// Reasons a change to a message is refused
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotAuthor       = errors.New("only its author or a host can change a message")
+	ErrEmptyMessage    = errors.New("message text is empty")
+	ErrInvalidEmoji    = errors.New("invalid reaction")
+	ErrNotSaved        = errors.New("change could not be saved, try again")
+)
+
+// apply returns the message as it is after a change
+func (m ChatMessage) apply(change ChatMessage) ChatMessage {
+	switch change.Type {
+	case "edit":
+		m.Text = change.Text
+		m.Edited = true
+	case "delete":
+		m.Text = ""
+		m.Deleted = true
+		m.Reactions = nil
+		m.Attachment = nil
+	case "react":
+		// Copy the reactions, the message may be shared with a reader
+		reactions := make(map[string][]Reactor, len(m.Reactions))
+		for emoji, reactors := range m.Reactions {
+			reactions[emoji] = reactors
+		}
+		reactor := Reactor{ID: clientKey(change.UserID, change.FromID), Name: change.From}
+		reactors := make([]Reactor, 0, len(reactions[change.Emoji])+1)
+		for _, r := range reactions[change.Emoji] {
+			if r.ID != reactor.ID {
+				reactors = append(reactors, r)
+			}
+		}
+		if !change.Removed {
+			reactors = append(reactors, reactor)
+		}
+		if len(reactors) == 0 {
+			delete(reactions, change.Emoji)
+		} else {
+			reactions[change.Emoji] = reactors
+		}
+		m.Reactions = reactions
+	}
+	return m
+}
+
+// reacted reports whether someone, by reactor ID, reacted to the message
+// with an emoji
+func (m ChatMessage) reacted(emoji, reactorID string) bool {
+	for _, r := range m.Reactions[emoji] {
+		if r.ID == reactorID {
+			return true
+		}
+	}
+	return false
+}
+
+// wroteBy reports whether a participant sent the message. Signed-in users
+// are recognised across connections. Guests choose their own names, so they
+// are only recognised on the connection that sent the message, by the
+// participant ID the server gave it.
+func (m ChatMessage) wroteBy(participant *ChatParticipant) bool {
+	if m.UserID != 0 {
+		return m.UserID == participant.UserID
+	}
+	return participant.UserID == 0 && m.FromID != "" && m.FromID == participant.ID
+}
+
+// findMessage looks a chat message up by sequence number, in the history
+// store first and then in this node's buffer. The stored record is nil if
+// the message is not in the history store.
+func (cm *ChatManager) findMessage(roomID string, seq uint64) (ChatMessage, *db.ChatMessage, error) {
+	if seq == 0 {
+		return ChatMessage{}, nil, ErrMessageNotFound
+	}
+
+	if cm.history != nil {
+		record, err := cm.history.GetMessageBySeq(roomID, seq)
+		if err == nil {
+			return messageFromRecord(*record), record, nil
+		}
+		if !errors.Is(err, db.ErrChatMessageNotFound) {
+			log.Printf("[Chat] Error loading message %d of room %s: %v", seq, roomID, err)
+			return ChatMessage{}, nil, ErrNotSaved
+		}
+	}
+
+	if buffer := cm.buffer(roomID); buffer != nil {
+		if message, found := buffer.find(seq); found {
+			return message, nil, nil
+		}
+	}
+	return ChatMessage{}, nil, ErrMessageNotFound
+}
+
+// ChangeMessage edits, deletes or reacts to the message with sequence number
+// change.Target on behalf of a participant and tells the room. Only the
+// author or a host may edit or delete a message; anyone may react.
+func (cm *ChatManager) ChangeMessage(participant *ChatParticipant, change ChatMessage) error {
+	roomID := participant.RoomID
+
+	message, record, err := cm.findMessage(roomID, change.Target)
+	if err != nil {
+		return err
+	}
+	if (message.Type != "chat" && message.Type != "action" && message.Type != "attachment") || message.Deleted {
+		return ErrMessageNotFound
+	}
+
+	event := ChatMessage{
+		Type:      change.Type,
+		Target:    message.Seq,
+		From:      participant.name(),
+		FromID:    participant.ID,
+		UserID:    participant.UserID,
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+	}
+
+	switch change.Type {
+	case "edit", "delete":
+		if !message.wroteBy(participant) && !participant.Host {
+			return ErrNotAuthor
+		}
+		if change.Type == "edit" {
+			event.Text = strings.TrimSpace(change.Text)
+			if event.Text == "" {
+				return ErrEmptyMessage
+			}
+			if event.Text, err = cm.moderate(participant, "edit", event.Text); err != nil {
+				return err
+			}
+		}
+		// A deleted message's file goes with it, or its link would still work
+		if change.Type == "delete" && message.Attachment != nil {
+			if err := cm.removeAttachment(message.Attachment.ID); err != nil {
+				log.Printf("[Chat] Error deleting attachment %s of message %d in room %s: %v", message.Attachment.ID, message.Seq, roomID, err)
+				return ErrNotSaved
+			}
+		}
+		if record != nil {
+			now := event.Timestamp
+			if change.Type == "edit" {
+				record.Text = event.Text
+				record.EditedAt = &now
+			} else {
+				record.Text = ""
+				record.DeletedAt = &now
+				record.AttachmentID = nil
+			}
+			if err := cm.history.UpdateMessage(record); err != nil {
+				log.Printf("[Chat] Error saving %s of message %d in room %s: %v", change.Type, message.Seq, roomID, err)
+				return ErrNotSaved
+			}
+		}
+
+	case "react":
+		event.Emoji = strings.TrimSpace(change.Emoji)
+		if event.Emoji == "" || len(event.Emoji) > maxEmojiLength {
+			return ErrInvalidEmoji
+		}
+		if record != nil {
+			reaction := &db.ChatReaction{
+				MessageID: record.ID,
+				Sender:    participant.name(),
+				SenderKey: clientKey(participant.UserID, participant.ID),
+				Emoji:     event.Emoji,
+			}
+			if participant.UserID != 0 {
+				reaction.UserID = &participant.UserID
+			}
+			added, err := cm.history.ToggleReaction(reaction)
+			if err != nil {
+				log.Printf("[Chat] Error saving reaction to message %d in room %s: %v", message.Seq, roomID, err)
+				return ErrNotSaved
+			}
+			event.Removed = !added
+		} else {
+			event.Removed = message.reacted(event.Emoji, clientKey(participant.UserID, participant.ID))
+		}
+	}
+
+	cm.broadcastToRoom(roomID, event, "")
+	return nil
+}
@@ -0,0 +1,212 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/blobstore"
+	"seaside/lib/db"
+)
+
+func TestWroteBy(t *testing.T) {
+	tests := []struct {
+		name        string
+		message     ChatMessage
+		participant *ChatParticipant
+		want        bool
+	}{
+		{
+			name:        "user on the connection that sent it",
+			message:     ChatMessage{From: "alice", FromID: "p1", UserID: 1},
+			participant: &ChatParticipant{ID: "p1", UserID: 1, Username: "alice"},
+			want:        true,
+		},
+		{
+			name:        "user on another connection",
+			message:     ChatMessage{From: "alice", FromID: "p1", UserID: 1},
+			participant: &ChatParticipant{ID: "p2", UserID: 1, Username: "alice"},
+			want:        true,
+		},
+		{
+			name:        "another user with the same name",
+			message:     ChatMessage{From: "alice", FromID: "p1", UserID: 1},
+			participant: &ChatParticipant{ID: "p2", UserID: 2, Username: "alice"},
+			want:        false,
+		},
+		{
+			name:        "guest on the connection that sent it",
+			message:     ChatMessage{From: "guest", FromID: "p1"},
+			participant: &ChatParticipant{ID: "p1", Username: "guest"},
+			want:        true,
+		},
+		{
+			name:        "guest taking the sender's name",
+			message:     ChatMessage{From: "guest", FromID: "p1"},
+			participant: &ChatParticipant{ID: "p2", Username: "guest"},
+			want:        false,
+		},
+		{
+			name:        "guest reusing a signed-in user's participant ID",
+			message:     ChatMessage{From: "alice", FromID: "p1", UserID: 1},
+			participant: &ChatParticipant{ID: "p1", Username: "alice"},
+			want:        false,
+		},
+		{
+			name:        "user changing a guest's message",
+			message:     ChatMessage{From: "guest", FromID: "p1"},
+			participant: &ChatParticipant{ID: "p1", UserID: 1, Username: "guest"},
+			want:        false,
+		},
+		{
+			name:        "message without a sender ID",
+			message:     ChatMessage{From: "guest"},
+			participant: &ChatParticipant{Username: "guest"},
+			want:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.message.wroteBy(tt.participant); got != tt.want {
+				t.Fatalf("wroteBy = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReactionsAreKeptPerPerson(t *testing.T) {
+	cm := NewChatManager(nil, nil, nil)
+	// Two guests can send under the same name
+	first, conn := joinChat(t, cm, "room", "g1", auth.Identity{}, "Gus_aaaaaa")
+	second, _ := joinChat(t, cm, "room", "g2", auth.Identity{}, "Gus_aaaaaa")
+	user, _ := joinChat(t, cm, "room", "u1", auth.Identity{UserID: 7}, "Uma")
+
+	cm.postMessage(ChatMessage{Type: "chat", Text: "hi", From: first.name(), FromID: first.ID, Timestamp: time.Now(), RoomID: "room"})
+	seq := conn.next(t, "chat").Seq
+
+	steps := []struct {
+		name        string
+		participant *ChatParticipant
+		wantRemoved bool
+		wantIDs     []string
+	}{
+		{"first guest reacts", first, false, []string{"guest:g1"}},
+		{"guest with the same name reacts", second, false, []string{"guest:g1", "guest:g2"}},
+		{"user reacts", user, false, []string{"guest:g1", "guest:g2", "user:7"}},
+		{"first guest takes theirs back", first, true, []string{"guest:g2", "user:7"}},
+	}
+	for _, step := range steps {
+		if err := cm.ChangeMessage(step.participant, ChatMessage{Type: "react", Target: seq, Emoji: "👍"}); err != nil {
+			t.Fatalf("%s: ChangeMessage: %v", step.name, err)
+		}
+		event := conn.next(t, "react")
+		if event.Removed != step.wantRemoved {
+			t.Fatalf("%s: Removed = %v, want %v", step.name, event.Removed, step.wantRemoved)
+		}
+
+		message, _, err := cm.findMessage("room", seq)
+		if err != nil {
+			t.Fatalf("%s: findMessage: %v", step.name, err)
+		}
+		var ids []string
+		for _, reactor := range message.Reactions["👍"] {
+			ids = append(ids, reactor.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(step.wantIDs) {
+			t.Fatalf("%s: reactors %v, want %v", step.name, ids, step.wantIDs)
+		}
+	}
+}
+
+func TestFindMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		historyErr error
+		wantErr    error
+	}{
+		{"stored message", nil, nil},
+		{"missing from the store, found in the buffer", fmt.Errorf("lookup: %w", db.ErrChatMessageNotFound), nil},
+		{"store failing", errors.New("connection refused"), ErrNotSaved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := &fakeHistory{}
+			cm := NewChatManager(nil, nil, history)
+			sender, conn := joinChat(t, cm, "room", "u1", auth.Identity{UserID: 7}, "Uma")
+			cm.postMessage(ChatMessage{Type: "chat", Text: "hi", From: sender.name(), FromID: sender.ID, UserID: 7, Timestamp: time.Now(), RoomID: "room"})
+			seq := conn.next(t, "chat").Seq
+
+			history.mutex.Lock()
+			history.err = tt.historyErr
+			history.mutex.Unlock()
+
+			message, _, err := cm.findMessage("room", seq)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("findMessage = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && message.Text != "hi" {
+				t.Fatalf("Text = %q, want hi", message.Text)
+			}
+		})
+	}
+
+	cm := NewChatManager(nil, nil, &fakeHistory{})
+	joinChat(t, cm, "room", "u1", auth.Identity{UserID: 7}, "Uma")
+	if _, _, err := cm.findMessage("room", 42); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("findMessage of a missing message = %v, want %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestDeletingAMessageDeletesItsAttachment(t *testing.T) {
+	ctx := context.Background()
+	blobs, err := blobstore.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	keys := []string{"chat/a1.png", "chat/a1_thumb.jpg"}
+	for _, key := range keys {
+		if err := blobs.Put(ctx, key, []byte("image"), "image/png"); err != nil {
+			t.Fatalf("Put(%s): %v", key, err)
+		}
+	}
+
+	userID := uint(7)
+	attachments := &fakeAttachments{attachments: map[string]db.ChatAttachment{
+		"a1": {ID: "a1", RoomID: "room", UserID: &userID, FileName: "cat.png", ContentType: "image/png", StorageKey: keys[0], ThumbnailKey: &keys[1]},
+	}}
+	history := &fakeHistory{}
+	cm := NewChatManager(nil, nil, history)
+	cm.attachments = attachments
+	cm.blobs = blobs
+	uploader, conn := joinChat(t, cm, "room", "u1", auth.Identity{UserID: userID}, "Uma")
+
+	if err := cm.PostAttachment(uploader, "a1", "look"); err != nil {
+		t.Fatalf("PostAttachment: %v", err)
+	}
+	seq := conn.next(t, "attachment").Seq
+	if err := cm.ChangeMessage(uploader, ChatMessage{Type: "delete", Target: seq}); err != nil {
+		t.Fatalf("ChangeMessage: %v", err)
+	}
+	conn.next(t, "delete")
+
+	if _, err := attachments.GetAttachment("a1"); err == nil {
+		t.Fatal("attachment record was kept")
+	}
+	for _, key := range keys {
+		if _, err := blobs.Get(ctx, key); !errors.Is(err, blobstore.ErrNotFound) {
+			t.Fatalf("Get(%s) = %v, want %v", key, err, blobstore.ErrNotFound)
+		}
+	}
+	record, err := history.GetMessageBySeq("room", seq)
+	if err != nil {
+		t.Fatalf("GetMessageBySeq: %v", err)
+	}
+	if record.DeletedAt == nil || record.AttachmentID != nil {
+		t.Fatalf("stored message still shares attachment %v", record.AttachmentID)
+	}
+}
@@ -2,37 +2,61 @@ package chat
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"time"
 
+	"seaside/lib/auth"
+	"seaside/lib/ratelimit"
+	"seaside/lib/roomstore"
+
 	"github.com/gofiber/websocket/v2"
-	"github.com/google/uuid"
 )
 
 type chatClient struct {
 	Id       string
+	Identity auth.Identity
 	Username string
+	Avatar   string
 	RoomId   string
-	Conn     *websocket.Conn
+	Conn     Conn
 	Manager  *ChatManager
+
+	participant *ChatParticipant
+	limiter     *ratelimit.Limiter
 }
 
-func NewChatClient(username, roomID string, conn *websocket.Conn, manager *ChatManager) *chatClient {
+func NewChatClient(id string, identity auth.Identity, username, avatar, roomID string, conn Conn, manager *ChatManager, limiter *ratelimit.Limiter) *chatClient {
 	return &chatClient{
-		Id:       uuid.New().String(),
+		Id:       id,
+		Identity: identity,
 		Username: username,
+		Avatar:   avatar,
 		RoomId:   roomID,
 		Conn:     conn,
 		Manager:  manager,
+		limiter:  limiter,
 	}
 }
 
-func (cc *chatClient) HandleConnection() {
-	defer cc.cleanup()
-
+// join adds the client to its room and catches it up. On failure the
+// client is told why.
+func (cc *chatClient) join() error {
 	//adding user to the room
-	cc.Manager.AddParticipant(cc.RoomId, cc.Id, cc.Username, cc.Conn)
+	participant, err := cc.Manager.AddParticipant(cc.RoomId, cc.Id, cc.Identity, cc.Username, cc.Avatar, cc.Conn)
+	if err != nil {
+		log.Printf("[Chat] Error adding %s to room %s: %v", cc.Username, cc.RoomId, err)
+		reject(cc.Conn, cc.RoomId, err)
+		return err
+	}
+	cc.participant = participant
+
+	// Catch up on what was said before joining
+	for _, message := range cc.Manager.RecentMessages(cc.RoomId, historyReplay) {
+		cc.sendMessage(message)
+	}
 
 	//sending the welcome message
 	welcomeMsg := ChatMessage{
@@ -44,66 +68,90 @@ func (cc *chatClient) HandleConnection() {
 	}
 	cc.sendMessage(welcomeMsg)
 
-	//send the current participant list
-	participants := cc.Manager.GetRoomParticipants(cc.RoomId)
+	if topic := cc.Manager.Topic(cc.RoomId); topic != "" {
+		cc.sendMessage(ChatMessage{
+			Type:      "topic",
+			Text:      topic,
+			From:      "system",
+			Timestamp: time.Now(),
+			RoomID:    cc.RoomId,
+		})
+	}
+
+	//send the current participant list; "presence" messages keep it up to date
 	participantsMsg := ChatMessage{
-		Type:      "participants",
-		Text:      "Current participants: " + strings.Join(participants, ", "),
-		From:      "system",
-		Timestamp: time.Now(),
-		RoomID:    cc.RoomId,
+		Type:         "participants",
+		From:         "system",
+		Timestamp:    time.Now(),
+		RoomID:       cc.RoomId,
+		Self:         cc.Id,
+		Participants: cc.Manager.GetRoomParticipants(cc.RoomId),
 	}
 	cc.sendMessage(participantsMsg)
+	return nil
+}
 
-	// main message handeling loop
-	for {
-		_, message, err := cc.Conn.ReadMessage()
-		if err != nil {
-			log.Printf("[Chat] Error reading message from %s: %v", cc.Username, err)
-			break
-		}
-		cc.handleIncomingMessage(message)
+// reject tells a client why it could not join
+func reject(conn Conn, roomID string, err error) {
+	if errors.Is(err, ErrServerRestarting) {
+		conn.WriteJSON(restartingMessage(roomID))
+		return
+	}
+
+	text := "Could not join the chat"
+	if errors.Is(err, ErrRoomLocked) || errors.Is(err, ErrRoomExpired) || errors.Is(err, roomstore.ErrRoomClosed) || errors.Is(err, ErrLoginRequired) ||
+		errors.Is(err, ErrInviteRequired) || errors.Is(err, ErrInvalidInvite) || errors.Is(err, ErrBanned) || errors.Is(err, ErrReservedName) {
+		text = "Could not join the chat: " + err.Error()
 	}
+
+	conn.WriteJSON(ChatMessage{
+		Type:      "system",
+		Text:      text,
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+	})
 }
 
 // handle the incoming messages
 func (cc *chatClient) handleIncomingMessage(message []byte) {
 	var msgData map[string]interface{}
-	if err := json.Unmarshal(message, &msgData); err != nil {
+	err := json.Unmarshal(message, &msgData)
+
+	// Check what type of message this is; frames that make no sense count too
+	msgType, ok := msgData["type"].(string)
+	if !cc.allow(msgType) {
+		return
+	}
+	if err != nil {
 		log.Printf("[Chat] Error unmarshaling message: %v", err)
 		return
 	}
-
-	// Check what type of message this is
-	msgType, ok := msgData["type"].(string)
 	if !ok {
 		log.Printf("[Chat] Invalid message type from %s", cc.Username)
 		return
 	}
 
-	if msgType == "chat" {
-		text, ok := msgData["text"].(string)
-		if ok && text == "clear" {
-			clearMsg := ChatMessage{
-				Type:      "system",
-				Text:      "Chat cleared",
-				From:      "system",
-				Timestamp: time.Now(),
-				RoomID:    cc.RoomId,
-			}
-			cc.Manager.BroadcastMessage(cc.RoomId, clearMsg)
-			return
-		}
-	}
-
 	// Route to appropriate handler based on message type
 	switch msgType {
 	case "chat":
 		cc.handleChatMessage(msgData)
+	case "attachment":
+		cc.handleAttachmentMessage(msgData)
+	case "direct":
+		cc.handleDirectMessage(msgData)
 	case "typing":
 		cc.handleTypingMessage(msgData)
+	case "status":
+		cc.handleStatusMessage(msgData)
 	case "ping":
 		cc.handlePingMessage()
+	case "ack":
+		cc.participant.Ack(sequenceNumber(msgData["seq"]))
+	case "resume":
+		cc.handleResumeMessage(msgData)
+	case "edit", "delete", "react":
+		cc.handleChangeMessage(msgType, msgData)
 	default:
 		log.Printf("[Chat] Unknown message type: %s from %s", msgType, cc.Username)
 	}
@@ -115,43 +163,119 @@ func (cc *chatClient) handleChatMessage(msgData map[string]interface{}) {
 		return
 	}
 
+	// slash commands act on the room instead of being sent
+	if IsCommand(text) {
+		if err := cc.Manager.commands.Run(commandEnv{cc}, text); err != nil {
+			cc.reply(err.Error())
+		}
+		return
+	}
+	text = strings.TrimPrefix(text, "/") // "//" sends a text starting with a slash
+
+	text, err := cc.Manager.moderate(cc.participant, "chat", text)
+	if err != nil {
+		cc.reply(err.Error())
+		return
+	}
+
 	// creating a proper chat message
 	chatMsg := ChatMessage{
 		Type:      "chat",
 		Text:      text,
 		From:      cc.Username,
+		FromID:    cc.Id,
+		UserID:    cc.Identity.UserID,
 		Timestamp: time.Now(),
 		RoomID:    cc.RoomId,
 	}
 
-	// broadcast the message to everyone (including sender)
-	cc.Manager.broadcastToRoom(cc.RoomId, chatMsg, nil)
+	// number it, keep it for people joining later, then broadcast it to everyone (including sender)
+	cc.Manager.postMessage(chatMsg)
 
 	log.Printf("[Chat] %s: %s ::: %s", cc.Username, text, time.Now())
 }
 
-// handle the typing message
-func (cc *chatClient) handleTypingMessage(msgData map[string]interface{}) {
-	isTyping, ok := msgData["isTyping"].(bool)
-	if !ok {
+// handleAttachmentMessage shares a file the client uploaded, captioned
+// with the message text
+func (cc *chatClient) handleAttachmentMessage(msgData map[string]interface{}) {
+	attachmentID, _ := msgData["attachment"].(string)
+	caption, _ := msgData["text"].(string)
+
+	if err := cc.Manager.PostAttachment(cc.participant, attachmentID, caption); err != nil {
+		log.Printf("[Chat] Error sharing attachment %q from %s in room %s: %v", attachmentID, cc.Username, cc.RoomId, err)
+		text := "Could not share attachment, try again"
+		if errors.Is(err, ErrAttachmentNotFound) || errors.Is(err, ErrMessageRejected) {
+			text = "Could not share attachment: " + err.Error()
+		}
+		cc.reply(text)
+	}
+}
+
+// handleDirectMessage sends a private message to one participant, with a
+// copy to the sender
+func (cc *chatClient) handleDirectMessage(msgData map[string]interface{}) {
+	text, ok := msgData["text"].(string)
+	if !ok || text == "" {
 		return
 	}
+	to, _ := msgData["to"].(string)
 
-	// the typing message
-	typingMsg := ChatMessage{
-		Type:      "typing",
-		Text:      "",
+	text, err := cc.Manager.moderate(cc.participant, "direct", text)
+	if err != nil {
+		cc.reply(err.Error())
+		return
+	}
+
+	directMsg := ChatMessage{
+		Type:      "direct",
+		Text:      text,
 		From:      cc.Username,
+		FromID:    cc.Id,
+		To:        to,
+		UserID:    cc.Identity.UserID,
 		Timestamp: time.Now(),
 		RoomID:    cc.RoomId,
 	}
 
+	if err := cc.Manager.SendDirect(cc.RoomId, directMsg); err != nil {
+		log.Printf("[Chat] Error sending direct message from %s in room %s: %v", cc.Username, cc.RoomId, err)
+		text := "Could not send direct message, try again"
+		if errors.Is(err, ErrRecipientNotFound) {
+			text = "Could not send direct message: " + err.Error()
+		}
+		cc.sendMessage(ChatMessage{
+			Type:      "system",
+			Text:      text,
+			From:      "system",
+			Timestamp: time.Now(),
+			RoomID:    cc.RoomId,
+		})
+	}
+}
+
+// handle the typing message; typing shows as the participant's status
+func (cc *chatClient) handleTypingMessage(msgData map[string]interface{}) {
+	isTyping, ok := msgData["isTyping"].(bool)
+	if !ok {
+		return
+	}
+
+	status := StatusActive
 	if isTyping {
-		typingMsg.Text = cc.Username + " is hmm..."
+		status = StatusTyping
 	}
+	cc.Manager.SetStatus(cc.participant, status)
+}
 
-	// send the indicator to the other end
-	cc.Manager.broadcastToRoom(cc.RoomId, typingMsg, cc.Conn)
+// handleStatusMessage marks the client away or back
+func (cc *chatClient) handleStatusMessage(msgData map[string]interface{}) {
+	status, _ := msgData["status"].(string)
+	if status == StatusTyping {
+		return // Sent as "typing"
+	}
+	if err := cc.Manager.SetStatus(cc.participant, status); err != nil {
+		log.Printf("[Chat] Rejected status %q from %s in room %s: %v", status, cc.Username, cc.RoomId, err)
+	}
 }
 
 // handles the ping messagefor the connection health
@@ -166,6 +290,187 @@ func (cc *chatClient) handlePingMessage() {
 	cc.sendMessage(pingMsg)
 }
 
+// handleChangeMessage edits, deletes or reacts to an earlier message
+func (cc *chatClient) handleChangeMessage(msgType string, msgData map[string]interface{}) {
+	change := ChatMessage{
+		Type:   msgType,
+		Target: sequenceNumber(msgData["target"]),
+	}
+	change.Text, _ = msgData["text"].(string)
+	change.Emoji, _ = msgData["emoji"].(string)
+
+	if err := cc.Manager.ChangeMessage(cc.participant, change); err != nil {
+		log.Printf("[Chat] Rejected %s from %s in room %s: %v", msgType, cc.Username, cc.RoomId, err)
+		cc.sendMessage(ChatMessage{
+			Type:      "system",
+			Text:      "Could not " + msgType + " message: " + err.Error(),
+			From:      "system",
+			Timestamp: time.Now(),
+			RoomID:    cc.RoomId,
+		})
+	}
+}
+
+// handleResumeMessage replays what a reconnecting client missed. Without a
+// sequence number it resumes from what the client acknowledged before it
+// dropped. The reply carries the room's latest sequence number; a client
+// that is ahead of it knows the room started over.
+func (cc *chatClient) handleResumeMessage(msgData map[string]interface{}) {
+	seq := sequenceNumber(msgData["seq"])
+	if seq == 0 {
+		seq = cc.Manager.lastAck(cc.RoomId, clientKey(cc.Identity.UserID, cc.Id))
+	}
+
+	var missed []ChatMessage
+	var latest uint64
+	var truncated bool
+	if seq != 0 {
+		missed, latest, truncated = cc.Manager.Missed(cc.RoomId, seq)
+	}
+	for _, message := range missed {
+		message.History = true
+		cc.sendMessage(message)
+	}
+
+	resumeMsg := ChatMessage{
+		Type:      "resume",
+		Seq:       latest,
+		Text:      "",
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    cc.RoomId,
+		Truncated: truncated,
+	}
+	cc.sendMessage(resumeMsg)
+}
+
+// sequenceNumber reads a sequence number from a decoded frame field
+func sequenceNumber(value interface{}) uint64 {
+	seq, ok := value.(float64)
+	if !ok || seq < 0 {
+		return 0
+	}
+	return uint64(seq)
+}
+
+// frameClass returns the budget a client frame is counted against
+func frameClass(msgType string) ratelimit.Class {
+	switch msgType {
+	case "chat", "attachment", "direct", "edit", "delete", "react":
+		return ratelimit.ClassChat
+	case "typing", "status":
+		return ratelimit.ClassTyping
+	}
+	return ratelimit.ClassOther
+}
+
+// allow meters a frame against the client's budgets. Frames over budget
+// are dropped; the client is warned, muted and finally disconnected if it
+// keeps sending them.
+func (cc *chatClient) allow(msgType string) bool {
+	action := cc.limiter.Check(frameClass(msgType))
+	switch action {
+	case ratelimit.Allow:
+		return true
+	case ratelimit.Warn:
+		cc.warn("You are sending messages too fast, some were not sent", nil)
+	case ratelimit.Mute:
+		until := cc.limiter.MutedUntil()
+		log.Printf("[Chat] Muted %s in room %s until %s for flooding", cc.Username, cc.RoomId, until.Format(time.TimeOnly))
+		cc.warn(fmt.Sprintf("You are muted for %d seconds for sending too many messages", int(time.Until(until).Round(time.Second).Seconds())), &until)
+	case ratelimit.Disconnect:
+		log.Printf("[Chat] Disconnecting %s from room %s for flooding", cc.Username, cc.RoomId)
+		cc.warn("You were disconnected for sending too many messages", nil)
+		cc.participant.DisconnectWithCode(websocket.ClosePolicyViolation)
+	}
+	return false
+}
+
+// warn tells this client it is being rate limited
+func (cc *chatClient) warn(text string, until *time.Time) {
+	cc.sendMessage(ChatMessage{
+		Type:      "warning",
+		Text:      text,
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    cc.RoomId,
+		Until:     until,
+	})
+}
+
+// reply sends a system message to this client only
+func (cc *chatClient) reply(text string) {
+	cc.sendMessage(ChatMessage{
+		Type:      "system",
+		Text:      text,
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    cc.RoomId,
+	})
+}
+
+// commandEnv runs slash commands on behalf of a client
+type commandEnv struct {
+	cc *chatClient
+}
+
+func (e commandEnv) Caller() ParticipantInfo {
+	return e.cc.participant.info()
+}
+
+func (e commandEnv) Participants() []ParticipantInfo {
+	return e.cc.Manager.GetRoomParticipants(e.cc.RoomId)
+}
+
+func (e commandEnv) Reply(text string) {
+	e.cc.reply(text)
+}
+
+func (e commandEnv) Announce(text string) {
+	e.cc.Manager.announce(e.cc.RoomId, text)
+}
+
+func (e commandEnv) Post(messageType, text string) error {
+	text, err := e.cc.Manager.moderate(e.cc.participant, messageType, text)
+	if err != nil {
+		return err
+	}
+	e.cc.Manager.postMessage(ChatMessage{
+		Type:      messageType,
+		Text:      text,
+		From:      e.cc.Username,
+		FromID:    e.cc.Id,
+		UserID:    e.cc.Identity.UserID,
+		Timestamp: time.Now(),
+		RoomID:    e.cc.RoomId,
+	})
+	return nil
+}
+
+func (e commandEnv) Rename(name string) error {
+	if err := e.cc.Manager.Rename(e.cc.participant, name); err != nil {
+		return err
+	}
+	e.cc.Username = e.cc.participant.name()
+	return nil
+}
+
+func (e commandEnv) Topic() string {
+	return e.cc.Manager.Topic(e.cc.RoomId)
+}
+
+func (e commandEnv) SetTopic(topic string) error {
+	return e.cc.Manager.SetTopic(e.cc.participant, topic)
+}
+
+func (e commandEnv) Kick(participantID string) error {
+	return e.cc.Manager.Kick(e.cc.participant, participantID)
+}
+
+func (e commandEnv) Clear() error {
+	return e.cc.Manager.Clear(e.cc.RoomId)
+}
+
 // sendMessage sends a message to this specific client
 func (cc *chatClient) sendMessage(message ChatMessage) {
 	messageJSON, err := json.Marshal(message)
@@ -174,15 +479,16 @@ func (cc *chatClient) sendMessage(message ChatMessage) {
 		return
 	}
 
-	err = cc.Conn.WriteMessage(websocket.TextMessage, messageJSON)
+	err = cc.participant.Write(messageJSON)
 	if err != nil {
 		log.Printf("[Chat] Error sending message to %s: %v", cc.Username, err)
 	}
 }
 
-// cleanup removes the client from the room and closes connection
+// cleanup removes the client from the room
 func (cc *chatClient) cleanup() {
 	cc.Manager.RemoveParticipant(cc.RoomId, cc.Id)
-	cc.Conn.Close()
+	// The connection is released once its handler returns
+	cc.participant.wait()
 	log.Printf("[Chat] Client %s disconnected from room %s", cc.Username, cc.RoomId)
 }
@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Errors returned to the caller of a command
+var (
+	ErrUnknownCommand = errors.New("unknown command, type /help for a list")
+	ErrNotAllowed     = errors.New("you cannot use this command")
+	ErrHostOnly       = errors.New("only a host can do this")
+	ErrUsage          = errors.New("wrong arguments")
+)
+
+// Permission decides who may run a command
+type Permission func(caller ParticipantInfo) bool
+
+// Permissions used by the built-in commands
+var (
+	Everyone   Permission = func(ParticipantInfo) bool { return true }
+	HostsOnly  Permission = func(caller ParticipantInfo) bool { return caller.Host }
+	GuestsOnly Permission = func(caller ParticipantInfo) bool { return caller.UserID == 0 }
+)
+
+// CommandEnv is what a command can see and do in the room it was typed in.
+// The chat client provides one for every command; handlers only act
+// through it, so they can be tested against a fake.
+type CommandEnv interface {
+	// Caller describes who typed the command
+	Caller() ParticipantInfo
+	// Participants lists everyone in the room's chat
+	Participants() []ParticipantInfo
+
+	// Reply sends a system message to the caller only
+	Reply(text string)
+	// Announce sends a system message to the whole room
+	Announce(text string)
+	// Post sends a message of the given type from the caller to the room,
+	// unless moderation rejects it
+	Post(messageType, text string) error
+
+	// Rename changes the caller's name
+	Rename(name string) error
+	// Topic returns the room's topic, "" if it has none
+	Topic() string
+	// SetTopic changes the room's topic; "" removes it
+	SetTopic(topic string) error
+	// Kick disconnects a participant from the chat
+	Kick(participantID string) error
+	// Clear removes every message of the room
+	Clear() error
+}
+
+// Command is a slash command that can be typed into the chat
+type Command struct {
+	Name       string     // Typed after the slash
+	Usage      string     // Arguments, e.g. "<name>"
+	Help       string     // One line shown by /help
+	Permission Permission // Who may run it; everyone if nil
+	Run        func(env CommandEnv, args string) error
+}
+
+// CommandRegistry holds the commands available in a chat
+type CommandRegistry struct {
+	commands map[string]Command
+}
+
+// NewCommandRegistry creates an empty registry
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: make(map[string]Command)}
+}
+
+// Register adds a command, replacing any command with the same name
+func (r *CommandRegistry) Register(command Command) {
+	if command.Permission == nil {
+		command.Permission = Everyone
+	}
+	r.commands[strings.ToLower(command.Name)] = command
+}
+
+// Lookup returns a command by name
+func (r *CommandRegistry) Lookup(name string) (Command, bool) {
+	command, ok := r.commands[strings.ToLower(name)]
+	return command, ok
+}
+
+// Available lists the commands a caller may run, by name
+func (r *CommandRegistry) Available(caller ParticipantInfo) []Command {
+	commands := make([]Command, 0, len(r.commands))
+	for _, command := range r.commands {
+		if command.Permission(caller) {
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// IsCommand reports whether a chat text is a command. Texts starting with
+// "//" are chat messages starting with a slash.
+func IsCommand(text string) bool {
+	return strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "//")
+}
+
+// Run parses and runs a command line such as "/nick alice". Errors are
+// meant for the caller.
+func (r *CommandRegistry) Run(env CommandEnv, line string) error {
+	name, args, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "/"), " ")
+	command, ok := r.Lookup(name)
+	if !ok {
+		return fmt.Errorf("/%s: %w", name, ErrUnknownCommand)
+	}
+	if !command.Permission(env.Caller()) {
+		return fmt.Errorf("/%s: %w", command.Name, ErrNotAllowed)
+	}
+
+	err := command.Run(env, strings.TrimSpace(args))
+	if errors.Is(err, ErrUsage) {
+		return fmt.Errorf("usage: %s", command.usage())
+	}
+	if err != nil {
+		return fmt.Errorf("/%s: %w", command.Name, err)
+	}
+	return nil
+}
+
+func (c Command) usage() string {
+	if c.Usage == "" {
+		return "/" + c.Name
+	}
+	return "/" + c.Name + " " + c.Usage
+}
+
+// DefaultCommands returns a registry with the built-in commands
+func DefaultCommands() *CommandRegistry {
+	r := NewCommandRegistry()
+	r.Register(Command{
+		Name:  "help",
+		Usage: "[command]",
+		Help:  "List commands, or explain one",
+		Run:   r.help,
+	})
+	r.Register(Command{
+		Name:       "clear",
+		Help:       "Remove every message for everyone",
+		Permission: HostsOnly,
+		Run:        clearCommand,
+	})
+	r.Register(Command{
+		Name:       "nick",
+		Usage:      "<name>",
+		Help:       "Change your name",
+		Permission: GuestsOnly,
+		Run:        nickCommand,
+	})
+	r.Register(Command{
+		Name:  "me",
+		Usage: "<action>",
+		Help:  "Describe what you are doing",
+		Run:   meCommand,
+	})
+	r.Register(Command{
+		Name:  "topic",
+		Usage: "[topic]",
+		Help:  "Show the room's topic; hosts can change it, or remove it with -",
+		Run:   topicCommand,
+	})
+	r.Register(Command{
+		Name:       "kick",
+		Usage:      "<name or ID>",
+		Help:       "Remove someone from the chat",
+		Permission: HostsOnly,
+		Run:        kickCommand,
+	})
+	return r
+}
+
+func (r *CommandRegistry) help(env CommandEnv, args string) error {
+	if args != "" {
+		command, ok := r.Lookup(strings.TrimPrefix(args, "/"))
+		if !ok || !command.Permission(env.Caller()) {
+			return ErrUnknownCommand
+		}
+		env.Reply(command.usage() + " - " + command.Help)
+		return nil
+	}
+
+	lines := []string{"Commands:"}
+	for _, command := range r.Available(env.Caller()) {
+		lines = append(lines, command.usage()+" - "+command.Help)
+	}
+	env.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+func clearCommand(env CommandEnv, args string) error {
+	if args != "" {
+		return ErrUsage
+	}
+	return env.Clear()
+}
+
+func nickCommand(env CommandEnv, args string) error {
+	if args == "" {
+		return ErrUsage
+	}
+	return env.Rename(args)
+}
+
+func meCommand(env CommandEnv, args string) error {
+	if args == "" {
+		return ErrUsage
+	}
+	return env.Post("action", args)
+}
+
+func topicCommand(env CommandEnv, args string) error {
+	if args == "" {
+		if topic := env.Topic(); topic != "" {
+			env.Reply("Topic: " + topic)
+		} else {
+			env.Reply("This room has no topic")
+		}
+		return nil
+	}
+
+	if !env.Caller().Host {
+		return ErrHostOnly
+	}
+	if args == "-" {
+		args = ""
+	}
+	return env.SetTopic(args)
+}
+
+func kickCommand(env CommandEnv, args string) error {
+	if args == "" {
+		return ErrUsage
+	}
+
+	// Match by ID first, then by name if that is unambiguous
+	var matches []ParticipantInfo
+	for _, p := range env.Participants() {
+		if p.ID == args {
+			matches = []ParticipantInfo{p}
+			break
+		}
+		if strings.EqualFold(p.Name, args) {
+			matches = append(matches, p)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return fmt.Errorf("nobody called %s is in this room", args)
+	case len(matches) > 1:
+		return fmt.Errorf("several people are called %s, use their ID", args)
+	case matches[0].ID == env.Caller().ID:
+		return errors.New("you cannot kick yourself")
+	case matches[0].Host:
+		return errors.New("hosts cannot be kicked")
+	}
+	return env.Kick(matches[0].ID)
+}
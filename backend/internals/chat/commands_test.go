@@ -0,0 +1,258 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeEnv is a CommandEnv that records what commands do
+type fakeEnv struct {
+	caller       ParticipantInfo
+	participants []ParticipantInfo
+	topic        string
+
+	replies   []string
+	announced []string
+	posted    []string // "type: text"
+	renamed   string
+	kicked    string
+	cleared   bool
+}
+
+func (e *fakeEnv) Caller() ParticipantInfo         { return e.caller }
+func (e *fakeEnv) Participants() []ParticipantInfo { return e.participants }
+func (e *fakeEnv) Reply(text string)               { e.replies = append(e.replies, text) }
+func (e *fakeEnv) Announce(text string)            { e.announced = append(e.announced, text) }
+func (e *fakeEnv) Topic() string                   { return e.topic }
+
+func (e *fakeEnv) Post(messageType, text string) error {
+	e.posted = append(e.posted, messageType+": "+text)
+	return nil
+}
+
+func (e *fakeEnv) Rename(name string) error {
+	e.renamed = name
+	return nil
+}
+
+func (e *fakeEnv) SetTopic(topic string) error {
+	e.topic = topic
+	return nil
+}
+
+func (e *fakeEnv) Kick(participantID string) error {
+	e.kicked = participantID
+	return nil
+}
+
+func (e *fakeEnv) Clear() error {
+	e.cleared = true
+	return nil
+}
+
+var (
+	testHost  = ParticipantInfo{ID: "h1", Name: "Hana", UserID: 1, Host: true}
+	testUser  = ParticipantInfo{ID: "u1", Name: "Uma", UserID: 2}
+	testGuest = ParticipantInfo{ID: "g1", Name: "Gus"}
+	testTwin  = ParticipantInfo{ID: "g2", Name: "gus"}
+)
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		caller  ParticipantInfo
+		line    string
+		wantErr error  // Checked with errors.Is
+		errText string // Checked as a substring, if set
+		check   func(t *testing.T, env *fakeEnv)
+	}{
+		{
+			name:    "unknown command",
+			caller:  testUser,
+			line:    "/dance",
+			wantErr: ErrUnknownCommand,
+		},
+		{
+			name:   "command names ignore case",
+			caller: testUser,
+			line:   "/ME waves",
+			check: func(t *testing.T, env *fakeEnv) {
+				if len(env.posted) != 1 || env.posted[0] != "action: waves" {
+					t.Errorf("posted %v, want an action", env.posted)
+				}
+			},
+		},
+		{
+			name:    "missing arguments",
+			caller:  testUser,
+			line:    "/me",
+			errText: "usage: /me <action>",
+		},
+		{
+			name:    "host command from a member",
+			caller:  testUser,
+			line:    "/clear",
+			wantErr: ErrNotAllowed,
+			check: func(t *testing.T, env *fakeEnv) {
+				if env.cleared {
+					t.Error("chat was cleared")
+				}
+			},
+		},
+		{
+			name:   "host clears the chat",
+			caller: testHost,
+			line:   "/clear",
+			check: func(t *testing.T, env *fakeEnv) {
+				if !env.cleared {
+					t.Error("chat was not cleared")
+				}
+			},
+		},
+		{
+			name:   "guest renames",
+			caller: testGuest,
+			line:   "/nick  Gustav ",
+			check: func(t *testing.T, env *fakeEnv) {
+				if env.renamed != "Gustav" {
+					t.Errorf("renamed to %q, want %q", env.renamed, "Gustav")
+				}
+			},
+		},
+		{
+			name:    "signed-in users keep their account name",
+			caller:  testUser,
+			line:    "/nick Someone",
+			wantErr: ErrNotAllowed,
+		},
+		{
+			name:   "topic is shown to anyone",
+			caller: testUser,
+			line:   "/topic",
+			check: func(t *testing.T, env *fakeEnv) {
+				if len(env.replies) != 1 || env.replies[0] != "Topic: Planning" {
+					t.Errorf("replies %v, want the topic", env.replies)
+				}
+			},
+		},
+		{
+			name:    "members cannot change the topic",
+			caller:  testUser,
+			line:    "/topic Lunch",
+			wantErr: ErrHostOnly,
+		},
+		{
+			name:   "host removes the topic",
+			caller: testHost,
+			line:   "/topic -",
+			check: func(t *testing.T, env *fakeEnv) {
+				if env.topic != "" {
+					t.Errorf("topic = %q, want none", env.topic)
+				}
+			},
+		},
+		{
+			name:   "kick by name",
+			caller: testHost,
+			line:   "/kick uma",
+			check: func(t *testing.T, env *fakeEnv) {
+				if env.kicked != testUser.ID {
+					t.Errorf("kicked %q, want %q", env.kicked, testUser.ID)
+				}
+			},
+		},
+		{
+			name:    "kick by an ambiguous name",
+			caller:  testHost,
+			line:    "/kick Gus",
+			errText: "use their ID",
+		},
+		{
+			name:   "kick by ID",
+			caller: testHost,
+			line:   "/kick g2",
+			check: func(t *testing.T, env *fakeEnv) {
+				if env.kicked != testTwin.ID {
+					t.Errorf("kicked %q, want %q", env.kicked, testTwin.ID)
+				}
+			},
+		},
+		{
+			name:    "kick someone absent",
+			caller:  testHost,
+			line:    "/kick Zoe",
+			errText: "nobody called Zoe",
+		},
+		{
+			name:    "kick yourself",
+			caller:  testHost,
+			line:    "/kick h1",
+			errText: "cannot kick yourself",
+		},
+		{
+			name:   "help lists what the caller may run",
+			caller: testUser,
+			line:   "/help",
+			check: func(t *testing.T, env *fakeEnv) {
+				if len(env.replies) != 1 {
+					t.Fatalf("replies %v, want one", env.replies)
+				}
+				if !strings.Contains(env.replies[0], "/me <action>") || strings.Contains(env.replies[0], "/clear") {
+					t.Errorf("help = %q, want /me without /clear", env.replies[0])
+				}
+			},
+		},
+		{
+			name:    "help hides host commands",
+			caller:  testUser,
+			line:    "/help kick",
+			wantErr: ErrUnknownCommand,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &fakeEnv{
+				caller:       tt.caller,
+				participants: []ParticipantInfo{testHost, testUser, testGuest, testTwin},
+				topic:        "Planning",
+			}
+			err := DefaultCommands().Run(env, tt.line)
+
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Run = %v, want %v", err, tt.wantErr)
+				}
+			case tt.errText != "":
+				if err == nil || !strings.Contains(err.Error(), tt.errText) {
+					t.Fatalf("Run = %v, want an error containing %q", err, tt.errText)
+				}
+			case err != nil:
+				t.Fatalf("Run = %v", err)
+			}
+			if tt.check != nil {
+				tt.check(t, env)
+			}
+		})
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"/help", true},
+		{"/", true},
+		{"//not a command", false},
+		{"hello /help", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsCommand(tt.text); got != tt.want {
+			t.Errorf("IsCommand(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
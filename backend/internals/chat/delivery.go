@@ -0,0 +1,261 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// chatBufferSize is how many recent messages each node keeps per room for
+// clients resuming after a dropped connection
+const chatBufferSize = 256
+
+// resumeLimit bounds the stored messages replayed to a resuming client
+const resumeLimit = 200
+
+// sequenced reports whether messages of a type are numbered and can be
+// resumed. Presence updates and replies to a single client are not.
+func sequenced(messageType string) bool {
+	switch messageType {
+	case "chat", "action", "attachment", "system", "join", "leave", "edit", "delete", "react", "nick", "topic", "clear":
+		return true
+	}
+	return false
+}
+
+// clientKey identifies the person behind a connection. Signed-in users are
+// recognised across reconnects. Guests choose their own names, so anyone
+// could claim a guest's name: they are only recognised by the participant
+// ID the server gave their connection.
+func clientKey(userID uint, participantID string) string {
+	if userID != 0 {
+		return fmt.Sprintf("user:%d", userID)
+	}
+	return "guest:" + participantID
+}
+
+// messageBuffer keeps the latest sequenced messages of a room seen by this
+// node, and what each client acknowledged before it disconnected
+type messageBuffer struct {
+	floor uint64 // Latest stored sequence number when the buffer was created
+
+	mutex    sync.Mutex
+	messages []ChatMessage     // Ordered by Seq
+	latest   uint64            // Highest Seq seen
+	acks     map[string]uint64 // client key -> last acknowledged Seq
+}
+
+func newMessageBuffer(floor uint64) *messageBuffer {
+	return &messageBuffer{
+		floor:  floor,
+		latest: floor,
+		acks:   make(map[string]uint64),
+	}
+}
+
+// add records a delivered message. Messages published by several nodes may
+// arrive slightly out of order, so it is inserted by sequence number.
+func (b *messageBuffer) add(message ChatMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Nothing before a clear may be replayed; the clear itself is, so
+	// clients that missed it still clear what they show
+	if message.Type == "clear" {
+		b.reset()
+	}
+
+	// Changes also update the message they change
+	if message.Target != 0 {
+		if j, found := b.index(message.Target); found {
+			b.messages[j] = b.messages[j].apply(message)
+		}
+	}
+
+	i, found := b.index(message.Seq)
+	if found {
+		return
+	}
+	b.messages = append(b.messages, ChatMessage{})
+	copy(b.messages[i+1:], b.messages[i:])
+	b.messages[i] = message
+
+	if len(b.messages) > chatBufferSize {
+		b.messages = append(b.messages[:0], b.messages[len(b.messages)-chatBufferSize:]...)
+	}
+	if message.Seq > b.latest {
+		b.latest = message.Seq
+	}
+}
+
+// clear forgets every buffered message and acknowledgement
+func (b *messageBuffer) clear() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reset()
+}
+
+// reset is clear for a caller holding the mutex. The sequence carries on.
+func (b *messageBuffer) reset() {
+	b.messages = nil
+	b.acks = make(map[string]uint64)
+}
+
+// index finds a buffered message by sequence number
+func (b *messageBuffer) index(seq uint64) (int, bool) {
+	i := sort.Search(len(b.messages), func(i int) bool { return b.messages[i].Seq >= seq })
+	return i, i < len(b.messages) && b.messages[i].Seq == seq
+}
+
+// find returns a buffered message by sequence number
+func (b *messageBuffer) find(seq uint64) (ChatMessage, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	i, found := b.index(seq)
+	if !found {
+		return ChatMessage{}, false
+	}
+	return b.messages[i], true
+}
+
+// since returns the buffered messages after seq, the latest sequence number
+// and whether the buffer reaches back far enough to hold everything missed
+func (b *messageBuffer) since(seq uint64) ([]ChatMessage, uint64, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if seq >= b.latest {
+		return nil, b.latest, true
+	}
+
+	i := sort.Search(len(b.messages), func(i int) bool { return b.messages[i].Seq > seq })
+	missed := append([]ChatMessage(nil), b.messages[i:]...)
+	complete := len(b.messages) > 0 && b.messages[0].Seq <= seq+1
+	return missed, b.latest, complete
+}
+
+// remember keeps a client's last acknowledgement for when it reconnects
+func (b *messageBuffer) remember(key string, seq uint64) {
+	if seq == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.acks[key] = seq
+}
+
+// acked returns the last acknowledgement of a client that disconnected
+func (b *messageBuffer) acked(key string) uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.acks[key]
+}
+
+// buffer returns the message buffer of a room with local participants
+func (cm *ChatManager) buffer(roomID string) *messageBuffer {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.buffers[roomID]
+}
+
+// latestStoredSeq returns the highest sequence number in a room's history
+func (cm *ChatManager) latestStoredSeq(roomID string) uint64 {
+	if cm.history == nil {
+		return 0
+	}
+
+	seq, err := cm.history.LatestSeq(roomID)
+	if err != nil {
+		log.Printf("[Chat] Error loading latest sequence of room %s: %v", roomID, err)
+		return 0
+	}
+	return seq
+}
+
+// sequence gives a message the next number of its room's sequence. If the
+// store has no sequence for the room it continues after the stored history.
+func (cm *ChatManager) sequence(message *ChatMessage) {
+	var floor uint64
+	if buffer := cm.buffer(message.RoomID); buffer != nil {
+		floor = buffer.floor
+	} else {
+		floor = cm.latestStoredSeq(message.RoomID)
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	seq, err := cm.store.NextSeq(ctx, message.RoomID, floor)
+	if err != nil {
+		// Still delivered, but a client that misses it cannot get it back
+		log.Printf("[Chat] Error numbering message in room %s: %v", message.RoomID, err)
+		return
+	}
+	message.Seq = seq
+}
+
+// Missed returns what a client that saw messages up to seq has missed, the
+// latest sequence number of the room and whether older missed messages had
+// to be left out. Recent messages come from this node's buffer; anything
+// older comes from the history store.
+func (cm *ChatManager) Missed(roomID string, seq uint64) ([]ChatMessage, uint64, bool) {
+	buffer := cm.buffer(roomID)
+	if buffer == nil {
+		return nil, 0, false
+	}
+
+	buffered, latest, complete := buffer.since(seq)
+	if complete {
+		return buffered, latest, false
+	}
+	if cm.history == nil {
+		return buffered, latest, true
+	}
+
+	// Ask for one extra message to tell whether the gap is too long to replay
+	records, err := cm.history.GetMessagesAfter(roomID, seq, resumeLimit+1)
+	if err != nil {
+		log.Printf("[Chat] Error loading missed messages of room %s: %v", roomID, err)
+		return buffered, latest, true
+	}
+	truncated := len(records) > resumeLimit
+	if truncated {
+		// Give the latest messages and let the client scroll back for the rest
+		records, err = cm.history.GetMessages(roomID, 0, resumeLimit)
+		if err != nil {
+			log.Printf("[Chat] Error loading missed messages of room %s: %v", roomID, err)
+			return buffered, latest, true
+		}
+	}
+
+	// Stored chat messages and buffered notices interleave by sequence number
+	missed := make([]ChatMessage, 0, len(records)+len(buffered))
+	for _, record := range records {
+		if record.Seq > seq {
+			missed = append(missed, messageFromRecord(record))
+		}
+	}
+	missed = append(missed, buffered...)
+	sort.SliceStable(missed, func(i, j int) bool { return missed[i].Seq < missed[j].Seq })
+
+	deduped := make([]ChatMessage, 0, len(missed))
+	for _, message := range missed {
+		if len(deduped) > 0 && deduped[len(deduped)-1].Seq == message.Seq {
+			continue
+		}
+		deduped = append(deduped, message)
+	}
+	return deduped, latest, truncated
+}
+
+// lastAck returns what a client acknowledged on its previous connection to
+// this node, or 0
+func (cm *ChatManager) lastAck(roomID, key string) uint64 {
+	if buffer := cm.buffer(roomID); buffer != nil {
+		return buffer.acked(key)
+	}
+	return 0
+}
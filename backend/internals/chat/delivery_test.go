@@ -0,0 +1,22 @@
+package chat
+
+import "testing"
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		userID        uint
+		participantID string
+		want          string
+	}{
+		{"signed-in user", 7, "p1", "user:7"},
+		{"same user on another connection", 7, "p2", "user:7"},
+		{"guest", 0, "p1", "guest:p1"},
+		{"guest on another connection", 0, "p2", "guest:p2"},
+	}
+	for _, tt := range tests {
+		if got := clientKey(tt.userID, tt.participantID); got != tt.want {
+			t.Errorf("%s: clientKey(%d, %q) = %q, want %q", tt.name, tt.userID, tt.participantID, got, tt.want)
+		}
+	}
+}
@@ -1,17 +1,65 @@
 package chat
 
 import (
+	"context"
 	"log"
 
+	"seaside/lib/auth"
+	"seaside/lib/blobstore"
+	"seaside/lib/db"
+	"seaside/lib/ratelimit"
+	"seaside/lib/roomstore"
+
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 )
 
-var sharedChatManager = NewChatManager()
+// Profile is how a signed-in user appears in chat
+type Profile struct {
+	Name   string // Account username
+	Avatar string // Image URL, "" if the user has none
+}
+
+// ProfileLookup returns the profile of a signed-in user
+type ProfileLookup func(userID uint) (Profile, error)
+
+var (
+	sharedChatManager = NewChatManager(nil, nil, nil)
+	lookupProfile     ProfileLookup
+	checkInvite       InviteChecker
+)
+
+// Init makes the chat endpoint keep its rooms in the given store, open them
+// through openRoom, keep messages in history, show signed-in users with
+// their account name and avatar and admit invite holders checked by invites
+func Init(store roomstore.Store, openRoom RoomOpener, history db.ChatMessageRepositoryInterface, profiles ProfileLookup, invites InviteChecker) {
+	sharedChatManager = NewChatManager(store, openRoom, history)
+	lookupProfile = profiles
+	checkInvite = invites
+}
+
+// EnableAttachments lets clients share files uploaded through the
+// attachments endpoint, whose files are kept in blobs
+func EnableAttachments(attachments db.ChatAttachmentRepositoryInterface, blobs blobstore.BlobStore) {
+	sharedChatManager.attachments = attachments
+	sharedChatManager.blobs = blobs
+}
+
+// EnableModerationLog keeps a record of the messages moderation objects to
+func EnableModerationLog(events db.ChatModerationRepositoryInterface) {
+	sharedChatManager.moderationLog = events
+}
 
-// client connects to the chat endpoint
+// UseModerator adds a check to the end of the chat's moderation chain
+func UseModerator(moderator Moderator) {
+	sharedChatManager.moderation.Use(moderator)
+}
+
+// ChatWebSocketHandler serves /chat, the chat-only socket kept for clients
+// that do not use the room socket
 func ChatWebSocketHandler(c *websocket.Conn) {
 	roomId := c.Query("roomID")
-	userId := c.Query("username")
+	identity := auth.WebSocketIdentity(c)
 
 	if roomId == "" {
 		log.Println("room id is missing")
@@ -19,17 +67,98 @@ func ChatWebSocketHandler(c *websocket.Conn) {
 		return
 	}
 
-	if userId == "" {
-		userId = "null_admin"
+	// The invite that let a guest into the call lets them into its chat too
+	if invite := c.Query("invite"); invite != "" {
+		role := ""
+		err := ErrInvalidInvite
+		if checkInvite != nil {
+			role, err = checkInvite(roomId, invite)
+		}
+		if err != nil {
+			log.Printf("[Chat] Rejected invite for room %s: %v", roomId, err)
+			reject(c, roomId, ErrInvalidInvite)
+			c.Close()
+			return
+		}
+		identity.Role = role
 	}
 
-	log.Printf("[Chat] New chat connection for room: %s, user: %s", roomId, userId)
+	limiter := sharedChatManager.limits.Connect(ratelimit.UserKey(identity.UserID))
+	defer limiter.Close()
 
-	// create a new client
-	client := NewChatClient(userId, roomId, c, sharedChatManager)
+	session, err := Join(roomId, uuid.New().String(), identity, c.Query("username"), c, limiter)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	// main message handeling loop
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			log.Printf("[Chat] Error reading message from %s: %v", session.client.Username, err)
+			break
+		}
+		session.Handle(message)
+	}
+	session.Close()
+	c.Close()
+}
+
+// Session is a participant's chat on a connection read by someone else,
+// such as the chat channel of a room socket
+type Session struct {
+	client *chatClient
+}
+
+// Join adds a participant to a room's chat under the given ID and catches
+// it up. Signed-in users chat under their account name; guests under the
+// name they gave. The frames the client sends go to Handle, metered by the
+// limiter, and Close takes the participant out again.
+func Join(roomID, participantID string, identity auth.Identity, name string, conn Conn, limiter *ratelimit.Limiter) (*Session, error) {
+	avatar := ""
+	if !identity.Guest() && lookupProfile != nil {
+		profile, err := lookupProfile(identity.UserID)
+		if err != nil {
+			log.Printf("[Chat] Error looking up user %d: %v", identity.UserID, err)
+			return nil, err
+		}
+		name = profile.Name
+		avatar = profile.Avatar
+	}
+
+	if name == "" {
+		name = "guest"
+	}
+
+	log.Printf("[Chat] New chat connection for room: %s, user: %s", roomID, name)
+
+	client := NewChatClient(participantID, identity, name, avatar, roomID, conn, sharedChatManager, limiter)
+	if err := client.join(); err != nil {
+		return nil, err
+	}
+	return &Session{client: client}, nil
+}
+
+// Handle acts on a frame the client sent
+func (s *Session) Handle(frame []byte) {
+	s.client.handleIncomingMessage(frame)
+}
+
+// Close takes the participant out of the room's chat
+func (s *Session) Close() {
+	s.client.cleanup()
+}
+
+// CloseRoom disconnects everyone chatting in a room
+func CloseRoom(roomID string) {
+	sharedChatManager.CloseRoom(roomID)
+}
 
-	// start the connection
-	client.HandleConnection()
+// Drain stops taking chat joins, tells everyone chatting on this node to
+// reconnect and waits until they have all left, or ctx is done
+func Drain(ctx context.Context) error {
+	return sharedChatManager.Drain(ctx)
 }
 
 // get the statistics for the chat features that has been implemented
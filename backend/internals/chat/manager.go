@@ -1,16 +1,71 @@
 package chat
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
+	"unicode/utf8"
+
+	"seaside/lib/auth"
+	"seaside/lib/blobstore"
+	"seaside/lib/db"
+	"seaside/lib/drain"
+	"seaside/lib/ratelimit"
+	"seaside/lib/roomstore"
 
 	"github.com/gofiber/websocket/v2"
 )
 
+// storeTimeout bounds every call to the room store
+const storeTimeout = 5 * time.Second
+
+// historyReplay is how many recent messages someone joining the chat receives
+const historyReplay = 50
+
+// Limits on what commands can set
+const (
+	maxChatNameLength = 32
+	maxTopicLength    = 200
+)
+
+// systemName is who server notices come from; nobody may go by it
+const systemName = "system"
+
+// reservedName reports whether a display name would pass for the server's
+func reservedName(name string) bool {
+	return strings.EqualFold(strings.TrimSpace(name), systemName)
+}
+
+func storeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), storeTimeout)
+}
+
+// Reasons a user may not join a room's chat
+var (
+	ErrRoomLocked       = errors.New("room is locked")
+	ErrRoomExpired      = errors.New("room has expired")
+	ErrLoginRequired    = errors.New("room requires signing in")
+	ErrInviteRequired   = errors.New("room requires an invite")
+	ErrInvalidInvite    = errors.New("invalid invite")
+	ErrBanned           = errors.New("banned from room")
+	ErrReservedName     = errors.New("that name is reserved")
+	ErrServerRestarting = errors.New("server is restarting")
+)
+
+// RoomOpener returns a room's settings, creating the room if it is not live
+// yet. The video room map provides one so chat sees persisted settings too.
+type RoomOpener func(roomID string) (*roomstore.RoomInfo, error)
+
+// InviteChecker validates an invite token for a room and returns the role it grants
+type InviteChecker func(roomID, token string) (string, error)
+
 // isAlphanumeric checks if a string contains only alphanumeric characters
 func isAlphanumeric(s string) bool {
 	for _, r := range s {
@@ -21,61 +76,350 @@ func isAlphanumeric(s string) bool {
 	return true
 }
 
+// splitUsername separates the random suffix clients add to keep usernames
+// unique from the name people see. The suffix is "" if there is none.
+func splitUsername(username string) (string, string) {
+	if idx := strings.LastIndex(username, "_"); idx != -1 {
+		// Check if the suffix looks like a random string (alphanumeric, 6 chars)
+		suffix := username[idx+1:]
+		if len(suffix) == 6 && isAlphanumeric(suffix) {
+			return username[:idx], suffix
+		}
+	}
+	return username, ""
+}
+
 // ChatMessage represents a chat message with all necessary fields
 type ChatMessage struct {
-	Type      string    `json:"type"`      // Type: "chat", "system", "join", "leave", "typing"
-	Text      string    `json:"text"`      // The actual message text
-	From      string    `json:"from"`      // Who sent the message
-	Timestamp time.Time `json:"timestamp"` // When the message was sent
-	RoomID    string    `json:"roomId"`    // Which room the message belongs to
+	ID        uint64               `json:"id,omitempty"`        // Stored chat messages only
+	Seq       uint64               `json:"seq,omitempty"`       // Position in the room; on "resume", the latest position
+	Type      string               `json:"type"`                // Type: "chat", "action", "attachment", "direct", "system", "join", "leave", "resume", "edit", "delete", "react", "nick", "topic", "participants", "presence", "warning", "server_restarting", "clear"
+	Text      string               `json:"text"`                // The actual message text
+	From      string               `json:"from"`                // Who sent the message
+	FromID    string               `json:"fromId,omitempty"`    // Participant ID of the sender of a "chat", "action", "attachment", "direct" or "react" message
+	To        string               `json:"to,omitempty"`        // On "direct": participant ID of the recipient
+	UserID    uint                 `json:"userId,omitempty"`    // Signed-in sender
+	Name      string               `json:"name,omitempty"`      // On "nick": the name the participant now sends under
+	Timestamp time.Time            `json:"timestamp"`           // When the message was sent
+	RoomID    string               `json:"roomId"`              // Which room the message belongs to
+	History   bool                 `json:"history,omitempty"`   // Replayed rather than delivered live
+	Truncated bool                 `json:"truncated,omitempty"` // On "resume": older missed messages were left out
+	Target    uint64               `json:"target,omitempty"`    // On "edit", "delete" and "react": Seq of the changed message
+	Emoji     string               `json:"emoji,omitempty"`     // On "react"
+	Removed   bool                 `json:"removed,omitempty"`   // On "react": the reaction was taken back
+	Edited    bool                 `json:"edited,omitempty"`
+	Deleted   bool                 `json:"deleted,omitempty"`   // Text is cleared on deletion
+	Reactions map[string][]Reactor `json:"reactions,omitempty"` // Emoji -> who reacted
+
+	Attachment *AttachmentInfo `json:"attachment,omitempty"` // On "attachment": the shared file; Text is its caption
+
+	Self         string            `json:"self,omitempty"`         // On "participants": the recipient's own ID
+	Participants []ParticipantInfo `json:"participants,omitempty"` // On "participants": everyone in the room
+	Presence     *PresenceDiff     `json:"presence,omitempty"`     // On "presence"
+
+	Until      *time.Time `json:"until,omitempty"`      // On "warning": when the sender's mute ends
+	RetryAfter int64      `json:"retryAfter,omitempty"` // On "server_restarting": milliseconds to wait before reconnecting
+}
+
+// Reactor is someone who reacted to a message. Names change and guests pick
+// their own, so reactors are told apart by ID: "user:<id>" for signed-in
+// users, "guest:<participant ID>" for guests.
+type Reactor struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ParticipantInfo describes someone in a room's chat. The ID addresses
+// direct messages.
+type ParticipantInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"` // Display name
+	UserID   uint      `json:"userId,omitempty"`
+	Avatar   string    `json:"avatar,omitempty"` // Image URL, signed-in users only
+	Role     string    `json:"role"`
+	Host     bool      `json:"host,omitempty"` // Owner or co-host
+	JoinedAt time.Time `json:"joinedAt"`
+	Status   string    `json:"status"`
+}
+
+// messageFromRecord converts a stored message into the wire format
+func messageFromRecord(record db.ChatMessage) ChatMessage {
+	message := ChatMessage{
+		ID:        record.ID,
+		Seq:       record.Seq,
+		Type:      record.Type,
+		Text:      record.Text,
+		From:      record.Sender,
+		Timestamp: record.CreatedAt,
+		RoomID:    record.RoomID,
+		Edited:    record.EditedAt != nil,
+		Deleted:   record.DeletedAt != nil,
+	}
+	if record.UserID != nil {
+		message.UserID = *record.UserID
+	}
+	if record.SenderID != nil {
+		message.FromID = *record.SenderID
+	}
+	if record.Attachment != nil {
+		message.Attachment = attachmentInfo(*record.Attachment)
+	}
+	for _, reaction := range record.Reactions {
+		if message.Reactions == nil {
+			message.Reactions = make(map[string][]Reactor)
+		}
+		reactor := Reactor{ID: reaction.SenderKey, Name: reaction.Sender}
+		message.Reactions[reaction.Emoji] = append(message.Reactions[reaction.Emoji], reactor)
+	}
+	return message
+}
+
+// Conn is where a participant's frames are written: its own WebSocket on
+// /chat, or its chat channel of a room socket
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	Close() error
 }
 
 // ChatParticipant represents a user in a chat room
 type ChatParticipant struct {
-	ID       string          // Unique participant ID
-	Username string          // Display name
-	Conn     *websocket.Conn // WebSocket connection
-	RoomID   string          // Which room they're in
+	ID       string    // Unique participant ID
+	UserID   uint      // Signed-in user, 0 for guests
+	Username string    // Display name, read with name() once joined
+	Avatar   string    // Image URL, "" for guests
+	Role     string    // RoleHost, RoleCoHost, RoleMember or RoleGuest
+	Host     bool      // Owner or co-host, may change anyone's messages
+	Status   string    // Last status set by the client
+	JoinedAt time.Time // When they joined the chat
+	Conn     Conn      // Connection frames are written to
+	RoomID   string    // Which room they're in
+
+	send       chan []byte   // Frames waiting for the writer
+	done       chan struct{} // Closed to stop the writer
+	closeOnce  sync.Once
+	writerWG   sync.WaitGroup
+	closeCode  int           // Close frame sent once the writer stops, 0 for none
+	writeMutex sync.Mutex    // Serialises writes to Conn
+	nameMutex  sync.RWMutex  // Guards Username, which Rename changes
+	acked      atomic.Uint64 // Latest sequence number the client acknowledged
+}
+
+// Ack records that the client has every message up to seq
+func (p *ChatParticipant) Ack(seq uint64) {
+	if seq > p.acked.Load() {
+		p.acked.Store(seq)
+	}
+}
+
+// name returns the username the participant chats under
+func (p *ChatParticipant) name() string {
+	p.nameMutex.RLock()
+	defer p.nameMutex.RUnlock()
+	return p.Username
+}
+
+// info describes the participant as the roster shows it
+func (p *ChatParticipant) info() ParticipantInfo {
+	name, _ := splitUsername(p.name())
+	return ParticipantInfo{
+		ID:       p.ID,
+		Name:     name,
+		UserID:   p.UserID,
+		Avatar:   p.Avatar,
+		Role:     p.Role,
+		Host:     p.Host,
+		JoinedAt: p.JoinedAt,
+		Status:   p.Status,
+	}
+}
+
+// roomEnvelope is what gets published on a room's chat channel
+type roomEnvelope struct {
+	Exclude string      `json:"exclude,omitempty"` // Participant ID that must not receive it
+	Only    []string    `json:"only,omitempty"`    // Participant IDs that receive it; everyone if empty
+	Message ChatMessage `json:"message"`
+	Close   bool        `json:"close,omitempty"` // Disconnect everyone after delivering
+}
+
+// addressedTo reports whether a participant should receive the envelope
+func (e roomEnvelope) addressedTo(participantID string) bool {
+	if participantID == e.Exclude {
+		return false
+	}
+	if len(e.Only) == 0 {
+		return true
+	}
+	for _, id := range e.Only {
+		if id == participantID {
+			return true
+		}
+	}
+	return false
 }
 
-// ChatManager handles all chat functionality across multiple rooms
+// ChatManager handles all chat functionality across multiple rooms. Only the
+// connections accepted by this node are kept here; membership and message
+// fan-out go through the room store so every node sees the same rooms.
 type ChatManager struct {
-	rooms map[string][]*ChatParticipant // Map of roomID -> list of participants
-	mutex sync.RWMutex                  // Thread-safe access to rooms
+	rooms         map[string][]*ChatParticipant        // Map of roomID -> list of local participants
+	subscriptions map[string]roomstore.Subscription    // Map of roomID -> store subscription
+	buffers       map[string]*messageBuffer            // Map of roomID -> recent messages for resuming clients
+	store         roomstore.Store                      // Shared room state
+	openRoom      RoomOpener                           // Loads a room's settings on join
+	history       db.ChatMessageRepositoryInterface    // Stored messages; nil keeps chat live only
+	attachments   db.ChatAttachmentRepositoryInterface // Uploaded files; nil disables sharing them
+	blobs         blobstore.BlobStore                  // Where uploaded files are kept
+	commands      *CommandRegistry                     // Slash commands typed into the chat
+	moderation    *ModerationChain                     // Checks what people send
+	moderationLog db.ChatModerationRepositoryInterface // Records what moderation objected to; nil only logs it
+	limits        *ratelimit.Group                     // Budgets for what clients send
+	gate          drain.Gate                           // Closed once the server starts shutting down
+	mutex         sync.RWMutex                         // Thread-safe access to rooms
 }
 
-// NewChatManager creates a new chat manager instance
-func NewChatManager() *ChatManager {
-	return &ChatManager{
-		rooms: make(map[string][]*ChatParticipant), // Initialize empty rooms map
+// NewChatManager creates a new chat manager instance backed by the given
+// store. A nil store keeps everything in process; a nil openRoom creates
+// rooms with default settings; a nil history forgets messages once sent.
+func NewChatManager(store roomstore.Store, openRoom RoomOpener, history db.ChatMessageRepositoryInterface) *ChatManager {
+	if store == nil {
+		store = roomstore.NewMemoryStore()
+	}
+	cm := &ChatManager{
+		rooms:         make(map[string][]*ChatParticipant), // Initialize empty rooms map
+		subscriptions: make(map[string]roomstore.Subscription),
+		buffers:       make(map[string]*messageBuffer),
+		store:         store,
+		openRoom:      openRoom,
+		history:       history,
+		commands:      DefaultCommands(),
+		moderation:    DefaultModeration(),
+		limits:        ratelimit.NewGroup(ratelimit.DefaultPolicy()),
 	}
+	if cm.openRoom == nil {
+		cm.openRoom = cm.createRoom
+	}
+	return cm
+}
+
+// createRoom is the default RoomOpener
+func (cm *ChatManager) createRoom(roomID string) (*roomstore.RoomInfo, error) {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	if _, err := cm.store.CreateRoom(ctx, roomstore.RoomInfo{ID: roomID, CreatedAt: time.Now()}); err != nil {
+		return nil, err
+	}
+	return cm.store.GetRoom(ctx, roomID)
 }
 
 // AddParticipant adds a new user to a chat room
-func (cm *ChatManager) AddParticipant(roomID, userID, username string, conn *websocket.Conn) {
-	cm.mutex.Lock()         // Lock for writing
-	defer cm.mutex.Unlock() // Always unlock when function exits
+func (cm *ChatManager) AddParticipant(roomID, userID string, identity auth.Identity, username, avatar string, conn Conn) (*ChatParticipant, error) {
+	if !cm.gate.Enter() {
+		return nil, ErrServerRestarting
+	}
+	participant, err := cm.addParticipant(roomID, userID, identity, username, avatar, conn)
+	if err != nil {
+		cm.gate.Leave()
+		return nil, err
+	}
+
+	// Shutdown began while joining and may have missed this participant
+	if cm.gate.Closed() {
+		restart(participant)
+	}
+	return participant, nil
+}
+
+// addParticipant checks whether a user may join a room's chat and adds them
+func (cm *ChatManager) addParticipant(roomID, userID string, identity auth.Identity, username, avatar string, conn Conn) (*ChatParticipant, error) {
+	// Joining chat for a room nobody created yet creates it
+	info, err := cm.openRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if info.Expired() {
+		return nil, ErrRoomExpired
+	}
+	if info.Locked {
+		return nil, ErrRoomLocked
+	}
+	owner := info.HostUserID != 0 && identity.UserID == info.HostUserID
+	if !owner && info.Banned(identity.UserID, identity.IP) {
+		return nil, ErrBanned
+	}
+	if info.PrivacyMode == roomstore.PrivacyMembers && identity.Guest() && !identity.Invited() {
+		return nil, ErrLoginRequired
+	}
+	if info.PrivacyMode == roomstore.PrivacyInvite && !owner && !identity.Invited() {
+		return nil, ErrInviteRequired
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
 
 	// Extract base username (remove random suffix if present)
-	displayName := username
-	if idx := strings.LastIndex(username, "_"); idx != -1 {
-		// Check if the suffix looks like a random string (alphanumeric, 6 chars)
-		suffix := username[idx+1:]
-		if len(suffix) == 6 && isAlphanumeric(suffix) {
-			displayName = username[:idx]
-		}
+	displayName, _ := splitUsername(username)
+	if reservedName(displayName) {
+		return nil, ErrReservedName
 	}
 
 	// Create new participant
 	participant := &ChatParticipant{
 		ID:       userID,
+		UserID:   identity.UserID,
 		Username: username,
+		Avatar:   avatar,
+		Role:     roleOf(owner, identity),
+		Host:     owner || identity.Role == auth.RoleCoHost,
+		Status:   StatusActive,
+		JoinedAt: time.Now(),
 		Conn:     conn,
 		RoomID:   roomID,
+		send:     make(chan []byte, sendQueueSize),
+		done:     make(chan struct{}),
+	}
+	participant.startWriter()
+
+	// A room's sequence continues after its stored history
+	var floor uint64
+	if cm.buffer(roomID) == nil {
+		floor = cm.latestStoredSeq(roomID)
 	}
 
-	// Add to room
+	// Add to room, following its channel if this is the first local participant
+	cm.mutex.Lock()
+	if _, subscribed := cm.subscriptions[roomID]; !subscribed {
+		subscription, err := cm.store.Subscribe(ctx, roomstore.Channel(roomstore.ScopeChat, roomID), cm.deliver(roomID), cm.overflow(roomID))
+		if err != nil {
+			cm.mutex.Unlock()
+			participant.release()
+			return nil, err
+		}
+		cm.subscriptions[roomID] = subscription
+		cm.buffers[roomID] = newMessageBuffer(floor)
+	}
 	cm.rooms[roomID] = append(cm.rooms[roomID], participant)
+	cm.mutex.Unlock()
+
+	member := roomstore.Member{
+		ID:       userID,
+		NodeID:   roomstore.NodeID,
+		UserID:   identity.UserID,
+		Name:     username,
+		Avatar:   avatar,
+		Role:     participant.Role,
+		Host:     participant.Host,
+		Status:   participant.Status,
+		JoinedAt: participant.JoinedAt,
+	}
+	if err := cm.store.AddMember(ctx, roomstore.ScopeChat, roomID, member); err != nil {
+		cm.removeLocal(roomID, userID)
+		return nil, err
+	}
 
 	// Send join notification to all participants in the room
 	joinMsg := ChatMessage{
@@ -85,22 +429,28 @@ func (cm *ChatManager) AddParticipant(roomID, userID, username string, conn *web
 		Timestamp: time.Now(),
 		RoomID:    roomID,
 	}
-	cm.broadcastToRoom(roomID, joinMsg, nil) // nil = don't exclude anyone
+	cm.broadcastToRoom(roomID, joinMsg, "") // "" = don't exclude anyone
+
+	// The newcomer gets the whole roster when its connection is set up
+	cm.sendPresence(roomID, PresenceDiff{Joined: []ParticipantInfo{participant.info()}}, userID)
 
 	log.Printf("[Chat] %s joined room %s", displayName, roomID)
+	return participant, nil
 }
 
-// RemoveParticipant removes a user from a chat room
-func (cm *ChatManager) RemoveParticipant(roomID, userID string) {
+// removeLocal drops a participant from this node and returns it, or nil if
+// it was not here. The room's subscription is closed once the last
+// local participant leaves.
+func (cm *ChatManager) removeLocal(roomID, userID string) *ChatParticipant {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
 
 	participants, exists := cm.rooms[roomID]
 	if !exists {
-		return // Room doesn't exist
+		return nil // Room doesn't exist
 	}
 
-	var username string
+	var left *ChatParticipant
 	var newParticipants []*ChatParticipant
 
 	// Filter out the leaving participant
@@ -108,28 +458,52 @@ func (cm *ChatManager) RemoveParticipant(roomID, userID string) {
 		if p.ID != userID {
 			newParticipants = append(newParticipants, p)
 		} else {
-			username = p.Username // Remember who left
+			left = p // Remember who left
+			left.release()
+			cm.buffers[roomID].remember(clientKey(p.UserID, p.ID), p.acked.Load())
 		}
 	}
 
 	// Update room
 	if len(newParticipants) == 0 {
 		delete(cm.rooms, roomID) // Delete empty room
+		delete(cm.buffers, roomID)
+		if subscription, ok := cm.subscriptions[roomID]; ok {
+			subscription.Close()
+			delete(cm.subscriptions, roomID)
+		}
 	} else {
 		cm.rooms[roomID] = newParticipants
 	}
 
-	// Send leave notification
-	if username != "" {
-		// Extract base username (remove random suffix if present)
-		displayName := username
-		if idx := strings.LastIndex(username, "_"); idx != -1 {
-			// Check if the suffix looks like a random string (alphanumeric, 6 chars)
-			suffix := username[idx+1:]
-			if len(suffix) == 6 && isAlphanumeric(suffix) {
-				displayName = username[:idx]
-			}
+	return left
+}
+
+// RemoveParticipant removes a user from a chat room
+func (cm *ChatManager) RemoveParticipant(roomID, userID string) {
+	left := cm.removeLocal(roomID, userID)
+	if left == nil {
+		return
+	}
+	defer cm.gate.Leave()
+	username := left.name()
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	remaining, err := cm.store.RemoveMember(ctx, roomstore.ScopeChat, roomID, userID)
+	if err != nil {
+		log.Printf("[Chat] Error removing %s from room %s: %v", userID, roomID, err)
+	} else if remaining == 0 {
+		if err := cm.store.DeleteRoomIfEmpty(ctx, roomID); err != nil {
+			log.Printf("[Chat] Error releasing room %s: %v", roomID, err)
 		}
+	}
+
+	// Send leave notification, unless nobody is left to hear it
+	if err != nil || remaining > 0 {
+		// Extract base username (remove random suffix if present)
+		displayName, _ := splitUsername(username)
 
 		leaveMsg := ChatMessage{
 			Type:      "leave",
@@ -138,73 +512,376 @@ func (cm *ChatManager) RemoveParticipant(roomID, userID string) {
 			Timestamp: time.Now(),
 			RoomID:    roomID,
 		}
-		cm.broadcastToRoom(roomID, leaveMsg, nil)
+		cm.broadcastToRoom(roomID, leaveMsg, "")
+		cm.sendPresence(roomID, PresenceDiff{Left: []string{userID}}, "")
 		log.Printf("[Chat] %s left room %s", displayName, roomID)
 	}
 }
 
+// saveMessage stores a chat message and sets its ID. A message that cannot
+// be stored is still delivered, it just won't be replayed.
+func (cm *ChatManager) saveMessage(message *ChatMessage) {
+	if cm.history == nil {
+		return
+	}
+
+	record := &db.ChatMessage{
+		RoomID:    message.RoomID,
+		Seq:       message.Seq,
+		Sender:    message.From,
+		Type:      message.Type,
+		Text:      message.Text,
+		CreatedAt: message.Timestamp,
+	}
+	if message.UserID != 0 {
+		record.UserID = &message.UserID
+	}
+	if message.FromID != "" {
+		record.SenderID = &message.FromID
+	}
+	if message.Attachment != nil {
+		record.AttachmentID = &message.Attachment.ID
+	}
+	if err := cm.history.CreateMessage(record); err != nil {
+		log.Printf("[Chat] Error storing message in room %s: %v", message.RoomID, err)
+		return
+	}
+	message.ID = record.ID
+}
+
+// RecentMessages returns the latest stored messages of a room, oldest first
+func (cm *ChatManager) RecentMessages(roomID string, limit int) []ChatMessage {
+	if cm.history == nil {
+		return nil
+	}
+
+	records, err := cm.history.GetMessages(roomID, 0, limit)
+	if err != nil {
+		log.Printf("[Chat] Error loading history of room %s: %v", roomID, err)
+		return nil
+	}
+
+	messages := make([]ChatMessage, 0, len(records))
+	for _, record := range records {
+		message := messageFromRecord(record)
+		message.History = true
+		messages = append(messages, message)
+	}
+	return messages
+}
+
 // BroadcastMessage sends a message to all participants in a room
 func (cm *ChatManager) BroadcastMessage(roomID string, message ChatMessage) {
-	cm.mutex.RLock()         // Read lock (multiple readers allowed)
-	defer cm.mutex.RUnlock() // Unlock when done
+	cm.broadcastToRoom(roomID, message, "")
+}
 
-	cm.broadcastToRoom(roomID, message, nil)
+// CloseRoom tells everyone in a room that it was closed and disconnects them
+func (cm *ChatManager) CloseRoom(roomID string) {
+	closeMsg := ChatMessage{
+		Type:      "system",
+		Text:      "The host closed this room",
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+	}
+	cm.publish(roomID, roomEnvelope{Message: closeMsg, Close: true})
 }
 
-// broadcastToRoom is the internal function that actually sends messages
-func (cm *ChatManager) broadcastToRoom(roomID string, message ChatMessage, excludeConn *websocket.Conn) {
-	participants, exists := cm.rooms[roomID]
-	if !exists {
-		return // Room doesn't exist
+// ErrRecipientNotFound is returned for direct messages to someone not in the room
+var ErrRecipientNotFound = errors.New("recipient is not in this room")
+
+// SendDirect delivers a message only to its sender and the participant it
+// is addressed to, wherever they are connected. Direct messages are neither
+// numbered nor stored, so they are never replayed to the rest of the room.
+func (cm *ChatManager) SendDirect(roomID string, message ChatMessage) error {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	members, err := cm.store.Members(ctx, roomstore.ScopeChat, roomID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.ID == message.To && member.ID != message.FromID {
+			cm.publish(roomID, roomEnvelope{Only: []string{message.FromID, message.To}, Message: message})
+			return nil
+		}
+	}
+	return ErrRecipientNotFound
+}
+
+// postMessage numbers a message from a participant, keeps it for people
+// joining later and broadcasts it to everyone, including the sender
+func (cm *ChatManager) postMessage(message ChatMessage) {
+	cm.sequence(&message)
+	cm.saveMessage(&message)
+	cm.broadcastToRoom(message.RoomID, message, "")
+}
+
+// announce broadcasts a system message to a room
+func (cm *ChatManager) announce(roomID, text string) {
+	cm.broadcastToRoom(roomID, ChatMessage{
+		Type:      "system",
+		Text:      text,
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+	}, "")
+}
+
+// Rename changes the name a participant chats under and tells the room. The
+// random suffix that keeps usernames unique is kept.
+func (cm *ChatManager) Rename(participant *ChatParticipant, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxChatNameLength || reservedName(name) {
+		return fmt.Errorf("names are 1 to %d characters and cannot be %q", maxChatNameLength, systemName)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return errors.New("names cannot contain control characters")
+		}
+	}
+
+	roomID := participant.RoomID
+	for _, other := range cm.GetRoomParticipants(roomID) {
+		if other.ID != participant.ID && strings.EqualFold(other.Name, name) {
+			return fmt.Errorf("someone is already called %s", name)
+		}
+	}
+
+	oldName, suffix := splitUsername(participant.name())
+	username := name
+	if suffix != "" {
+		username = name + "_" + suffix
+	}
+
+	if err := cm.updateMember(participant, func(member *roomstore.Member) { member.Name = username }); err != nil {
+		log.Printf("[Chat] Error renaming %s in room %s: %v", participant.ID, roomID, err)
+		return ErrNotSaved
+	}
+
+	participant.nameMutex.Lock()
+	oldUsername := participant.Username
+	participant.Username = username
+	participant.nameMutex.Unlock()
+
+	cm.broadcastToRoom(roomID, ChatMessage{
+		Type:      "nick",
+		Text:      oldName + " is now known as " + name,
+		From:      oldUsername,
+		Name:      username,
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+	}, "")
+	return nil
+}
+
+// Topic returns the topic of a room, "" if it has none
+func (cm *ChatManager) Topic(roomID string) string {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	info, err := cm.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return ""
 	}
+	return info.Topic
+}
 
+// SetTopic changes the topic of a participant's room and tells the room
+func (cm *ChatManager) SetTopic(participant *ChatParticipant, topic string) error {
+	topic = strings.TrimSpace(topic)
+	if utf8.RuneCountInString(topic) > maxTopicLength {
+		return fmt.Errorf("topics are at most %d characters", maxTopicLength)
+	}
+	topic, err := cm.moderate(participant, "topic", topic)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	_, err = cm.store.UpdateRoom(ctx, participant.RoomID, func(info *roomstore.RoomInfo) error {
+		info.Topic = topic
+		return nil
+	})
+	if err != nil {
+		log.Printf("[Chat] Error setting the topic of room %s: %v", participant.RoomID, err)
+		return ErrNotSaved
+	}
+
+	cm.broadcastToRoom(participant.RoomID, ChatMessage{
+		Type:      "topic",
+		Text:      topic,
+		From:      participant.name(),
+		UserID:    participant.UserID,
+		Timestamp: time.Now(),
+		RoomID:    participant.RoomID,
+	}, "")
+	return nil
+}
+
+// Kick disconnects a participant from a room's chat, wherever it is
+// connected, and tells the room who removed them
+func (cm *ChatManager) Kick(by *ChatParticipant, participantID string) error {
+	var kicked *ParticipantInfo
+	for _, p := range cm.GetRoomParticipants(by.RoomID) {
+		if p.ID == participantID {
+			kicked = &p
+			break
+		}
+	}
+	if kicked == nil {
+		return ErrRecipientNotFound
+	}
+
+	byName, _ := splitUsername(by.name())
+	cm.publish(by.RoomID, roomEnvelope{
+		Only: []string{participantID},
+		Message: ChatMessage{
+			Type:      "system",
+			Text:      "You were removed from the chat by " + byName,
+			From:      "system",
+			Timestamp: time.Now(),
+			RoomID:    by.RoomID,
+		},
+		Close: true,
+	})
+	cm.announce(by.RoomID, kicked.Name+" was removed from the chat by "+byName)
+	return nil
+}
+
+// Clear removes every stored and buffered message of a room and tells
+// clients to clear what they show. Other nodes empty their buffers when the
+// clear frame reaches them.
+func (cm *ChatManager) Clear(roomID string) error {
+	if cm.history != nil {
+		if err := cm.history.DeleteMessages(roomID); err != nil {
+			log.Printf("[Chat] Error clearing the history of room %s: %v", roomID, err)
+			return ErrNotSaved
+		}
+	}
+	if buffer := cm.buffer(roomID); buffer != nil {
+		buffer.clear()
+	}
+	cm.broadcastToRoom(roomID, ChatMessage{
+		Type:      "clear",
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+	}, "")
+	return nil
+}
+
+// broadcastToRoom publishes a message to the room on every node, numbering
+// it first unless it is ephemeral
+func (cm *ChatManager) broadcastToRoom(roomID string, message ChatMessage, excludeID string) {
+	if message.Seq == 0 && sequenced(message.Type) {
+		cm.sequence(&message)
+	}
+	cm.publish(roomID, roomEnvelope{Exclude: excludeID, Message: message})
+}
+
+func (cm *ChatManager) publish(roomID string, envelope roomEnvelope) {
 	// Convert message to JSON
-	messageJSON, err := json.Marshal(message)
+	payload, err := json.Marshal(envelope)
 	if err != nil {
 		log.Printf("[Chat] Error marshaling message: %v", err)
 		return
 	}
 
-	// Send to all participants except the excluded one
-	for _, participant := range participants {
-		if participant.Conn == excludeConn {
-			continue // Skip excluded connection
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	if err := cm.store.Publish(ctx, roomstore.Channel(roomstore.ScopeChat, roomID), payload); err != nil {
+		log.Printf("[Chat] Error publishing message to room %s: %v", roomID, err)
+	}
+}
+
+// deliver returns the subscription handler that writes a room's messages
+// to the participants connected to this node
+func (cm *ChatManager) deliver(roomID string) roomstore.Handler {
+	return func(payload []byte) {
+		var envelope roomEnvelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			log.Printf("[Chat] Error unmarshaling message for room %s: %v", roomID, err)
+			return
 		}
 
-		err := participant.Conn.WriteMessage(websocket.TextMessage, messageJSON)
+		messageJSON, err := json.Marshal(envelope.Message)
 		if err != nil {
-			log.Printf("[Chat] Error sending message to %s: %v", participant.Username, err)
-			// Remove disconnected participant
-			go cm.RemoveParticipant(roomID, participant.ID)
+			log.Printf("[Chat] Error marshaling message: %v", err)
+			return
+		}
+
+		cm.mutex.RLock()
+		participants := cm.rooms[roomID]
+		buffer := cm.buffers[roomID]
+		cm.mutex.RUnlock()
+
+		// Keep it for participants who drop and resume
+		if buffer != nil && envelope.Message.Seq != 0 {
+			buffer.add(envelope.Message)
+		}
+
+		// Send to the participants it is addressed to
+		for _, participant := range participants {
+			if !envelope.addressedTo(participant.ID) {
+				continue // Skip excluded participant
+			}
+
+			if err := participant.Write(messageJSON); err != nil {
+				log.Printf("[Chat] Error sending message to %s: %v", participant.name(), err)
+				// Remove disconnected participant
+				go cm.RemoveParticipant(roomID, participant.ID)
+			}
+
+			// Ending the client's read loop makes it clean up after itself
+			if envelope.Close {
+				participant.Disconnect()
+			}
 		}
 	}
 }
 
-// GetRoomParticipants returns list of usernames in a room
-func (cm *ChatManager) GetRoomParticipants(roomID string) []string {
-	cm.mutex.RLock()
-	defer cm.mutex.RUnlock()
+// overflow handles a room whose subscription fell behind. Every chat frame
+// matters to the client's history or roster, so when one is dropped the
+// room's participants are told to reconnect and resume.
+func (cm *ChatManager) overflow(roomID string) roomstore.Overflow {
+	return func(payload []byte) bool {
+		// The publisher may hold the manager's lock
+		go func() {
+			cm.mutex.RLock()
+			participants := cm.rooms[roomID]
+			cm.mutex.RUnlock()
+
+			log.Printf("[Chat] Room %s fell behind on its messages, reconnecting its participants", roomID)
+			for _, participant := range participants {
+				participant.DisconnectWithCode(websocket.CloseTryAgainLater)
+			}
+		}()
+		return false
+	}
+}
 
-	participants, exists := cm.rooms[roomID]
-	if !exists {
-		return []string{} // Empty room
+// GetRoomParticipants returns the participants of a room across all nodes
+func (cm *ChatManager) GetRoomParticipants(roomID string) []ParticipantInfo {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	members, err := cm.store.Members(ctx, roomstore.ScopeChat, roomID)
+	if err != nil {
+		log.Printf("[Chat] Error listing participants of room %s: %v", roomID, err)
+		return []ParticipantInfo{}
 	}
 
-	// Extract display names (remove random suffixes)
-	usernames := make([]string, 0, len(participants))
-	for _, p := range participants {
-		displayName := p.Username
-		if idx := strings.LastIndex(p.Username, "_"); idx != -1 {
-			// Check if the suffix looks like a random string (alphanumeric, 6 chars)
-			suffix := p.Username[idx+1:]
-			if len(suffix) == 6 && isAlphanumeric(suffix) {
-				displayName = p.Username[:idx]
-			}
-		}
-		usernames = append(usernames, displayName)
+	participants := make([]ParticipantInfo, 0, len(members))
+	for _, m := range members {
+		participants = append(participants, memberInfo(m))
 	}
 
-	return usernames
+	return participants
 }
 
 // GetRoomStats returns chat statistics for monitoring
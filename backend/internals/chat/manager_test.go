@@ -0,0 +1,190 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/db"
+)
+
+// fakeConn records the frames written to a participant
+type fakeConn struct {
+	mutex  sync.Mutex
+	frames []ChatMessage
+}
+
+func (c *fakeConn) WriteMessage(messageType int, data []byte) error {
+	var message ChatMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.frames = append(c.frames, message)
+	return nil
+}
+
+func (c *fakeConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(0, data)
+}
+
+func (c *fakeConn) WriteControl(int, []byte, time.Time) error { return nil }
+func (c *fakeConn) SetWriteDeadline(time.Time) error          { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error           { return nil }
+func (c *fakeConn) Close() error                              { return nil }
+
+// next waits for the next frame of a type written to the connection
+func (c *fakeConn) next(t *testing.T, messageType string) ChatMessage {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		for i, message := range c.frames {
+			if message.Type == messageType {
+				c.frames = c.frames[i+1:]
+				c.mutex.Unlock()
+				return message
+			}
+		}
+		c.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no %s frame arrived", messageType)
+	return ChatMessage{}
+}
+
+// fakeHistory keeps stored chat messages in memory
+type fakeHistory struct {
+	mutex    sync.Mutex
+	messages []*db.ChatMessage
+	err      error // Returned by GetMessageBySeq, if set
+}
+
+func (h *fakeHistory) CreateMessage(message *db.ChatMessage) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	message.ID = uint64(len(h.messages) + 1)
+	stored := *message
+	h.messages = append(h.messages, &stored)
+	return nil
+}
+
+func (h *fakeHistory) GetMessageBySeq(roomID string, seq uint64) (*db.ChatMessage, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.err != nil {
+		return nil, h.err
+	}
+	for _, message := range h.messages {
+		if message.RoomID == roomID && message.Seq == seq {
+			found := *message
+			if found.AttachmentID != nil {
+				found.Attachment = &db.ChatAttachment{ID: *found.AttachmentID} // Preloaded by the repository
+			}
+			return &found, nil
+		}
+	}
+	return nil, db.ErrChatMessageNotFound
+}
+
+func (h *fakeHistory) UpdateMessage(message *db.ChatMessage) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, stored := range h.messages {
+		if stored.ID == message.ID {
+			updated := *message
+			h.messages[i] = &updated
+		}
+	}
+	return nil
+}
+
+func (h *fakeHistory) GetMessages(string, uint64, int) ([]db.ChatMessage, error) { return nil, nil }
+func (h *fakeHistory) GetMessagesAfter(string, uint64, int) ([]db.ChatMessage, error) {
+	return nil, nil
+}
+func (h *fakeHistory) ToggleReaction(*db.ChatReaction) (bool, error) { return true, nil }
+func (h *fakeHistory) DeleteMessages(string) error                   { return nil }
+func (h *fakeHistory) LatestSeq(string) (uint64, error)              { return 0, nil }
+
+// fakeAttachments keeps uploaded files' records in memory
+type fakeAttachments struct {
+	mutex       sync.Mutex
+	attachments map[string]db.ChatAttachment
+}
+
+func (a *fakeAttachments) CreateAttachment(attachment *db.ChatAttachment) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.attachments[attachment.ID] = *attachment
+	return nil
+}
+
+func (a *fakeAttachments) GetAttachment(id string) (*db.ChatAttachment, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	attachment, found := a.attachments[id]
+	if !found {
+		return nil, fmt.Errorf("chat attachment not found")
+	}
+	return &attachment, nil
+}
+
+func (a *fakeAttachments) DeleteAttachment(id string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.attachments, id)
+	return nil
+}
+
+// joinChat adds a participant to a room of the manager and takes it out
+// again when the test ends
+func joinChat(t *testing.T, cm *ChatManager, roomID, id string, identity auth.Identity, username string) (*ChatParticipant, *fakeConn) {
+	t.Helper()
+	conn := &fakeConn{}
+	participant, err := cm.AddParticipant(roomID, id, identity, username, "", conn)
+	if err != nil {
+		t.Fatalf("AddParticipant(%s): %v", id, err)
+	}
+	t.Cleanup(func() { cm.RemoveParticipant(roomID, id) })
+	return participant, conn
+}
+
+func TestRenameWhileOthersRead(t *testing.T) {
+	cm := NewChatManager(nil, nil, nil)
+	guest, _ := joinChat(t, cm, "room", "g1", auth.Identity{}, "Gus_ab12cd")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := cm.Rename(guest, fmt.Sprintf("Gus%d", i)); err != nil {
+				t.Errorf("Rename: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			guest.info()
+		}
+	}()
+	wg.Wait()
+
+	if name := guest.info().Name; name != "Gus19" {
+		t.Fatalf("Name = %q, want Gus19", name)
+	}
+	if username := guest.name(); username != "Gus19_ab12cd" {
+		t.Fatalf("username = %q, want the suffix kept", username)
+	}
+}
@@ -0,0 +1,434 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"seaside/lib/db"
+	"seaside/lib/roomstore"
+)
+
+// ModerationAction is what happens to a message a check objects to. When
+// several checks object, the highest action wins.
+type ModerationAction int
+
+const (
+	ModerationAllow  ModerationAction = iota
+	ModerationFlag                    // Delivered as sent, recorded for the host
+	ModerationMask                    // Delivered with the offending parts hidden
+	ModerationReject                  // Not delivered
+)
+
+func (a ModerationAction) String() string {
+	switch a {
+	case ModerationFlag:
+		return "flagged"
+	case ModerationMask:
+		return "masked"
+	case ModerationReject:
+		return "rejected"
+	}
+	return "allowed"
+}
+
+// parseModerationAction reads an action from a room's settings
+func parseModerationAction(value string, fallback ModerationAction) ModerationAction {
+	switch value {
+	case "flag":
+		return ModerationFlag
+	case "mask":
+		return ModerationMask
+	case "reject":
+		return ModerationReject
+	}
+	return fallback
+}
+
+// ErrMessageRejected is returned for messages moderation does not deliver
+var ErrMessageRejected = errors.New("message not sent")
+
+// Server defaults for rooms that set nothing
+const (
+	defaultMaxMessageLength = 2000
+	defaultSpamLimit        = 3
+	spamWindow              = 30 * time.Second // Repeats further apart are not spam
+	spamSweepSize           = 1000             // Senders remembered before quiet ones are forgotten
+	wordPatternCacheSize    = 256              // Compiled word lists kept before the cache starts over
+)
+
+// DefaultBlockedWords is the server's profanity list. Rooms can add to it.
+var DefaultBlockedWords = []string{
+	"asshole", "bastard", "bitch", "bullshit", "cunt", "dickhead",
+	"fuck", "fucker", "fucking", "motherfucker", "shit", "twat",
+}
+
+// ModerationSettings are the rules moderating one room's chat
+type ModerationSettings struct {
+	BlockedWords    []string
+	ProfanityAction ModerationAction
+	AllowedDomains  []string // If set, links may only point here
+	BlockedDomains  []string
+	LinkAction      ModerationAction
+	MaxLength       int // In characters; 0 for no limit
+	SpamLimit       int // Identical messages someone may send in a row; 0 for no limit
+}
+
+// moderationSettings combines a room's settings with the server's
+// defaults. It returns false if the room turned moderation off.
+func moderationSettings(room *roomstore.ChatModeration) (ModerationSettings, bool) {
+	settings := ModerationSettings{
+		BlockedWords:    DefaultBlockedWords,
+		ProfanityAction: ModerationMask,
+		LinkAction:      ModerationReject,
+		MaxLength:       defaultMaxMessageLength,
+		SpamLimit:       defaultSpamLimit,
+	}
+	if room == nil {
+		return settings, true
+	}
+	if room.Disabled {
+		return settings, false
+	}
+
+	if len(room.BlockedWords) > 0 {
+		settings.BlockedWords = append(append([]string(nil), DefaultBlockedWords...), room.BlockedWords...)
+	}
+	settings.ProfanityAction = parseModerationAction(room.ProfanityAction, settings.ProfanityAction)
+	settings.AllowedDomains = room.AllowedDomains
+	settings.BlockedDomains = room.BlockedDomains
+	settings.LinkAction = parseModerationAction(room.LinkAction, settings.LinkAction)
+	if room.MaxLength > 0 {
+		settings.MaxLength = room.MaxLength
+	}
+	if room.SpamLimit > 0 {
+		settings.SpamLimit = room.SpamLimit
+	}
+	return settings, true
+}
+
+// ModeratedMessage is what a moderator gets to check
+type ModeratedMessage struct {
+	RoomID string
+	From   string // Username of the sender
+	FromID string // Participant ID of the sending connection
+	UserID uint   // Signed-in sender, 0 for guests
+	Type   string // "chat", "action", "direct", "attachment", "edit" or "topic"
+	Text   string
+}
+
+// Verdict is a moderator's decision on a message
+type Verdict struct {
+	Action ModerationAction
+	Text   string // With ModerationMask, the text to deliver instead
+	Reason string // Shown to the sender of a rejected message
+}
+
+// Moderator checks chat messages for one kind of problem
+type Moderator struct {
+	Name  string // Recorded with the messages it objects to
+	Check func(message ModeratedMessage, settings ModerationSettings) Verdict
+}
+
+// ModerationResult is the outcome of running a message through a chain
+type ModerationResult struct {
+	Action  ModerationAction
+	Text    string   // What to deliver
+	Rules   []string // Moderators that objected
+	Reasons []string // Their reasons, in the same order
+}
+
+// ModerationChain runs moderators in order. A rejection stops the chain;
+// the moderators after a mask check the masked text.
+type ModerationChain struct {
+	mutex      sync.RWMutex
+	moderators []Moderator
+}
+
+// NewModerationChain creates a chain of the given moderators
+func NewModerationChain(moderators ...Moderator) *ModerationChain {
+	return &ModerationChain{moderators: moderators}
+}
+
+// Use adds a moderator at the end of the chain
+func (c *ModerationChain) Use(moderator Moderator) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.moderators = append(c.moderators, moderator)
+}
+
+// Moderate runs a message through the chain
+func (c *ModerationChain) Moderate(message ModeratedMessage, settings ModerationSettings) ModerationResult {
+	c.mutex.RLock()
+	moderators := c.moderators
+	c.mutex.RUnlock()
+
+	result := ModerationResult{Text: message.Text}
+	for _, moderator := range moderators {
+		message.Text = result.Text
+		verdict := moderator.Check(message, settings)
+		if verdict.Action == ModerationAllow {
+			continue
+		}
+
+		result.Rules = append(result.Rules, moderator.Name)
+		result.Reasons = append(result.Reasons, verdict.Reason)
+		if verdict.Action > result.Action {
+			result.Action = verdict.Action
+		}
+		if verdict.Action == ModerationMask {
+			result.Text = verdict.Text
+		}
+		if verdict.Action == ModerationReject {
+			break
+		}
+	}
+	return result
+}
+
+// DefaultModeration returns a chain with the built-in checks
+func DefaultModeration() *ModerationChain {
+	return NewModerationChain(
+		Moderator{Name: "length", Check: checkLength},
+		Moderator{Name: "profanity", Check: checkProfanity},
+		Moderator{Name: "links", Check: checkLinks},
+		spamModerator(),
+	)
+}
+
+func checkLength(message ModeratedMessage, settings ModerationSettings) Verdict {
+	if settings.MaxLength > 0 && utf8.RuneCountInString(message.Text) > settings.MaxLength {
+		return Verdict{
+			Action: ModerationReject,
+			Reason: fmt.Sprintf("messages are at most %d characters", settings.MaxLength),
+		}
+	}
+	return Verdict{}
+}
+
+func checkProfanity(message ModeratedMessage, settings ModerationSettings) Verdict {
+	if len(settings.BlockedWords) == 0 {
+		return Verdict{}
+	}
+
+	words := make([]string, 0, len(settings.BlockedWords))
+	for _, word := range settings.BlockedWords {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if len(words) == 0 {
+		return Verdict{}
+	}
+	pattern, err := wordPatterns.get(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	if err != nil {
+		log.Printf("[Chat] Invalid blocked word list: %v", err)
+		return Verdict{}
+	}
+	if !pattern.MatchString(message.Text) {
+		return Verdict{}
+	}
+
+	return Verdict{
+		Action: settings.ProfanityAction,
+		Text: pattern.ReplaceAllStringFunc(message.Text, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		}),
+		Reason: "it contains blocked words",
+	}
+}
+
+// patternCache keeps compiled blocked word lists, so each distinct list is
+// compiled once rather than for every message. Rooms with the same words
+// share an entry.
+type patternCache struct {
+	mutex    sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+var wordPatterns = &patternCache{patterns: make(map[string]*regexp.Regexp)}
+
+func (c *patternCache) get(expr string) (*regexp.Regexp, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if pattern, ok := c.patterns[expr]; ok {
+		return pattern, nil
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	// Lists nobody uses any more are dropped with the rest
+	if len(c.patterns) >= wordPatternCacheSize {
+		clear(c.patterns)
+	}
+	c.patterns[expr] = pattern
+	return pattern, nil
+}
+
+// linkPattern finds the links people type; bare domains are left alone
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+
+func checkLinks(message ModeratedMessage, settings ModerationSettings) Verdict {
+	if len(settings.AllowedDomains) == 0 && len(settings.BlockedDomains) == 0 {
+		return Verdict{}
+	}
+
+	found := false
+	masked := linkPattern.ReplaceAllStringFunc(message.Text, func(link string) string {
+		if linkAllowed(link, settings) {
+			return link
+		}
+		found = true
+		return "[link removed]"
+	})
+	if !found {
+		return Verdict{}
+	}
+	return Verdict{Action: settings.LinkAction, Text: masked, Reason: "links to that site are not allowed"}
+}
+
+// linkAllowed checks a link's host against a room's domain lists. A domain
+// covers its subdomains.
+func linkAllowed(link string, settings ModerationSettings) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+
+	matches := func(domains []string) bool {
+		for _, domain := range domains {
+			domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), ".")
+			if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(settings.BlockedDomains) {
+		return false
+	}
+	return len(settings.AllowedDomains) == 0 || matches(settings.AllowedDomains)
+}
+
+// repeats tracks the last message of one sender
+type repeats struct {
+	text  string
+	count int
+	last  time.Time
+}
+
+// spamModerator rejects a message someone already sent SpamLimit times in
+// a row, each within spamWindow of the one before
+func spamModerator() Moderator {
+	var mutex sync.Mutex
+	recent := make(map[string]*repeats)
+
+	return Moderator{Name: "spam", Check: func(message ModeratedMessage, settings ModerationSettings) Verdict {
+		if settings.SpamLimit <= 0 {
+			return Verdict{}
+		}
+		key := message.RoomID + "\x00" + clientKey(message.UserID, message.FromID)
+		text := strings.ToLower(strings.Join(strings.Fields(message.Text), " "))
+		now := time.Now()
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if len(recent) > spamSweepSize {
+			for key, r := range recent {
+				if now.Sub(r.last) > spamWindow {
+					delete(recent, key)
+				}
+			}
+		}
+
+		r := recent[key]
+		if r == nil || r.text != text || now.Sub(r.last) > spamWindow {
+			recent[key] = &repeats{text: text, count: 1, last: now}
+			return Verdict{}
+		}
+		r.count++
+		r.last = now
+		if r.count > settings.SpamLimit {
+			return Verdict{Action: ModerationReject, Reason: "you sent the same message too many times"}
+		}
+		return Verdict{}
+	}}
+}
+
+// roomModeration returns a room's moderation settings, nil for the defaults
+func (cm *ChatManager) roomModeration(roomID string) *roomstore.ChatModeration {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	info, err := cm.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil
+	}
+	return info.ChatModeration
+}
+
+// moderate checks text a participant is about to send and returns what to
+// deliver instead. Messages moderation objects to are recorded for the host.
+func (cm *ChatManager) moderate(participant *ChatParticipant, messageType, text string) (string, error) {
+	if text == "" {
+		return text, nil
+	}
+	settings, enabled := moderationSettings(cm.roomModeration(participant.RoomID))
+	if !enabled {
+		return text, nil
+	}
+
+	result := cm.moderation.Moderate(ModeratedMessage{
+		RoomID: participant.RoomID,
+		From:   participant.name(),
+		FromID: participant.ID,
+		UserID: participant.UserID,
+		Type:   messageType,
+		Text:   text,
+	}, settings)
+	if result.Action == ModerationAllow {
+		return text, nil
+	}
+
+	cm.recordModeration(participant, messageType, text, result)
+	if result.Action == ModerationReject {
+		return "", fmt.Errorf("%w: %s", ErrMessageRejected, strings.Join(result.Reasons, "; "))
+	}
+	return result.Text, nil
+}
+
+// recordModeration keeps an audit record of a moderated message
+func (cm *ChatManager) recordModeration(participant *ChatParticipant, messageType, text string, result ModerationResult) {
+	log.Printf("[Chat] Moderation %s %s from %s in room %s: %s", result.Action, messageType, participant.name(), participant.RoomID, strings.Join(result.Rules, ", "))
+	if cm.moderationLog == nil {
+		return
+	}
+
+	event := &db.ChatModerationEvent{
+		RoomID:  participant.RoomID,
+		Sender:  participant.name(),
+		Type:    messageType,
+		Text:    text,
+		Action:  result.Action.String(),
+		Rules:   strings.Join(result.Rules, ","),
+		Reasons: strings.Join(result.Reasons, "; "),
+	}
+	if participant.UserID != 0 {
+		event.UserID = &participant.UserID
+	}
+	if err := cm.moderationLog.CreateEvent(event); err != nil {
+		log.Printf("[Chat] Error recording moderation in room %s: %v", participant.RoomID, err)
+	}
+}
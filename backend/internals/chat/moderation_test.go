@@ -0,0 +1,167 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"seaside/lib/roomstore"
+)
+
+func TestModerationVerdicts(t *testing.T) {
+	defaults, _ := moderationSettings(nil)
+	withLinks := defaults
+	withLinks.AllowedDomains = []string{"example.com"}
+	withBlockedLinks := defaults
+	withBlockedLinks.BlockedDomains = []string{"bad.example"}
+	withBlockedLinks.LinkAction = ModerationMask
+	flagging := defaults
+	flagging.ProfanityAction = ModerationFlag
+
+	tests := []struct {
+		name       string
+		settings   ModerationSettings
+		text       string
+		wantAction ModerationAction
+		wantText   string
+		wantRules  []string
+	}{
+		{"clean message", defaults, "hello there", ModerationAllow, "hello there", nil},
+		{"blocked word is masked", defaults, "oh shit, sorry", ModerationMask, "oh ****, sorry", []string{"profanity"}},
+		{"blocked words ignore case", defaults, "SHIT happens", ModerationMask, "**** happens", []string{"profanity"}},
+		{"words containing a blocked word pass", defaults, "shitake mushrooms", ModerationAllow, "shitake mushrooms", nil},
+		{"flagged words are delivered as sent", flagging, "shit", ModerationFlag, "shit", []string{"profanity"}},
+		{"too long", defaults, strings.Repeat("a", defaultMaxMessageLength+1), ModerationReject, strings.Repeat("a", defaultMaxMessageLength+1), []string{"length"}},
+		{"links pass without domain lists", defaults, "see https://anywhere.test/x", ModerationAllow, "see https://anywhere.test/x", nil},
+		{"allowed domain", withLinks, "see https://docs.example.com/page", ModerationAllow, "see https://docs.example.com/page", nil},
+		{"domain not allowed", withLinks, "see www.elsewhere.test", ModerationReject, "see www.elsewhere.test", []string{"links"}},
+		{"blocked domain is masked", withBlockedLinks, "go to http://bad.example/x now", ModerationMask, "go to [link removed] now", []string{"links"}},
+		{"masks add up", withBlockedLinks, "shit http://bad.example", ModerationMask, "**** [link removed]", []string{"profanity", "links"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DefaultModeration().Moderate(ModeratedMessage{RoomID: "room", From: "alice", Type: "chat", Text: tt.text}, tt.settings)
+			if result.Action != tt.wantAction {
+				t.Errorf("Action = %v, want %v", result.Action, tt.wantAction)
+			}
+			if result.Text != tt.wantText {
+				t.Errorf("Text = %q, want %q", result.Text, tt.wantText)
+			}
+			if fmt.Sprint(result.Rules) != fmt.Sprint(tt.wantRules) {
+				t.Errorf("Rules = %v, want %v", result.Rules, tt.wantRules)
+			}
+		})
+	}
+}
+
+func TestRejectionStopsTheChain(t *testing.T) {
+	var checked []string
+	moderator := func(name string, action ModerationAction) Moderator {
+		return Moderator{Name: name, Check: func(message ModeratedMessage, settings ModerationSettings) Verdict {
+			checked = append(checked, name)
+			return Verdict{Action: action, Text: message.Text + "!"}
+		}}
+	}
+	chain := NewModerationChain(
+		moderator("mask", ModerationMask),
+		moderator("flag", ModerationFlag),
+		moderator("reject", ModerationReject),
+		moderator("after", ModerationAllow),
+	)
+
+	result := chain.Moderate(ModeratedMessage{Text: "hi"}, ModerationSettings{})
+	if result.Action != ModerationReject {
+		t.Errorf("Action = %v, want %v", result.Action, ModerationReject)
+	}
+	if want := "mask flag reject"; strings.Join(checked, " ") != want {
+		t.Errorf("checked %v, want %s", checked, want)
+	}
+	// Only the mask changes what is delivered
+	if result.Text != "hi!" {
+		t.Errorf("Text = %q, want %q", result.Text, "hi!")
+	}
+}
+
+func TestSpam(t *testing.T) {
+	settings := ModerationSettings{SpamLimit: 2}
+	check := spamModerator().Check
+	steps := []struct {
+		fromID string
+		from   string
+		text   string
+		want   ModerationAction
+	}{
+		{"p1", "alice", "buy now", ModerationAllow},
+		{"p1", "alice", "Buy  now", ModerationAllow},
+		{"p1", "alice", "buy now", ModerationReject},
+		{"p2", "bob", "buy now", ModerationAllow},   // Counted per sender
+		{"p3", "alice", "buy now", ModerationAllow}, // Guests by connection, not by name
+		{"p1", "alice", "something else", ModerationAllow},
+		{"p1", "alice", "buy now", ModerationAllow},
+	}
+
+	for i, step := range steps {
+		verdict := check(ModeratedMessage{RoomID: "room", From: step.from, FromID: step.fromID, Text: step.text}, settings)
+		if verdict.Action != step.want {
+			t.Fatalf("message %d from %s: Action = %v, want %v", i, step.fromID, verdict.Action, step.want)
+		}
+	}
+}
+
+func TestModerationSettings(t *testing.T) {
+	tests := []struct {
+		name          string
+		room          *roomstore.ChatModeration
+		wantEnabled   bool
+		wantWords     int
+		wantProfanity ModerationAction
+		wantMaxLength int
+	}{
+		{"server defaults", nil, true, len(DefaultBlockedWords), ModerationMask, defaultMaxMessageLength},
+		{"disabled", &roomstore.ChatModeration{Disabled: true}, false, len(DefaultBlockedWords), ModerationMask, defaultMaxMessageLength},
+		{"extra words", &roomstore.ChatModeration{BlockedWords: []string{"darn"}}, true, len(DefaultBlockedWords) + 1, ModerationMask, defaultMaxMessageLength},
+		{"own actions and limits", &roomstore.ChatModeration{ProfanityAction: "reject", MaxLength: 500}, true, len(DefaultBlockedWords), ModerationReject, 500},
+		{"unknown action keeps the default", &roomstore.ChatModeration{ProfanityAction: "ban"}, true, len(DefaultBlockedWords), ModerationMask, defaultMaxMessageLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, enabled := moderationSettings(tt.room)
+			if enabled != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", enabled, tt.wantEnabled)
+			}
+			if len(settings.BlockedWords) != tt.wantWords {
+				t.Errorf("%d blocked words, want %d", len(settings.BlockedWords), tt.wantWords)
+			}
+			if settings.ProfanityAction != tt.wantProfanity {
+				t.Errorf("ProfanityAction = %v, want %v", settings.ProfanityAction, tt.wantProfanity)
+			}
+			if settings.MaxLength != tt.wantMaxLength {
+				t.Errorf("MaxLength = %d, want %d", settings.MaxLength, tt.wantMaxLength)
+			}
+		})
+	}
+
+	// A room's words are added to the server's list, not written into it
+	moderationSettings(&roomstore.ChatModeration{BlockedWords: []string{"darn"}})
+	for _, word := range DefaultBlockedWords {
+		if word == "darn" {
+			t.Fatal("room's words leaked into the server's list")
+		}
+	}
+}
+
+func TestWordPatternsAreCompiledOnce(t *testing.T) {
+	first, err := wordPatterns.get(`(?i)\b(?:alpha|beta)\b`)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	second, _ := wordPatterns.get(`(?i)\b(?:alpha|beta)\b`)
+	if first != second {
+		t.Fatal("the same word list was compiled twice")
+	}
+	if _, err := wordPatterns.get(`(`); err == nil {
+		t.Fatal("invalid pattern compiled")
+	}
+}
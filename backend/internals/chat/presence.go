@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/roomstore"
+)
+
+// Roles shown in the roster
+const (
+	RoleHost   = "host"    // Owns the room
+	RoleCoHost = "co-host" // Joined with a co-host invite
+	RoleMember = "member"  // Signed in
+	RoleGuest  = "guest"
+)
+
+// Presence statuses
+const (
+	StatusActive = "active"
+	StatusTyping = "typing"
+	StatusAway   = "away" // The client's window is hidden
+)
+
+// ErrInvalidStatus is returned for a status clients cannot set
+var ErrInvalidStatus = errors.New("invalid status")
+
+// PresenceDiff is how the roster changed. Clients apply it to the snapshot
+// they got in the "participants" message.
+type PresenceDiff struct {
+	Joined  []ParticipantInfo `json:"joined,omitempty"`
+	Updated []ParticipantInfo `json:"updated,omitempty"` // Replaces the entry with the same ID
+	Left    []string          `json:"left,omitempty"`    // Participant IDs
+}
+
+// roleOf returns the role someone joins a room's chat with
+func roleOf(owner bool, identity auth.Identity) string {
+	switch {
+	case owner:
+		return RoleHost
+	case identity.Role == auth.RoleCoHost:
+		return RoleCoHost
+	case identity.Guest():
+		return RoleGuest
+	default:
+		return RoleMember
+	}
+}
+
+// memberInfo converts a member record into a roster entry
+func memberInfo(member roomstore.Member) ParticipantInfo {
+	name, _ := splitUsername(member.Name)
+	info := ParticipantInfo{
+		ID:       member.ID,
+		Name:     name,
+		UserID:   member.UserID,
+		Avatar:   member.Avatar,
+		Role:     member.Role,
+		Host:     member.Host,
+		JoinedAt: member.JoinedAt,
+		Status:   member.Status,
+	}
+	if info.Status == "" {
+		info.Status = StatusActive
+	}
+	return info
+}
+
+// sendPresence tells a room how its roster changed. Presence is not
+// numbered; a client that reconnects gets a fresh snapshot instead.
+func (cm *ChatManager) sendPresence(roomID string, diff PresenceDiff, excludeID string) {
+	cm.broadcastToRoom(roomID, ChatMessage{
+		Type:      "presence",
+		From:      "system",
+		Timestamp: time.Now(),
+		RoomID:    roomID,
+		Presence:  &diff,
+	}, excludeID)
+}
+
+// updateMember changes a participant's member record, which every node
+// lists the roster from, and tells the room
+func (cm *ChatManager) updateMember(participant *ChatParticipant, change func(*roomstore.Member)) error {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	member, err := cm.store.UpdateMember(ctx, roomstore.ScopeChat, participant.RoomID, participant.ID, change)
+	if errors.Is(err, roomstore.ErrMemberNotFound) {
+		return nil // Already gone, leaving tells the room
+	}
+	if err != nil {
+		return err
+	}
+	cm.sendPresence(participant.RoomID, PresenceDiff{Updated: []ParticipantInfo{memberInfo(*member)}}, "")
+	return nil
+}
+
+// SetStatus changes whether a participant is active, typing or away. Only
+// actual changes reach the room.
+func (cm *ChatManager) SetStatus(participant *ChatParticipant, status string) error {
+	switch status {
+	case StatusActive, StatusTyping, StatusAway:
+	default:
+		return ErrInvalidStatus
+	}
+	if participant.Status == status {
+		return nil
+	}
+
+	if err := cm.updateMember(participant, func(member *roomstore.Member) { member.Status = status }); err != nil {
+		log.Printf("[Chat] Error setting the status of %s in room %s: %v", participant.ID, participant.RoomID, err)
+		return ErrNotSaved
+	}
+	participant.Status = status
+	return nil
+}
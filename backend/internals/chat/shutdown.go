@@ -0,0 +1,53 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"seaside/lib/drain"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// Drain prepares the chat to shut down: it stops taking joins, tells
+// everyone chatting on this node to reconnect and waits until they have all
+// left, or ctx is done
+func (cm *ChatManager) Drain(ctx context.Context) error {
+	cm.gate.Close()
+
+	cm.mutex.RLock()
+	var participants []*ChatParticipant
+	for _, room := range cm.rooms {
+		participants = append(participants, room...)
+	}
+	cm.mutex.RUnlock()
+
+	log.Printf("[Chat] Draining %d participants before shutdown", len(participants))
+	for _, participant := range participants {
+		restart(participant)
+	}
+	return cm.gate.Wait(ctx)
+}
+
+// restart tells a participant to reconnect, then disconnects it. The close
+// code tells clients that reconnecting is expected.
+func restart(participant *ChatParticipant) {
+	if data, err := json.Marshal(restartingMessage(participant.RoomID)); err == nil {
+		participant.Write(data)
+	}
+	participant.DisconnectWithCode(websocket.CloseServiceRestart)
+}
+
+// restartingMessage tells a client when to reconnect
+func restartingMessage(roomID string) ChatMessage {
+	return ChatMessage{
+		Type:       "server_restarting",
+		Text:       "The server is restarting, reconnecting shortly",
+		From:       "system",
+		Timestamp:  time.Now(),
+		RoomID:     roomID,
+		RetryAfter: drain.RetryAfter().Milliseconds(),
+	}
+}
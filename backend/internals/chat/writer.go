@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const (
+	// sendQueueSize is the number of frames buffered per participant. It
+	// holds a join's history replay with room to spare.
+	sendQueueSize = 256
+
+	// enqueueTimeout is how long a frame may wait for queue space before
+	// the participant is treated as a slow consumer and disconnected
+	enqueueTimeout = time.Second
+
+	// writeWait bounds a single WebSocket write
+	writeWait = 10 * time.Second
+
+	// flushWait bounds writing out frames still queued when a participant
+	// is disconnected
+	flushWait = time.Second
+)
+
+// errDisconnected is returned when writing to a participant that is gone
+var errDisconnected = errors.New("participant disconnected")
+
+// Write queues a raw frame for this participant. A participant that has
+// not drained its queue within a second is disconnected.
+func (p *ChatParticipant) Write(data []byte) error {
+	select {
+	case <-p.done:
+		return errDisconnected
+	default:
+	}
+
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.send <- data:
+		return nil
+	case <-p.done:
+		return errDisconnected
+	case <-timer.C:
+		log.Printf("[Chat] %s is not draining its send queue, disconnecting", p.name())
+		p.DisconnectWithCode(websocket.CloseTryAgainLater)
+		return errDisconnected
+	}
+}
+
+// Disconnect writes out the queued frames, sends a close frame and wakes
+// the client's read loop
+func (p *ChatParticipant) Disconnect() {
+	p.DisconnectWithCode(websocket.CloseNormalClosure)
+}
+
+// DisconnectWithCode is Disconnect with the close code telling the client
+// why. Only the first disconnect takes effect.
+func (p *ChatParticipant) DisconnectWithCode(code int) {
+	p.closeOnce.Do(func() {
+		p.closeCode = code
+		close(p.done)
+	})
+}
+
+// release stops the writer without closing the connection, once the
+// participant has left the chat
+func (p *ChatParticipant) release() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// startWriter launches the goroutine that owns all writes to the connection
+func (p *ChatParticipant) startWriter() {
+	p.writerWG.Add(1)
+	go p.writePump()
+}
+
+// wait blocks until the writer goroutine has exited
+func (p *ChatParticipant) wait() {
+	p.writerWG.Wait()
+}
+
+// writePump drains the send queue until the participant is disconnected
+// or released
+func (p *ChatParticipant) writePump() {
+	defer p.writerWG.Done()
+	for {
+		select {
+		case data := <-p.send:
+			if err := p.writeFrame(data, time.Now().Add(writeWait)); err != nil {
+				log.Printf("[Chat] Error sending message to %s: %v", p.name(), err)
+				p.DisconnectWithCode(websocket.CloseGoingAway)
+				if p.closeCode != 0 {
+					p.hangUp()
+				}
+				return
+			}
+		case <-p.done:
+			if p.closeCode != 0 {
+				p.flush()
+				p.hangUp()
+			}
+			return
+		}
+	}
+}
+
+// flush writes out whatever is still queued, e.g. a final message
+// explaining why the participant is being disconnected
+func (p *ChatParticipant) flush() {
+	deadline := time.Now().Add(flushWait)
+	for {
+		select {
+		case data := <-p.send:
+			if err := p.writeFrame(data, deadline); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *ChatParticipant) writeFrame(data []byte, deadline time.Time) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	p.Conn.SetWriteDeadline(deadline)
+	return p.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// hangUp sends a close frame and wakes the client's read loop. Conn.Close
+// does not release a hijacked connection until its handler returns.
+func (p *ChatParticipant) hangUp() {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+
+	p.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(p.closeCode, ""), time.Now().Add(flushWait))
+	p.Conn.SetReadDeadline(time.Now())
+}
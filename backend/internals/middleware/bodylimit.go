@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RouteBodyLimit lets requests to one route carry bodies up to limit, while
+// every other route keeps the server's BodyLimit. fasthttp reads a body
+// before any handler runs, so the limit has to be picked from the request
+// line: install the result as the server's HeaderReceived hook. Segments of
+// pattern starting with ":" match any single path segment.
+func RouteBodyLimit(method, pattern string, limit int) func(*fasthttp.RequestHeader) fasthttp.RequestConfig {
+	segments := strings.Split(strings.Trim(pattern, "/"), "/")
+	return func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+		if string(header.Method()) != method || !matchPath(header.RequestURI(), segments) {
+			return fasthttp.RequestConfig{}
+		}
+		return fasthttp.RequestConfig{MaxRequestBodySize: limit}
+	}
+}
+
+// matchPath reports whether the path of uri has the given segments
+func matchPath(uri []byte, segments []string) bool {
+	if i := bytes.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	parts := strings.Split(strings.Trim(string(uri), "/"), "/")
+	if len(parts) != len(segments) {
+		return false
+	}
+	for i, segment := range segments {
+		if parts[i] == "" || (!strings.HasPrefix(segment, ":") && parts[i] != segment) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRouteBodyLimit(t *testing.T) {
+	limit := RouteBodyLimit(fasthttp.MethodPost, "/api/rooms/:id/attachments", 1<<20)
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		want   int // 0 keeps the server's limit
+	}{
+		{"upload", fasthttp.MethodPost, "/api/rooms/abc/attachments", 1 << 20},
+		{"upload with a query", fasthttp.MethodPost, "/api/rooms/abc/attachments?x=1", 1 << 20},
+		{"upload with a trailing slash", fasthttp.MethodPost, "/api/rooms/abc/attachments/", 1 << 20},
+		{"other method", fasthttp.MethodGet, "/api/rooms/abc/attachments", 0},
+		{"other route", fasthttp.MethodPost, "/api/rooms/abc/messages", 0},
+		{"missing room ID", fasthttp.MethodPost, "/api/rooms//attachments", 0},
+		{"longer path", fasthttp.MethodPost, "/api/rooms/abc/attachments/x", 0},
+		{"shorter path", fasthttp.MethodPost, "/api/rooms/abc", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header fasthttp.RequestHeader
+			header.SetMethod(tt.method)
+			header.SetRequestURI(tt.uri)
+			if got := limit(&header).MaxRequestBodySize; got != tt.want {
+				t.Fatalf("MaxRequestBodySize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
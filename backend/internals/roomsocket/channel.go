@@ -0,0 +1,115 @@
+package roomsocket
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// writeWait bounds a write that did not set a deadline of its own
+const writeWait = 10 * time.Second
+
+// socket is the client's WebSocket, written to by every channel
+type socket struct {
+	conn *websocket.Conn
+
+	mutex     sync.Mutex // Serialises writes
+	closeOnce sync.Once
+}
+
+// write sends a frame on a channel
+func (s *socket) write(channel string, data []byte, deadline time.Time) error {
+	frame, err := json.Marshal(Frame{Channel: channel, Data: data})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conn.SetWriteDeadline(deadline)
+	return s.conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+// control sends a ping or pong
+func (s *socket) control(messageType int, data []byte, deadline time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn.WriteControl(messageType, data, deadline)
+}
+
+// hangUp sends the close frame of the first channel to end the connection
+// and wakes the read loop, which then takes the participant out of the
+// call and the chat
+func (s *socket) hangUp(data []byte, deadline time.Time) error {
+	s.closeOnce.Do(func() {
+		s.control(websocket.CloseMessage, data, deadline)
+	})
+	return s.conn.SetReadDeadline(time.Now())
+}
+
+// channel is one channel of a socket. It stands in for a connection of its
+// own, so the call and the chat write to it as they would to /join-room
+// and /chat.
+type channel struct {
+	socket   *socket
+	name     string
+	deadline atomic.Int64 // Unix nanoseconds, 0 for writeWait
+}
+
+func (c *channel) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *channel) WriteMessage(messageType int, data []byte) error {
+	name := c.name
+	if name == ChannelChat {
+		name = chatChannel(data)
+	}
+
+	deadline := time.Now().Add(writeWait)
+	if nanos := c.deadline.Load(); nanos != 0 {
+		deadline = time.Unix(0, nanos)
+	}
+	return c.socket.write(name, data, deadline)
+}
+
+// WriteControl closes the whole socket on a close frame: leaving the call
+// or the chat means leaving the room
+func (c *channel) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage {
+		return c.socket.hangUp(data, deadline)
+	}
+	return c.socket.control(messageType, data, deadline)
+}
+
+func (c *channel) SetWriteDeadline(t time.Time) error {
+	c.deadline.Store(t.UnixNano())
+	return nil
+}
+
+func (c *channel) SetReadDeadline(t time.Time) error {
+	return c.socket.conn.SetReadDeadline(t)
+}
+
+func (c *channel) Close() error {
+	return c.socket.conn.Close()
+}
+
+// chatChannel picks the channel of a chat frame: the roster and changes to
+// it go on the presence channel, everything else on the chat channel
+func chatChannel(data []byte) string {
+	var frame struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(data, &frame) == nil && (frame.Type == "participants" || frame.Type == "presence") {
+		return ChannelPresence
+	}
+	return ChannelChat
+}
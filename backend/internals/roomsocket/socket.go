@@ -0,0 +1,213 @@
+// Package roomsocket serves /room, a single WebSocket per participant that
+// carries a room's signalling, chat and presence on separate channels.
+//
+// Every frame in either direction is an envelope naming its channel:
+//
+//	{"channel": "signal", "data": {"v": 1, "type": "offer", ...}}
+//
+// The data of a frame is what /join-room ("signal") or /chat ("chat" and
+// "presence") would carry on their own. The participant has one ID in the
+// call and in the chat, joins the chat once admitted to the call, and
+// leaves both when either removes it or the socket closes.
+package roomsocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"seaside/internals/chat"
+	"seaside/internals/video"
+	"seaside/lib/auth"
+	"seaside/lib/ratelimit"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+)
+
+// Channels of the room socket
+const (
+	ChannelSignal   = "signal"   // Call signalling
+	ChannelChat     = "chat"     // Chat messages
+	ChannelPresence = "presence" // Chat roster and its changes; typing and status from clients
+)
+
+// Frame is the envelope of everything sent on the room socket
+type Frame struct {
+	Channel string          `json:"channel"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// limits meters the frames clients send on every channel together
+var limits = ratelimit.NewGroup(ratelimit.DefaultPolicy())
+
+// Handler serves the room socket
+func Handler(c *websocket.Conn) {
+	roomID := c.Query("roomID")
+	if roomID == "" {
+		log.Println("[Room] roomID is missing in WebSocket connection")
+		c.Close()
+		return
+	}
+
+	s := &socket{conn: c}
+	signal := &channel{socket: s, name: ChannelSignal}
+
+	// An invite link admits its holder with the role it was issued for
+	identity := auth.WebSocketIdentity(c)
+	if invite := c.Query("invite"); invite != "" {
+		role, err := video.AllRooms.CheckInvite(roomID, invite)
+		if err != nil {
+			frame, _ := video.RejectionFrame(err)
+			signal.WriteJSON(frame)
+			c.Close()
+			return
+		}
+		identity.Role = role
+	}
+
+	client := &roomClient{
+		id:       uuid.New().String(),
+		roomID:   roomID,
+		identity: identity,
+		name:     c.Query("name"),
+		chatConn: &channel{socket: s, name: ChannelChat},
+	}
+	participant, err := video.AllRooms.Join(roomID, client.id, identity, client.name, signal)
+	if err != nil {
+		if frame, ok := video.RejectionFrame(err); ok {
+			signal.WriteJSON(frame)
+		}
+		c.Close()
+		return
+	}
+	client.participant = participant
+
+	c.SetPongHandler(func(string) error {
+		video.AllRooms.UpdateLastPing(roomID, signal)
+		return nil
+	})
+	c.SetReadLimit(video.MaxMessageSize)
+
+	client.limiter = limits.Connect(ratelimit.UserKey(identity.UserID))
+	defer client.limiter.Close()
+
+	// The chat opens once the participant is in the call
+	if participant.Waiting() {
+		go func() {
+			select {
+			case <-participant.Admitted():
+				client.joinChat()
+			case <-participant.Done():
+			}
+		}()
+	} else {
+		client.joinChat()
+	}
+
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			log.Printf("[Room] Read error in room %s: %v", roomID, err)
+			break
+		}
+		if !client.handle(data) {
+			break
+		}
+	}
+
+	client.leave()
+	c.Close()
+}
+
+// roomClient is a participant connected through the room socket
+type roomClient struct {
+	id          string // Same in the call and the chat
+	roomID      string
+	identity    auth.Identity
+	name        string
+	participant *video.Participant
+	limiter     *ratelimit.Limiter
+	chatConn    *channel
+
+	mutex   sync.Mutex
+	session *chat.Session // nil until admitted, or if the chat could not be joined
+	closed  bool
+}
+
+// joinChat adds the participant to the room's chat. If that fails the call
+// goes on without it.
+func (rc *roomClient) joinChat() {
+	session, err := chat.Join(rc.roomID, rc.id, rc.identity, rc.name, rc.chatConn, rc.limiter)
+	if err != nil {
+		log.Printf("[Room] %s is in the call of room %s without chat: %v", rc.id, rc.roomID, err)
+		return
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	// The socket closed while joining
+	if rc.closed {
+		session.Close()
+		return
+	}
+	rc.session = session
+}
+
+// handle routes a frame to its channel. It returns false once the client
+// is being disconnected.
+func (rc *roomClient) handle(data []byte) bool {
+	var frame Frame
+	if err := json.Unmarshal(data, &frame); err != nil || len(frame.Data) == 0 {
+		return rc.refuse(video.ErrCodeMalformed, "frames must have a channel and data")
+	}
+
+	switch frame.Channel {
+	case ChannelSignal:
+		return video.AllRooms.HandleFrame(rc.roomID, rc.participant, rc.limiter, frame.Data)
+	case ChannelChat, ChannelPresence:
+		rc.mutex.Lock()
+		session := rc.session
+		rc.mutex.Unlock()
+		if session == nil {
+			if rc.participant.Waiting() {
+				return rc.refuse(video.ErrCodeNotAdmitted, "wait for a host to admit you")
+			}
+			return rc.refuse(video.ErrCodeUnavailable, "chat is not available")
+		}
+		session.Handle(frame.Data)
+		return true
+	}
+	return rc.refuse(video.ErrCodeMalformed, fmt.Sprintf("unknown channel %q", frame.Channel))
+}
+
+// refuse answers a frame that reached neither the call nor the chat with an
+// error frame, counting it against the client's budget
+func (rc *roomClient) refuse(code, message string) bool {
+	switch rc.limiter.Check(ratelimit.ClassOther) {
+	case ratelimit.Allow:
+		rc.participant.Enqueue(video.NewErrorMessage(code, message, 0))
+	case ratelimit.Warn, ratelimit.Mute:
+		rc.participant.Enqueue(video.NewErrorMessage(video.ErrCodeRateLimited, "sending too fast, frames are being dropped", 0))
+	case ratelimit.Disconnect:
+		log.Printf("[Room] Disconnecting %s from room %s for flooding", rc.id, rc.roomID)
+		rc.participant.Enqueue(video.NewErrorMessage(video.ErrCodeRateLimited, "disconnected for sending too many frames", 0))
+		rc.participant.CloseWithCode(websocket.ClosePolicyViolation)
+		return false
+	}
+	return true
+}
+
+// leave takes the participant out of the call and the chat
+func (rc *roomClient) leave() {
+	rc.mutex.Lock()
+	rc.closed = true
+	session := rc.session
+	rc.mutex.Unlock()
+
+	video.AllRooms.Leave(rc.roomID, rc.participant)
+	if session != nil {
+		session.Close()
+	}
+}
@@ -0,0 +1,201 @@
+package roomsocket
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"seaside/internals/video"
+	"seaside/lib/roomstore"
+
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// waitTimeout bounds waiting for a frame that should arrive
+const waitTimeout = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	ctx, cancel := context.WithCancel(context.Background())
+	video.AllRooms.Init(ctx, nil)
+	code := m.Run()
+	cancel()
+	os.Exit(code)
+}
+
+// startServer serves the room socket on a free loopback port and returns
+// its address
+func startServer(t *testing.T) string {
+	t.Helper()
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/room", websocket.New(Handler))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() { app.Shutdown() })
+	return listener.Addr().String()
+}
+
+// received is a frame read from the room socket, with the type of its data
+type received struct {
+	channel string
+	kind    string
+	data    json.RawMessage
+}
+
+// testSocket is a client's room socket
+type testSocket struct {
+	conn    *fastws.Conn
+	pending []received // Read while waiting for other frames
+}
+
+func dial(t *testing.T, addr, roomID, name string) *testSocket {
+	t.Helper()
+	query := url.Values{"roomID": {roomID}, "name": {name}}
+	conn, _, err := fastws.DefaultDialer.Dial("ws://"+addr+"/room?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testSocket{conn: conn}
+}
+
+func (s *testSocket) send(t *testing.T, frame string) {
+	t.Helper()
+	if err := s.conn.WriteMessage(fastws.TextMessage, []byte(frame)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+}
+
+// next waits for a frame of the given type on a channel, keeping the
+// others for later calls. The call and the chat share some type names.
+func (s *testSocket) next(t *testing.T, channel, kind string) received {
+	t.Helper()
+	for i, frame := range s.pending {
+		if frame.channel == channel && frame.kind == kind {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return frame
+		}
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no %s frame on the %s channel: %v", kind, channel, err)
+		}
+		var frame Frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatalf("frame %s is not an envelope: %v", data, err)
+		}
+		var body struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(frame.Data, &body)
+
+		got := received{channel: frame.Channel, kind: body.Type, data: frame.Data}
+		if got.channel == channel && got.kind == kind {
+			return got
+		}
+		s.pending = append(s.pending, got)
+	}
+}
+
+// nextError waits for an error frame on the signal channel and returns its code
+func (s *testSocket) nextError(t *testing.T) video.ErrorPayload {
+	t.Helper()
+	var message video.SignalMessage
+	json.Unmarshal(s.next(t, ChannelSignal, string(video.MessageError)).data, &message)
+	var payload video.ErrorPayload
+	json.Unmarshal(message.Payload, &payload)
+	return payload
+}
+
+func TestChannelsReachTheCallAndTheChat(t *testing.T) {
+	addr := startServer(t)
+	alice := dial(t, addr, "channels", "alice")
+	alice.next(t, ChannelSignal, string(video.MessageRoster))
+	alice.next(t, ChannelPresence, "participants")
+
+	// Each channel's frames go to the call or the chat
+	alice.send(t, `{"channel":"signal","data":{"v":1,"type":"ping","seq":1}}`)
+	alice.next(t, ChannelSignal, string(video.MessagePong))
+	alice.send(t, `{"channel":"chat","data":{"type":"chat","text":"hello"}}`)
+	var message struct {
+		Text string `json:"text"`
+		From string `json:"from"`
+	}
+	json.Unmarshal(alice.next(t, ChannelChat, "chat").data, &message)
+	if message.Text != "hello" || message.From != "alice" {
+		t.Fatalf("chat message %+v, want hello from alice", message)
+	}
+
+	// Someone joining is announced on every channel it concerns
+	bob := dial(t, addr, "channels", "bob")
+	bob.next(t, ChannelSignal, string(video.MessageRoster))
+	alice.next(t, ChannelSignal, string(video.MessageJoin))
+	alice.next(t, ChannelPresence, "presence")
+	alice.next(t, ChannelChat, "join")
+
+	// Closing the socket leaves the call and the chat
+	bob.conn.Close()
+	alice.next(t, ChannelSignal, string(video.MessageLeave))
+	alice.next(t, ChannelChat, "leave")
+}
+
+func TestRefusedFrames(t *testing.T) {
+	addr := startServer(t)
+	alice := dial(t, addr, "refusals", "alice")
+	alice.next(t, ChannelSignal, string(video.MessageRoster))
+
+	frames := []struct {
+		name  string
+		frame string
+		want  string
+	}{
+		{"not JSON", `hello`, video.ErrCodeMalformed},
+		{"no data", `{"channel":"chat"}`, video.ErrCodeMalformed},
+		{"unknown channel", `{"channel":"video","data":{}}`, video.ErrCodeMalformed},
+		{"invalid signalling", `{"channel":"signal","data":{"v":1,"type":"dance"}}`, video.ErrCodeUnknownType},
+	}
+	for _, tt := range frames {
+		alice.send(t, tt.frame)
+		if got := alice.nextError(t); got.Code != tt.want {
+			t.Fatalf("%s: error code = %q (%s), want %q", tt.name, got.Code, got.Message, tt.want)
+		}
+	}
+}
+
+func TestWaitingParticipantHasNoChat(t *testing.T) {
+	addr := startServer(t)
+	info := roomstore.RoomInfo{ID: "lobby", WaitingRoom: true, CreatedAt: time.Now()}
+	if _, err := video.AllRooms.Store().CreateRoom(context.Background(), info); err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+
+	host := dial(t, addr, "lobby", "hana")
+	host.next(t, ChannelSignal, string(video.MessageRoster))
+	waiter := dial(t, addr, "lobby", "wes")
+	waiter.next(t, ChannelSignal, string(video.MessageLobbyWaiting))
+	var knock video.SignalMessage
+	json.Unmarshal(host.next(t, ChannelSignal, string(video.MessageKnock)).data, &knock)
+
+	waiter.send(t, `{"channel":"chat","data":{"type":"chat","text":"let me in"}}`)
+	if got := waiter.nextError(t); got.Code != video.ErrCodeNotAdmitted {
+		t.Fatalf("error code = %q, want %q", got.Code, video.ErrCodeNotAdmitted)
+	}
+
+	// Once admitted the chat opens, and the same frame goes through
+	host.send(t, `{"channel":"signal","data":{"v":1,"type":"admit","to":"`+knock.From+`","seq":1}}`)
+	waiter.next(t, ChannelPresence, "participants")
+	waiter.send(t, `{"channel":"chat","data":{"type":"chat","text":"thanks"}}`)
+	host.next(t, ChannelChat, "chat")
+}
@@ -0,0 +1,160 @@
+package video
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"seaside/lib/roomstore"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// getWaiting returns a snapshot of the waiting room on this node
+func (r *RoomMap) getWaiting(roomID string) []*Participant {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+
+	room, ok := r.Map[roomID]
+	if !ok {
+		return []*Participant{}
+	}
+
+	snapshot := make([]*Participant, len(room.Waiting))
+	copy(snapshot, room.Waiting)
+	return snapshot
+}
+
+// WaitingList returns everyone in a room's waiting room across all nodes
+func (r *RoomMap) WaitingList(roomID string) []KnockPayload {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	members, err := r.store.Members(ctx, roomstore.ScopeLobby, roomID)
+	if err != nil {
+		log.Printf("Failed to list waiting room of %s: %v", roomID, err)
+		return nil
+	}
+
+	waiting := make([]KnockPayload, 0, len(members))
+	for _, member := range members {
+		waiting = append(waiting, KnockPayload{ID: member.ID, UserID: member.UserID, Name: member.Name})
+	}
+	return waiting
+}
+
+// IsWaiting reports whether a participant is in a room's waiting room on any node
+func (r *RoomMap) IsWaiting(roomID, participantID string) bool {
+	for _, knock := range r.WaitingList(roomID) {
+		if knock.ID == participantID {
+			return true
+		}
+	}
+	return false
+}
+
+// admit moves a waiting participant into the call. Admission skips the
+// lock, since the host let them in, but not the participant limit.
+func (r *RoomMap) admit(roomID string, waiter *Participant) {
+	info, err := r.GetRoom(roomID)
+	if err != nil {
+		log.Printf("Failed to admit %s to room %s: %v", waiter.ID, roomID, err)
+		return
+	}
+
+	// Take a slot in the call before leaving the waiting room
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	member := roomstore.Member{
+		ID:       waiter.ID,
+		NodeID:   roomstore.NodeID,
+		UserID:   waiter.UserID,
+		IP:       waiter.IP,
+		Name:     waiter.Name,
+		JoinedAt: waiter.JoinedAt,
+	}
+	err = r.store.AddMemberWithin(ctx, roomstore.ScopeVideo, roomID, member, r.capacity(info))
+	if errors.Is(err, roomstore.ErrRoomFull) {
+		r.dismiss(roomID, waiter, LobbyDenied, NewErrorMessage(ErrCodeRoomFull, "room has reached its participant limit", 0))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to admit %s to room %s: %v", waiter.ID, roomID, err)
+		waiter.Close()
+		return
+	}
+
+	r.Mutex.Lock()
+	room, ok := r.Map[roomID]
+	index := -1
+	if ok && waiter.lobbyExit == "" {
+		for i, p := range room.Waiting {
+			if p == waiter {
+				index = i
+				break
+			}
+		}
+	}
+	// Someone else decided first, or the waiter left
+	if index < 0 {
+		r.Mutex.Unlock()
+		if _, err := r.store.RemoveMember(ctx, roomstore.ScopeVideo, roomID, waiter.ID); err != nil {
+			log.Printf("Failed to release the slot of %s in room %s: %v", waiter.ID, roomID, err)
+		}
+		return
+	}
+	room.Waiting = append(room.Waiting[:index], room.Waiting[index+1:]...)
+	room.Participants = append(room.Participants, waiter)
+	waiter.markAdmitted()
+	if waiter.lobbyTimer != nil {
+		waiter.lobbyTimer.Stop()
+	}
+	r.Mutex.Unlock()
+
+	if _, err := r.store.RemoveMember(ctx, roomstore.ScopeLobby, roomID, waiter.ID); err != nil {
+		log.Printf("Failed to remove %s from the waiting room of %s: %v", waiter.ID, roomID, err)
+	}
+
+	log.Printf("Admitted %s to room %s", waiter.ID, roomID)
+	r.BroadcastHosts(roomID, lobbyLeftMessage(waiter.ID, LobbyAdmitted))
+	r.announceJoin(roomID, waiter)
+}
+
+// startLobbyTimer sends a waiting participant away if nobody admits it in
+// time. It starts once the waiter is in the store, so a failed join leaves
+// no timer behind.
+func (r *RoomMap) startLobbyTimer(roomID string, waiter *Participant) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	if !waiter.Waiting() || waiter.closing() {
+		return
+	}
+	waiter.lobbyTimer = time.AfterFunc(lobbyTimeout, func() {
+		r.dismiss(roomID, waiter, LobbyTimeout, NewErrorMessage(ErrCodeLobbyTimeout, "nobody admitted you in time", 0))
+	})
+}
+
+// dismiss sends a waiting participant away with the given error frame. Its
+// handler then removes it and tells the hosts why it left.
+func (r *RoomMap) dismiss(roomID string, waiter *Participant, reason string, frame SignalMessage) {
+	r.Mutex.Lock()
+	if !waiter.Waiting() || waiter.lobbyExit != "" {
+		r.Mutex.Unlock()
+		return
+	}
+	waiter.lobbyExit = reason
+	r.Mutex.Unlock()
+
+	log.Printf("Dismissed %s from the waiting room of %s: %s", waiter.ID, roomID, reason)
+	waiter.Enqueue(frame)
+	waiter.CloseWithCode(websocket.CloseNormalClosure)
+}
+
+// lobbyLeftMessage tells hosts that someone stopped waiting
+func lobbyLeftMessage(participantID, reason string) SignalMessage {
+	msg := NewSignalMessage(MessageLobbyLeft, LobbyLeftPayload{Reason: reason})
+	msg.From = participantID
+	return msg
+}
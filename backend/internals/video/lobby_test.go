@@ -0,0 +1,142 @@
+package video
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/roomstore"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// newLobbyRoom opens a room with a waiting room, hosted by "h", and has
+// "w" knock on it
+func newLobbyRoom(t *testing.T) (rooms *RoomMap, host, waiter *testClient) {
+	rooms = newTestRooms(t)
+	if _, err := rooms.Store().CreateRoom(context.Background(), roomstore.RoomInfo{ID: "room", WaitingRoom: true, CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	host = join(t, rooms, "room", "h", auth.Identity{})
+	host.conn.next(t, MessageRoster)
+	waiter = join(t, rooms, "room", "w", auth.Identity{})
+	if !waiter.Waiting() {
+		t.Fatal("joiner skipped the waiting room")
+	}
+	waiter.conn.next(t, MessageLobbyWaiting)
+	if knock := host.conn.next(t, MessageKnock); knock.From != "w" {
+		t.Fatalf("host heard a knock from %q, want w", knock.From)
+	}
+	return rooms, host, waiter
+}
+
+// lobbyLeftReason waits for the host to hear that someone stopped waiting
+func lobbyLeftReason(t *testing.T, host *testClient) string {
+	t.Helper()
+	var payload LobbyLeftPayload
+	json.Unmarshal(host.conn.next(t, MessageLobbyLeft).Payload, &payload)
+	return payload.Reason
+}
+
+func TestWaitingParticipantCannotSignal(t *testing.T) {
+	rooms, host, waiter := newLobbyRoom(t)
+
+	frames := []string{
+		`{"v":1,"type":"offer","to":"h","seq":1,"payload":{"type":"offer","sdp":"v=0"}}`,
+		`{"v":1,"type":"ice-candidate","seq":2,"payload":{"candidate":"c","sdpMid":"0"}}`,
+		`{"v":1,"type":"admit","to":"w","seq":3}`,
+	}
+	for _, frame := range frames {
+		if !waiter.send(t, rooms, "room", frame) {
+			t.Fatal("HandleFrame disconnected the waiter")
+		}
+		if got := waiter.conn.nextError(t); got.Code != ErrCodeNotAdmitted {
+			t.Fatalf("error code = %q, want %q", got.Code, ErrCodeNotAdmitted)
+		}
+	}
+	host.conn.none(t, MessageOffer)
+	host.conn.none(t, MessageICECandidate)
+
+	// Keeping the connection alive is allowed
+	waiter.send(t, rooms, "room", `{"v":1,"type":"ping"}`)
+	waiter.conn.next(t, MessagePong)
+}
+
+func TestAdmitAnnouncesTheJoiner(t *testing.T) {
+	rooms, host, waiter := newLobbyRoom(t)
+
+	host.send(t, rooms, "room", `{"v":1,"type":"admit","to":"w"}`)
+
+	var roster RosterPayload
+	json.Unmarshal(waiter.conn.next(t, MessageRoster).Payload, &roster)
+	if roster.ID != "w" || len(roster.Peers) != 1 || roster.Peers[0] != "h" {
+		t.Fatalf("roster = %+v, want w joining h", roster)
+	}
+	if reason := lobbyLeftReason(t, host); reason != LobbyAdmitted {
+		t.Fatalf("host was told %q, want %q", reason, LobbyAdmitted)
+	}
+	if join := host.conn.next(t, MessageJoin); join.From != "w" {
+		t.Fatalf("host was told %q joined, want w", join.From)
+	}
+	if waiter.Waiting() || rooms.IsWaiting("room", "w") || !rooms.HasMember("room", "w") {
+		t.Fatal("admitted participant is not in the call")
+	}
+
+	// Now in the call, the participant can signal
+	waiter.send(t, rooms, "room", `{"v":1,"type":"offer","to":"h","payload":{"type":"offer","sdp":"v=0"}}`)
+	host.conn.next(t, MessageOffer)
+}
+
+func TestWaiterIsSentAway(t *testing.T) {
+	tests := []struct {
+		name       string
+		sendAway   func(t *testing.T, rooms *RoomMap, host, waiter *testClient)
+		wantCode   string
+		wantReason string
+	}{
+		{
+			name: "deny",
+			sendAway: func(t *testing.T, rooms *RoomMap, host, waiter *testClient) {
+				host.send(t, rooms, "room", `{"v":1,"type":"deny","to":"w"}`)
+			},
+			wantCode:   ErrCodeEntryDenied,
+			wantReason: LobbyDenied,
+		},
+		{
+			name: "timeout",
+			sendAway: func(t *testing.T, rooms *RoomMap, host, waiter *testClient) {
+				rooms.Mutex.Lock()
+				waiter.lobbyTimer.Reset(time.Millisecond)
+				rooms.Mutex.Unlock()
+			},
+			wantCode:   ErrCodeLobbyTimeout,
+			wantReason: LobbyTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rooms, host, waiter := newLobbyRoom(t)
+
+			tt.sendAway(t, rooms, host, waiter)
+			if got := waiter.conn.nextError(t); got.Code != tt.wantCode {
+				t.Fatalf("error code = %q, want %q", got.Code, tt.wantCode)
+			}
+			if code := waiter.conn.waitClosed(t); code != websocket.CloseNormalClosure {
+				t.Fatalf("close code = %d, want %d", code, websocket.CloseNormalClosure)
+			}
+
+			// The handler's read loop ends and takes the waiter out
+			rooms.Leave("room", waiter.Participant)
+			if reason := lobbyLeftReason(t, host); reason != tt.wantReason {
+				t.Fatalf("host was told %q, want %q", reason, tt.wantReason)
+			}
+			if rooms.IsWaiting("room", "w") || rooms.HasMember("room", "w") {
+				t.Fatal("sent away participant is still in the room")
+			}
+			host.conn.none(t, MessageJoin)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package video
+
+import (
+	"log"
+
+	"seaside/lib/roomstore"
+)
+
+// GetMember looks up a participant in a room on any node. It returns nil if
+// the participant is not in the call.
+func (r *RoomMap) GetMember(roomID, participantID string) (*roomstore.Member, error) {
+	members, err := r.Members(roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		if member.ID == participantID {
+			return &member, nil
+		}
+	}
+	return nil, nil
+}
+
+// BanSaver keeps a ban beyond the room's record in the store, which is
+// dropped once the room empties, e.g. in the database
+type BanSaver func(roomID string, member roomstore.Member) error
+
+// SetBanSaver sets where bans are kept. Without one, a ban lasts while
+// someone is in the room.
+func (r *RoomMap) SetBanSaver(save BanSaver) {
+	r.saveBan = save
+}
+
+// Ban keeps a participant out of a room: signed-in users by account, guests
+// by address. It does not disconnect them.
+func (r *RoomMap) Ban(roomID string, member roomstore.Member) error {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	_, err := r.store.UpdateRoom(ctx, roomID, func(info *roomstore.RoomInfo) error {
+		if info.Banned(member.UserID, member.IP) {
+			return nil
+		}
+		if member.UserID != 0 {
+			info.BannedUserIDs = append(info.BannedUserIDs, member.UserID)
+		} else if member.IP != "" {
+			info.BannedIPs = append(info.BannedIPs, member.IP)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if r.saveBan != nil {
+		return r.saveBan(roomID, member)
+	}
+	return nil
+}
+
+// handleHostCommand checks and carries out a frame only hosts may send.
+// Recording runs on the host's node. Admit, deny, kick and ban are published to the room so they take effect
+// on whichever node the target is connected to.
+func (r *RoomMap) handleHostCommand(roomID string, sender *Participant, signal *SignalMessage) *ProtocolError {
+	if !sender.Host {
+		return protocolErrorf(ErrCodeNotHost, "only hosts can send %s", signal.Type)
+	}
+	if signal.To == sender.ID {
+		return protocolErrorf(ErrCodeForbidden, "cannot send %s to yourself", signal.Type)
+	}
+
+	switch signal.Type {
+	case MessageRecordStart:
+		return r.startRecording(roomID, sender)
+	case MessageRecordStop:
+		return r.stopRecording(roomID, sender)
+
+	case MessageAdmit, MessageDeny:
+		if !r.IsWaiting(roomID, signal.To) {
+			return protocolErrorf(ErrCodePeerNotFound, "%q is not in the waiting room", signal.To)
+		}
+
+	case MessageKick, MessageBan, MessageMuteRequest:
+		target, err := r.GetMember(roomID, signal.To)
+		if err != nil {
+			log.Printf("Failed to look up %s in room %s: %v", signal.To, roomID, err)
+			return protocolErrorf(ErrCodeUnavailable, "%s could not be sent, try again", signal.Type)
+		}
+		if target == nil {
+			return protocolErrorf(ErrCodePeerNotFound, "peer %q is not in this room", signal.To)
+		}
+		if target.Host && signal.Type != MessageMuteRequest {
+			return protocolErrorf(ErrCodeForbidden, "hosts cannot be removed from the room")
+		}
+
+		if signal.Type == MessageBan {
+			if err := r.Ban(roomID, *target); err != nil {
+				log.Printf("Failed to ban %s from room %s: %v", signal.To, roomID, err)
+				return protocolErrorf(ErrCodeUnavailable, "ban could not be saved, try again")
+			}
+		}
+	}
+
+	log.Printf("Host %s sent %s for %s in room %s", sender.ID, signal.Type, signal.To, roomID)
+	if !r.Broadcast(roomID, *signal, sender.ID) {
+		return protocolErrorf(ErrCodeUnavailable, "%s could not be relayed, try again", signal.Type)
+	}
+	return nil
+}
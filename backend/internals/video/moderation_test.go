@@ -0,0 +1,202 @@
+package video
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/roomstore"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// newModeratedRoom opens a room owned by user 1, with its owner "h", a
+// co-host "co", a signed-in member "u" and a guest "g" in the call
+func newModeratedRoom(t *testing.T) (rooms *RoomMap, clients map[string]*testClient) {
+	rooms = newTestRooms(t)
+	if _, err := rooms.Store().CreateRoom(context.Background(), roomstore.RoomInfo{ID: "room", HostUserID: 1, CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	clients = map[string]*testClient{
+		"h":  join(t, rooms, "room", "h", auth.Identity{UserID: 1}),
+		"co": join(t, rooms, "room", "co", auth.Identity{UserID: 3, Role: auth.RoleCoHost}),
+		"u":  join(t, rooms, "room", "u", auth.Identity{UserID: 2}),
+		"g":  join(t, rooms, "room", "g", auth.Identity{IP: "203.0.113.9"}),
+	}
+	return rooms, clients
+}
+
+func TestHostCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		frame    string
+		wantCode string // Error returned to the sender, empty if it is carried out
+	}{
+		{"member kicks", "u", `{"v":1,"type":"kick","to":"g"}`, ErrCodeNotHost},
+		{"guest bans", "g", `{"v":1,"type":"ban","to":"u"}`, ErrCodeNotHost},
+		{"member asks to mute", "u", `{"v":1,"type":"mute-request","to":"g","payload":{"kind":"audio"}}`, ErrCodeNotHost},
+		{"host kicks themselves", "h", `{"v":1,"type":"kick","to":"h"}`, ErrCodeForbidden},
+		{"co-host kicks the owner", "co", `{"v":1,"type":"kick","to":"h"}`, ErrCodeForbidden},
+		{"owner bans a co-host", "h", `{"v":1,"type":"ban","to":"co"}`, ErrCodeForbidden},
+		{"kick someone absent", "h", `{"v":1,"type":"kick","to":"nobody"}`, ErrCodePeerNotFound},
+		{"co-host kicks", "co", `{"v":1,"type":"kick","to":"g"}`, ""},
+		{"host asks a host to mute", "h", `{"v":1,"type":"mute-request","to":"co","payload":{"kind":"video"}}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rooms, clients := newModeratedRoom(t)
+			sender := clients[tt.from]
+
+			sender.send(t, rooms, "room", tt.frame)
+			if tt.wantCode == "" {
+				sender.conn.none(t, MessageError)
+				return
+			}
+			if got := sender.conn.nextError(t); got.Code != tt.wantCode {
+				t.Fatalf("error code = %q, want %q", got.Code, tt.wantCode)
+			}
+			// Refused commands reach nobody
+			for id, client := range clients {
+				client.conn.none(t, MessageKicked)
+				client.conn.none(t, MessageMuteRequest)
+				if !rooms.HasMember("room", id) {
+					t.Fatalf("%s was removed by a refused command", id)
+				}
+			}
+		})
+	}
+}
+
+func TestKickAndBan(t *testing.T) {
+	tests := []struct {
+		name       string
+		msgType    MessageType
+		target     string
+		wantBanned bool
+	}{
+		{"kick a member", MessageKick, "u", false},
+		{"kick a guest", MessageKick, "g", false},
+		{"ban a member", MessageBan, "u", true},
+		{"ban a guest", MessageBan, "g", true},
+	}
+	identities := map[string]auth.Identity{
+		"u": {UserID: 2},
+		"g": {IP: "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rooms, clients := newModeratedRoom(t)
+			target := clients[tt.target]
+
+			clients["h"].send(t, rooms, "room", `{"v":1,"type":"`+string(tt.msgType)+`","to":"`+tt.target+`"}`)
+
+			var kicked KickedPayload
+			msg := target.conn.next(t, MessageKicked)
+			json.Unmarshal(msg.Payload, &kicked)
+			if msg.From != "h" || kicked.Banned != tt.wantBanned {
+				t.Fatalf("kicked frame from %q with %+v, want from h with banned %v", msg.From, kicked, tt.wantBanned)
+			}
+			if code := target.conn.waitClosed(t); code != websocket.CloseNormalClosure {
+				t.Fatalf("close code = %d, want %d", code, websocket.CloseNormalClosure)
+			}
+			if rooms.HasMember("room", tt.target) || rooms.GetParticipant("room", tt.target) != nil {
+				t.Fatalf("%s is still in the room", tt.target)
+			}
+			for id, client := range clients {
+				if id != tt.target {
+					client.conn.none(t, MessageKicked)
+				}
+			}
+
+			// Only a ban keeps them out
+			again, err := rooms.Join("room", tt.target+"-again", identities[tt.target], "", newFakeConn())
+			if err == nil {
+				defer again.Close()
+			}
+			if banned := errors.Is(err, ErrBanned); banned != tt.wantBanned {
+				t.Fatalf("rejoining = %v, want banned %v", err, tt.wantBanned)
+			}
+		})
+	}
+}
+
+func TestMuteRequest(t *testing.T) {
+	rooms, clients := newModeratedRoom(t)
+
+	clients["h"].send(t, rooms, "room", `{"v":1,"type":"mute-request","to":"u","payload":{"kind":"audio"}}`)
+
+	var request MuteRequestPayload
+	msg := clients["u"].conn.next(t, MessageMuteRequest)
+	json.Unmarshal(msg.Payload, &request)
+	if msg.From != "h" || request.Kind != "audio" {
+		t.Fatalf("mute request from %q for %q, want from h for audio", msg.From, request.Kind)
+	}
+	// Asking is all it does
+	clients["g"].conn.none(t, MessageMuteRequest)
+	if !rooms.HasMember("room", "u") {
+		t.Fatal("participant asked to mute was removed")
+	}
+}
+
+// savedRooms stands in for the database behind the room loader
+type savedRooms struct {
+	mutex sync.Mutex
+	bans  []roomstore.Member
+}
+
+func (s *savedRooms) load(roomID string) (*roomstore.RoomInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := &roomstore.RoomInfo{ID: roomID, HostUserID: 1, CreatedAt: time.Now()}
+	for _, ban := range s.bans {
+		if ban.UserID != 0 {
+			info.BannedUserIDs = append(info.BannedUserIDs, ban.UserID)
+		} else {
+			info.BannedIPs = append(info.BannedIPs, ban.IP)
+		}
+	}
+	return info, nil
+}
+
+func (s *savedRooms) saveBan(roomID string, member roomstore.Member) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bans = append(s.bans, member)
+	return nil
+}
+
+func TestBanOutlastsTheRoom(t *testing.T) {
+	rooms := newTestRooms(t)
+	saved := &savedRooms{}
+	rooms.SetLoader(saved.load)
+	rooms.SetBanSaver(saved.saveBan)
+
+	host := join(t, rooms, "room", "h", auth.Identity{UserID: 1})
+	member := join(t, rooms, "room", "u", auth.Identity{UserID: 2})
+	guest := join(t, rooms, "room", "g", auth.Identity{IP: "203.0.113.9"})
+	host.send(t, rooms, "room", `{"v":1,"type":"ban","to":"u"}`)
+	host.send(t, rooms, "room", `{"v":1,"type":"ban","to":"g"}`)
+	member.conn.waitClosed(t)
+	guest.conn.waitClosed(t)
+
+	// Once the host leaves, nothing of the room is left in the store
+	rooms.Leave("room", host.Participant)
+	if _, err := rooms.GetRoom("room"); !errors.Is(err, roomstore.ErrRoomNotFound) {
+		t.Fatalf("GetRoom after the room emptied = %v, want %v", err, roomstore.ErrRoomNotFound)
+	}
+
+	// Reloading it brings the bans back
+	for _, identity := range []auth.Identity{{UserID: 2}, {IP: "203.0.113.9"}} {
+		if _, err := rooms.Join("room", "again", identity, "", newFakeConn()); !errors.Is(err, ErrBanned) {
+			t.Fatalf("rejoining as %+v = %v, want %v", identity, err, ErrBanned)
+		}
+	}
+	join(t, rooms, "room", "other", auth.Identity{UserID: 4})
+}
@@ -0,0 +1,288 @@
+package video
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"seaside/lib/monitoring"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const (
+	// sendQueueSize is the number of frames buffered per participant
+	sendQueueSize = 64
+
+	// iceHighWater leaves headroom in the queue for control frames: ICE
+	// candidates are dropped once the queue holds this many frames
+	iceHighWater = sendQueueSize * 3 / 4
+
+	// controlEnqueueTimeout is how long a control frame may wait for queue space
+	// before the participant is treated as a slow consumer and disconnected
+	controlEnqueueTimeout = time.Second
+
+	// writeWait bounds a single WebSocket write
+	writeWait = 10 * time.Second
+
+	// flushWait bounds writing out frames still queued when a participant closes
+	flushWait = time.Second
+
+	// pingInterval is how often the writer sends a WebSocket ping
+	pingInterval = 30 * time.Second
+)
+
+// MessageClass decides how a frame is treated when a send queue is backed up
+type MessageClass int
+
+const (
+	// ClassControl frames (offers, answers, roster, join/leave, errors) must be
+	// delivered; a participant that cannot accept them is disconnected
+	ClassControl MessageClass = iota
+
+	// ClassICE frames are trickled candidates; losing some only delays
+	// connectivity, so they are dropped under backpressure
+	ClassICE
+)
+
+// ClassOf returns the delivery class for a message type
+func ClassOf(msgType MessageType) MessageClass {
+	if msgType == MessageICECandidate {
+		return ClassICE
+	}
+	return ClassControl
+}
+
+// Conn is where a participant's frames are written: its own WebSocket on
+// /join-room, or its signalling channel of a room socket
+type Conn interface {
+	WriteJSON(v interface{}) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+type Participant struct {
+	Host     bool
+	ID       string
+	UserID   uint   // 0 for guests
+	Name     string // Name given by the joiner, shown to hosts when knocking
+	IP       string // Client address, used to ban guests
+	Conn     Conn
+	Mutex    sync.Mutex
+	JoinedAt time.Time
+	LastPing time.Time
+
+	send      chan SignalMessage
+	done      chan struct{}
+	closeOnce sync.Once
+	closeCode int
+	writerWG  sync.WaitGroup
+
+	// Waiting room state; lobbyTimer and lobbyExit are guarded by the
+	// RoomMap mutex
+	admitted   atomic.Bool
+	entered    chan struct{} // Closed once admitted
+	lobbyTimer *time.Timer
+	lobbyExit  string
+}
+
+func newParticipant(id string, host bool, conn Conn) *Participant {
+	now := time.Now()
+	return &Participant{
+		Host:     host,
+		ID:       id,
+		Conn:     conn,
+		JoinedAt: now,
+		LastPing: now,
+		send:     make(chan SignalMessage, sendQueueSize),
+		done:     make(chan struct{}),
+		entered:  make(chan struct{}),
+	}
+}
+
+// Enqueue queues a frame for delivery according to its message class.
+// It returns false if the frame was dropped.
+func (p *Participant) Enqueue(msg SignalMessage) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+
+	if ClassOf(msg.Type) == ClassICE {
+		if len(p.send) >= iceHighWater {
+			monitoring.GlobalMetrics.IncrementDroppedSignalFrames()
+			return false
+		}
+		select {
+		case p.send <- msg:
+			monitoring.GlobalMetrics.AddSignalQueueDepth(1)
+			return true
+		default:
+			monitoring.GlobalMetrics.IncrementDroppedSignalFrames()
+			return false
+		}
+	}
+
+	timer := time.NewTimer(controlEnqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.send <- msg:
+		monitoring.GlobalMetrics.AddSignalQueueDepth(1)
+		return true
+	case <-p.done:
+		return false
+	case <-timer.C:
+		log.Printf("Participant %s is not draining its send queue, disconnecting", p.ID)
+		monitoring.GlobalMetrics.IncrementDroppedSignalFrames()
+		monitoring.GlobalMetrics.IncrementSlowConsumerDisconnects()
+		p.Close()
+		return false
+	}
+}
+
+// Waiting reports whether the participant is still in the waiting room
+func (p *Participant) Waiting() bool {
+	return !p.admitted.Load()
+}
+
+// Admitted is closed once the participant is in the call, right away for
+// people who skip the waiting room
+func (p *Participant) Admitted() <-chan struct{} {
+	return p.entered
+}
+
+// Done is closed once the participant is disconnected
+func (p *Participant) Done() <-chan struct{} {
+	return p.done
+}
+
+// markAdmitted lets the participant into the call. The caller holds the
+// RoomMap mutex or owns the participant.
+func (p *Participant) markAdmitted() {
+	if !p.admitted.Swap(true) {
+		close(p.entered)
+	}
+}
+
+// QueueDepth returns the number of frames waiting to be written
+func (p *Participant) QueueDepth() int {
+	return len(p.send)
+}
+
+// WriteJSON writes a frame directly, bypassing the queue. It is only used
+// before the writer goroutine has started.
+func (p *Participant) WriteJSON(v interface{}) error {
+	return p.writeFrame(v, time.Now().Add(writeWait))
+}
+
+func (p *Participant) writeFrame(v interface{}, deadline time.Time) error {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	p.Conn.SetWriteDeadline(deadline)
+	return p.Conn.WriteJSON(v)
+}
+
+// startWriter launches the goroutine that owns all writes to the connection
+func (p *Participant) startWriter() {
+	p.writerWG.Add(1)
+	go p.writePump()
+}
+
+// writePump drains the send queue and sends heartbeat pings. On exit it
+// sends a close frame and unblocks the read loop of the handler.
+func (p *Participant) writePump() {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		monitoring.GlobalMetrics.AddSignalQueueDepth(-int64(len(p.send)))
+		p.hangUp()
+		p.writerWG.Done()
+	}()
+
+	for {
+		select {
+		case msg := <-p.send:
+			monitoring.GlobalMetrics.AddSignalQueueDepth(-1)
+			if err := p.WriteJSON(msg); err != nil {
+				log.Printf("Write error for participant %s: %v", p.ID, err)
+				p.Close()
+				return
+			}
+		case <-ticker.C:
+			p.Mutex.Lock()
+			err := p.Conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
+			p.Mutex.Unlock()
+			if err != nil {
+				log.Printf("Heartbeat failed for participant %s: %v", p.ID, err)
+				p.Close()
+				return
+			}
+		case <-p.done:
+			p.flush()
+			return
+		}
+	}
+}
+
+// flush writes out whatever is still queued, e.g. a final error frame
+// explaining why the participant is being disconnected
+func (p *Participant) flush() {
+	deadline := time.Now().Add(flushWait)
+	for {
+		select {
+		case msg := <-p.send:
+			monitoring.GlobalMetrics.AddSignalQueueDepth(-1)
+			if err := p.writeFrame(msg, deadline); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// hangUp ends the connection from the writer side. Conn.Close does not
+// release a hijacked connection until the handler returns, so the read loop
+// is woken with an expired deadline instead.
+func (p *Participant) hangUp() {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+
+	p.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(p.closeCode, ""), time.Now().Add(flushWait))
+	p.Conn.SetReadDeadline(time.Now())
+	p.Conn.Close()
+}
+
+// Close stops the writer goroutine. It is safe to call more than once.
+func (p *Participant) Close() {
+	p.CloseWithCode(websocket.CloseGoingAway)
+}
+
+// CloseWithCode stops the writer goroutine and tells the client why with a
+// WebSocket close code. Only the first close takes effect.
+func (p *Participant) CloseWithCode(code int) {
+	p.closeOnce.Do(func() {
+		p.closeCode = code
+		close(p.done)
+	})
+}
+
+// closing reports whether Close has been called
+func (p *Participant) closing() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until the writer goroutine has exited
+func (p *Participant) wait() {
+	p.writerWG.Wait()
+}
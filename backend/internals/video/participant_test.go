@@ -0,0 +1,132 @@
+package video
+
+import (
+	"testing"
+	"time"
+
+	"seaside/lib/monitoring"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// metric reads a counter of the global metrics
+func metric(name string) int64 {
+	return monitoring.GlobalMetrics.GetSnapshot()[name].(int64)
+}
+
+func candidate() SignalMessage {
+	return NewSignalMessage(MessageICECandidate, ICECandidate{Candidate: "c"})
+}
+
+func TestCandidatesStopAtHighWater(t *testing.T) {
+	participant := newParticipant("a", false, newFakeConn())
+	defer participant.Close()
+	dropped := metric("dropped_signal_frames")
+
+	for i := 0; i < iceHighWater; i++ {
+		if !participant.Enqueue(candidate()) {
+			t.Fatalf("candidate %d was dropped below the high-water mark", i)
+		}
+	}
+	if participant.Enqueue(candidate()) {
+		t.Fatal("candidate was queued above the high-water mark")
+	}
+	if got := metric("dropped_signal_frames") - dropped; got != 1 {
+		t.Fatalf("%d dropped frames counted, want 1", got)
+	}
+
+	// The headroom is kept for frames that must arrive
+	if !participant.Enqueue(NewSignalMessage(MessageJoin, nil)) {
+		t.Fatal("control frame was dropped above the high-water mark")
+	}
+	if depth := participant.QueueDepth(); depth != iceHighWater+1 {
+		t.Fatalf("QueueDepth = %d, want %d", depth, iceHighWater+1)
+	}
+}
+
+func TestSlowConsumerIsDisconnected(t *testing.T) {
+	conn := newFakeConn()
+	conn.stall = make(chan struct{})
+	participant := newParticipant("a", false, conn)
+	participant.startWriter()
+	defer participant.wait()
+	disconnects := metric("slow_consumer_disconnects")
+
+	// The writer takes the first frame and blocks on it; the rest fill the queue
+	participant.Enqueue(NewSignalMessage(MessageJoin, nil))
+	for participant.QueueDepth() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < sendQueueSize; i++ {
+		if !participant.Enqueue(NewSignalMessage(MessageJoin, nil)) {
+			t.Fatalf("frame %d was dropped before the queue was full", i)
+		}
+	}
+
+	start := time.Now()
+	if participant.Enqueue(NewSignalMessage(MessageJoin, nil)) {
+		t.Fatal("control frame was queued past a full queue")
+	}
+	if waited := time.Since(start); waited < controlEnqueueTimeout {
+		t.Fatalf("gave up after %v, want %v", waited, controlEnqueueTimeout)
+	}
+	if !participant.closing() {
+		t.Fatal("slow consumer was not disconnected")
+	}
+	if got := metric("slow_consumer_disconnects") - disconnects; got != 1 {
+		t.Fatalf("%d slow consumer disconnects counted, want 1", got)
+	}
+
+	// Once closed, nothing more is queued and the connection is hung up
+	if participant.Enqueue(NewSignalMessage(MessageJoin, nil)) {
+		t.Fatal("frame was queued after disconnecting")
+	}
+	close(conn.stall)
+	if code := conn.waitClosed(t); code != websocket.CloseGoingAway {
+		t.Fatalf("close code = %d, want %d", code, websocket.CloseGoingAway)
+	}
+}
+
+func TestQueueDepthMetric(t *testing.T) {
+	conn := newFakeConn()
+	participant := newParticipant("a", false, conn)
+	depth := metric("signal_queue_depth")
+
+	const frames = 5
+	for i := 0; i < frames; i++ {
+		participant.Enqueue(NewSignalMessage(MessageJoin, nil))
+	}
+	if got := metric("signal_queue_depth") - depth; got != frames {
+		t.Fatalf("queue depth rose by %d, want %d", got, frames)
+	}
+
+	// Written frames leave the queue
+	participant.startWriter()
+	for i := 0; i < frames; i++ {
+		conn.next(t, MessageJoin)
+	}
+	participant.Close()
+	participant.wait()
+	if got := metric("signal_queue_depth") - depth; got != 0 {
+		t.Fatalf("queue depth is %d above where it started, want 0", got)
+	}
+}
+
+func TestQueueDepthMetricAfterClosing(t *testing.T) {
+	conn := newFakeConn()
+	conn.stall = make(chan struct{})
+	participant := newParticipant("a", false, conn)
+	depth := metric("signal_queue_depth")
+
+	for i := 0; i < 3; i++ {
+		participant.Enqueue(NewSignalMessage(MessageJoin, nil))
+	}
+	participant.startWriter()
+	participant.Close()
+	close(conn.stall)
+	participant.wait()
+
+	if got := metric("signal_queue_depth") - depth; got != 0 {
+		t.Fatalf("queue depth is %d above where it started, want 0", got)
+	}
+}
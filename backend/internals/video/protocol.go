@@ -0,0 +1,329 @@
+package video
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is the signalling protocol version spoken by this server.
+// Clients must send it in the "v" field of every frame.
+const ProtocolVersion = 1
+
+// MaxMessageSize is the largest signalling frame accepted from a client
+const MaxMessageSize = 64 * 1024
+
+// maxPeerIDLength bounds the from/to fields of a frame
+const maxPeerIDLength = 64
+
+// SFUPeerID addresses the server in SFU rooms. Clients send their answers
+// and candidates to it, and the server's offers and candidates come from it.
+const SFUPeerID = "sfu"
+
+// Call modes carried in roster and mode frames
+const (
+	ModeMesh = "mesh" // Participants connect to each other
+	ModeSFU  = "sfu"  // Participants connect to the server, which forwards media
+)
+
+// MessageType identifies the kind of a signalling frame
+type MessageType string
+
+const (
+	// Sent by clients and relayed to peers
+	MessageOffer        MessageType = "offer"
+	MessageAnswer       MessageType = "answer"
+	MessageICECandidate MessageType = "ice-candidate"
+
+	// Connection health
+	MessagePing MessageType = "ping"
+	MessagePong MessageType = "pong"
+
+	// Sent by the server only
+	MessageRoster MessageType = "roster"
+	MessageJoin   MessageType = "join"
+	MessageLeave  MessageType = "leave"
+	MessageError  MessageType = "error"
+
+	// Room lifecycle changes made by the host
+	MessageRoomLocked MessageType = "room-locked"
+	MessageRoomClosed MessageType = "room-closed"
+
+	// Waiting room: hosts answer knocks with admit or deny
+	MessageAdmit        MessageType = "admit"
+	MessageDeny         MessageType = "deny"
+	MessageLobbyWaiting MessageType = "lobby-waiting" // Sent to a joiner put in the waiting room
+	MessageKnock        MessageType = "knock"         // Sent to hosts when someone starts waiting
+	MessageLobbyLeft    MessageType = "lobby-left"    // Sent to hosts when someone stops waiting
+
+	// Moderation: hosts remove or ban participants and ask them to mute
+	MessageKick        MessageType = "kick"
+	MessageBan         MessageType = "ban"
+	MessageMuteRequest MessageType = "mute-request"
+	MessageKicked      MessageType = "kicked" // Sent to a participant removed by a host
+
+	// Sent when a room outgrows the mesh and switches to the SFU
+	MessageMode MessageType = "mode"
+
+	// Recording: hosts start and stop it, everyone is told while it runs
+	MessageRecordStart MessageType = "record-start"
+	MessageRecordStop  MessageType = "record-stop"
+	MessageRecording   MessageType = "recording"
+
+	// Sent before the server closes every connection to restart
+	MessageServerRestarting MessageType = "server_restarting"
+)
+
+// hostMessageTypes lists the client frames only hosts may send
+var hostMessageTypes = map[MessageType]bool{
+	MessageAdmit:       true,
+	MessageDeny:        true,
+	MessageKick:        true,
+	MessageBan:         true,
+	MessageMuteRequest: true,
+	MessageRecordStart: true,
+	MessageRecordStop:  true,
+}
+
+// clientMessageTypes lists the frame types a client is allowed to send
+var clientMessageTypes = map[MessageType]bool{
+	MessageOffer:        true,
+	MessageAnswer:       true,
+	MessageICECandidate: true,
+	MessagePing:         true,
+	MessageAdmit:        true,
+	MessageDeny:         true,
+	MessageKick:         true,
+	MessageBan:          true,
+	MessageMuteRequest:  true,
+	MessageRecordStart:  true,
+	MessageRecordStop:   true,
+}
+
+// Error codes carried in error frames
+const (
+	ErrCodeMalformed          = "malformed"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodePeerNotFound       = "peer_not_found"
+	ErrCodeRoomFull           = "room_full"
+	ErrCodeRoomLocked         = "room_locked"
+	ErrCodeRoomExpired        = "room_expired"
+	ErrCodeRoomClosed         = "room_closed"
+	ErrCodeLoginRequired      = "login_required"
+	ErrCodeInviteRequired     = "invite_required"
+	ErrCodeInvalidInvite      = "invalid_invite"
+	ErrCodeUnavailable        = "unavailable"
+	ErrCodeNotHost            = "not_host"
+	ErrCodeNotAdmitted        = "not_admitted"
+	ErrCodeEntryDenied        = "entry_denied"
+	ErrCodeLobbyTimeout       = "lobby_timeout"
+	ErrCodeBanned             = "banned"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeConflict           = "conflict"
+	ErrCodeRateLimited        = "rate_limited"
+)
+
+// SignalMessage is the envelope for every frame exchanged on /join-room
+type SignalMessage struct {
+	Version int             `json:"v"`                 // Protocol version
+	Type    MessageType     `json:"type"`              // Frame type
+	From    string          `json:"from,omitempty"`    // Sender participant ID, stamped by the server
+	To      string          `json:"to,omitempty"`      // Target participant ID, empty to reach every peer
+	Seq     uint64          `json:"seq,omitempty"`     // Client-assigned sequence number, echoed in errors
+	Payload json.RawMessage `json:"payload,omitempty"` // Type-specific body
+}
+
+// SessionDescription is the payload of offer and answer frames
+type SessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// ICECandidate is the payload of ice-candidate frames
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// RosterPayload is sent to a participant when it joins a room. Offers should be
+// addressed to each listed peer so that mesh calls work beyond two people.
+type RosterPayload struct {
+	ID      string         `json:"id"`                // The joining participant's own ID
+	Peers   []string       `json:"peers"`             // IDs of the participants already in the room
+	Host    bool           `json:"host,omitempty"`    // Whether the joiner hosts the room
+	Waiting []KnockPayload `json:"waiting,omitempty"` // People in the waiting room, sent to hosts only
+	Mode    string         `json:"mode"`              // ModeMesh or ModeSFU
+}
+
+// ModePayload is the payload of mode frames. In ModeSFU clients drop their
+// peer connections and wait for an offer from SFUPeerID.
+type ModePayload struct {
+	Mode string `json:"mode"`
+}
+
+// KnockPayload is the payload of knock frames
+type KnockPayload struct {
+	ID     string `json:"id"`               // The waiting participant's ID
+	UserID uint   `json:"userId,omitempty"` // Signed-in user, 0 for guests
+	Name   string `json:"name,omitempty"`   // Name the joiner gave
+}
+
+// Reasons carried in lobby-left frames
+const (
+	LobbyAdmitted = "admitted"
+	LobbyDenied   = "denied"
+	LobbyTimeout  = "timeout"
+	LobbyLeft     = "left"
+)
+
+// LobbyLeftPayload is the payload of lobby-left frames
+type LobbyLeftPayload struct {
+	Reason string `json:"reason"`
+}
+
+// MuteRequestPayload is the payload of mute-request frames. The target's
+// client decides whether to comply.
+type MuteRequestPayload struct {
+	Kind string `json:"kind"` // "audio" or "video"
+}
+
+// KickedPayload is the payload of kicked frames
+type KickedPayload struct {
+	Banned bool `json:"banned,omitempty"` // The participant may not rejoin
+}
+
+// RestartingPayload is the payload of server_restarting frames. Clients
+// should wait RetryAfter milliseconds, then join again.
+type RestartingPayload struct {
+	RetryAfter int64 `json:"retryAfter"`
+}
+
+// RecordingPayload is the payload of recording frames, sent when recording
+// starts or stops and to people joining while it runs
+type RecordingPayload struct {
+	Active  bool   `json:"active"`
+	Session string `json:"session,omitempty"` // Groups the recording's files
+}
+
+// RoomStatePayload is the payload of room-locked frames
+type RoomStatePayload struct {
+	Locked bool `json:"locked"`
+}
+
+// ErrorPayload is the payload of error frames returned to the sender
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Seq     uint64 `json:"seq,omitempty"` // Seq of the offending frame, if known
+}
+
+// ProtocolError describes why a client frame was rejected
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func protocolErrorf(code, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// DecodeSignalMessage parses and validates a frame received from a client
+func DecodeSignalMessage(data []byte) (*SignalMessage, error) {
+	var msg SignalMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, protocolErrorf(ErrCodeMalformed, "invalid JSON frame")
+	}
+	if err := msg.Validate(); err != nil {
+		return &msg, err
+	}
+	return &msg, nil
+}
+
+// Validate checks the envelope and the payload of a client frame
+func (m *SignalMessage) Validate() error {
+	if m.Version != ProtocolVersion {
+		return protocolErrorf(ErrCodeUnsupportedVersion, "unsupported protocol version %d, expected %d", m.Version, ProtocolVersion)
+	}
+
+	if !clientMessageTypes[m.Type] {
+		return protocolErrorf(ErrCodeUnknownType, "unknown message type %q", m.Type)
+	}
+
+	if len(m.From) > maxPeerIDLength || len(m.To) > maxPeerIDLength {
+		return protocolErrorf(ErrCodeMalformed, "peer ID exceeds %d characters", maxPeerIDLength)
+	}
+
+	switch m.Type {
+	case MessageOffer, MessageAnswer:
+		var sd SessionDescription
+		if err := json.Unmarshal(m.Payload, &sd); err != nil {
+			return protocolErrorf(ErrCodeInvalidPayload, "%s payload must be a session description", m.Type)
+		}
+		if sd.Type != string(m.Type) {
+			return protocolErrorf(ErrCodeInvalidPayload, "session description type %q does not match frame type %q", sd.Type, m.Type)
+		}
+		if sd.SDP == "" {
+			return protocolErrorf(ErrCodeInvalidPayload, "session description is missing sdp")
+		}
+	case MessageICECandidate:
+		var candidate ICECandidate
+		if err := json.Unmarshal(m.Payload, &candidate); err != nil {
+			return protocolErrorf(ErrCodeInvalidPayload, "ice-candidate payload must be a candidate object")
+		}
+		// An empty candidate string signals end-of-candidates, but it still needs an m-line
+		if candidate.SDPMid == nil && candidate.SDPMLineIndex == nil {
+			return protocolErrorf(ErrCodeInvalidPayload, "ice-candidate requires sdpMid or sdpMLineIndex")
+		}
+	case MessageAdmit, MessageDeny:
+		if m.To == "" {
+			return protocolErrorf(ErrCodeInvalidPayload, "%s requires the waiting participant in \"to\"", m.Type)
+		}
+	case MessageKick, MessageBan:
+		if m.To == "" {
+			return protocolErrorf(ErrCodeInvalidPayload, "%s requires the participant in \"to\"", m.Type)
+		}
+	case MessageMuteRequest:
+		if m.To == "" {
+			return protocolErrorf(ErrCodeInvalidPayload, "mute-request requires the participant in \"to\"")
+		}
+		var request MuteRequestPayload
+		if err := json.Unmarshal(m.Payload, &request); err != nil || (request.Kind != "audio" && request.Kind != "video") {
+			return protocolErrorf(ErrCodeInvalidPayload, "mute-request payload must have kind \"audio\" or \"video\"")
+		}
+	case MessagePing, MessageRecordStart, MessageRecordStop:
+		// No payload
+	}
+
+	return nil
+}
+
+// NewSignalMessage builds a server frame with the given payload
+func NewSignalMessage(msgType MessageType, payload interface{}) SignalMessage {
+	msg := SignalMessage{
+		Version: ProtocolVersion,
+		Type:    msgType,
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err == nil {
+			msg.Payload = data
+		}
+	}
+	return msg
+}
+
+// NewErrorMessage builds an error frame for the sender of a rejected frame
+func NewErrorMessage(code, message string, seq uint64) SignalMessage {
+	return NewSignalMessage(MessageError, ErrorPayload{
+		Code:    code,
+		Message: message,
+		Seq:     seq,
+	})
+}
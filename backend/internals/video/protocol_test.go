@@ -0,0 +1,79 @@
+package video
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeSignalMessage(t *testing.T) {
+	longID := strings.Repeat("p", maxPeerIDLength+1)
+	tests := []struct {
+		name     string
+		frame    string
+		wantCode string // Empty for a valid frame
+	}{
+		{"offer", `{"v":1,"type":"offer","to":"b","payload":{"type":"offer","sdp":"v=0"}}`, ""},
+		{"answer", `{"v":1,"type":"answer","to":"b","payload":{"type":"answer","sdp":"v=0"}}`, ""},
+		{"candidate with an m-line index", `{"v":1,"type":"ice-candidate","payload":{"candidate":"c","sdpMLineIndex":0}}`, ""},
+		{"end of candidates", `{"v":1,"type":"ice-candidate","payload":{"candidate":"","sdpMid":"0"}}`, ""},
+		{"ping", `{"v":1,"type":"ping"}`, ""},
+		{"admit", `{"v":1,"type":"admit","to":"b"}`, ""},
+		{"mute request", `{"v":1,"type":"mute-request","to":"b","payload":{"kind":"audio"}}`, ""},
+		{"record start", `{"v":1,"type":"record-start"}`, ""},
+
+		{"not JSON", `offer`, ErrCodeMalformed},
+		{"not an object", `[1]`, ErrCodeMalformed},
+		{"missing version", `{"type":"ping"}`, ErrCodeUnsupportedVersion},
+		{"future version", `{"v":2,"type":"ping"}`, ErrCodeUnsupportedVersion},
+		{"unknown type", `{"v":1,"type":"dance"}`, ErrCodeUnknownType},
+		{"server-only type", `{"v":1,"type":"roster"}`, ErrCodeUnknownType},
+		{"long target", `{"v":1,"type":"ping","to":"` + longID + `"}`, ErrCodeMalformed},
+		{"long sender", `{"v":1,"type":"ping","from":"` + longID + `"}`, ErrCodeMalformed},
+		{"offer without payload", `{"v":1,"type":"offer"}`, ErrCodeInvalidPayload},
+		{"offer carrying an answer", `{"v":1,"type":"offer","payload":{"type":"answer","sdp":"v=0"}}`, ErrCodeInvalidPayload},
+		{"answer without sdp", `{"v":1,"type":"answer","payload":{"type":"answer"}}`, ErrCodeInvalidPayload},
+		{"candidate without an m-line", `{"v":1,"type":"ice-candidate","payload":{"candidate":"c"}}`, ErrCodeInvalidPayload},
+		{"candidate that is not an object", `{"v":1,"type":"ice-candidate","payload":"c"}`, ErrCodeInvalidPayload},
+		{"admit without a target", `{"v":1,"type":"admit"}`, ErrCodeInvalidPayload},
+		{"deny without a target", `{"v":1,"type":"deny"}`, ErrCodeInvalidPayload},
+		{"kick without a target", `{"v":1,"type":"kick"}`, ErrCodeInvalidPayload},
+		{"ban without a target", `{"v":1,"type":"ban"}`, ErrCodeInvalidPayload},
+		{"mute request without a target", `{"v":1,"type":"mute-request","payload":{"kind":"audio"}}`, ErrCodeInvalidPayload},
+		{"mute request for screens", `{"v":1,"type":"mute-request","to":"b","payload":{"kind":"screen"}}`, ErrCodeInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := DecodeSignalMessage([]byte(tt.frame))
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("DecodeSignalMessage = %v, want a valid frame", err)
+				}
+				return
+			}
+
+			var perr *ProtocolError
+			if !errors.As(err, &perr) {
+				t.Fatalf("DecodeSignalMessage = %v, want a protocol error", err)
+			}
+			if perr.Code != tt.wantCode {
+				t.Fatalf("code = %q, want %q (%s)", perr.Code, tt.wantCode, perr.Message)
+			}
+			// Frames that parsed are returned, so errors can echo their seq
+			if tt.wantCode != ErrCodeMalformed && msg == nil {
+				t.Fatal("rejected frame was not returned")
+			}
+		})
+	}
+}
+
+func TestDecodeSignalMessageKeepsSeq(t *testing.T) {
+	msg, err := DecodeSignalMessage([]byte(`{"v":1,"type":"dance","seq":9}`))
+	if err == nil {
+		t.Fatal("unknown type was accepted")
+	}
+	if msg == nil || msg.Seq != 9 {
+		t.Fatalf("message = %+v, want seq 9", msg)
+	}
+}
@@ -0,0 +1,456 @@
+package video
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"seaside/lib/roomstore"
+	"seaside/lib/webm"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+const (
+	// vp8ClockRate is the RTP clock rate of video tracks
+	vp8ClockRate = 90000
+
+	// maxLatePackets is how far the sample builder waits for reordered
+	// packets before giving up on a frame
+	maxLatePackets = 128
+)
+
+// Recording formats
+const (
+	RecordingFormatOgg  = "ogg"  // Opus audio
+	RecordingFormatWebM = "webm" // VP8 video
+)
+
+// RecordingFile describes one recorded track once recording stops
+type RecordingFile struct {
+	Session       string // Shared by the files of one recording
+	RoomID        string
+	ParticipantID string
+	UserID        uint   // 0 for guests
+	Kind          string // "audio" or "video"
+	Format        string // RecordingFormatOgg or RecordingFormatWebM
+	Path          string
+	Size          int64
+	StartedBy     uint // User who started the recording, 0 for guests
+	StartedAt     time.Time
+	EndedAt       time.Time
+}
+
+// RecordingSaver stores a finished recording, e.g. in the database
+type RecordingSaver func(RecordingFile) error
+
+// EnableRecording lets hosts record their calls into dir. The server records
+// the media it forwards, so recording moves mesh calls to the SFU, and only
+// calls on a single node can be recorded.
+func (r *RoomMap) EnableRecording(dir string, save RecordingSaver) error {
+	if r.sfuAPI == nil {
+		return errors.New("recording requires the SFU")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	r.recordingDir = dir
+	r.saveRecording = save
+	log.Printf("Recording enabled, writing to %s", dir)
+	return nil
+}
+
+// DeleteRecordings removes the files of every recording of a room
+func (r *RoomMap) DeleteRecordings(roomID string) error {
+	if r.recordingDir == "" {
+		return nil
+	}
+	return os.RemoveAll(filepath.Join(r.recordingDir, roomID))
+}
+
+// RecordedRooms lists the rooms with recording files on this node
+func (r *RoomMap) RecordedRooms() ([]string, error) {
+	if r.recordingDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(r.recordingDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var roomIDs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			roomIDs = append(roomIDs, entry.Name())
+		}
+	}
+	return roomIDs, nil
+}
+
+// startRecording starts recording a room on behalf of a host. Only rooms
+// saved by a signed-in owner can be recorded, since recordings belong to them.
+func (r *RoomMap) startRecording(roomID string, host *Participant) *ProtocolError {
+	if r.recordingDir == "" {
+		return protocolErrorf(ErrCodeUnavailable, "recording needs the media server, which is not enabled on this server")
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	info, err := r.store.GetRoom(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to load room %s: %v", roomID, err)
+		return protocolErrorf(ErrCodeUnavailable, "recording could not be started, try again")
+	}
+	if info.HostUserID == 0 {
+		return protocolErrorf(ErrCodeForbidden, "only saved rooms can be recorded")
+	}
+
+	// The server records the media it forwards, which it only has for the
+	// participants connected to this node
+	members, err := r.store.Members(ctx, roomstore.ScopeVideo, roomID)
+	if err != nil {
+		log.Printf("Failed to list members of room %s: %v", roomID, err)
+		return protocolErrorf(ErrCodeUnavailable, "recording could not be started, try again")
+	}
+	for _, member := range members {
+		if member.NodeID != roomstore.NodeID {
+			return protocolErrorf(ErrCodeUnavailable, "this call is spread over several servers and cannot be recorded")
+		}
+	}
+
+	// A mesh call moves to the SFU first. Participants connect to the server
+	// when the mode frame reaches them; their tracks are recorded as they
+	// arrive.
+	if !info.SFU {
+		switched, err := r.switchToSFU(ctx, roomID)
+		if err != nil {
+			log.Printf("Failed to switch room %s to the SFU: %v", roomID, err)
+			return protocolErrorf(ErrCodeUnavailable, "recording could not be started, try again")
+		}
+		if switched {
+			log.Printf("Room %s switches to the SFU to be recorded", roomID)
+			r.Broadcast(roomID, NewSignalMessage(MessageMode, ModePayload{Mode: ModeSFU}), "")
+		}
+	}
+
+	media := r.mediaRoom(roomID)
+	if media == nil {
+		return protocolErrorf(ErrCodeUnavailable, "recording could not be started, try again")
+	}
+	session, err := media.startRecording(r.recordingDir, r.saveRecording, host.UserID)
+	if err != nil {
+		return protocolErrorf(ErrCodeConflict, "%v", err)
+	}
+
+	log.Printf("Host %s started recording %s in room %s", host.ID, session, roomID)
+	r.Broadcast(roomID, NewSignalMessage(MessageRecording, RecordingPayload{Active: true, Session: session}), "")
+	return nil
+}
+
+// stopRecording stops the recording of a room and saves its files
+func (r *RoomMap) stopRecording(roomID string, host *Participant) *ProtocolError {
+	r.Mutex.RLock()
+	var media *sfuRoom
+	if room, ok := r.Map[roomID]; ok {
+		media = room.media
+	}
+	r.Mutex.RUnlock()
+
+	var rec *recording
+	if media != nil {
+		rec = media.stopRecording()
+	}
+	if rec == nil {
+		return protocolErrorf(ErrCodeConflict, "this room is not being recorded")
+	}
+
+	log.Printf("Host %s stopped recording %s in room %s", host.ID, rec.session, roomID)
+	rec.saveFiles()
+	r.Broadcast(roomID, NewSignalMessage(MessageRecording, RecordingPayload{Active: false, Session: rec.session}), "")
+	return nil
+}
+
+// recordingSession returns the recording running in a room on this node,
+// or "" if there is none
+func (r *RoomMap) recordingSession(roomID string) string {
+	r.Mutex.RLock()
+	var media *sfuRoom
+	if room, ok := r.Map[roomID]; ok {
+		media = room.media
+	}
+	r.Mutex.RUnlock()
+
+	if media == nil {
+		return ""
+	}
+	media.mutex.Lock()
+	defer media.mutex.Unlock()
+	if media.recording == nil {
+		return ""
+	}
+	return media.recording.session
+}
+
+// recording writes every track forwarded by an SFU room to its own file
+type recording struct {
+	session   string
+	roomID    string
+	dir       string // Files go to dir/<room>/
+	startedBy uint
+	startedAt time.Time
+	save      RecordingSaver
+	active    map[*trackRecorder]bool
+	files     []RecordingFile // Tracks that have ended
+}
+
+// startRecording begins recording the room's tracks, including the ones
+// published later. The caller must not hold the mutex.
+func (m *sfuRoom) startRecording(dir string, save RecordingSaver, startedBy uint) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return "", errors.New("the room has ended")
+	}
+	if m.recording != nil {
+		return "", errors.New("the room is already being recorded")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, m.roomID), 0o750); err != nil {
+		log.Printf("Failed to create recording directory for room %s: %v", m.roomID, err)
+		return "", errors.New("the recording could not be created")
+	}
+
+	m.recording = &recording{
+		session:   uuid.New().String(),
+		roomID:    m.roomID,
+		dir:       dir,
+		startedBy: startedBy,
+		startedAt: time.Now(),
+		save:      save,
+		active:    make(map[*trackRecorder]bool),
+	}
+	for _, session := range m.sessions {
+		for _, track := range session.published {
+			m.recording.record(track)
+		}
+	}
+	return m.recording.session, nil
+}
+
+// stopRecording ends the recording and closes its files. It returns nil if
+// the room was not being recorded. The caller must not hold the mutex.
+func (m *sfuRoom) stopRecording() *recording {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.endRecording()
+}
+
+// endRecording is stopRecording for callers holding the mutex
+func (m *sfuRoom) endRecording() *recording {
+	rec := m.recording
+	if rec == nil {
+		return nil
+	}
+	m.recording = nil
+
+	for recorder := range rec.active {
+		rec.finish(recorder)
+	}
+	return rec
+}
+
+// record starts writing a track to a new file. Codecs without a matching
+// container are skipped.
+func (rec *recording) record(track *sfuTrack) {
+	codec := track.remote.Codec().MimeType
+	kind := track.remote.Kind().String()
+
+	format := ""
+	switch {
+	case strings.EqualFold(codec, webrtc.MimeTypeOpus):
+		format = RecordingFormatOgg
+	case strings.EqualFold(codec, webrtc.MimeTypeVP8):
+		format = RecordingFormatWebM
+	default:
+		log.Printf("Not recording %s track from %s in room %s: %s is not supported", kind, track.publisher.ID, rec.roomID, codec)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s-%s-%d.%s", rec.session, track.publisher.ID, kind, len(rec.files)+len(rec.active)+1, format)
+	path := filepath.Join(rec.dir, rec.roomID, name)
+
+	var writer trackWriter
+	var err error
+	if format == RecordingFormatOgg {
+		writer, err = oggwriter.New(path, 48000, 2)
+	} else {
+		writer, err = newVP8Writer(path)
+	}
+	if err != nil {
+		log.Printf("Failed to record %s track from %s in room %s: %v", kind, track.publisher.ID, rec.roomID, err)
+		return
+	}
+
+	recorder := &trackRecorder{
+		writer: writer,
+		file: RecordingFile{
+			Session:       rec.session,
+			RoomID:        rec.roomID,
+			ParticipantID: track.publisher.ID,
+			UserID:        track.publisher.UserID,
+			Kind:          kind,
+			Format:        format,
+			Path:          path,
+			StartedBy:     rec.startedBy,
+			StartedAt:     time.Now(),
+		},
+	}
+	rec.active[recorder] = true
+	track.recorder.Store(recorder)
+}
+
+// finish closes a track's file once the track ends or recording stops
+func (rec *recording) finish(recorder *trackRecorder) {
+	if !rec.active[recorder] {
+		return
+	}
+	delete(rec.active, recorder)
+	rec.files = append(rec.files, recorder.close())
+}
+
+// saveFiles hands the finished files to the saver
+func (rec *recording) saveFiles() {
+	for _, file := range rec.files {
+		if rec.save == nil {
+			continue
+		}
+		if err := rec.save(file); err != nil {
+			log.Printf("Failed to save recording %s of room %s: %v", file.Path, file.RoomID, err)
+		}
+	}
+}
+
+// trackWriter writes the RTP packets of a track into a container
+type trackWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+// trackRecorder records one track. Packets arrive on the track's forwarding
+// goroutine while recording can be stopped from anywhere.
+type trackRecorder struct {
+	mutex  sync.Mutex
+	writer trackWriter
+	file   RecordingFile
+	closed bool
+	failed bool
+}
+
+// write records an RTP packet; buf is reused by the caller
+func (t *trackRecorder) write(buf []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed || t.failed {
+		return
+	}
+
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(append([]byte(nil), buf...)); err != nil {
+		return
+	}
+	if err := t.writer.WriteRTP(packet); err != nil {
+		// Keep forwarding, but stop filling a file that cannot be written
+		log.Printf("Failed to record %s: %v", t.file.Path, err)
+		t.failed = true
+	}
+}
+
+// close finishes the file and reports its final size
+func (t *trackRecorder) close() RecordingFile {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		if err := t.writer.Close(); err != nil {
+			log.Printf("Failed to finish recording %s: %v", t.file.Path, err)
+		}
+		t.file.EndedAt = time.Now()
+		if info, err := os.Stat(t.file.Path); err == nil {
+			t.file.Size = info.Size()
+		}
+	}
+	return t.file
+}
+
+// vp8Writer assembles VP8 frames from RTP packets and writes them to WebM.
+// The file starts with the first keyframe.
+type vp8Writer struct {
+	file    *os.File
+	builder *samplebuilder.SampleBuilder
+	webm    *webm.Writer
+	firstTS uint32
+}
+
+func newVP8Writer(path string) (*vp8Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &vp8Writer{
+		file:    file,
+		builder: samplebuilder.New(maxLatePackets, &codecs.VP8Packet{}, vp8ClockRate),
+	}, nil
+}
+
+func (w *vp8Writer) WriteRTP(packet *rtp.Packet) error {
+	w.builder.Push(packet)
+
+	for sample := w.builder.Pop(); sample != nil; sample = w.builder.Pop() {
+		frame := sample.Data
+		// A clear P bit marks a keyframe, whose header carries the frame size
+		keyframe := len(frame) >= 10 && frame[0]&0x01 == 0
+
+		if w.webm == nil {
+			if !keyframe {
+				continue
+			}
+			track := webm.VideoTrack{
+				CodecID: "V_VP8",
+				Width:   int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3FFF),
+				Height:  int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3FFF),
+			}
+			writer, err := webm.NewWriter(w.file, track)
+			if err != nil {
+				return err
+			}
+			w.webm = writer
+			w.firstTS = sample.PacketTimestamp
+		}
+
+		elapsed := time.Duration(sample.PacketTimestamp-w.firstTS) * time.Second / vp8ClockRate
+		if err := w.webm.WriteFrame(keyframe, elapsed, frame); err != nil && !errors.Is(err, webm.ErrNonMonotonic) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *vp8Writer) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,107 @@
+package video
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/roomstore"
+)
+
+// newRecordingRooms returns a RoomMap with the SFU and recording enabled
+func newRecordingRooms(t *testing.T) *RoomMap {
+	rooms := newTestRooms(t)
+	if err := rooms.EnableSFU(SFUConfig{Threshold: defaultSFUThreshold, MaxParticipants: defaultSFUParticipants}); err != nil {
+		t.Fatalf("EnableSFU: %v", err)
+	}
+	if err := rooms.EnableRecording(t.TempDir(), nil); err != nil {
+		t.Fatalf("EnableRecording: %v", err)
+	}
+	return rooms
+}
+
+// recordingState waits for the next recording frame and returns whether it
+// says the room is being recorded
+func recordingState(t *testing.T, client *testClient) bool {
+	t.Helper()
+	var payload RecordingPayload
+	json.Unmarshal(client.conn.next(t, MessageRecording).Payload, &payload)
+	return payload.Active
+}
+
+func TestRecordingMovesMeshCallsToTheSFU(t *testing.T) {
+	rooms := newRecordingRooms(t)
+	if _, err := rooms.Store().CreateRoom(context.Background(), roomstore.RoomInfo{ID: "room", HostUserID: 1, CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	host := join(t, rooms, "room", "h", auth.Identity{UserID: 1})
+	member := join(t, rooms, "room", "u", auth.Identity{UserID: 2})
+	defer rooms.Leave("room", host.Participant)
+	defer rooms.Leave("room", member.Participant)
+
+	var roster RosterPayload
+	json.Unmarshal(member.conn.next(t, MessageRoster).Payload, &roster)
+	if roster.Mode != ModeMesh {
+		t.Fatalf("room of two runs in %q mode, want %q", roster.Mode, ModeMesh)
+	}
+
+	host.send(t, rooms, "room", `{"v":1,"type":"record-start"}`)
+	for _, client := range []*testClient{host, member} {
+		var mode ModePayload
+		json.Unmarshal(client.conn.next(t, MessageMode).Payload, &mode)
+		if mode.Mode != ModeSFU {
+			t.Fatalf("%s was told to switch to %q, want %q", client.ID, mode.Mode, ModeSFU)
+		}
+		// The server calls everyone so it has their media to record
+		if offer := client.conn.next(t, MessageOffer); offer.From != SFUPeerID {
+			t.Fatalf("%s got an offer from %q, want %q", client.ID, offer.From, SFUPeerID)
+		}
+		if !recordingState(t, client) {
+			t.Fatalf("%s was not told the call is recorded", client.ID)
+		}
+	}
+	host.conn.none(t, MessageError)
+	if info, _ := rooms.GetRoom("room"); !info.SFU {
+		t.Fatal("room was not switched to the SFU")
+	}
+
+	host.send(t, rooms, "room", `{"v":1,"type":"record-stop"}`)
+	if recordingState(t, member) {
+		t.Fatal("member was not told the recording stopped")
+	}
+}
+
+func TestRecordingRefusals(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     roomstore.RoomInfo
+		identity auth.Identity
+		frame    string
+		wantCode string
+	}{
+		{"anonymous room", roomstore.RoomInfo{ID: "room"}, auth.Identity{}, `{"v":1,"type":"record-start"}`, ErrCodeForbidden},
+		{"stop without a recording", roomstore.RoomInfo{ID: "room", HostUserID: 1}, auth.Identity{UserID: 1}, `{"v":1,"type":"record-stop"}`, ErrCodeConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rooms := newRecordingRooms(t)
+			tt.info.CreatedAt = time.Now()
+			rooms.Store().CreateRoom(context.Background(), tt.info)
+			host := join(t, rooms, "room", "h", tt.identity)
+			defer rooms.Leave("room", host.Participant)
+
+			host.send(t, rooms, "room", tt.frame)
+			if got := host.conn.nextError(t); got.Code != tt.wantCode {
+				t.Fatalf("error code = %q, want %q", got.Code, tt.wantCode)
+			}
+			// Refusing to record leaves the call as it was
+			host.conn.none(t, MessageMode)
+			if info, _ := rooms.GetRoom("room"); info != nil && info.SFU {
+				t.Fatal("room was switched to the SFU")
+			}
+		})
+	}
+}
@@ -1,210 +1,850 @@
 package video
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
 	"math/rand"
 	"sync"
 	"time"
 
+	"seaside/lib/auth"
+	"seaside/lib/drain"
 	"seaside/lib/monitoring"
+	"seaside/lib/roomstore"
 
 	"github.com/gofiber/websocket/v2"
-	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
 )
 
-type Participant struct {
-	Host     bool
-	ID       string
-	Conn     *websocket.Conn
-	Mutex    sync.Mutex
-	JoinedAt time.Time
-	LastPing time.Time
+// MaxMeshParticipants is the largest room size supported by peer-to-peer mesh calls
+const MaxMeshParticipants = 6
+
+const (
+	// storeTimeout bounds every call to the room store
+	storeTimeout = 5 * time.Second
+
+	// emptyRoomTTL is how long a created room may stay empty before cleanup removes it
+	emptyRoomTTL = 5 * time.Minute
+
+	// lobbyTimeout is how long someone may sit in the waiting room
+	lobbyTimeout = 5 * time.Minute
+)
+
+// ErrRoomFull is returned when a room already holds its participant limit
+var ErrRoomFull = roomstore.ErrRoomFull
+
+// ErrRoomLocked is returned when the host has locked a room against new joins
+var ErrRoomLocked = errors.New("room is locked")
+
+// ErrRoomExpired is returned when a room is past its expiry time
+var ErrRoomExpired = errors.New("room has expired")
+
+// ErrLoginRequired is returned when a guest tries to join a members-only room
+var ErrLoginRequired = errors.New("room requires signing in")
+
+// ErrInviteRequired is returned when joining an invite-only room without an invite
+var ErrInviteRequired = errors.New("room requires an invite")
+
+// ErrBanned is returned when a host has banned the joiner from the room
+var ErrBanned = errors.New("banned from room")
+
+// ErrInvalidInvite is returned for invite tokens that are expired, forged or
+// issued for another room
+var ErrInvalidInvite = errors.New("invalid invite")
+
+// ErrServerRestarting is returned for joins while the server is shutting down
+var ErrServerRestarting = errors.New("server is restarting")
+
+// RoomLoader looks up the settings of a room that is not in the store, e.g.
+// a persisted room after a restart. It returns nil if the room is unknown.
+type RoomLoader func(roomID string) (*roomstore.RoomInfo, error)
+
+func storeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), storeTimeout)
+}
+
+// Room holds the participants of one call connected to this node. Frames for
+// the room arrive through its store subscription, which delivers them in
+// order on a goroutine of its own, so a slow room never delays another one.
+type Room struct {
+	ID           string
+	Participants []*Participant
+	Waiting      []*Participant // Joiners in the waiting room
+	CreatedAt    time.Time
+
+	rooms        *RoomMap
+	subscription roomstore.Subscription
+	media        *sfuRoom // Set once the room uses the SFU
+}
+
+// deliver fans a frame received from the store out to local participants
+func (room *Room) deliver(payload []byte) {
+	var msg BroadcastMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("Dropping undecodable frame for room %s: %v", room.ID, err)
+		return
+	}
+
+	for _, participant := range room.rooms.Get(room.ID) {
+		// Don't send message back to sender
+		if participant.ID == msg.Exclude {
+			continue
+		}
+
+		// Targeted frames only reach the addressed peer
+		if msg.Message.To != "" && participant.ID != msg.Message.To {
+			continue
+		}
+		if msg.HostsOnly && !participant.Host {
+			continue
+		}
+
+		// A kick or ban reaches its target as a kicked frame, then ends the connection
+		if msg.Message.Type == MessageKick || msg.Message.Type == MessageBan {
+			kicked := NewSignalMessage(MessageKicked, KickedPayload{Banned: msg.Message.Type == MessageBan})
+			kicked.From = msg.Message.From
+			participant.Enqueue(kicked)
+			participant.CloseWithCode(websocket.CloseNormalClosure)
+			room.rooms.RemoveClient(room.ID, participant.Conn)
+			continue
+		}
+
+		participant.Enqueue(msg.Message)
+
+		// The room outgrew the mesh; the server now calls everyone
+		if msg.Message.Type == MessageMode {
+			room.rooms.startSFU(room.ID, participant)
+		}
+
+		// Closing flushes the queue, so the frame is written before the disconnect.
+		// A normal closure tells clients not to reconnect.
+		if msg.Message.Type == MessageRoomClosed {
+			participant.CloseWithCode(websocket.CloseNormalClosure)
+		}
+	}
+
+	// Hosts' decisions are addressed to the waiting participant
+	for _, waiter := range room.rooms.getWaiting(room.ID) {
+		switch {
+		case msg.Message.Type == MessageRoomClosed:
+			waiter.Enqueue(msg.Message)
+			waiter.CloseWithCode(websocket.CloseNormalClosure)
+		case msg.Message.To != waiter.ID:
+		case msg.Message.Type == MessageAdmit:
+			room.rooms.admit(room.ID, waiter)
+		case msg.Message.Type == MessageDeny:
+			room.rooms.dismiss(room.ID, waiter, LobbyDenied, NewErrorMessage(ErrCodeEntryDenied, "the host declined your request to join", 0))
+		}
+	}
+}
+
+// overflow lets a room that fell behind on its frames skip ICE candidates,
+// which peers can do without. Any other missed frame would leave the call
+// out of step, so the room's participants are told to reconnect instead.
+func (room *Room) overflow(payload []byte) bool {
+	var msg BroadcastMessage
+	if err := json.Unmarshal(payload, &msg); err == nil && msg.Message.Type == MessageICECandidate {
+		return true
+	}
+
+	// The publisher may hold the room map's lock
+	go room.reconnect()
+	return false
+}
+
+// reconnect disconnects everyone in the room on this node with a close code
+// that makes clients come back
+func (room *Room) reconnect() {
+	log.Printf("Room %s fell behind on its frames, reconnecting its participants", room.ID)
+	for _, participant := range room.rooms.Get(room.ID) {
+		participant.CloseWithCode(websocket.CloseTryAgainLater)
+	}
+	for _, waiter := range room.rooms.getWaiting(room.ID) {
+		waiter.CloseWithCode(websocket.CloseTryAgainLater)
+	}
+}
+
+// close stops the subscription and every participant writer
+func (room *Room) close() {
+	if room.subscription != nil {
+		room.subscription.Close()
+	}
+	for _, participant := range room.Participants {
+		participant.Close()
+	}
+	for _, waiter := range room.Waiting {
+		waiter.Close()
+	}
 }
 
 type RoomMap struct {
-	Mutex sync.RWMutex
-	Map   map[string][]Participant
+	Mutex   sync.RWMutex
+	Map     map[string]*Room
+	store   roomstore.Store
+	loader  RoomLoader
+	saveBan BanSaver
+	invites *auth.JWTUtil
+	sfu     *SFUConfig  // nil keeps every call a mesh
+	sfuAPI  *webrtc.API // Builds the SFU's peer connections
+
+	recordingDir  string // Empty when recording is disabled
+	saveRecording RecordingSaver
+
+	gate drain.Gate // Closed once the server starts shutting down
 }
 
-func (r *RoomMap) Init() {
-	r.Map = make(map[string][]Participant)
+// Init prepares the map to track rooms in the given store. A nil store
+// keeps everything in process. Background cleanup stops when ctx is done.
+func (r *RoomMap) Init(ctx context.Context, store roomstore.Store) {
+	if store == nil {
+		store = roomstore.NewMemoryStore()
+	}
+	r.Map = make(map[string]*Room)
+	r.store = store
 
 	// Start cleanup routine for inactive rooms
-	go r.cleanupRoutine()
+	go r.cleanupRoutine(ctx)
+}
+
+// Store returns the room store backing this map
+func (r *RoomMap) Store() roomstore.Store {
+	return r.store
+}
+
+// SetLoader sets where settings for rooms missing from the store come from
+func (r *RoomMap) SetLoader(loader RoomLoader) {
+	r.loader = loader
 }
 
-func (r *RoomMap) Get(roomID string) []Participant {
+// SetInviteSigner sets the JWTUtil that signs room invites. Invites are
+// rejected until one is set.
+func (r *RoomMap) SetInviteSigner(jwtUtil *auth.JWTUtil) {
+	r.invites = jwtUtil
+}
+
+// CheckInvite validates an invite token for a room and returns the role it grants
+func (r *RoomMap) CheckInvite(roomID, token string) (string, error) {
+	if r.invites == nil {
+		return "", ErrInvalidInvite
+	}
+
+	claims, err := r.invites.ValidateRoomInvite(token, roomID)
+	if err != nil {
+		log.Printf("Rejected invite for room %s: %v", roomID, err)
+		return "", ErrInvalidInvite
+	}
+	return claims.Role, nil
+}
+
+// Get returns a snapshot of the participants in a room connected to this node
+func (r *RoomMap) Get(roomID string) []*Participant {
 	r.Mutex.RLock()
 	defer r.Mutex.RUnlock()
-	return r.Map[roomID]
+
+	room, ok := r.Map[roomID]
+	if !ok {
+		return []*Participant{}
+	}
+
+	snapshot := make([]*Participant, len(room.Participants))
+	copy(snapshot, room.Participants)
+	return snapshot
 }
 
-func (r *RoomMap) CreateRoom() string {
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
+// GetParticipant looks up a participant connected to this node by its ID
+func (r *RoomMap) GetParticipant(roomID, participantID string) *Participant {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+
+	room, ok := r.Map[roomID]
+	if !ok {
+		return nil
+	}
+
+	for _, participant := range room.Participants {
+		if participant.ID == participantID {
+			return participant
+		}
+	}
+	return nil
+}
+
+// Members returns everyone in a room across all nodes
+func (r *RoomMap) Members(roomID string) ([]roomstore.Member, error) {
+	ctx, cancel := storeContext()
+	defer cancel()
+	return r.store.Members(ctx, roomstore.ScopeVideo, roomID)
+}
+
+// HasMember reports whether a participant is in a room on any node
+func (r *RoomMap) HasMember(roomID, participantID string) bool {
+	members, err := r.Members(roomID)
+	if err != nil {
+		log.Printf("Failed to list members of room %s: %v", roomID, err)
+		return false
+	}
+	for _, member := range members {
+		if member.ID == participantID {
+			return true
+		}
+	}
+	return false
+}
+
+// HasUser reports whether a signed-in user is in a room's call or chat on
+// any node
+func (r *RoomMap) HasUser(roomID string, userID uint) bool {
+	if userID == 0 {
+		return false
+	}
+	ctx, cancel := storeContext()
+	defer cancel()
+	for _, scope := range []string{roomstore.ScopeChat, roomstore.ScopeVideo} {
+		members, err := r.store.Members(ctx, scope, roomID)
+		if err != nil {
+			log.Printf("Failed to list %s members of room %s: %v", scope, roomID, err)
+			return false
+		}
+		for _, member := range members {
+			if member.UserID == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PeerIDs returns the IDs of everyone in a room except the given participant
+func (r *RoomMap) PeerIDs(roomID, excludeID string) []string {
+	peers := []string{}
+
+	members, err := r.Members(roomID)
+	if err != nil {
+		log.Printf("Failed to list members of room %s: %v", roomID, err)
+		return peers
+	}
+	for _, member := range members {
+		if member.ID != excludeID {
+			peers = append(peers, member.ID)
+		}
+	}
+	return peers
+}
+
+// Broadcast publishes a frame to everyone in a room except the given
+// participant, wherever they are connected
+func (r *RoomMap) Broadcast(roomID string, msg SignalMessage, excludeID string) bool {
+	return r.publish(BroadcastMessage{Message: msg, RoomID: roomID, Exclude: excludeID})
+}
+
+// BroadcastHosts publishes a frame to the hosts of a room
+func (r *RoomMap) BroadcastHosts(roomID string, msg SignalMessage) bool {
+	return r.publish(BroadcastMessage{Message: msg, RoomID: roomID, HostsOnly: true})
+}
+
+func (r *RoomMap) publish(msg BroadcastMessage) bool {
+	roomID := msg.RoomID
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode frame for room %s: %v", roomID, err)
+		return false
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	if err := r.store.Publish(ctx, roomstore.Channel(roomstore.ScopeVideo, roomID), payload); err != nil {
+		log.Printf("Failed to publish frame for room %s: %v", roomID, err)
+		return false
+	}
+	return true
+}
+
+// CreateRoom registers a room with a fresh ID and the settings in info.
+// info.HostUserID is the account allowed to manage it through the API, or 0
+// for an anonymous room.
+func (r *RoomMap) CreateRoom(info roomstore.RoomInfo) (string, error) {
+	ctx, cancel := storeContext()
+	defer cancel()
 
 	// Use crypto/rand for better randomness in production
 	rgen := rand.New(rand.NewSource(time.Now().UnixNano()))
 	letters := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
-	var roomID string
 	for {
 		b := make([]rune, 8)
 		for i := range b {
 			b[i] = letters[rgen.Intn(len(letters))]
 		}
-		roomID = string(b)
+		info.ID = string(b)
+		info.CreatedAt = time.Now()
 
-		// Ensure room ID is unique
-		if _, exists := r.Map[roomID]; !exists {
-			break
+		// Ensure room ID is unique across every node
+		created, err := r.store.CreateRoom(ctx, info)
+		if err != nil {
+			return "", err
+		}
+		if created {
+			return info.ID, nil
 		}
 	}
+}
 
-	r.Map[roomID] = []Participant{}
-	
-	// Update metrics
-	monitoring.GlobalMetrics.IncrementRooms()
-	
-	return roomID
+// OpenRoom returns the store record of a room, creating it if needed. Rooms
+// the loader knows keep their settings and rooms it reports closed stay
+// closed; anything else becomes an anonymous room.
+func (r *RoomMap) OpenRoom(roomID string) (*roomstore.RoomInfo, error) {
+	ctx, cancel := storeContext()
+	defer cancel()
+	return r.openRoom(ctx, roomID)
+}
+
+func (r *RoomMap) openRoom(ctx context.Context, roomID string) (*roomstore.RoomInfo, error) {
+	info, err := r.store.GetRoom(ctx, roomID)
+	if !errors.Is(err, roomstore.ErrRoomNotFound) {
+		return info, err
+	}
+
+	info = &roomstore.RoomInfo{ID: roomID, CreatedAt: time.Now()}
+	if r.loader != nil {
+		loaded, err := r.loader(roomID)
+		if err != nil {
+			return nil, err
+		}
+		if loaded != nil {
+			info = loaded
+		}
+	}
+
+	// Another node may have created it first, so read back what was stored
+	if _, err := r.store.CreateRoom(ctx, *info); err != nil {
+		return nil, err
+	}
+	return r.store.GetRoom(ctx, roomID)
+}
+
+// UpdateSettings applies changed room settings to a live room. Rooms that
+// are not live pick them up from the loader when they are next opened.
+func (r *RoomMap) UpdateSettings(info roomstore.RoomInfo) error {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	_, err := r.store.UpdateRoom(ctx, info.ID, func(current *roomstore.RoomInfo) error {
+		current.MaxParticipants = info.MaxParticipants
+		current.PrivacyMode = info.PrivacyMode
+		current.ExpiresAt = info.ExpiresAt
+		current.WaitingRoom = info.WaitingRoom
+		current.ChatModeration = info.ChatModeration
+		return nil
+	})
+	if errors.Is(err, roomstore.ErrRoomNotFound) {
+		return nil
+	}
+	return err
+}
+
+// GetRoom returns the store record of a room
+func (r *RoomMap) GetRoom(roomID string) (*roomstore.RoomInfo, error) {
+	ctx, cancel := storeContext()
+	defer cancel()
+	return r.store.GetRoom(ctx, roomID)
+}
+
+// SetLocked locks or unlocks a room against new joins and tells everyone in it
+func (r *RoomMap) SetLocked(roomID string, locked bool) error {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	_, err := r.store.UpdateRoom(ctx, roomID, func(info *roomstore.RoomInfo) error {
+		info.Locked = locked
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.Broadcast(roomID, NewSignalMessage(MessageRoomLocked, RoomStatePayload{Locked: locked}), "")
+	return nil
 }
 
-func (r *RoomMap) InsertInRoom(roomID string, host bool, conn *websocket.Conn) {
+// localRoom returns the room tracked on this node, subscribing to its
+// frames the first time a local participant joins
+func (r *RoomMap) localRoom(roomID string) (*Room, error) {
+	r.Mutex.RLock()
+	room, ok := r.Map[roomID]
+	r.Mutex.RUnlock()
+	if ok {
+		return room, nil
+	}
+
+	room = &Room{
+		ID:           roomID,
+		Participants: []*Participant{},
+		CreatedAt:    time.Now(),
+		rooms:        r,
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	subscription, err := r.store.Subscribe(ctx, roomstore.Channel(roomstore.ScopeVideo, roomID), room.deliver, room.overflow)
+	if err != nil {
+		return nil, err
+	}
+	room.subscription = subscription
+
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 
-	clientID := uuid.New().String()
-	now := time.Now()
-	newParticipant := Participant{
-		Host:     host,
-		ID:       clientID,
-		Conn:     conn,
-		Mutex:    sync.Mutex{},
-		JoinedAt: now,
-		LastPing: now,
+	// Another join may have set the room up while we were subscribing
+	if existing, ok := r.Map[roomID]; ok {
+		subscription.Close()
+		return existing, nil
+	}
+
+	r.Map[roomID] = room
+	monitoring.GlobalMetrics.IncrementRooms()
+	return room, nil
+}
+
+// capacity is the most participants a room may hold
+func (r *RoomMap) capacity(info *roomstore.RoomInfo) int {
+	limit := r.MaxParticipants()
+	if info.MaxParticipants > 0 && info.MaxParticipants < limit {
+		return info.MaxParticipants
+	}
+	return limit
+}
+
+// InsertInRoom adds a connection to a room under the given participant ID
+// and returns the new participant with its writer running. The room is
+// created if it does not exist yet. If the room has a waiting room the
+// participant is put there instead; Participant.Waiting reports this.
+func (r *RoomMap) InsertInRoom(roomID, participantID string, identity auth.Identity, name string, conn Conn) (*Participant, error) {
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	info, err := r.openRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if info.Expired() {
+		return nil, ErrRoomExpired
+	}
+	if info.Locked {
+		return nil, ErrRoomLocked
+	}
+	owner := info.HostUserID != 0 && identity.UserID == info.HostUserID
+	if !owner && info.Banned(identity.UserID, identity.IP) {
+		return nil, ErrBanned
+	}
+	if info.PrivacyMode == roomstore.PrivacyMembers && identity.Guest() && !identity.Invited() {
+		return nil, ErrLoginRequired
+	}
+	if info.PrivacyMode == roomstore.PrivacyInvite && !owner && !identity.Invited() {
+		return nil, ErrInviteRequired
+	}
+
+	// Full rooms are turned away early; the slot itself is taken when the
+	// participant is added to the store
+	members, err := r.store.Members(ctx, roomstore.ScopeVideo, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) >= r.capacity(info) {
+		return nil, ErrRoomFull
+	}
+
+	// The owner and co-hosts host their room; anonymous rooms are hosted by
+	// whoever finds them empty
+	host := owner || identity.Role == auth.RoleCoHost
+	if info.HostUserID == 0 && len(members) == 0 {
+		host = true
+	}
+
+	newParticipant := newParticipant(participantID, host, conn)
+	newParticipant.UserID = identity.UserID
+	newParticipant.Name = name
+	newParticipant.IP = identity.IP
+
+	// Hosts skip the waiting room; everyone else waits to be admitted
+	if !info.WaitingRoom || host {
+		newParticipant.markAdmitted()
+	}
+
+	for {
+		room, err := r.localRoom(roomID)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Mutex.Lock()
+		// The room may have emptied and been dropped since we looked it up
+		if r.Map[roomID] != room {
+			r.Mutex.Unlock()
+			continue
+		}
+		if newParticipant.Waiting() {
+			room.Waiting = append(room.Waiting, newParticipant)
+		} else {
+			room.Participants = append(room.Participants, newParticipant)
+		}
+		r.Mutex.Unlock()
+		break
+	}
+
+	newParticipant.startWriter()
+
+	member := roomstore.Member{
+		ID:       newParticipant.ID,
+		NodeID:   roomstore.NodeID,
+		UserID:   newParticipant.UserID,
+		IP:       newParticipant.IP,
+		Name:     newParticipant.Name,
+		Host:     newParticipant.Host,
+		JoinedAt: newParticipant.JoinedAt,
+	}
+	if newParticipant.Waiting() {
+		err = r.store.AddMember(ctx, roomstore.ScopeLobby, roomID, member)
+	} else {
+		err = r.store.AddMemberWithin(ctx, roomstore.ScopeVideo, roomID, member, r.capacity(info))
+	}
+	if err != nil {
+		r.RemoveClient(roomID, conn)
+		return nil, err
+	}
+	if newParticipant.Waiting() {
+		r.startLobbyTimer(roomID, newParticipant)
 	}
 
-	r.Map[roomID] = append(r.Map[roomID], newParticipant)
-	
 	// Update metrics
 	monitoring.GlobalMetrics.IncrementConnections()
+
+	return newParticipant, nil
 }
 
 // Remove a client from a room safely
-func (r *RoomMap) RemoveClient(roomID string, conn *websocket.Conn) {
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
+func (r *RoomMap) RemoveClient(roomID string, conn Conn) {
+	var removed *Participant
+	var lobbyExit string
+	var media *sfuRoom
+	emptied := false
 
-	participants, ok := r.Map[roomID]
+	r.Mutex.Lock()
+	room, ok := r.Map[roomID]
 	if !ok {
+		r.Mutex.Unlock()
 		return
 	}
 
-	for i, participant := range participants {
+	for i, participant := range room.Participants {
 		if participant.Conn == conn {
 			// Remove participant from slice
-			r.Map[roomID] = append(participants[:i], participants[i+1:]...)
-			
+			room.Participants = append(room.Participants[:i], room.Participants[i+1:]...)
+			participant.Close()
+			removed = participant
+
 			// Update metrics
 			monitoring.GlobalMetrics.DecrementConnections()
 			break
 		}
 	}
+	for i, waiter := range room.Waiting {
+		if removed == nil && waiter.Conn == conn {
+			room.Waiting = append(room.Waiting[:i], room.Waiting[i+1:]...)
+			if waiter.lobbyTimer != nil {
+				waiter.lobbyTimer.Stop()
+			}
+			waiter.Close()
+			removed = waiter
+			lobbyExit = waiter.lobbyExit
+			if lobbyExit == "" {
+				lobbyExit = LobbyLeft
+			}
 
-	// If room empty after removal, delete the room
-	if len(r.Map[roomID]) == 0 {
+			monitoring.GlobalMetrics.DecrementConnections()
+			break
+		}
+	}
+
+	// If nobody on this node is left, stop following the room
+	media = room.media
+	if len(room.Participants) == 0 && len(room.Waiting) == 0 {
+		room.close()
 		delete(r.Map, roomID)
 		monitoring.GlobalMetrics.DecrementRooms()
+		emptied = true
+	}
+	r.Mutex.Unlock()
+
+	// Peer connections are closed outside the map lock
+	if media != nil {
+		if removed != nil {
+			media.leave(removed.ID)
+		}
+		if emptied {
+			media.close()
+		}
+	}
+
+	if removed == nil {
+		return
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	scope := roomstore.ScopeVideo
+	if lobbyExit != "" {
+		scope = roomstore.ScopeLobby
+		r.BroadcastHosts(roomID, lobbyLeftMessage(removed.ID, lobbyExit))
+	}
+
+	remaining, err := r.store.RemoveMember(ctx, scope, roomID, removed.ID)
+	if err != nil {
+		log.Printf("Failed to remove participant %s from room %s: %v", removed.ID, roomID, err)
+		return
+	}
+
+	// Forget the room once nobody is connected to it anywhere
+	if remaining == 0 {
+		if err := r.store.DeleteRoomIfEmpty(ctx, roomID); err != nil {
+			log.Printf("Failed to release room %s: %v", roomID, err)
+		}
 	}
 }
 
-func (r *RoomMap) DeleteRoom(roomID string) {
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
+// DeleteRoom closes a room and disconnects its participants on every node
+func (r *RoomMap) DeleteRoom(roomID string) error {
+	r.Broadcast(roomID, NewSignalMessage(MessageRoomClosed, nil), "")
 
-	delete(r.Map, roomID)
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	if err := r.store.DeleteRoom(ctx, roomID); err != nil {
+		return err
+	}
+	log.Printf("Room closed: %s", roomID)
+	return nil
 }
 
 // Update last ping time for a participant
-func (r *RoomMap) UpdateLastPing(roomID string, conn *websocket.Conn) {
+func (r *RoomMap) UpdateLastPing(roomID string, conn Conn) {
 	r.Mutex.Lock()
 	defer r.Mutex.Unlock()
 
-	participants, ok := r.Map[roomID]
+	room, ok := r.Map[roomID]
 	if !ok {
 		return
 	}
 
-	for i := range participants {
-		if participants[i].Conn == conn {
-			participants[i].LastPing = time.Now()
-			break
+	for _, participants := range [][]*Participant{room.Participants, room.Waiting} {
+		for _, participant := range participants {
+			if participant.Conn == conn {
+				participant.LastPing = time.Now()
+				return
+			}
 		}
 	}
 }
 
-// Get room statistics
+// Get room statistics for this node
 func (r *RoomMap) GetRoomStats() map[string]interface{} {
 	r.Mutex.RLock()
 	defer r.Mutex.RUnlock()
 
 	totalRooms := len(r.Map)
 	totalParticipants := 0
+	waitingParticipants := 0
 	activeRooms := 0
-
-	for _, participants := range r.Map {
-		totalParticipants += len(participants)
-		if len(participants) > 0 {
+	queuedFrames := 0
+	maxQueueDepth := 0
+	sfuRooms := 0
+	sfuSessions := 0
+	forwardedTracks := 0
+
+	for _, room := range r.Map {
+		totalParticipants += len(room.Participants)
+		waitingParticipants += len(room.Waiting)
+		if len(room.Participants) > 0 {
 			activeRooms++
 		}
+		if room.media != nil {
+			sessions, tracks := room.media.stats()
+			sfuRooms++
+			sfuSessions += sessions
+			forwardedTracks += tracks
+		}
+		for _, participant := range room.Participants {
+			depth := participant.QueueDepth()
+			queuedFrames += depth
+			if depth > maxQueueDepth {
+				maxQueueDepth = depth
+			}
+		}
 	}
 
 	return map[string]interface{}{
-		"totalRooms":        totalRooms,
-		"activeRooms":       activeRooms,
-		"totalParticipants": totalParticipants,
+		"totalRooms":          totalRooms,
+		"activeRooms":         activeRooms,
+		"totalParticipants":   totalParticipants,
+		"waitingParticipants": waitingParticipants,
+		"queuedFrames":        queuedFrames,
+		"maxQueueDepth":       maxQueueDepth,
+		"sfuRooms":            sfuRooms,
+		"sfuSessions":         sfuSessions,
+		"forwardedTracks":     forwardedTracks,
+		"node":                roomstore.NodeID,
 	}
 }
 
 // Cleanup routine to remove stale rooms and participants
-func (r *RoomMap) cleanupRoutine() {
+func (r *RoomMap) cleanupRoutine(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute) // Run every 5 minutes
 	defer ticker.Stop()
 
-	for range ticker.C {
-		r.cleanup()
+	for {
+		select {
+		case <-ticker.C:
+			r.cleanup()
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 func (r *RoomMap) cleanup() {
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
-
 	now := time.Now()
-	roomsToDelete := []string{}
 
-	for roomID, participants := range r.Map {
-		activeParticipants := []Participant{}
-
-		for _, participant := range participants {
-			// Remove participants that haven't pinged in 2 minutes
-			if now.Sub(participant.LastPing) < 2*time.Minute {
-				activeParticipants = append(activeParticipants, participant)
-			} else {
-				// Close stale connection
-				participant.Conn.Close()
+	r.Mutex.RLock()
+	for _, room := range r.Map {
+		for _, participant := range room.Participants {
+			// Disconnect participants that haven't pinged in 2 minutes. Closing
+			// the writer ends their handler, which removes them from the room.
+			if now.Sub(participant.LastPing) >= 2*time.Minute {
+				participant.Close()
 			}
 		}
-
-		if len(activeParticipants) == 0 {
-			// Mark room for deletion if no active participants
-			roomsToDelete = append(roomsToDelete, roomID)
-		} else {
-			r.Map[roomID] = activeParticipants
-		}
 	}
+	r.Mutex.RUnlock()
 
-	// Delete empty rooms
-	for _, roomID := range roomsToDelete {
-		delete(r.Map, roomID)
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	// Delete rooms that were created but nobody has been in for a while
+	rooms, err := r.store.ListRooms(ctx)
+	if err != nil {
+		log.Printf("Failed to list rooms for cleanup: %v", err)
+		return
+	}
+	for _, info := range rooms {
+		if now.Sub(info.CreatedAt) < emptyRoomTTL {
+			continue
+		}
+		if err := r.store.DeleteRoomIfEmpty(ctx, info.ID); err != nil {
+			log.Printf("Failed to clean up room %s: %v", info.ID, err)
+		}
 	}
 }
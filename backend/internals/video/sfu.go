@@ -0,0 +1,609 @@
+package video
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"seaside/lib/roomstore"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// defaultSFUThreshold is the room size above which calls move to the SFU
+	defaultSFUThreshold = 4
+
+	// defaultSFUParticipants is the largest room size in SFU mode unless
+	// SFU_MAX_PARTICIPANTS says otherwise
+	defaultSFUParticipants = 25
+
+	// keyframeInterval is how often publishers are asked for a keyframe, so
+	// new subscribers do not wait long for a picture
+	keyframeInterval = 3 * time.Second
+
+	// rtpBufferSize fits one RTP packet at the usual MTU
+	rtpBufferSize = 1500
+)
+
+// SFUConfig configures the selective forwarding unit. Each node forwards
+// media only between participants connected to it, so deployments with
+// several nodes should route all sockets of a room to the same node.
+type SFUConfig struct {
+	Threshold       int      // Rooms switch to the SFU once they hold more participants than this
+	MaxParticipants int      // Largest room size in SFU mode
+	PublicIPs       []string // Addresses advertised in the server's ICE candidates, e.g. behind 1:1 NAT
+	MinPort         uint16   // UDP port range for media; any free port when unset
+	MaxPort         uint16   //
+}
+
+// SFUConfigFromEnv reads the SFU settings. It returns nil when SFU_ENABLED
+// is not set, in which case every call stays a mesh.
+func SFUConfigFromEnv() (*SFUConfig, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("SFU_ENABLED")); !enabled {
+		return nil, nil
+	}
+
+	config := &SFUConfig{
+		Threshold:       defaultSFUThreshold,
+		MaxParticipants: defaultSFUParticipants,
+	}
+
+	if threshold := os.Getenv("SFU_THRESHOLD"); threshold != "" {
+		value, err := strconv.Atoi(threshold)
+		if err != nil || value < 1 || value > MaxMeshParticipants {
+			return nil, fmt.Errorf("invalid SFU_THRESHOLD %q, expected 1 to %d", threshold, MaxMeshParticipants)
+		}
+		config.Threshold = value
+	}
+	if max := os.Getenv("SFU_MAX_PARTICIPANTS"); max != "" {
+		value, err := strconv.Atoi(max)
+		if err != nil || value < MaxMeshParticipants {
+			return nil, fmt.Errorf("invalid SFU_MAX_PARTICIPANTS %q, expected at least %d", max, MaxMeshParticipants)
+		}
+		config.MaxParticipants = value
+	}
+	for _, ip := range strings.Split(os.Getenv("SFU_PUBLIC_IP"), ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			config.PublicIPs = append(config.PublicIPs, ip)
+		}
+	}
+	if ports := os.Getenv("SFU_UDP_PORTS"); ports != "" {
+		min, max, found := strings.Cut(ports, "-")
+		minPort, minErr := strconv.ParseUint(min, 10, 16)
+		maxPort, maxErr := strconv.ParseUint(max, 10, 16)
+		if !found || minErr != nil || maxErr != nil || minPort == 0 || minPort > maxPort {
+			return nil, fmt.Errorf("invalid SFU_UDP_PORTS %q, expected e.g. 50000-50100", ports)
+		}
+		config.MinPort, config.MaxPort = uint16(minPort), uint16(maxPort)
+	}
+
+	return config, nil
+}
+
+// EnableSFU lets rooms that outgrow the mesh switch to the server's SFU
+func (r *RoomMap) EnableSFU(config SFUConfig) error {
+	settings := webrtc.SettingEngine{}
+	if len(config.PublicIPs) > 0 {
+		settings.SetNAT1To1IPs(config.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	if config.MinPort != 0 {
+		if err := settings.SetEphemeralUDPPortRange(config.MinPort, config.MaxPort); err != nil {
+			return err
+		}
+	}
+
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return err
+	}
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		return err
+	}
+
+	r.sfu = &config
+	r.sfuAPI = webrtc.NewAPI(
+		webrtc.WithSettingEngine(settings),
+		webrtc.WithMediaEngine(media),
+		webrtc.WithInterceptorRegistry(interceptors),
+	)
+	log.Printf("SFU enabled for rooms above %d participants", config.Threshold)
+	return nil
+}
+
+// MaxParticipants is the largest room size this server supports
+func (r *RoomMap) MaxParticipants() int {
+	if r.sfu != nil {
+		return r.sfu.MaxParticipants
+	}
+	return MaxMeshParticipants
+}
+
+// roomMode reports whether a room uses the SFU, switching it over once it
+// holds more participants than the threshold. switched is true for the
+// join that caused the switch. Rooms stay on the SFU until they are released.
+func (r *RoomMap) roomMode(roomID string) (sfu bool, switched bool) {
+	if r.sfu == nil {
+		return false, false
+	}
+
+	ctx, cancel := storeContext()
+	defer cancel()
+
+	info, err := r.store.GetRoom(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to load room %s: %v", roomID, err)
+		return false, false
+	}
+	if info.SFU {
+		return true, false
+	}
+
+	members, err := r.store.Members(ctx, roomstore.ScopeVideo, roomID)
+	if err != nil {
+		log.Printf("Failed to list members of room %s: %v", roomID, err)
+		return false, false
+	}
+	if len(members) <= r.sfu.Threshold {
+		return false, false
+	}
+
+	switched, err = r.switchToSFU(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to switch room %s to the SFU: %v", roomID, err)
+		return false, false
+	}
+	if switched {
+		log.Printf("Room %s has %d participants, switching to the SFU", roomID, len(members))
+	}
+	return true, switched
+}
+
+// switchToSFU moves a room to the SFU for good. It returns false if another
+// node had switched it already, in which case that node told the room.
+func (r *RoomMap) switchToSFU(ctx context.Context, roomID string) (bool, error) {
+	switched := false
+	_, err := r.store.UpdateRoom(ctx, roomID, func(info *roomstore.RoomInfo) error {
+		switched = !info.SFU
+		info.SFU = true
+		return nil
+	})
+	return switched, err
+}
+
+// mediaRoom returns the SFU state of a room on this node, creating it on
+// first use. It returns nil if nobody in the room is connected here.
+func (r *RoomMap) mediaRoom(roomID string) *sfuRoom {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	room, ok := r.Map[roomID]
+	if !ok || r.sfuAPI == nil {
+		return nil
+	}
+	if room.media == nil {
+		room.media = &sfuRoom{
+			roomID:   roomID,
+			api:      r.sfuAPI,
+			sessions: make(map[string]*sfuSession),
+		}
+	}
+	return room.media
+}
+
+// startSFU connects a participant to the SFU. The server sends the offer.
+func (r *RoomMap) startSFU(roomID string, participant *Participant) {
+	media := r.mediaRoom(roomID)
+	if media == nil {
+		return
+	}
+	if err := media.join(participant); err != nil {
+		log.Printf("Failed to connect %s to the SFU of room %s: %v", participant.ID, roomID, err)
+		participant.Enqueue(NewErrorMessage(ErrCodeUnavailable, "could not connect you to the media server", 0))
+	}
+}
+
+// handleSFUSignal applies a frame a participant addressed to SFUPeerID
+func (r *RoomMap) handleSFUSignal(roomID string, participant *Participant, signal *SignalMessage) *ProtocolError {
+	r.Mutex.RLock()
+	var media *sfuRoom
+	if room, ok := r.Map[roomID]; ok {
+		media = room.media
+	}
+	r.Mutex.RUnlock()
+
+	if media == nil {
+		return protocolErrorf(ErrCodePeerNotFound, "this room is not using the SFU")
+	}
+	return media.signal(participant, signal)
+}
+
+// sfuRoom forwards media between the participants of a room connected to
+// this node. Every participant has one peer connection with the server that
+// carries the tracks it publishes and the tracks of everyone else.
+type sfuRoom struct {
+	mutex     sync.Mutex
+	roomID    string
+	api       *webrtc.API
+	sessions  map[string]*sfuSession // Participant ID -> session
+	recording *recording             // Set while the room is recorded
+	closed    bool
+
+	// Frames for participants are sent after the mutex is released, so a
+	// participant slow to take them never holds up the room
+	outbox    []outgoing
+	sendMutex sync.Mutex // Keeps frames in order while they are sent
+}
+
+// outgoing is a frame waiting for the room's mutex to be released
+type outgoing struct {
+	participant *Participant
+	msg         SignalMessage
+}
+
+// sfuSession is the server's peer connection with one participant
+type sfuSession struct {
+	participant *Participant
+	pc          *webrtc.PeerConnection
+	published   map[string]*sfuTrack            // Tracks the participant sends, by track ID
+	subscribed  map[*sfuTrack]*webrtc.RTPSender // Tracks forwarded to the participant
+	candidates  []webrtc.ICECandidateInit       // Candidates that arrived before the answer
+	renegotiate bool                            // An offer is due once signalling is stable
+}
+
+// sfuTrack is a published track, forwarded to every other participant
+type sfuTrack struct {
+	remote    *webrtc.TrackRemote
+	local     *webrtc.TrackLocalStaticRTP
+	publisher *Participant
+	recorder  atomic.Pointer[trackRecorder] // Set while the track is recorded
+}
+
+// send queues a frame for a participant. The caller holds the mutex; the
+// frame goes out when unlock releases it.
+func (m *sfuRoom) send(participant *Participant, msg SignalMessage) {
+	m.outbox = append(m.outbox, outgoing{participant: participant, msg: msg})
+}
+
+// unlock releases the mutex, then sends the frames queued while it was held
+func (m *sfuRoom) unlock() {
+	frames := m.outbox
+	m.outbox = nil
+	m.sendMutex.Lock()
+	m.mutex.Unlock()
+	defer m.sendMutex.Unlock()
+
+	for _, frame := range frames {
+		frame.participant.Enqueue(frame.msg)
+	}
+}
+
+// join opens a session for a participant and offers it every track in the room
+func (m *sfuRoom) join(participant *Participant) error {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	if m.closed {
+		return nil
+	}
+	if _, ok := m.sessions[participant.ID]; ok {
+		return nil
+	}
+
+	pc, err := m.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+
+	// Receive whatever the participant publishes
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		init := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}
+		if _, err := pc.AddTransceiverFromKind(kind, init); err != nil {
+			pc.Close()
+			return err
+		}
+	}
+
+	session := &sfuSession{
+		participant: participant,
+		pc:          pc,
+		published:   make(map[string]*sfuTrack),
+		subscribed:  make(map[*sfuTrack]*webrtc.RTPSender),
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		msg := NewSignalMessage(MessageICECandidate, ICECandidate(candidate.ToJSON()))
+		msg.From = SFUPeerID
+
+		// Queued behind the offer it belongs to
+		m.mutex.Lock()
+		m.send(participant, msg)
+		m.unlock()
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		m.forward(session, remote)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		// Reconnecting the socket gets the client a fresh session
+		if state == webrtc.PeerConnectionStateFailed {
+			log.Printf("SFU connection with %s in room %s failed", participant.ID, m.roomID)
+			participant.Close()
+		}
+	})
+
+	m.sessions[participant.ID] = session
+	log.Printf("Participant %s joined the SFU of room %s", participant.ID, m.roomID)
+	m.negotiate()
+	return nil
+}
+
+// leave closes a participant's session and stops forwarding its tracks
+func (m *sfuRoom) leave(participantID string) {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	session, ok := m.sessions[participantID]
+	if !ok {
+		return
+	}
+	delete(m.sessions, participantID)
+	if err := session.pc.Close(); err != nil {
+		log.Printf("Failed to close SFU connection with %s: %v", participantID, err)
+	}
+	m.negotiate()
+}
+
+// close ends every session once nobody in the room is left on this node,
+// saving the recording if there is one
+func (m *sfuRoom) close() {
+	m.mutex.Lock()
+	m.closed = true
+	for id, session := range m.sessions {
+		session.pc.Close()
+		delete(m.sessions, id)
+	}
+	rec := m.endRecording()
+	m.mutex.Unlock()
+
+	if rec != nil {
+		log.Printf("Room %s ended, saving recording %s", m.roomID, rec.session)
+		rec.saveFiles()
+	}
+}
+
+// signal applies an answer or candidate from a participant
+func (m *sfuRoom) signal(participant *Participant, signal *SignalMessage) *ProtocolError {
+	m.mutex.Lock()
+	defer m.unlock()
+
+	session, ok := m.sessions[participant.ID]
+	if !ok {
+		return protocolErrorf(ErrCodePeerNotFound, "you are not connected to the SFU")
+	}
+
+	switch signal.Type {
+	case MessageAnswer:
+		var sd SessionDescription
+		json.Unmarshal(signal.Payload, &sd) // Validated when decoded
+		answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sd.SDP}
+		if err := session.pc.SetRemoteDescription(answer); err != nil {
+			return protocolErrorf(ErrCodeInvalidPayload, "answer rejected: %v", err)
+		}
+		for _, candidate := range session.candidates {
+			if err := session.pc.AddICECandidate(candidate); err != nil {
+				log.Printf("Dropped SFU candidate from %s: %v", participant.ID, err)
+			}
+		}
+		session.candidates = nil
+
+		// Changes made while the offer was out go in the next one
+		m.negotiate()
+	case MessageICECandidate:
+		var candidate ICECandidate
+		json.Unmarshal(signal.Payload, &candidate) // Validated when decoded
+		if session.pc.RemoteDescription() == nil {
+			session.candidates = append(session.candidates, webrtc.ICECandidateInit(candidate))
+			return nil
+		}
+		if err := session.pc.AddICECandidate(webrtc.ICECandidateInit(candidate)); err != nil {
+			return protocolErrorf(ErrCodeInvalidPayload, "candidate rejected: %v", err)
+		}
+	case MessageOffer:
+		return protocolErrorf(ErrCodeInvalidPayload, "the server makes the offers in SFU rooms")
+	default:
+		return protocolErrorf(ErrCodeUnknownType, "%s cannot be sent to the SFU", signal.Type)
+	}
+	return nil
+}
+
+// negotiate brings every session's subscriptions up to date and offers the
+// changes. Sessions still waiting for an answer get their offer once it
+// arrives. The caller holds the mutex.
+func (m *sfuRoom) negotiate() {
+	for _, session := range m.sessions {
+		if m.subscribe(session) || session.pc.LocalDescription() == nil {
+			session.renegotiate = true
+		}
+		if session.renegotiate && session.pc.SignalingState() == webrtc.SignalingStateStable {
+			m.offer(session)
+		}
+	}
+}
+
+// subscribe forwards every track published by someone else to a session
+// and drops tracks whose publisher is gone. It reports whether anything
+// changed.
+func (m *sfuRoom) subscribe(session *sfuSession) bool {
+	wanted := make(map[*sfuTrack]bool)
+	for _, other := range m.sessions {
+		if other == session {
+			continue
+		}
+		for _, track := range other.published {
+			wanted[track] = true
+		}
+	}
+
+	changed := false
+	for track, sender := range session.subscribed {
+		if wanted[track] {
+			continue
+		}
+		if err := session.pc.RemoveTrack(sender); err != nil {
+			log.Printf("Failed to stop forwarding %s to %s: %v", track.local.ID(), session.participant.ID, err)
+		}
+		delete(session.subscribed, track)
+		changed = true
+	}
+	for track := range wanted {
+		if _, ok := session.subscribed[track]; ok {
+			continue
+		}
+		sender, err := session.pc.AddTrack(track.local)
+		if err != nil {
+			log.Printf("Failed to forward %s to %s: %v", track.local.ID(), session.participant.ID, err)
+			continue
+		}
+		go drainRTCP(sender)
+		session.subscribed[track] = sender
+		changed = true
+	}
+	return changed
+}
+
+// forward copies a published track to its subscribers until the publisher
+// stops sending or leaves
+func (m *sfuRoom) forward(session *sfuSession, remote *webrtc.TrackRemote) {
+	publisherID := session.participant.ID
+
+	// Forwarded streams carry the publisher's participant ID, so clients can
+	// tell whose media they receive
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), publisherID)
+	if err != nil {
+		log.Printf("Failed to forward %s track from %s: %v", remote.Kind(), publisherID, err)
+		return
+	}
+	track := &sfuTrack{remote: remote, local: local, publisher: session.participant}
+
+	m.mutex.Lock()
+	if m.sessions[publisherID] != session {
+		m.mutex.Unlock()
+		return
+	}
+	session.published[remote.ID()] = track
+	if m.recording != nil {
+		m.recording.record(track)
+	}
+	m.negotiate()
+	m.unlock()
+
+	log.Printf("Forwarding %s track from %s in room %s", remote.Kind(), publisherID, m.roomID)
+
+	defer func() {
+		m.mutex.Lock()
+		if session.published[remote.ID()] == track {
+			delete(session.published, remote.ID())
+			m.negotiate()
+		}
+		if recorder := track.recorder.Swap(nil); recorder != nil && m.recording != nil {
+			m.recording.finish(recorder)
+		}
+		m.unlock()
+	}()
+
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
+		done := make(chan struct{})
+		defer close(done)
+		go session.requestKeyframes(remote, done)
+	}
+
+	buf := make([]byte, rtpBufferSize)
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+		// ErrClosedPipe only means a subscriber went away
+		if _, err := local.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+		if recorder := track.recorder.Load(); recorder != nil {
+			recorder.write(buf[:n])
+		}
+	}
+}
+
+// offer sends a session's current state to its participant. The caller
+// holds the mutex.
+func (m *sfuRoom) offer(s *sfuSession) {
+	s.renegotiate = false
+
+	offer, err := s.pc.CreateOffer(nil)
+	if err == nil {
+		err = s.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("Failed to create SFU offer for %s: %v", s.participant.ID, err)
+		s.participant.Close()
+		return
+	}
+
+	msg := NewSignalMessage(MessageOffer, SessionDescription{Type: offer.Type.String(), SDP: offer.SDP})
+	msg.From = SFUPeerID
+	m.send(s.participant, msg)
+}
+
+// requestKeyframes periodically asks a publisher for a video keyframe
+func (s *sfuSession) requestKeyframes(remote *webrtc.TrackRemote, done <-chan struct{}) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			pli := &rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())}
+			if err := s.pc.WriteRTCP([]rtcp.Packet{pli}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// drainRTCP reads a sender's incoming RTCP so interceptors such as NACK
+// keep working
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, rtpBufferSize)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// stats counts the sessions and forwarded tracks of the room on this node
+func (m *sfuRoom) stats() (sessions, tracks int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, session := range m.sessions {
+		tracks += len(session.published)
+	}
+	return len(m.sessions), tracks
+}
@@ -0,0 +1,51 @@
+package video
+
+import (
+	"context"
+	"log"
+
+	"seaside/lib/drain"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// Drain prepares the server to shut down: it stops taking joins, tells
+// everyone in a call or waiting room on this node to reconnect and waits
+// until they have all left, or ctx is done. Participants' queues are
+// written out before their connections close.
+func (r *RoomMap) Drain(ctx context.Context) error {
+	r.gate.Close()
+
+	r.Mutex.RLock()
+	var participants []*Participant
+	for _, room := range r.Map {
+		participants = append(participants, room.Participants...)
+		participants = append(participants, room.Waiting...)
+	}
+	r.Mutex.RUnlock()
+
+	log.Printf("Draining %d participants before shutdown", len(participants))
+	for _, participant := range participants {
+		restart(participant)
+	}
+	return r.gate.Wait(ctx)
+}
+
+// Draining reports whether the server has started shutting down
+func (r *RoomMap) Draining() bool {
+	return r.gate.Closed()
+}
+
+// restart tells a participant to reconnect, then disconnects it. The close
+// code tells clients that reconnecting is expected.
+func restart(participant *Participant) {
+	participant.Enqueue(restartingFrame())
+	participant.CloseWithCode(websocket.CloseServiceRestart)
+}
+
+// restartingFrame tells a client when to reconnect
+func restartingFrame() SignalMessage {
+	return NewSignalMessage(MessageServerRestarting, RestartingPayload{
+		RetryAfter: drain.RetryAfter().Milliseconds(),
+	})
+}
@@ -1,12 +1,18 @@
 package video
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"sync"
-	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/ratelimit"
+	"seaside/lib/roomstore"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 )
 
 var AllRooms RoomMap
@@ -15,54 +21,38 @@ type response struct {
 	RoomID string `json:"roomID"`
 }
 
+// BroadcastMessage is the envelope published to a room's store channel
 type BroadcastMessage struct {
-	Message map[string]interface{}
-	RoomID  string
-	Client  *websocket.Conn
+	Message   SignalMessage `json:"message"`
+	RoomID    string        `json:"roomId"`
+	Exclude   string        `json:"exclude,omitempty"`   // participant that must not receive the frame
+	HostsOnly bool          `json:"hostsOnly,omitempty"` // only deliver to hosts
 }
 
+// maxNameLength bounds the name a joiner shows to hosts while knocking
+const maxNameLength = 64
+
+// signalLimits meters the frames clients send on /join-room
+var signalLimits = ratelimit.NewGroup(ratelimit.DefaultPolicy())
+
 // This is unused in current code but kept for compatibility
 type Client struct {
 	Conn  *websocket.Conn
 	Mutex sync.Mutex
 }
 
-var (
-	broadcast     = make(chan BroadcastMessage, 100) // Buffered channel
-	broadcastOnce sync.Once
-)
-
-func broadcaster() {
-	for msg := range broadcast {
-		clients := AllRooms.Get(msg.RoomID)
-		log.Printf("Broadcasting to %d clients in room %s", len(clients), msg.RoomID)
-		
-		for i := 0; i < len(clients); i++ {
-			client := &clients[i]
-			// Don't send message back to sender
-			if client.Conn == msg.Client {
-				continue
-			}
-
-			client.Mutex.Lock()
-			err := client.Conn.WriteJSON(msg.Message)
-			client.Mutex.Unlock()
-
-			if err != nil {
-				log.Printf("Broadcast error for room %s: %v. Closing connection.", msg.RoomID, err)
-				client.Conn.Close()
-				AllRooms.RemoveClient(msg.RoomID, client.Conn)
-			}
-		}
-	}
-}
-
 func CreateRoomRequestHandler(c *fiber.Ctx) error {
-	roomID := AllRooms.CreateRoom()
+	roomID, err := AllRooms.CreateRoom(roomstore.RoomInfo{})
+	if err != nil {
+		log.Printf("Failed to create room: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create room"})
+	}
 	log.Printf("Room created: %s", roomID)
 	return c.JSON(response{RoomID: roomID})
 }
 
+// WebSocketJoinHandler serves /join-room, the signalling-only socket kept
+// for clients that do not use the room socket
 func WebSocketJoinHandler(c *websocket.Conn) {
 	roomID := c.Query("roomID")
 	if roomID == "" {
@@ -73,152 +63,277 @@ func WebSocketJoinHandler(c *websocket.Conn) {
 
 	log.Printf("New WebSocket connection for room: %s", roomID)
 
-	// Check if room exists, if not create it
-	participants := AllRooms.Get(roomID)
-
-	// Add new participant to the room
-	AllRooms.InsertInRoom(roomID, false, c)
-
-	// Get updated participants list
-	participants = AllRooms.Get(roomID)
-
-	// Notify ALL participants when someone joins
-	if len(participants) > 1 {
-		log.Printf("Notifying all participants in room %s that someone joined", roomID)
-		
-		// Notify the new participant
-		err := c.WriteJSON(map[string]interface{}{
-			"join": true,
-		})
+	// An invite link admits its holder with the role it was issued for
+	identity := auth.WebSocketIdentity(c)
+	if invite := c.Query("invite"); invite != "" {
+		role, err := AllRooms.CheckInvite(roomID, invite)
 		if err != nil {
-			log.Printf("Error notifying new participant: %v", err)
+			frame, _ := RejectionFrame(err)
+			c.WriteJSON(frame)
+			c.Close()
+			return
 		}
-		
-		// Notify existing participants
-		joinMsg := BroadcastMessage{
-			Message: map[string]interface{}{
-				"join": true,
-			},
-			RoomID: roomID,
-			Client: c, // Exclude the new joiner from broadcast
-		}
-		
-		select {
-		case broadcast <- joinMsg:
-		case <-time.After(5 * time.Second):
-			log.Printf("Failed to broadcast join message for room %s", roomID)
+		identity.Role = role
+	}
+
+	participant, err := AllRooms.Join(roomID, uuid.New().String(), identity, c.Query("name"), c)
+	if err != nil {
+		if frame, ok := RejectionFrame(err); ok {
+			c.WriteJSON(frame)
 		}
+		c.Close()
+		return
 	}
 
 	// Set up ping/pong for connection health monitoring
 	c.SetPongHandler(func(string) error {
-		log.Printf("Received pong from room %s", roomID)
 		AllRooms.UpdateLastPing(roomID, c)
 		return nil
 	})
 
-	// Start broadcaster once
-	broadcastOnce.Do(func() {
-		go broadcaster()
-	})
+	// Reject oversized frames before they are decoded
+	c.SetReadLimit(MaxMessageSize)
 
-	// Start heartbeat for this connection
-	heartbeatTicker := time.NewTicker(30 * time.Second)
-	defer heartbeatTicker.Stop()
-
-	// Channel to signal when to stop heartbeat
-	done := make(chan bool, 1)
-
-	// Heartbeat goroutine
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Heartbeat goroutine panic for room %s: %v", roomID, r)
-			}
-		}()
-
-		for {
-			select {
-			case <-heartbeatTicker.C:
-				if err := c.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-					log.Printf("Heartbeat failed for room %s: %v", roomID, err)
-					select {
-					case done <- true:
-					default:
-					}
-					return
-				}
-			case <-done:
-				return
-			}
-		}
-	}()
+	limiter := signalLimits.Connect(ratelimit.UserKey(identity.UserID))
+	defer limiter.Close()
 
 	// Listen for messages from this participant
 	for {
-		var msg BroadcastMessage
-		err := c.ReadJSON(&msg.Message)
+		_, data, err := c.ReadMessage()
 		if err != nil {
 			log.Printf("Read error in room %s: %v", roomID, err)
 			break
 		}
+		if !AllRooms.HandleFrame(roomID, participant, limiter, data) {
+			break
+		}
+	}
+
+	AllRooms.Leave(roomID, participant)
+}
+
+// RejectionFrame returns the error frame telling a client why Join or
+// CheckInvite turned it away, if the reason is one to share
+func RejectionFrame(err error) (SignalMessage, bool) {
+	switch {
+	case errors.Is(err, ErrInvalidInvite):
+		return NewErrorMessage(ErrCodeInvalidInvite, "this invite link is invalid or has expired", 0), true
+	case errors.Is(err, ErrRoomFull):
+		return NewErrorMessage(ErrCodeRoomFull, "room has reached its participant limit", 0), true
+	case errors.Is(err, ErrBanned):
+		return NewErrorMessage(ErrCodeBanned, "you have been banned from this room", 0), true
+	case errors.Is(err, ErrLoginRequired):
+		return NewErrorMessage(ErrCodeLoginRequired, "sign in to join this room", 0), true
+	case errors.Is(err, ErrInviteRequired):
+		return NewErrorMessage(ErrCodeInviteRequired, "you need an invite to join this room", 0), true
+	case errors.Is(err, roomstore.ErrRoomClosed):
+		return NewErrorMessage(ErrCodeRoomClosed, "this room no longer exists", 0), true
+	case errors.Is(err, ErrRoomExpired):
+		return NewErrorMessage(ErrCodeRoomExpired, "this room has expired", 0), true
+	case errors.Is(err, ErrRoomLocked):
+		return NewErrorMessage(ErrCodeRoomLocked, "the host has locked this room", 0), true
+	case errors.Is(err, ErrServerRestarting):
+		return restartingFrame(), true
+	}
+	return SignalMessage{}, false
+}
 
-		// Handle ping messages from client
-		if msgType, ok := msg.Message["type"].(string); ok && msgType == "ping" {
-			// Send pong response
-			err := c.WriteJSON(map[string]interface{}{
-				"type": "pong",
-			})
-			if err != nil {
-				log.Printf("Error sending pong to room %s: %v", roomID, err)
-			}
-			AllRooms.UpdateLastPing(roomID, c)
-			continue
+// Join puts a connection in a room's call, or in its waiting room, and
+// tells the room. Frames the client sends go to HandleFrame; once they
+// stop, Leave takes the participant out again.
+func (r *RoomMap) Join(roomID, participantID string, identity auth.Identity, name string, conn Conn) (*Participant, error) {
+	if len(name) > maxNameLength {
+		name = name[:maxNameLength]
+	}
+	if !r.gate.Enter() {
+		return nil, ErrServerRestarting
+	}
+
+	// Add new participant to the room
+	participant, err := r.InsertInRoom(roomID, participantID, identity, name, conn)
+	if err != nil {
+		r.gate.Leave()
+		log.Printf("Rejected participant from room %s: %v", roomID, err)
+		return nil, err
+	}
+
+	// Shutdown began while joining and may have missed this participant
+	if r.gate.Closed() {
+		restart(participant)
+		return participant, nil
+	}
+
+	if participant.Waiting() {
+		// Hold the joiner until a host admits them; the host's admit announces them
+		log.Printf("Participant %s is waiting to join room %s", participant.ID, roomID)
+		participant.Enqueue(NewSignalMessage(MessageLobbyWaiting, nil))
+		knock := NewSignalMessage(MessageKnock, KnockPayload{ID: participant.ID, UserID: participant.UserID, Name: participant.Name})
+		knock.From = participant.ID
+		r.BroadcastHosts(roomID, knock)
+	} else {
+		r.announceJoin(roomID, participant)
+	}
+	return participant, nil
+}
+
+// HandleFrame acts on a signalling frame a participant sent. It returns
+// false once the participant is being disconnected.
+func (r *RoomMap) HandleFrame(roomID string, participant *Participant, limiter *ratelimit.Limiter, data []byte) bool {
+	signal, err := DecodeSignalMessage(data)
+	if !allowFrame(limiter, participant, signal) {
+		return !participant.closing()
+	}
+	if err != nil {
+		// Tell the sender why the frame was rejected instead of relaying it
+		var seq uint64
+		if signal != nil {
+			seq = signal.Seq
 		}
+		code, message := ErrCodeMalformed, err.Error()
+		if perr, ok := err.(*ProtocolError); ok {
+			code, message = perr.Code, perr.Message
+		}
+		log.Printf("Rejected signalling frame in room %s: %v", roomID, err)
+		participant.Enqueue(NewErrorMessage(code, message, seq))
+		return true
+	}
+
+	// Handle ping messages from client
+	if signal.Type == MessagePing {
+		// Send pong response
+		participant.Enqueue(NewSignalMessage(MessagePong, nil))
+		r.UpdateLastPing(roomID, participant.Conn)
+		return true
+	}
+
+	// People in the waiting room can only keep their connection alive
+	if participant.Waiting() {
+		participant.Enqueue(NewErrorMessage(ErrCodeNotAdmitted, "wait for a host to admit you", signal.Seq))
+		return true
+	}
 
-		msg.Client = c
-		msg.RoomID = roomID
+	// The sender is always the participant owning this connection
+	signal.From = participant.ID
 
-		// Log the message type for debugging
-		if _, hasOffer := msg.Message["offer"]; hasOffer {
-			log.Printf("Broadcasting offer in room %s", roomID)
-		} else if _, hasAnswer := msg.Message["answer"]; hasAnswer {
-			log.Printf("Broadcasting answer in room %s", roomID)
-		} else if _, hasCandidate := msg.Message["iceCandidate"]; hasCandidate {
-			log.Printf("Broadcasting ICE candidate in room %s", roomID)
+	// In SFU rooms media is negotiated with the server
+	if signal.To == SFUPeerID {
+		if err := r.handleSFUSignal(roomID, participant, signal); err != nil {
+			log.Printf("Rejected %s from %s for the SFU of room %s: %v", signal.Type, participant.ID, roomID, err)
+			participant.Enqueue(NewErrorMessage(err.Code, err.Message, signal.Seq))
 		}
+		return true
+	}
 
-		// Broadcast message with timeout to prevent blocking
-		select {
-		case broadcast <- msg:
-		case <-time.After(5 * time.Second):
-			log.Printf("Broadcast channel full, dropping message from room %s", roomID)
+	// Waiting room and moderation commands
+	if hostMessageTypes[signal.Type] {
+		if err := r.handleHostCommand(roomID, participant, signal); err != nil {
+			log.Printf("Rejected %s from %s in room %s: %v", signal.Type, participant.ID, roomID, err)
+			participant.Enqueue(NewErrorMessage(err.Code, err.Message, signal.Seq))
 		}
+		return true
+	}
+
+	// Targeted frames must address someone else who is still in the room
+	if signal.To != "" && (signal.To == participant.ID || !r.HasMember(roomID, signal.To)) {
+		participant.Enqueue(NewErrorMessage(ErrCodePeerNotFound, fmt.Sprintf("peer %q is not in this room", signal.To), signal.Seq))
+		return true
 	}
 
-	// Signal heartbeat to stop
-	select {
-	case done <- true:
-	default:
+	if signal.To != "" {
+		log.Printf("Relaying %s in room %s to %s", signal.Type, roomID, signal.To)
+	} else {
+		log.Printf("Broadcasting %s in room %s", signal.Type, roomID)
 	}
 
+	// Publish the frame to the room, wherever its peers are connected
+	if !r.Broadcast(roomID, *signal, participant.ID) {
+		participant.Enqueue(NewErrorMessage(ErrCodeUnavailable, "frame could not be relayed, try again", signal.Seq))
+	}
+	return true
+}
+
+// Leave takes a participant whose connection ended out of the room
+func (r *RoomMap) Leave(roomID string, participant *Participant) {
+	defer r.gate.Leave()
+
 	// Cleanup after connection closes
 	log.Printf("Cleaning up connection for room %s", roomID)
-	AllRooms.RemoveClient(roomID, c)
-
-	// Notify others that a participant left
-	participants = AllRooms.Get(roomID)
-	for i := 0; i < len(participants); i++ {
-		participant := &participants[i]
-		participant.Mutex.Lock()
-		err := participant.Conn.WriteJSON(map[string]interface{}{
-			"leave": true,
-		})
-		participant.Mutex.Unlock()
-		if err != nil {
-			log.Printf("Error notifying participant of leave in room %s: %v", roomID, err)
+	r.RemoveClient(roomID, participant.Conn)
+	participant.wait()
+
+	// Notify others that a participant left; hosts already heard about
+	// people who never got past the waiting room
+	if participant.Waiting() {
+		return
+	}
+	leaveMsg := NewSignalMessage(MessageLeave, nil)
+	leaveMsg.From = participant.ID
+	r.Broadcast(roomID, leaveMsg, participant.ID)
+}
+
+// allowFrame meters a frame against its sender's budgets. Frames over
+// budget are dropped with an error frame the first time and whenever the
+// sender gets muted; a sender that keeps flooding is disconnected.
+func allowFrame(limiter *ratelimit.Limiter, participant *Participant, signal *SignalMessage) bool {
+	class := ratelimit.ClassOther
+	var seq uint64
+	if signal != nil {
+		seq = signal.Seq
+		if ClassOf(signal.Type) == ClassICE {
+			class = ratelimit.ClassICE
 		}
 	}
 
-	c.Close()
+	switch limiter.Check(class) {
+	case ratelimit.Allow:
+		return true
+	case ratelimit.Warn, ratelimit.Mute:
+		participant.Enqueue(NewErrorMessage(ErrCodeRateLimited, "sending too fast, frames are being dropped", seq))
+	case ratelimit.Disconnect:
+		log.Printf("Disconnecting participant %s for flooding", participant.ID)
+		participant.Enqueue(NewErrorMessage(ErrCodeRateLimited, "disconnected for sending too many frames", seq))
+		participant.CloseWithCode(websocket.ClosePolicyViolation)
+	}
+	return false
+}
+
+// announceJoin sends a participant who just entered the call its roster and
+// tells everyone else to expect its offer. In SFU rooms the server calls
+// the participant instead.
+func (r *RoomMap) announceJoin(roomID string, participant *Participant) {
+	sfu, switched := r.roomMode(roomID)
+
+	// Tell the new participant who it is and which peers it should call
+	roster := RosterPayload{
+		ID:    participant.ID,
+		Peers: r.PeerIDs(roomID, participant.ID),
+		Host:  participant.Host,
+		Mode:  ModeMesh,
+	}
+	if sfu {
+		roster.Mode = ModeSFU
+	}
+	if participant.Host {
+		roster.Waiting = r.WaitingList(roomID)
+	}
+	participant.Enqueue(NewSignalMessage(MessageRoster, roster))
+
+	// Let the joiner know the call is being recorded
+	if session := r.recordingSession(roomID); session != "" {
+		participant.Enqueue(NewSignalMessage(MessageRecording, RecordingPayload{Active: true, Session: session}))
+	}
+
+	// Everyone already in the call moves from the mesh to the SFU
+	if switched {
+		r.Broadcast(roomID, NewSignalMessage(MessageMode, ModePayload{Mode: ModeSFU}), participant.ID)
+	}
+
+	// Notify existing participants so they expect an offer from the new peer
+	joinMsg := NewSignalMessage(MessageJoin, nil)
+	joinMsg.From = participant.ID
+	r.Broadcast(roomID, joinMsg, participant.ID) // Exclude the new joiner from broadcast
+
+	if sfu {
+		r.startSFU(roomID, participant)
+	}
 }
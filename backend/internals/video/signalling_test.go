@@ -0,0 +1,255 @@
+package video
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"seaside/lib/auth"
+	"seaside/lib/ratelimit"
+	"seaside/lib/roomstore"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// waitTimeout bounds how long a test waits for a frame or a disconnect
+const waitTimeout = 2 * time.Second
+
+// fakeConn is a Conn that records what is written to it
+type fakeConn struct {
+	mutex     sync.Mutex
+	frames    []SignalMessage
+	read      int // Frames already returned by next
+	closeCode int // Code of the close frame, 0 until one is written
+	closed    bool
+	stall     chan struct{} // Blocks WriteJSON until closed, if set
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{}
+}
+
+func (c *fakeConn) WriteJSON(v interface{}) error {
+	if c.stall != nil {
+		<-c.stall
+	}
+	msg, ok := v.(SignalMessage)
+	if !ok {
+		return fmt.Errorf("unexpected frame %T", v)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.frames = append(c.frames, msg)
+	return nil
+}
+
+func (c *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if messageType == websocket.CloseMessage && len(data) >= 2 {
+		c.mutex.Lock()
+		c.closeCode = int(binary.BigEndian.Uint16(data))
+		c.mutex.Unlock()
+	}
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+
+func (c *fakeConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+// next waits for the next frame of the given type, skipping any others
+func (c *fakeConn) next(t *testing.T, msgType MessageType) SignalMessage {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		for c.read < len(c.frames) {
+			msg := c.frames[c.read]
+			c.read++
+			if msg.Type == msgType {
+				c.mutex.Unlock()
+				return msg
+			}
+		}
+		c.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no %s frame was written", msgType)
+	return SignalMessage{}
+}
+
+// nextError waits for the next error frame and returns its payload
+func (c *fakeConn) nextError(t *testing.T) ErrorPayload {
+	t.Helper()
+	var payload ErrorPayload
+	if err := json.Unmarshal(c.next(t, MessageError).Payload, &payload); err != nil {
+		t.Fatalf("undecodable error frame: %v", err)
+	}
+	return payload
+}
+
+// none checks that no frame of the given type arrives for a while
+func (c *fakeConn) none(t *testing.T, msgType MessageType) {
+	t.Helper()
+	time.Sleep(50 * time.Millisecond)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, msg := range c.frames[c.read:] {
+		if msg.Type == msgType {
+			t.Fatalf("unexpected %s frame: %+v", msgType, msg)
+		}
+	}
+}
+
+// waitClosed waits for the connection to be hung up and returns the close code
+func (c *fakeConn) waitClosed(t *testing.T) int {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		closed, code := c.closed, c.closeCode
+		c.mutex.Unlock()
+		if closed {
+			return code
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("connection was not closed")
+	return 0
+}
+
+// newTestRooms returns a RoomMap backed by a memory store
+func newTestRooms(t *testing.T) *RoomMap {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	rooms := &RoomMap{}
+	rooms.Init(ctx, roomstore.NewMemoryStore())
+	return rooms
+}
+
+// testClient is a participant joined through a fake connection
+type testClient struct {
+	*Participant
+	conn    *fakeConn
+	limiter *ratelimit.Limiter
+}
+
+// join connects a participant to a room of rooms
+func join(t *testing.T, rooms *RoomMap, roomID, id string, identity auth.Identity) *testClient {
+	t.Helper()
+	conn := newFakeConn()
+	participant, err := rooms.Join(roomID, id, identity, id, conn)
+	if err != nil {
+		t.Fatalf("Join(%s): %v", id, err)
+	}
+	client := &testClient{
+		Participant: participant,
+		conn:        conn,
+		limiter:     ratelimit.NewGroup(ratelimit.DefaultPolicy()).Connect(""),
+	}
+	t.Cleanup(func() {
+		client.limiter.Close()
+		participant.Close()
+	})
+	return client
+}
+
+// send hands a frame from the client to HandleFrame
+func (c *testClient) send(t *testing.T, rooms *RoomMap, roomID, frame string) bool {
+	t.Helper()
+	return rooms.HandleFrame(roomID, c.Participant, c.limiter, []byte(frame))
+}
+
+func TestHandleFrameRejectsInvalidFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    string
+		wantCode string
+		wantSeq  uint64
+	}{
+		{"malformed", `{"v":1,`, ErrCodeMalformed, 0},
+		{"old version", `{"v":0,"type":"ping","seq":3}`, ErrCodeUnsupportedVersion, 3},
+		{"unknown type", `{"v":1,"type":"join","seq":4}`, ErrCodeUnknownType, 4},
+		{"invalid payload", `{"v":1,"type":"offer","to":"b","seq":5,"payload":{"type":"offer"}}`, ErrCodeInvalidPayload, 5},
+		{"target not in the room", `{"v":1,"type":"offer","to":"nobody","seq":6,"payload":{"type":"offer","sdp":"v=0"}}`, ErrCodePeerNotFound, 6},
+		{"target is the sender", `{"v":1,"type":"offer","to":"a","seq":7,"payload":{"type":"offer","sdp":"v=0"}}`, ErrCodePeerNotFound, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rooms := newTestRooms(t)
+			a := join(t, rooms, "room", "a", auth.Identity{})
+			b := join(t, rooms, "room", "b", auth.Identity{})
+
+			if !a.send(t, rooms, "room", tt.frame) {
+				t.Fatal("HandleFrame disconnected the sender")
+			}
+			got := a.conn.nextError(t)
+			if got.Code != tt.wantCode || got.Seq != tt.wantSeq {
+				t.Fatalf("error = %+v, want code %q with seq %d", got, tt.wantCode, tt.wantSeq)
+			}
+			// Rejected frames are not relayed
+			b.conn.none(t, MessageOffer)
+		})
+	}
+}
+
+func TestHandleFrameRelays(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		msgType MessageType
+		reachB  bool
+		reachC  bool
+	}{
+		{"targeted offer", `{"v":1,"type":"offer","to":"b","payload":{"type":"offer","sdp":"v=0"}}`, MessageOffer, true, false},
+		{"targeted candidate", `{"v":1,"type":"ice-candidate","to":"c","payload":{"candidate":"c","sdpMid":"0"}}`, MessageICECandidate, false, true},
+		{"untargeted candidate", `{"v":1,"type":"ice-candidate","payload":{"candidate":"c","sdpMid":"0"}}`, MessageICECandidate, true, true},
+		{"forged sender", `{"v":1,"type":"answer","from":"c","to":"b","payload":{"type":"answer","sdp":"v=0"}}`, MessageAnswer, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rooms := newTestRooms(t)
+			a := join(t, rooms, "room", "a", auth.Identity{})
+			b := join(t, rooms, "room", "b", auth.Identity{})
+			c := join(t, rooms, "room", "c", auth.Identity{})
+
+			if !a.send(t, rooms, "room", tt.frame) {
+				t.Fatal("HandleFrame disconnected the sender")
+			}
+			for _, peer := range []struct {
+				client *testClient
+				reach  bool
+			}{{b, tt.reachB}, {c, tt.reachC}} {
+				if !peer.reach {
+					peer.client.conn.none(t, tt.msgType)
+					continue
+				}
+				// The server stamps who sent the frame
+				if msg := peer.client.conn.next(t, tt.msgType); msg.From != "a" {
+					t.Fatalf("%s received a frame from %q, want a", peer.client.ID, msg.From)
+				}
+			}
+			a.conn.none(t, tt.msgType)
+			a.conn.none(t, MessageError)
+		})
+	}
+}
+
+func TestHandleFramePing(t *testing.T) {
+	rooms := newTestRooms(t)
+	a := join(t, rooms, "room", "a", auth.Identity{})
+
+	a.send(t, rooms, "room", `{"v":1,"type":"ping"}`)
+	a.conn.next(t, MessagePong)
+}
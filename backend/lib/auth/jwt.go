@@ -12,10 +12,18 @@ type JWTUtil struct {
 	secretKey []byte
 }
 
+// Roles a room invite can grant
+const (
+	RoleGuest  = "guest"
+	RoleCoHost = "co-host"
+)
+
 type Claims struct {
 	UserID uint   `json:"user_id"`
 	Email  string `json:"email"`
-	Type   string `json:"type"` // "access" or "refresh"
+	Type   string `json:"type"`              // "access", "refresh" or "room_invite"
+	RoomID string `json:"room_id,omitempty"` // Room a "room_invite" token admits to
+	Role   string `json:"role,omitempty"`    // Role a "room_invite" token grants
 	jwt.RegisteredClaims
 }
 
@@ -60,6 +68,30 @@ func (j *JWTUtil) generateToken(userID uint, email, tokenType string, duration t
 	return token.SignedString(j.secretKey)
 }
 
+// GenerateRoomInvite creates an invite token that admits its holder to one
+// room with the given role. userID is the host issuing it.
+func (j *JWTUtil) GenerateRoomInvite(userID uint, roomID, role string, duration time.Duration) (string, error) {
+	if role != RoleGuest && role != RoleCoHost {
+		return "", fmt.Errorf("invalid invite role: %s", role)
+	}
+
+	claims := &Claims{
+		UserID: userID,
+		Type:   "room_invite",
+		RoomID: roomID,
+		Role:   role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			NotBefore: jwt.NewNumericDate(time.Now()),
+			Subject:   fmt.Sprintf("%d", userID),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(j.secretKey)
+}
+
 // ValidateAccessToken validates an access token
 func (j *JWTUtil) ValidateAccessToken(tokenString string) (*Claims, error) {
 	return j.validateToken(tokenString, "access")
@@ -70,6 +102,20 @@ func (j *JWTUtil) ValidateRefreshToken(tokenString string) (*Claims, error) {
 	return j.validateToken(tokenString, "refresh")
 }
 
+// ValidateRoomInvite validates an invite token and checks it is for roomID
+func (j *JWTUtil) ValidateRoomInvite(tokenString, roomID string) (*Claims, error) {
+	claims, err := j.validateToken(tokenString, "room_invite")
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.RoomID != roomID {
+		return nil, fmt.Errorf("invite is for a different room")
+	}
+
+	return claims, nil
+}
+
 // validateToken validates a token and checks its type
 func (j *JWTUtil) validateToken(tokenString, expectedType string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
@@ -4,8 +4,35 @@ import (
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
 )
 
+// Browsers cannot set headers on a WebSocket upgrade, so clients send the
+// access token as a second subprotocol "access_token.<jwt>" alongside
+// WebSocketProtocol, which is the one the server selects.
+const (
+	WebSocketProtocol    = "seaside"
+	WebSocketTokenPrefix = "access_token."
+)
+
+// Identity is who a WebSocket connection belongs to. UserID is 0 for guests.
+type Identity struct {
+	UserID uint
+	Email  string
+	Role   string // Role granted by a room invite, empty without one
+	IP     string // Client address the upgrade came from
+}
+
+// Invited reports whether the connection presented a valid room invite
+func (i Identity) Invited() bool {
+	return i.Role != ""
+}
+
+// Guest reports whether the connection is not signed in
+func (i Identity) Guest() bool {
+	return i.UserID == 0
+}
+
 // JWTMiddleware creates a JWT authentication middleware
 func JWTMiddleware(jwtUtil *JWTUtil) fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -79,3 +106,65 @@ func OptionalJWTMiddleware(jwtUtil *JWTUtil) fiber.Handler {
 		return c.Next()
 	}
 }
+
+// WebSocketAuthMiddleware authenticates a WebSocket upgrade using a "token"
+// query parameter or the Sec-WebSocket-Protocol header. Upgrades without a
+// token continue as guests; rooms decide whether guests may join.
+func WebSocketAuthMiddleware(jwtUtil *JWTUtil) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Fiber resolves the client address, honouring any proxy configuration
+		c.Locals("ip", c.IP())
+
+		tokenString := c.Query("token")
+		if tokenString == "" {
+			tokenString = tokenFromProtocols(c.Get("Sec-WebSocket-Protocol"))
+		}
+		if tokenString == "" {
+			return c.Next() // Continue as guest
+		}
+
+		// A token that does not validate is rejected rather than downgraded
+		claims, err := jwtUtil.ValidateAccessToken(tokenString)
+		if err != nil {
+			if strings.Contains(err.Error(), "expired") {
+				return c.Status(401).JSON(fiber.Map{
+					"error": "Token expired",
+					"code":  "TOKEN_EXPIRED",
+				})
+			}
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Invalid token",
+				"code":  "INVALID_TOKEN",
+			})
+		}
+
+		// Store user info in context; the websocket package copies it to the connection
+		c.Locals("userID", claims.UserID)
+		c.Locals("email", claims.Email)
+		c.Locals("authenticated", true)
+
+		return c.Next()
+	}
+}
+
+// tokenFromProtocols finds the access token in a Sec-WebSocket-Protocol header
+func tokenFromProtocols(header string) string {
+	for _, protocol := range strings.Split(header, ",") {
+		protocol = strings.TrimSpace(protocol)
+		if strings.HasPrefix(protocol, WebSocketTokenPrefix) {
+			return strings.TrimPrefix(protocol, WebSocketTokenPrefix)
+		}
+	}
+	return ""
+}
+
+// WebSocketIdentity returns the identity WebSocketAuthMiddleware attached to a connection
+func WebSocketIdentity(c *websocket.Conn) Identity {
+	ip, _ := c.Locals("ip").(string)
+	userID, ok := c.Locals("userID").(uint)
+	if !ok {
+		return Identity{IP: ip}
+	}
+	email, _ := c.Locals("email").(string)
+	return Identity{UserID: userID, Email: email, IP: ip}
+}
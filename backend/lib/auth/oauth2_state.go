@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
@@ -22,14 +23,15 @@ type StateInfo struct {
 	ExpiresAt time.Time
 }
 
-// NewOAuth2StateManager creates a new OAuth2 state manager
-func NewOAuth2StateManager() *OAuth2StateManager {
+// NewOAuth2StateManager creates a new OAuth2 state manager. Expired states
+// are cleaned up until ctx is done.
+func NewOAuth2StateManager(ctx context.Context) *OAuth2StateManager {
 	manager := &OAuth2StateManager{
 		states: make(map[string]*StateInfo),
 	}
 	
 	// Start cleanup goroutine
-	go manager.cleanupExpiredStates()
+	go manager.cleanupExpiredStates(ctx)
 	
 	return manager
 }
@@ -103,11 +105,16 @@ func (m *OAuth2StateManager) removeState(state string) {
 }
 
 // cleanupExpiredStates periodically removes expired states
-func (m *OAuth2StateManager) cleanupExpiredStates() {
+func (m *OAuth2StateManager) cleanupExpiredStates(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 	
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
 		m.mutex.Lock()
 		now := time.Now()
 		for state, info := range m.states {
@@ -0,0 +1,64 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned when a store has no object under a key
+var ErrNotFound = errors.New("object not found")
+
+// BlobStore keeps uploaded files. Keys are chosen by the server and use "/"
+// to separate parts, whatever the backend.
+type BlobStore interface {
+	// Put stores data under key, replacing any object already there
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get opens the object stored under key; the caller closes it
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object under key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// NewFromEnv builds the store selected by BLOB_STORE ("local" or "s3"). The
+// local store writes under BLOB_DIR; the S3 store uses S3_ENDPOINT,
+// S3_BUCKET, S3_REGION, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY.
+func NewFromEnv() (BlobStore, error) {
+	backend := strings.ToLower(os.Getenv("BLOB_STORE"))
+	switch backend {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "attachments"
+		}
+		store, err := NewLocalStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Storing attachments in %s", dir)
+		return store, nil
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		store, err := NewS3Store(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			Region:          region,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Storing attachments in S3 bucket %s", os.Getenv("S3_BUCKET"))
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q, expected \"local\" or \"s3\"", backend)
+	}
+}
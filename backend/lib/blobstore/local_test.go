@@ -0,0 +1,90 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStoreKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{"file", "chat/abc.png", true},
+		{"nested directories", "chat/2024/abc_thumb.jpg", true},
+		{"empty", "", false},
+		{"parent directory", "../secret", false},
+		{"climbing out of a directory", "chat/../../secret", false},
+		{"absolute path", "/etc/passwd", false},
+		{"current directory", ".", false},
+		{"directory itself", "chat/..", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			store, err := NewLocalStore(filepath.Join(root, "blobs"))
+			if err != nil {
+				t.Fatalf("NewLocalStore: %v", err)
+			}
+			ctx := context.Background()
+
+			err = store.Put(ctx, tt.key, []byte("data"), "text/plain")
+			if (err == nil) != tt.valid {
+				t.Fatalf("Put(%q) = %v, want valid %v", tt.key, err, tt.valid)
+			}
+			if _, err := store.Get(ctx, tt.key); (err == nil) != tt.valid {
+				t.Fatalf("Get(%q) = %v, want valid %v", tt.key, err, tt.valid)
+			}
+			if err := store.Delete(ctx, tt.key); (err == nil) != tt.valid {
+				t.Fatalf("Delete(%q) = %v, want valid %v", tt.key, err, tt.valid)
+			}
+
+			// Nothing may be written outside the store's directory
+			entries, _ := os.ReadDir(root)
+			if len(entries) != 1 {
+				t.Fatalf("files outside the store: %v", entries)
+			}
+		})
+	}
+}
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "chat/missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key = %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Put(ctx, "chat/a.png", []byte("image"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	reader, err := store.Get(ctx, "chat/a.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "image" {
+		t.Fatalf("Get = %q, want %q", data, "image")
+	}
+
+	if err := store.Delete(ctx, "chat/a.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "chat/a.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete = %v, want %v", err, ErrNotFound)
+	}
+	// Deleting twice is not an error
+	if err := store.Delete(ctx, "chat/a.png"); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an S3 stand-in keeping the objects of one bucket in memory
+type fakeS3 struct {
+	t      *testing.T
+	bucket string
+
+	mutex        sync.Mutex
+	objects      map[string]fakeObject // Escaped path within the bucket -> object
+	missingIsErr bool                  // Answer deletes of missing objects with 404
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *S3Store) {
+	t.Helper()
+	fake := &fakeS3{t: t, bucket: bucket, objects: make(map[string]fakeObject)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Store(S3Config{
+		Endpoint:        server.URL,
+		Bucket:          bucket,
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store: %v", err)
+	}
+	return fake, store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	// Requests are signed over the payload, by the store's access key
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != sha256Hex(body) {
+		f.t.Errorf("%s %s: payload hash %q does not match the body", r.Method, r.URL.Path, got)
+	}
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(authorization, "/eu-west-1/s3/aws4_request") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	prefix := "/" + f.bucket + "/"
+	if !strings.HasPrefix(r.URL.EscapedPath(), prefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if !strings.Contains(authorization, "SignedHeaders=content-type;host;") {
+			f.t.Errorf("PUT %s: content type is not signed: %s", key, authorization)
+		}
+		f.objects[key] = fakeObject{data: body, contentType: r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		object, found := f.objects[key]
+		if !found {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Write(object.data)
+	case http.MethodDelete:
+		if _, found := f.objects[key]; !found && f.missingIsErr {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// object returns what the fake holds under an escaped key
+func (f *fakeS3) object(key string) (fakeObject, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	object, found := f.objects[key]
+	return object, found
+}
+
+func TestS3StoreRoundTrip(t *testing.T) {
+	fake, store := newFakeS3(t, "uploads")
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "chat/missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing key = %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Put(ctx, "chat/a b.png", []byte("image"), "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Keys are escaped into the path; the content type is kept with the object
+	object, found := fake.object("chat/a%20b.png")
+	if !found {
+		t.Fatalf("Put stored %v, want chat/a%%20b.png", fake.objects)
+	}
+	if object.contentType != "image/png" {
+		t.Fatalf("content type = %q, want image/png", object.contentType)
+	}
+
+	reader, err := store.Get(ctx, "chat/a b.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "image" {
+		t.Fatalf("Get = %q, want %q", data, "image")
+	}
+
+	if err := store.Delete(ctx, "chat/a b.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "chat/a b.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete = %v, want %v", err, ErrNotFound)
+	}
+
+	// Deleting a missing object is not an error, however the service answers
+	if err := store.Delete(ctx, "chat/a b.png"); err != nil {
+		t.Fatalf("second Delete: %v", err)
+	}
+	fake.mutex.Lock()
+	fake.missingIsErr = true
+	fake.mutex.Unlock()
+	if err := store.Delete(ctx, "chat/a b.png"); err != nil {
+		t.Fatalf("Delete answered with 404: %v", err)
+	}
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	_, store := newFakeS3(t, "uploads")
+	ctx := context.Background()
+
+	// Other refusals are errors, with what the service said
+	store.config.AccessKeyID = "someone-else"
+	err := store.Put(ctx, "chat/a.png", []byte("image"), "image/png")
+	if err == nil || errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("Put with the wrong key = %v, want a 403 AccessDenied error", err)
+	}
+
+	store.config.AccessKeyID = "AKIDEXAMPLE"
+	store.config.Bucket = "elsewhere"
+	if _, err := store.Get(ctx, "chat/a.png"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get from a missing bucket = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestNewS3Store(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   S3Config
+		wantErr  bool
+		wantHost string
+	}{
+		{"custom endpoint", S3Config{Endpoint: "http://localhost:9000/", Bucket: "b", AccessKeyID: "k", SecretAccessKey: "s"}, false, "localhost:9000"},
+		{"AWS region", S3Config{Region: "eu-west-1", Bucket: "b", AccessKeyID: "k", SecretAccessKey: "s"}, false, "s3.eu-west-1.amazonaws.com"},
+		{"no bucket", S3Config{Endpoint: "http://localhost:9000", AccessKeyID: "k", SecretAccessKey: "s"}, true, ""},
+		{"no keys", S3Config{Endpoint: "http://localhost:9000", Bucket: "b"}, true, ""},
+		{"endpoint without a host", S3Config{Endpoint: "localhost", Bucket: "b", AccessKeyID: "k", SecretAccessKey: "s"}, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewS3Store(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewS3Store = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && store.endpoint.Host != tt.wantHost {
+				t.Fatalf("host = %q, want %q", store.endpoint.Host, tt.wantHost)
+			}
+		})
+	}
+}
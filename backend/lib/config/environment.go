@@ -30,6 +30,8 @@ type DeploymentConfig struct {
 	ExecutableDir   string
 	ConfigPaths     []string
 	MigrationPaths  []string
+	ICE             ICEConfig
+	Proxy           ProxyConfig
 }
 
 // DetectEnvironment determines the current deployment environment
@@ -145,6 +147,8 @@ func NewDeploymentConfig() *DeploymentConfig {
 	// Generate environment-specific paths
 	config.ConfigPaths = config.generateConfigPaths()
 	config.MigrationPaths = config.generateMigrationPaths()
+	config.ICE = config.loadICEConfig()
+	config.Proxy = config.loadProxyConfig()
 	
 	log.Printf("Deployment configuration initialized:")
 	log.Printf("  Environment: %s", config.Environment)
@@ -153,6 +157,8 @@ func NewDeploymentConfig() *DeploymentConfig {
 	log.Printf("  Executable Directory: %s", config.ExecutableDir)
 	log.Printf("  Config Paths: %d strategies", len(config.ConfigPaths))
 	log.Printf("  Migration Paths: %d strategies", len(config.MigrationPaths))
+	log.Printf("  ICE Servers: %d STUN, %d TURN", len(config.ICE.STUNURLs), len(config.ICE.TURNURLs))
+	log.Printf("  Trusted Proxies: %d", len(config.Proxy.TrustedProxies))
 	
 	return config
 }
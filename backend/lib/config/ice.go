@@ -0,0 +1,138 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCredentialTTL is how long TURN credentials stay valid unless
+// TURN_CREDENTIAL_TTL says otherwise
+const defaultCredentialTTL = 12 * time.Hour
+
+// defaultSTUNURLs are public STUN servers used when ICE_STUN_URLS is unset
+var defaultSTUNURLs = []string{
+	"stun:stun.l.google.com:19302",
+	"stun:stun1.l.google.com:19302",
+	"stun:stun2.l.google.com:19302",
+}
+
+// ICEServer is one entry of a client's RTCConfiguration.iceServers
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEConfig lists the STUN and TURN servers handed to clients
+type ICEConfig struct {
+	STUNURLs      []string
+	TURNURLs      []string
+	TURNSecret    string        // Shared with the relays; signs time-limited credentials
+	CredentialTTL time.Duration // How long issued credentials stay valid
+	GuestRelay    bool          // Whether guests get TURN credentials too
+}
+
+// loadICEConfig reads the ICE settings. Each variable can be overridden
+// per environment, e.g. ICE_TURN_URLS_PRODUCTION takes precedence over
+// ICE_TURN_URLS in production.
+func (dc *DeploymentConfig) loadICEConfig() ICEConfig {
+	ice := ICEConfig{
+		STUNURLs:      defaultSTUNURLs,
+		TURNURLs:      splitList(dc.envValue("ICE_TURN_URLS")),
+		TURNSecret:    dc.envValue("TURN_SECRET"),
+		CredentialTTL: defaultCredentialTTL,
+	}
+
+	if urls := splitList(dc.envValue("ICE_STUN_URLS")); len(urls) > 0 {
+		ice.STUNURLs = urls
+	}
+
+	if ttl := dc.envValue("TURN_CREDENTIAL_TTL"); ttl != "" {
+		if value, err := time.ParseDuration(ttl); err == nil && value > 0 {
+			ice.CredentialTTL = value
+		} else {
+			log.Printf("Warning: Invalid TURN_CREDENTIAL_TTL '%s', using %s", ttl, defaultCredentialTTL)
+		}
+	}
+
+	// Relays are costly, so only development hands them to guests by default
+	guestRelay := dc.envValue("ICE_GUEST_RELAY")
+	if guestRelay == "" {
+		guestRelay = dc.GetEnvironmentSpecificValue("true", "false", "false")
+	}
+	ice.GuestRelay, _ = strconv.ParseBool(guestRelay)
+
+	if len(ice.TURNURLs) > 0 && ice.TURNSecret == "" {
+		log.Println("Warning: ICE_TURN_URLS is set without TURN_SECRET, TURN servers will not be offered")
+		ice.TURNURLs = nil
+	}
+
+	return ice
+}
+
+// UseEmbeddedRelay offers the embedded relay to clients, unless external
+// TURN servers are configured
+func (c *ICEConfig) UseEmbeddedRelay(secret string, uris []string) {
+	if len(c.TURNURLs) > 0 {
+		return
+	}
+	c.TURNSecret = secret
+	for _, uri := range uris {
+		if strings.HasPrefix(uri, "stun:") {
+			c.STUNURLs = append(c.STUNURLs, uri)
+		} else {
+			c.TURNURLs = append(c.TURNURLs, uri)
+		}
+	}
+}
+
+// Servers returns the ICE servers for a user, with TURN servers only when
+// relay is true. TURN credentials follow the TURN REST API convention: the
+// username is "<expiry>:<user>" and the credential is the base64 HMAC-SHA1
+// of the username under the shared secret.
+func (c ICEConfig) Servers(user string, relay bool) ([]ICEServer, time.Time) {
+	expiresAt := time.Now().Add(c.CredentialTTL)
+	servers := []ICEServer{}
+
+	if len(c.STUNURLs) > 0 {
+		servers = append(servers, ICEServer{URLs: c.STUNURLs})
+	}
+
+	if relay && len(c.TURNURLs) > 0 {
+		username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + user
+		mac := hmac.New(sha1.New, []byte(c.TURNSecret))
+		mac.Write([]byte(username))
+		servers = append(servers, ICEServer{
+			URLs:       c.TURNURLs,
+			Username:   username,
+			Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		})
+	}
+
+	return servers, expiresAt
+}
+
+// envValue reads KEY_<ENVIRONMENT> before falling back to KEY
+func (dc *DeploymentConfig) envValue(key string) string {
+	if value := os.Getenv(key + "_" + strings.ToUpper(string(dc.Environment))); value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// splitList parses a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
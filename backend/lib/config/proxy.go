@@ -0,0 +1,25 @@
+package config
+
+// defaultProxyHeader is where trusted proxies put the client's address
+// unless TRUSTED_PROXY_HEADER says otherwise
+const defaultProxyHeader = "X-Real-IP"
+
+// ProxyConfig tells the server which reverse proxies may report the
+// client's address. Guest bans go by that address, so it must not be the
+// proxy's own, nor one a client made up.
+type ProxyConfig struct {
+	TrustedProxies []string // IPs or CIDR ranges; without any the connection's address is used
+	Header         string   // Header the proxies set, overwriting anything the client sent
+}
+
+// loadProxyConfig reads TRUSTED_PROXIES and TRUSTED_PROXY_HEADER
+func (dc *DeploymentConfig) loadProxyConfig() ProxyConfig {
+	proxy := ProxyConfig{
+		TrustedProxies: splitList(dc.envValue("TRUSTED_PROXIES")),
+		Header:         dc.envValue("TRUSTED_PROXY_HEADER"),
+	}
+	if proxy.Header == "" {
+		proxy.Header = defaultProxyHeader
+	}
+	return proxy
+}
@@ -15,6 +15,7 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -208,11 +209,13 @@ func RunMigrationsWithConfig(db *gorm.DB, deploymentConfig interface{}) error {
 	return nil
 }
 
-func InitializeDatabase() error {
-	return InitializeDatabaseWithConfig(nil)
+// InitializeDatabase connects, migrates and starts background services,
+// which run until ctx is done
+func InitializeDatabase(ctx context.Context) error {
+	return InitializeDatabaseWithConfig(ctx, nil)
 }
 
-func InitializeDatabaseWithConfig(deploymentConfig interface{}) error {
+func InitializeDatabaseWithConfig(ctx context.Context, deploymentConfig interface{}) error {
 	log.Println("=== Database Initialization Process ===")
 	
 	// Step 1: Connect to database
@@ -264,11 +267,11 @@ func InitializeDatabaseWithConfig(deploymentConfig interface{}) error {
 	// Step 5: Start background services
 	log.Println("Starting background database services...")
 	// Start health monitoring (every 5 minutes)
-	GlobalHealthChecker.StartHealthMonitoring(5 * time.Minute)
+	GlobalHealthChecker.StartHealthMonitoring(ctx, 5 * time.Minute)
 	log.Println("✅ Health monitoring started (interval: 5 minutes)")
 	
 	// Start periodic cleanup (every hour)
-	GlobalHealthChecker.StartPeriodicCleanup(time.Hour)
+	GlobalHealthChecker.StartPeriodicCleanup(ctx, time.Hour)
 	log.Println("✅ Periodic cleanup started (interval: 1 hour)")
 
 	// Step 6: Run seed data based on deployment configuration
@@ -305,3 +308,19 @@ func InitializeDatabaseWithConfig(deploymentConfig interface{}) error {
 	log.Println("=== End Database Initialization ===")
 	return nil
 }
+
+// CloseDatabase closes the connection pool, waiting for queries in flight
+func CloseDatabase() error {
+	if DB == nil {
+		return nil
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get database handle: %w", err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+	log.Println("Database connection pool closed")
+	return nil
+}
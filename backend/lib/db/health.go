@@ -135,7 +135,7 @@ func (hc *HealthChecker) checkDatabaseHealth() (DatabaseHealth, error) {
 
 // checkTableHealth checks the health of core tables
 func (hc *HealthChecker) checkTableHealth() ([]TableHealth, error) {
-	tables := []string{"users", "oauth_providers", "refresh_tokens"}
+	tables := []string{"users", "oauth_providers", "refresh_tokens", "rooms"}
 	var tableHealth []TableHealth
 
 	for _, tableName := range tables {
@@ -159,7 +159,7 @@ func (hc *HealthChecker) checkTableHealth() ([]TableHealth, error) {
 		}
 
 		// Get last update time (for tables with updated_at)
-		if tableName == "users" || tableName == "oauth_providers" {
+		if tableName == "users" || tableName == "oauth_providers" || tableName == "rooms" {
 			var lastUpdate time.Time
 			query := fmt.Sprintf("SELECT MAX(updated_at) FROM %s", tableName)
 			if err := hc.db.Raw(query).Scan(&lastUpdate).Error; err != nil {
@@ -279,11 +279,17 @@ func (hc *HealthChecker) checkPerformanceMetrics() (PerformanceMetrics, error) {
 	return metrics, nil
 }
 
-// StartHealthMonitoring starts periodic health monitoring
-func (hc *HealthChecker) StartHealthMonitoring(interval time.Duration) {
+// StartHealthMonitoring starts periodic health monitoring until ctx is done
+func (hc *HealthChecker) StartHealthMonitoring(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
 			status := hc.CheckHealth()
 			if status.Status != "healthy" {
 				log.Printf("Database health check: %s - Errors: %v", status.Status, status.Errors)
@@ -316,14 +322,23 @@ func (hc *HealthChecker) CleanupExpiredData() error {
 		log.Printf("Cleaned up %d expired OAuth provider tokens", result.RowsAffected)
 	}
 
+	// Expired rooms are closed by the room handlers, which also clear them
+	// from the room store
+
 	return nil
 }
 
-// StartPeriodicCleanup starts periodic cleanup of expired data
-func (hc *HealthChecker) StartPeriodicCleanup(interval time.Duration) {
+// StartPeriodicCleanup starts periodic cleanup of expired data until ctx is done
+func (hc *HealthChecker) StartPeriodicCleanup(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
 			if err := hc.CleanupExpiredData(); err != nil {
 				log.Printf("Periodic cleanup failed: %v", err)
 			}
@@ -41,4 +41,144 @@ type RefreshToken struct {
 	ExpiresAt  time.Time `gorm:"not null" json:"expires_at"`
 	CreatedAt  time.Time `json:"created_at"`
 	Revoked    bool      `gorm:"not null;default:false" json:"revoked"`
-}
\ No newline at end of file
+}
+// Room privacy modes
+const (
+	RoomPrivacyOpen    = "open"    // Anyone with the link can join
+	RoomPrivacyMembers = "members" // Only signed-in users and invite holders can join
+	RoomPrivacyInvite  = "invite"  // Only the owner and invite holders can join
+)
+
+type Room struct {
+	ID              string     `gorm:"primaryKey" json:"id"`
+	OwnerID         uint       `gorm:"not null;index" json:"owner_id"`
+	Title           string     `gorm:"not null;default:''" json:"title"`
+	MaxParticipants int        `gorm:"not null;default:6" json:"max_participants"`
+	PrivacyMode     string     `gorm:"not null;default:'open'" json:"privacy_mode"`
+	WaitingRoom     bool       `gorm:"not null;default:false" json:"waiting_room"`
+	ExpiresAt       *time.Time `gorm:"index" json:"expires_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+
+	ChatModeration *ChatModeration `gorm:"serializer:json" json:"chat_moderation,omitempty"` // nil for the server's defaults
+}
+
+// ChatModeration is how strictly a room's chat is moderated. Empty fields
+// keep the server's defaults.
+type ChatModeration struct {
+	Disabled        bool     `json:"disabled,omitempty"`
+	BlockedWords    []string `json:"blocked_words,omitempty"`
+	ProfanityAction string   `json:"profanity_action,omitempty"` // "mask", "reject" or "flag"
+	AllowedDomains  []string `json:"allowed_domains,omitempty"`
+	BlockedDomains  []string `json:"blocked_domains,omitempty"`
+	LinkAction      string   `json:"link_action,omitempty"` // "mask", "reject" or "flag"
+	MaxLength       int      `json:"max_length,omitempty"`
+	SpamLimit       int      `json:"spam_limit,omitempty"`
+}
+
+// Expired reports whether the room is past its expiry time
+func (r *Room) Expired() bool {
+	return r.ExpiresAt != nil && time.Now().After(*r.ExpiresAt)
+}
+
+// Reasons a room was retired
+const (
+	RoomDeleted = "deleted" // Its owner deleted it
+	RoomExpired = "expired" // Cleanup removed it after it expired
+)
+
+// RoomTombstone keeps the ID of a room that no longer exists, so nobody can
+// reopen it as an anonymous room
+type RoomTombstone struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	Reason    string    `gorm:"not null" json:"reason"`
+	RetiredAt time.Time `gorm:"not null" json:"retired_at"`
+}
+
+// RoomBan keeps someone a host banned out of a saved room: a signed-in
+// user by account, a guest by address
+type RoomBan struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	RoomID    string    `gorm:"not null;index" json:"room_id"`
+	UserID    *uint     `json:"user_id,omitempty"` // nil for guests
+	IP        *string   `json:"ip,omitempty"`      // Set for guests only
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Recording is one track of a call recorded by the server. The tracks of
+// one recording share a Session.
+type Recording struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	RoomID        string    `gorm:"not null;index" json:"room_id"`
+	Session       string    `gorm:"not null;index" json:"session"`
+	ParticipantID string    `gorm:"not null" json:"participant_id"`
+	UserID        *uint     `json:"user_id,omitempty"`      // nil for guests
+	Kind          string    `gorm:"not null" json:"kind"`   // "audio" or "video"
+	Format        string    `gorm:"not null" json:"format"` // "ogg" or "webm"
+	Path          string    `gorm:"not null" json:"-"`
+	SizeBytes     int64     `gorm:"not null;default:0" json:"size_bytes"`
+	StartedBy     *uint     `json:"started_by,omitempty"`
+	StartedAt     time.Time `gorm:"not null" json:"started_at"`
+	EndedAt       time.Time `gorm:"not null" json:"ended_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ChatMessage is a chat message kept for replay and scrolling back
+type ChatMessage struct {
+	ID        uint64         `gorm:"primaryKey" json:"id"`
+	RoomID    string         `gorm:"not null;index" json:"room_id"`
+	Seq       uint64         `gorm:"not null;default:0" json:"seq"` // Position in the room's chat
+	UserID    *uint          `json:"user_id,omitempty"`             // nil for guests
+	Sender    string         `gorm:"not null" json:"from"`
+	SenderID  *string        `json:"-"` // Participant ID of the sending connection
+	Type      string         `gorm:"not null;default:'chat'" json:"type"`
+	Text      string         `gorm:"not null" json:"text"`
+	EditedAt  *time.Time     `json:"edited_at,omitempty"`
+	DeletedAt *time.Time     `json:"deleted_at,omitempty"` // Text is cleared on deletion
+	Reactions []ChatReaction `gorm:"foreignKey:MessageID" json:"reactions,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+
+	AttachmentID *string         `json:"attachment_id,omitempty"` // On "attachment" messages
+	Attachment   *ChatAttachment `gorm:"foreignKey:AttachmentID" json:"attachment,omitempty"`
+}
+
+// ChatReaction is one person's emoji reaction to a chat message
+type ChatReaction struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	MessageID uint64    `gorm:"not null;index" json:"message_id"`
+	UserID    *uint     `json:"user_id,omitempty"` // nil for guests
+	Sender    string    `gorm:"not null" json:"from"`
+	SenderKey string    `gorm:"not null" json:"-"` // "user:<id>", or "guest:<participant ID>" for guests
+	Emoji     string    `gorm:"not null" json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChatModerationEvent records a chat message that moderation objected to
+type ChatModerationEvent struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	RoomID    string    `gorm:"not null;index" json:"room_id"`
+	UserID    *uint     `json:"user_id,omitempty"` // nil for guests
+	Sender    string    `gorm:"not null" json:"from"`
+	Type      string    `gorm:"not null" json:"type"`   // Type of the moderated message
+	Text      string    `gorm:"not null" json:"text"`   // As it was sent
+	Action    string    `gorm:"not null" json:"action"` // "flagged", "masked" or "rejected"
+	Rules     string    `gorm:"not null" json:"rules"`  // Comma-separated checks that objected
+	Reasons   string    `gorm:"not null" json:"reasons"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChatAttachment is a file uploaded to a room's chat. The ID is random, so
+// links to the file can be handed to guests in the room.
+type ChatAttachment struct {
+	ID           string    `gorm:"primaryKey" json:"id"`
+	RoomID       string    `gorm:"not null;index" json:"room_id"`
+	UserID       *uint     `json:"user_id,omitempty"` // nil once the uploader's account is deleted
+	FileName     string    `gorm:"not null" json:"file_name"`
+	ContentType  string    `gorm:"not null" json:"content_type"`
+	SizeBytes    int64     `gorm:"not null" json:"size_bytes"`
+	StorageKey   string    `gorm:"not null" json:"-"`                         // Key in the blob store
+	ThumbnailKey *string   `json:"-"`                                         // nil if no thumbnail could be made
+	Width        int       `gorm:"not null;default:0" json:"width,omitempty"` // Images only
+	Height       int       `gorm:"not null;default:0" json:"height,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
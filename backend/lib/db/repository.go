@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type UserRepositoryInterface interface {
@@ -167,4 +168,401 @@ func (r *UserRepository) CleanupExpiredTokens() error {
 		return fmt.Errorf("failed to cleanup expired tokens: %w", err)
 	}
 	return nil
-}
\ No newline at end of file
+}
+type RoomRepositoryInterface interface {
+	CreateRoom(room *Room) error
+	GetRoomByID(id string) (*Room, error)
+	GetRoomsByOwner(ownerID uint) ([]Room, error)
+	UpdateRoom(room *Room) error
+	DeleteRoom(id string) error
+	DeleteExpiredRooms() ([]Room, error)
+	RetiredRoom(id string) (string, error)
+	AddBan(ban *RoomBan) error
+	GetBans(roomID string) ([]RoomBan, error)
+}
+
+type RoomRepository struct {
+	db *gorm.DB
+}
+
+func NewRoomRepository(db *gorm.DB) RoomRepositoryInterface {
+	return &RoomRepository{db: db}
+}
+
+func (r *RoomRepository) CreateRoom(room *Room) error {
+	if err := r.db.Create(room).Error; err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return fmt.Errorf("room already exists")
+		}
+		return fmt.Errorf("failed to create room: %w", err)
+	}
+	return nil
+}
+
+// GetRoomByID returns a room that has not expired yet
+func (r *RoomRepository) GetRoomByID(id string) (*Room, error) {
+	var room Room
+	err := r.db.Where("id = ? AND (expires_at IS NULL OR expires_at > ?)", id, time.Now()).First(&room).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("room not found")
+		}
+		return nil, fmt.Errorf("failed to get room: %w", err)
+	}
+	return &room, nil
+}
+
+// GetRoomsByOwner returns a user's rooms that have not expired, newest first
+func (r *RoomRepository) GetRoomsByOwner(ownerID uint) ([]Room, error) {
+	var rooms []Room
+	err := r.db.Where("owner_id = ? AND (expires_at IS NULL OR expires_at > ?)", ownerID, time.Now()).
+		Order("created_at DESC").
+		Find(&rooms).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rooms: %w", err)
+	}
+	return rooms, nil
+}
+
+func (r *RoomRepository) UpdateRoom(room *Room) error {
+	if err := r.db.Save(room).Error; err != nil {
+		return fmt.Errorf("failed to update room: %w", err)
+	}
+	return nil
+}
+
+// DeleteRoom deletes a room and keeps its ID, so it cannot be reopened
+func (r *RoomRepository) DeleteRoom(id string) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&Room{}, "id = ?", id).Error; err != nil {
+			return err
+		}
+		return retire(tx, id, RoomDeleted)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete room: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredRooms deletes the rooms past their expiry time, keeping their
+// IDs, and returns them
+func (r *RoomRepository) DeleteExpiredRooms() ([]Room, error) {
+	var rooms []Room
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at IS NOT NULL AND expires_at < ?", time.Now()).Find(&rooms).Error; err != nil {
+			return err
+		}
+		for _, room := range rooms {
+			if err := tx.Delete(&Room{}, "id = ?", room.ID).Error; err != nil {
+				return err
+			}
+			if err := retire(tx, room.ID, RoomExpired); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete expired rooms: %w", err)
+	}
+	return rooms, nil
+}
+
+// RetiredRoom returns why a room that no longer exists was retired, one of
+// RoomDeleted or RoomExpired. It returns "" for IDs that were never saved.
+func (r *RoomRepository) RetiredRoom(id string) (string, error) {
+	var tombstone RoomTombstone
+	err := r.db.Where("id = ?", id).First(&tombstone).Error
+	if err == nil {
+		return tombstone.Reason, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", fmt.Errorf("failed to get room tombstone: %w", err)
+	}
+
+	// Expired rooms keep their row until cleanup removes them
+	var expired int64
+	err = r.db.Model(&Room{}).Where("id = ? AND expires_at IS NOT NULL AND expires_at <= ?", id, time.Now()).Count(&expired).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to get room: %w", err)
+	}
+	if expired > 0 {
+		return RoomExpired, nil
+	}
+	return "", nil
+}
+
+// retire records the ID of a room that no longer exists
+func retire(tx *gorm.DB, id, reason string) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&RoomTombstone{ID: id, Reason: reason, RetiredAt: time.Now()}).Error
+}
+
+// AddBan records a ban from a room. Banning someone again changes nothing.
+func (r *RoomRepository) AddBan(ban *RoomBan) error {
+	if err := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(ban).Error; err != nil {
+		return fmt.Errorf("failed to save ban: %w", err)
+	}
+	return nil
+}
+
+// GetBans returns the bans of a room
+func (r *RoomRepository) GetBans(roomID string) ([]RoomBan, error) {
+	var bans []RoomBan
+	if err := r.db.Where("room_id = ?", roomID).Find(&bans).Error; err != nil {
+		return nil, fmt.Errorf("failed to get bans: %w", err)
+	}
+	return bans, nil
+}
+
+type RecordingRepositoryInterface interface {
+	CreateRecording(recording *Recording) error
+	GetRecording(roomID string, id uint) (*Recording, error)
+	GetRecordingsByRoom(roomID string) ([]Recording, error)
+}
+
+type RecordingRepository struct {
+	db *gorm.DB
+}
+
+func NewRecordingRepository(db *gorm.DB) RecordingRepositoryInterface {
+	return &RecordingRepository{db: db}
+}
+
+func (r *RecordingRepository) CreateRecording(recording *Recording) error {
+	if err := r.db.Create(recording).Error; err != nil {
+		return fmt.Errorf("failed to create recording: %w", err)
+	}
+	return nil
+}
+
+// GetRecording returns a recording of the given room
+func (r *RecordingRepository) GetRecording(roomID string, id uint) (*Recording, error) {
+	var recording Recording
+	err := r.db.Where("id = ? AND room_id = ?", id, roomID).First(&recording).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("recording not found")
+		}
+		return nil, fmt.Errorf("failed to get recording: %w", err)
+	}
+	return &recording, nil
+}
+
+// GetRecordingsByRoom returns a room's recordings, newest first
+func (r *RecordingRepository) GetRecordingsByRoom(roomID string) ([]Recording, error) {
+	var recordings []Recording
+	err := r.db.Where("room_id = ?", roomID).
+		Order("started_at DESC, id").
+		Find(&recordings).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recordings: %w", err)
+	}
+	return recordings, nil
+}
+
+// ErrChatMessageNotFound is returned when a room has no message with the
+// requested sequence number
+var ErrChatMessageNotFound = errors.New("chat message not found")
+
+type ChatMessageRepositoryInterface interface {
+	CreateMessage(message *ChatMessage) error
+	GetMessages(roomID string, before uint64, limit int) ([]ChatMessage, error)
+	GetMessagesAfter(roomID string, seq uint64, limit int) ([]ChatMessage, error)
+	GetMessageBySeq(roomID string, seq uint64) (*ChatMessage, error)
+	UpdateMessage(message *ChatMessage) error
+	ToggleReaction(reaction *ChatReaction) (bool, error)
+	DeleteMessages(roomID string) error
+	LatestSeq(roomID string) (uint64, error)
+}
+
+type ChatMessageRepository struct {
+	db *gorm.DB
+}
+
+func NewChatMessageRepository(db *gorm.DB) ChatMessageRepositoryInterface {
+	return &ChatMessageRepository{db: db}
+}
+
+func (r *ChatMessageRepository) CreateMessage(message *ChatMessage) error {
+	if err := r.db.Create(message).Error; err != nil {
+		return fmt.Errorf("failed to create chat message: %w", err)
+	}
+	return nil
+}
+
+// GetMessages returns up to limit messages of a room sent before the message
+// with ID before, or the latest ones if before is 0. They are returned
+// oldest first.
+func (r *ChatMessageRepository) GetMessages(roomID string, before uint64, limit int) ([]ChatMessage, error) {
+	query := r.db.Preload("Reactions", orderReactions).Preload("Attachment").Where("room_id = ?", roomID)
+	if before != 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var messages []ChatMessage
+	if err := query.Order("id DESC").Limit(limit).Find(&messages).Error; err != nil {
+		return nil, fmt.Errorf("failed to get chat messages: %w", err)
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// GetMessagesAfter returns up to limit messages of a room with a sequence
+// number after seq, in sequence order
+func (r *ChatMessageRepository) GetMessagesAfter(roomID string, seq uint64, limit int) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	err := r.db.Preload("Reactions", orderReactions).Preload("Attachment").Where("room_id = ? AND seq > ?", roomID, seq).Order("seq ASC").Limit(limit).Find(&messages).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat messages: %w", err)
+	}
+	return messages, nil
+}
+
+// GetMessageBySeq returns the message of a room with the given sequence number
+func (r *ChatMessageRepository) GetMessageBySeq(roomID string, seq uint64) (*ChatMessage, error) {
+	var message ChatMessage
+	err := r.db.Preload("Reactions", orderReactions).Preload("Attachment").Where("room_id = ? AND seq = ?", roomID, seq).First(&message).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrChatMessageNotFound
+		}
+		return nil, fmt.Errorf("failed to get chat message: %w", err)
+	}
+	return &message, nil
+}
+
+// UpdateMessage saves an edited or deleted message
+func (r *ChatMessageRepository) UpdateMessage(message *ChatMessage) error {
+	err := r.db.Model(message).Select("Text", "EditedAt", "DeletedAt", "AttachmentID").Updates(message).Error
+	if err != nil {
+		return fmt.Errorf("failed to update chat message: %w", err)
+	}
+	return nil
+}
+
+// ToggleReaction adds a reaction, or removes it if the same person, by
+// SenderKey, already reacted to the message with the same emoji. It reports
+// whether the reaction was added.
+func (r *ChatMessageRepository) ToggleReaction(reaction *ChatReaction) (bool, error) {
+	added := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("message_id = ? AND sender_key = ? AND emoji = ?", reaction.MessageID, reaction.SenderKey, reaction.Emoji).Delete(&ChatReaction{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			return nil
+		}
+		added = true
+		return tx.Create(reaction).Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to toggle chat reaction: %w", err)
+	}
+	return added, nil
+}
+
+// DeleteMessages removes a room's whole chat history
+func (r *ChatMessageRepository) DeleteMessages(roomID string) error {
+	if err := r.db.Where("room_id = ?", roomID).Delete(&ChatMessage{}).Error; err != nil {
+		return fmt.Errorf("failed to delete chat messages: %w", err)
+	}
+	return nil
+}
+
+// orderReactions lists a message's reactions in the order they were added
+func orderReactions(db *gorm.DB) *gorm.DB {
+	return db.Order("id ASC")
+}
+
+// LatestSeq returns the highest sequence number stored for a room, 0 if none
+func (r *ChatMessageRepository) LatestSeq(roomID string) (uint64, error) {
+	var seq uint64
+	err := r.db.Model(&ChatMessage{}).Where("room_id = ?", roomID).Select("COALESCE(MAX(seq), 0)").Scan(&seq).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to get latest chat sequence: %w", err)
+	}
+	return seq, nil
+}
+
+type ChatAttachmentRepositoryInterface interface {
+	CreateAttachment(attachment *ChatAttachment) error
+	GetAttachment(id string) (*ChatAttachment, error)
+	DeleteAttachment(id string) error
+}
+
+type ChatAttachmentRepository struct {
+	db *gorm.DB
+}
+
+func NewChatAttachmentRepository(db *gorm.DB) ChatAttachmentRepositoryInterface {
+	return &ChatAttachmentRepository{db: db}
+}
+
+func (r *ChatAttachmentRepository) CreateAttachment(attachment *ChatAttachment) error {
+	if err := r.db.Create(attachment).Error; err != nil {
+		return fmt.Errorf("failed to create chat attachment: %w", err)
+	}
+	return nil
+}
+
+func (r *ChatAttachmentRepository) GetAttachment(id string) (*ChatAttachment, error) {
+	var attachment ChatAttachment
+	err := r.db.Where("id = ?", id).First(&attachment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("chat attachment not found")
+		}
+		return nil, fmt.Errorf("failed to get chat attachment: %w", err)
+	}
+	return &attachment, nil
+}
+
+// DeleteAttachment removes an attachment's record; messages sharing it lose
+// their link to it. The files stay in the blob store.
+func (r *ChatAttachmentRepository) DeleteAttachment(id string) error {
+	if err := r.db.Where("id = ?", id).Delete(&ChatAttachment{}).Error; err != nil {
+		return fmt.Errorf("failed to delete chat attachment: %w", err)
+	}
+	return nil
+}
+
+type ChatModerationRepositoryInterface interface {
+	CreateEvent(event *ChatModerationEvent) error
+	GetEvents(roomID string, before uint64, limit int) ([]ChatModerationEvent, error)
+}
+
+type ChatModerationRepository struct {
+	db *gorm.DB
+}
+
+func NewChatModerationRepository(db *gorm.DB) ChatModerationRepositoryInterface {
+	return &ChatModerationRepository{db: db}
+}
+
+func (r *ChatModerationRepository) CreateEvent(event *ChatModerationEvent) error {
+	if err := r.db.Create(event).Error; err != nil {
+		return fmt.Errorf("failed to create chat moderation event: %w", err)
+	}
+	return nil
+}
+
+// GetEvents returns up to limit moderation events of a room older than the
+// event with ID before, or the latest ones if before is 0. They are
+// returned newest first.
+func (r *ChatModerationRepository) GetEvents(roomID string, before uint64, limit int) ([]ChatModerationEvent, error) {
+	query := r.db.Where("room_id = ?", roomID)
+	if before != 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var events []ChatModerationEvent
+	if err := query.Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+		return nil, fmt.Errorf("failed to get chat moderation events: %w", err)
+	}
+	return events, nil
+}
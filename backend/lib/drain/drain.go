@@ -0,0 +1,79 @@
+// Package drain lets a server stop taking new sessions and wait for the
+// ones it has to end, so it can restart without dropping them mid-frame.
+package drain
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// minRetry is the least a client is told to wait before reconnecting
+	minRetry = time.Second
+
+	// retryWindow spreads reconnections out, so clients of a restarting
+	// server do not all come back at once
+	retryWindow = 5 * time.Second
+)
+
+// RetryAfter picks how long a client should wait before reconnecting
+func RetryAfter() time.Duration {
+	return minRetry + time.Duration(rand.Int63n(int64(retryWindow)))
+}
+
+// Gate admits sessions until it is closed. The zero value is open.
+type Gate struct {
+	mutex    sync.Mutex
+	closed   bool
+	sessions sync.WaitGroup
+}
+
+// Enter starts a session. It returns false once the gate is closed; the
+// caller must Leave for every session that entered.
+func (g *Gate) Enter() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.closed {
+		return false
+	}
+	g.sessions.Add(1)
+	return true
+}
+
+// Leave ends a session
+func (g *Gate) Leave() {
+	g.sessions.Done()
+}
+
+// Close stops admitting sessions. It is safe to call more than once.
+func (g *Gate) Close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.closed = true
+}
+
+// Closed reports whether the gate was closed
+func (g *Gate) Closed() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.closed
+}
+
+// Wait blocks until every session has left or ctx is done. Call it after
+// Close, so no session can enter while it waits.
+func (g *Gate) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,114 @@
+package drain
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGate(t *testing.T) {
+	var gate Gate
+	if gate.Closed() {
+		t.Fatal("zero gate is closed")
+	}
+	if !gate.Enter() {
+		t.Fatal("zero gate refused a session")
+	}
+
+	gate.Close()
+	gate.Close() // Closing twice is fine
+	if !gate.Closed() {
+		t.Fatal("gate is open after Close")
+	}
+	if gate.Enter() {
+		t.Fatal("closed gate admitted a session")
+	}
+
+	// The session that entered before Close holds Wait up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := gate.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait with a session in = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- gate.Wait(context.Background()) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("Wait returned %v before the session left", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	gate.Leave()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("Wait = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return once the session left")
+	}
+}
+
+func TestWaitWithoutSessions(t *testing.T) {
+	var gate Gate
+	gate.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := gate.Wait(ctx); err != nil {
+		t.Fatalf("Wait = %v, want nil", err)
+	}
+}
+
+func TestCloseWhileSessionsEnter(t *testing.T) {
+	var gate Gate
+	var inside atomic.Int64 // Sessions between Enter and Leave
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !gate.Enter() {
+					continue
+				}
+				inside.Add(1)
+				time.Sleep(time.Millisecond)
+				inside.Add(-1)
+				gate.Leave()
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	gate.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := gate.Wait(ctx); err != nil {
+		t.Fatalf("Wait = %v, want nil", err)
+	}
+
+	// Nobody entered after Close, so Wait saw everyone leave
+	if n := inside.Load(); n != 0 {
+		t.Fatalf("%d sessions still inside after Wait", n)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRetryAfter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if retry := RetryAfter(); retry < minRetry || retry >= minRetry+retryWindow {
+			t.Fatalf("RetryAfter = %v, want within [%v, %v)", retry, minRetry, minRetry+retryWindow)
+		}
+	}
+}
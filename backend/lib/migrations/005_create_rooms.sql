@@ -0,0 +1,47 @@
+-- 005_create_rooms.sql
+-- Persistent rooms owned by registered users
+
+-- Create rooms table
+CREATE TABLE IF NOT EXISTS rooms (
+    id VARCHAR(64) PRIMARY KEY,
+    owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title VARCHAR(255) NOT NULL DEFAULT '',
+    max_participants INTEGER NOT NULL DEFAULT 6,
+    privacy_mode VARCHAR(20) NOT NULL DEFAULT 'open',
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes for rooms table
+CREATE INDEX IF NOT EXISTS idx_rooms_owner_id ON rooms(owner_id);
+CREATE INDEX IF NOT EXISTS idx_rooms_expires_at ON rooms(expires_at);
+
+-- Allowed privacy modes on rooms
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint WHERE conname = 'chk_rooms_privacy_mode'
+    ) THEN
+        ALTER TABLE rooms ADD CONSTRAINT chk_rooms_privacy_mode
+        CHECK (privacy_mode IN ('open', 'members'));
+    END IF;
+END;
+$$;
+
+-- Rooms must allow at least two participants
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint WHERE conname = 'chk_rooms_max_participants'
+    ) THEN
+        ALTER TABLE rooms ADD CONSTRAINT chk_rooms_max_participants
+        CHECK (max_participants >= 2);
+    END IF;
+END;
+$$;
+
+-- Create trigger for updated_at
+DROP TRIGGER IF EXISTS update_rooms_updated_at ON rooms;
+CREATE TRIGGER update_rooms_updated_at BEFORE UPDATE ON rooms
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
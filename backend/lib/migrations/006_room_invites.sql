@@ -0,0 +1,7 @@
+-- 006_room_invites.sql
+-- Invite-only privacy mode for rooms
+
+-- Allow the invite privacy mode
+ALTER TABLE rooms DROP CONSTRAINT IF EXISTS chk_rooms_privacy_mode;
+ALTER TABLE rooms ADD CONSTRAINT chk_rooms_privacy_mode
+    CHECK (privacy_mode IN ('open', 'members', 'invite'));
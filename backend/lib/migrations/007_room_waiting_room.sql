@@ -0,0 +1,5 @@
+-- 007_room_waiting_room.sql
+-- Waiting room setting for rooms
+
+-- Hold joiners until a host admits them
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS waiting_room BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,23 @@
+-- 008_create_recordings.sql
+-- Server-side call recordings
+
+-- One row per recorded track; the files of one recording share a session
+CREATE TABLE IF NOT EXISTS recordings (
+    id SERIAL PRIMARY KEY,
+    room_id VARCHAR(64) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    session VARCHAR(64) NOT NULL,
+    participant_id VARCHAR(64) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    kind VARCHAR(10) NOT NULL,
+    format VARCHAR(10) NOT NULL,
+    path TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    started_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    started_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes for recordings table
+CREATE INDEX IF NOT EXISTS idx_recordings_room_id ON recordings(room_id, started_at DESC);
+CREATE INDEX IF NOT EXISTS idx_recordings_session ON recordings(session);
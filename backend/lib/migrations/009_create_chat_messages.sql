@@ -0,0 +1,17 @@
+-- 009_create_chat_messages.sql
+-- Chat history
+
+-- Chat messages, kept for late joiners and scrolling back. Rooms created
+-- without an account are not in the rooms table, so room_id has no foreign key.
+CREATE TABLE IF NOT EXISTS chat_messages (
+    id BIGSERIAL PRIMARY KEY,
+    room_id VARCHAR(64) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    sender VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL DEFAULT 'chat',
+    text TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Pages of a room's history are read newest first
+CREATE INDEX IF NOT EXISTS idx_chat_messages_room_id ON chat_messages(room_id, id DESC);
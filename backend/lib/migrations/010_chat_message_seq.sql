@@ -0,0 +1,7 @@
+-- 010_chat_message_seq.sql
+-- Chat sequence numbers
+
+-- Per-room sequence number, so reconnecting clients can ask for what they missed
+ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS seq BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_chat_messages_room_seq ON chat_messages(room_id, seq);
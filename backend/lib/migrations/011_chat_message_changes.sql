@@ -0,0 +1,17 @@
+-- 011_chat_message_changes.sql
+-- Chat message edits, deletions and reactions
+
+-- Deleted messages keep their row, without text, so replays show where they were
+ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP;
+ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+-- One row per person and emoji on a message
+CREATE TABLE IF NOT EXISTS chat_reactions (
+    id BIGSERIAL PRIMARY KEY,
+    message_id BIGINT NOT NULL REFERENCES chat_messages(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    sender VARCHAR(255) NOT NULL,
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (message_id, sender, emoji)
+);
@@ -0,0 +1,23 @@
+-- 012_create_chat_attachments.sql
+-- Files uploaded to chat
+
+-- The files themselves live in the blob store under storage_key. IDs are
+-- random UUIDs, which makes the download links unguessable.
+CREATE TABLE IF NOT EXISTS chat_attachments (
+    id VARCHAR(36) PRIMARY KEY,
+    room_id VARCHAR(64) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    thumbnail_key VARCHAR(255),
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_attachments_room_id ON chat_attachments(room_id);
+
+-- Messages sharing a file point at it
+ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS attachment_id VARCHAR(36) REFERENCES chat_attachments(id) ON DELETE SET NULL;
@@ -0,0 +1,23 @@
+-- 013_chat_moderation.sql
+-- Chat moderation settings and audit log
+
+-- Per-room overrides of the server's moderation defaults; NULL keeps them all
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS chat_moderation JSONB;
+
+-- Messages moderation flagged, masked or rejected, for hosts to review.
+-- Rooms created without an account are not in the rooms table, so room_id
+-- has no foreign key.
+CREATE TABLE IF NOT EXISTS chat_moderation_events (
+    id BIGSERIAL PRIMARY KEY,
+    room_id VARCHAR(64) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    sender VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    text TEXT NOT NULL,
+    action VARCHAR(20) NOT NULL,
+    rules VARCHAR(255) NOT NULL,
+    reasons TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_moderation_events_room_id ON chat_moderation_events(room_id, id DESC);
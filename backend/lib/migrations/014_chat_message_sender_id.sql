@@ -0,0 +1,6 @@
+-- 014_chat_message_sender_id.sql
+-- Participant ID of the connection that sent a chat message
+
+-- Guests have no account, so only the connection that sent a message may
+-- change it; the ID is issued by the server and cannot be claimed by name
+ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS sender_id VARCHAR(64);
@@ -0,0 +1,10 @@
+-- 015_room_tombstones.sql
+-- IDs of rooms that were deleted or expired
+
+-- Joining a room ID nobody saved creates an anonymous room, so IDs of
+-- retired rooms are kept to stop anyone from reopening them that way
+CREATE TABLE IF NOT EXISTS room_tombstones (
+    id VARCHAR(64) PRIMARY KEY,
+    reason VARCHAR(10) NOT NULL,
+    retired_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,17 @@
+-- 016_room_bans.sql
+-- People hosts banned from saved rooms
+
+-- A room's live state is dropped once everyone leaves, so bans are kept
+-- here as well. Signed-in users are banned by account, guests by address.
+CREATE TABLE IF NOT EXISTS room_bans (
+    id SERIAL PRIMARY KEY,
+    room_id VARCHAR(64) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    ip VARCHAR(45),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((user_id IS NULL) <> (ip IS NULL))
+);
+
+-- Indexes for room_bans table; banning someone twice keeps one row
+CREATE UNIQUE INDEX IF NOT EXISTS idx_room_bans_user ON room_bans(room_id, user_id) WHERE user_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_room_bans_ip ON room_bans(room_id, ip) WHERE ip IS NOT NULL;
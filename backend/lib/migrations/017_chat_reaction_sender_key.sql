@@ -0,0 +1,14 @@
+-- 017_chat_reaction_sender_key.sql
+-- Who reacted to a chat message, by account or connection
+
+-- Names are chosen by guests and change with /nick, so reactions are told
+-- apart by "user:<id>" for signed-in users and "guest:<participant ID>"
+-- for guests. Earlier guest reactions only have a name and keep it.
+ALTER TABLE chat_reactions ADD COLUMN IF NOT EXISTS sender_key VARCHAR(80);
+UPDATE chat_reactions
+SET sender_key = CASE WHEN user_id IS NOT NULL THEN 'user:' || user_id ELSE 'name:' || sender END
+WHERE sender_key IS NULL;
+ALTER TABLE chat_reactions ALTER COLUMN sender_key SET NOT NULL;
+
+ALTER TABLE chat_reactions DROP CONSTRAINT IF EXISTS chat_reactions_message_id_sender_emoji_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_reactions_sender_key ON chat_reactions(message_id, sender_key, emoji);
@@ -2,5 +2,5 @@ package migrations
 
 import "embed"
 
-//go:embed 001_initial_schema.sql 002_add_indexes.sql 003_seed_data.sql 004_enhanced_indexes.sql
+//go:embed 001_initial_schema.sql 002_add_indexes.sql 003_seed_data.sql 004_enhanced_indexes.sql 005_create_rooms.sql 006_room_invites.sql 007_room_waiting_room.sql 008_create_recordings.sql 009_create_chat_messages.sql 010_chat_message_seq.sql 011_chat_message_changes.sql 012_create_chat_attachments.sql 013_chat_moderation.sql 014_chat_message_sender_id.sql 015_room_tombstones.sql 016_room_bans.sql 017_chat_reaction_sender_key.sql
 var EmbeddedMigrations embed.FS
\ No newline at end of file
@@ -33,6 +33,16 @@ type MetricsCollector struct {
 	ActiveWebRTCStreams int64
 	DataTransferred     int64
 	
+	// Signalling queue metrics
+	SignalQueueDepth        int64
+	PeakSignalQueueDepth    int64
+	DroppedSignalFrames     int64
+	SlowConsumerDisconnects int64
+	
+	// WebSocket rate limiting metrics
+	RateLimitedFrames    int64
+	RateLimitDisconnects int64
+	
 	// Timestamps
 	LastUpdated         time.Time
 	StartTime          time.Time
@@ -90,6 +100,48 @@ func (m *MetricsCollector) IncrementFailedQueries() {
 	m.LastUpdated = time.Now()
 }
 
+// AddSignalQueueDepth adjusts the number of frames waiting in participant send queues
+func (m *MetricsCollector) AddSignalQueueDepth(delta int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.SignalQueueDepth += delta
+	if m.SignalQueueDepth < 0 {
+		m.SignalQueueDepth = 0
+	}
+	if m.SignalQueueDepth > m.PeakSignalQueueDepth {
+		m.PeakSignalQueueDepth = m.SignalQueueDepth
+	}
+	m.LastUpdated = time.Now()
+}
+
+func (m *MetricsCollector) IncrementDroppedSignalFrames() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.DroppedSignalFrames++
+	m.LastUpdated = time.Now()
+}
+
+func (m *MetricsCollector) IncrementSlowConsumerDisconnects() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.SlowConsumerDisconnects++
+	m.LastUpdated = time.Now()
+}
+
+func (m *MetricsCollector) IncrementRateLimitedFrames() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.RateLimitedFrames++
+	m.LastUpdated = time.Now()
+}
+
+func (m *MetricsCollector) IncrementRateLimitDisconnects() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.RateLimitDisconnects++
+	m.LastUpdated = time.Now()
+}
+
 func (m *MetricsCollector) GetSnapshot() map[string]interface{} {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -112,6 +164,12 @@ func (m *MetricsCollector) GetSnapshot() map[string]interface{} {
 		"error_rate":           m.ErrorRate,
 		"active_webrtc_streams": m.ActiveWebRTCStreams,
 		"data_transferred_mb":   float64(m.DataTransferred) / (1024 * 1024),
+		"signal_queue_depth":    m.SignalQueueDepth,
+		"peak_signal_queue_depth": m.PeakSignalQueueDepth,
+		"dropped_signal_frames": m.DroppedSignalFrames,
+		"slow_consumer_disconnects": m.SlowConsumerDisconnects,
+		"rate_limited_frames": m.RateLimitedFrames,
+		"rate_limit_disconnects": m.RateLimitDisconnects,
 		"last_updated":         m.LastUpdated.Unix(),
 	}
 }
\ No newline at end of file
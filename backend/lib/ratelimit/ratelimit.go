@@ -0,0 +1,302 @@
+// Package ratelimit throttles the frames clients send over a WebSocket.
+//
+// Every connection gets a token bucket per class of frame, and every
+// signed-in user gets buckets shared by all of their connections on this
+// server. A frame is only let through if both have a token left. Frames
+// over budget are dropped; a client that keeps sending them is warned, then
+// muted for a while, then disconnected. Users are remembered for a while
+// after they disconnect, so reconnecting does not lift a mute. Guests have
+// nothing that identifies them across connections, so each of their
+// connections is limited on its own.
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"seaside/lib/monitoring"
+)
+
+// Class groups the frames that share a budget
+type Class string
+
+const (
+	ClassChat   Class = "chat"   // Messages, edits, reactions and attachments
+	ClassTyping Class = "typing" // Typing and status updates
+	ClassICE    Class = "ice"    // Trickled ICE candidates
+	ClassOther  Class = "other"  // Everything else: offers, answers, pings, host commands
+)
+
+// Budget is the size and refill rate of a token bucket
+type Budget struct {
+	Rate  float64 // Tokens added per second
+	Burst float64 // Most tokens the bucket holds, i.e. the longest burst allowed
+}
+
+// Policy sets the budgets of a group of connections and how it treats
+// clients that exceed them
+type Policy struct {
+	Connection map[Class]Budget // Per connection; classes not listed are not limited
+	User       map[Class]Budget // Shared by all connections of a user
+
+	// A client whose frames were dropped is warned once, muted after
+	// MuteAfter dropped frames and disconnected instead of muted a
+	// (MaxMutes+1)th time. The count starts over once nothing was dropped
+	// for Cooldown.
+	MuteAfter int
+	MuteFor   time.Duration
+	MaxMutes  int
+	Cooldown  time.Duration
+	Muted     []Class // Classes dropped while a client is muted
+}
+
+// DefaultPolicy allows what a well-behaved client sends, with room for an
+// ICE gathering burst towards several peers at once
+func DefaultPolicy() Policy {
+	return Policy{
+		Connection: map[Class]Budget{
+			ClassChat:   {Rate: 1, Burst: 5},
+			ClassTyping: {Rate: 2, Burst: 5},
+			ClassICE:    {Rate: 20, Burst: 200},
+			ClassOther:  {Rate: 10, Burst: 40},
+		},
+		User: map[Class]Budget{
+			ClassChat:   {Rate: 2, Burst: 10},
+			ClassTyping: {Rate: 4, Burst: 10},
+			ClassICE:    {Rate: 40, Burst: 400},
+			ClassOther:  {Rate: 20, Burst: 80},
+		},
+		MuteAfter: 10,
+		MuteFor:   30 * time.Second,
+		MaxMutes:  2,
+		Cooldown:  time.Minute,
+		// Muting the rest would break the call or make the client think
+		// its connection died
+		Muted: []Class{ClassChat, ClassTyping},
+	}
+}
+
+// UserKey identifies whose per-user budgets a connection shares. Guests get
+// none: guests behind one address, e.g. a school or a carrier's NAT, must
+// not use up each other's budgets or get each other muted.
+func UserKey(userID uint) string {
+	if userID != 0 {
+		return fmt.Sprintf("user:%d", userID)
+	}
+	return ""
+}
+
+// Action is what to do with a frame
+type Action int
+
+const (
+	Allow      Action = iota
+	Drop              // Over budget or muted; drop it quietly
+	Warn              // Drop it and warn the client to slow down
+	Mute              // Drop it and tell the client it is muted until MutedUntil
+	Disconnect        // Drop it and close the connection
+)
+
+// bucket is a token bucket, refilled lazily when it is used
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one
+func (b *bucket) take(budget Budget, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = budget.Burst
+	} else {
+		b.tokens = min(budget.Burst, b.tokens+now.Sub(b.last).Seconds()*budget.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// record tracks how a client has been treating its budgets
+type record struct {
+	dropped    int // Frames dropped since the last cooldown
+	mutes      int
+	lastDrop   time.Time
+	mutedUntil time.Time
+}
+
+// user holds what is shared by one user's connections
+type user struct {
+	buckets     map[Class]*bucket
+	record      record
+	connections int
+	left        time.Time // When the last connection closed
+}
+
+// Group hands out limiters that share per-user budgets
+type Group struct {
+	policy Policy
+
+	mutex     sync.Mutex
+	users     map[string]*user
+	lastSweep time.Time
+}
+
+// NewGroup creates a group of connections limited by a policy
+func NewGroup(policy Policy) *Group {
+	return &Group{
+		policy: policy,
+		users:  make(map[string]*user),
+	}
+}
+
+// Connect returns the limiter of a new connection. Connections with the
+// same user key share the per-user budgets; an empty key has none.
+func (g *Group) Connect(userKey string) *Limiter {
+	l := &Limiter{
+		group:   g,
+		buckets: make(map[Class]*bucket),
+	}
+	if userKey == "" {
+		return l
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.sweep(time.Now())
+	u := g.users[userKey]
+	if u == nil {
+		u = &user{buckets: make(map[Class]*bucket)}
+		g.users[userKey] = u
+	}
+	u.connections++
+	l.userKey, l.user = userKey, u
+	return l
+}
+
+// sweep forgets users who left more than a cooldown ago, at most once per
+// cooldown. The caller holds the mutex.
+func (g *Group) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.policy.Cooldown {
+		return
+	}
+	g.lastSweep = now
+	for key, u := range g.users {
+		if u.connections == 0 && now.Sub(u.left) > g.policy.Cooldown {
+			delete(g.users, key)
+		}
+	}
+}
+
+// Limiter meters the frames of one connection
+type Limiter struct {
+	group   *Group
+	userKey string
+	user    *user
+	buckets map[Class]*bucket
+	record  record // Used for connections without a user
+}
+
+// Check decides what happens to a frame of the given class
+func (l *Limiter) Check(class Class) Action {
+	now := time.Now()
+	g := l.group
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	r := l.currentRecord()
+	if now.Before(r.mutedUntil) && g.mutes(class) {
+		return g.drop(r, now)
+	}
+
+	if !take(l.buckets, class, g.policy.Connection, now) {
+		return g.drop(r, now)
+	}
+	if l.user != nil && !take(l.user.buckets, class, g.policy.User, now) {
+		return g.drop(r, now)
+	}
+	return Allow
+}
+
+// mutes reports whether muted clients may not send frames of a class
+func (g *Group) mutes(class Class) bool {
+	for _, muted := range g.policy.Muted {
+		if muted == class {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes a token from the bucket of a class, if that class is limited
+func take(buckets map[Class]*bucket, class Class, budgets map[Class]Budget, now time.Time) bool {
+	budget, ok := budgets[class]
+	if !ok {
+		return true
+	}
+	b := buckets[class]
+	if b == nil {
+		b = &bucket{}
+		buckets[class] = b
+	}
+	return b.take(budget, now)
+}
+
+// drop counts a dropped frame and escalates if the client keeps going.
+// The caller holds the mutex.
+func (g *Group) drop(r *record, now time.Time) Action {
+	if now.Sub(r.lastDrop) > g.policy.Cooldown {
+		r.dropped, r.mutes = 0, 0
+	}
+	r.lastDrop = now
+	r.dropped++
+	monitoring.GlobalMetrics.IncrementRateLimitedFrames()
+
+	switch {
+	case r.dropped == 1:
+		return Warn
+	case g.policy.MuteAfter > 0 && r.dropped%g.policy.MuteAfter == 0:
+		r.mutes++
+		if r.mutes > g.policy.MaxMutes {
+			monitoring.GlobalMetrics.IncrementRateLimitDisconnects()
+			return Disconnect
+		}
+		r.mutedUntil = now.Add(g.policy.MuteFor)
+		return Mute
+	}
+	return Drop
+}
+
+// currentRecord returns the record of the connection's user, or of the
+// connection itself if it has none
+func (l *Limiter) currentRecord() *record {
+	if l.user != nil {
+		return &l.user.record
+	}
+	return &l.record
+}
+
+// MutedUntil returns when the current mute ends
+func (l *Limiter) MutedUntil() time.Time {
+	l.group.mutex.Lock()
+	defer l.group.mutex.Unlock()
+	return l.currentRecord().mutedUntil
+}
+
+// Close releases the connection's share of its user's budgets
+func (l *Limiter) Close() {
+	if l.user == nil {
+		return
+	}
+
+	g := l.group
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	l.user.connections--
+	if l.user.connections == 0 {
+		l.user.left = time.Now()
+	}
+	l.user = nil
+}
@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// testPolicy lets one chat frame through and never refills, so every frame
+// after the first is over budget
+func testPolicy() Policy {
+	return Policy{
+		Connection: map[Class]Budget{ClassChat: {Rate: 0, Burst: 1}},
+		User:       map[Class]Budget{ClassChat: {Rate: 0, Burst: 1}},
+		MuteAfter:  3,
+		MuteFor:    time.Minute,
+		MaxMutes:   1,
+		Cooldown:   time.Minute,
+		Muted:      []Class{ClassChat},
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	tests := []struct {
+		name    string
+		userKey string
+		want    []Action
+	}{
+		{
+			name:    "signed-in user",
+			userKey: UserKey(1),
+			want:    []Action{Allow, Warn, Drop, Mute, Drop, Drop, Disconnect},
+		},
+		{
+			name:    "guest",
+			userKey: UserKey(0),
+			want:    []Action{Allow, Warn, Drop, Mute, Drop, Drop, Disconnect},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewGroup(testPolicy()).Connect(tt.userKey)
+			defer limiter.Close()
+
+			for i, want := range tt.want {
+				if got := limiter.Check(ClassChat); got != want {
+					t.Fatalf("frame %d: Check = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMuteOnlyCoversMutedClasses(t *testing.T) {
+	policy := testPolicy()
+	policy.MuteAfter = 2
+	limiter := NewGroup(policy).Connect(UserKey(1))
+	defer limiter.Close()
+
+	for _, want := range []Action{Allow, Warn, Mute} {
+		if got := limiter.Check(ClassChat); got != want {
+			t.Fatalf("Check(chat) = %v, want %v", got, want)
+		}
+	}
+	if limiter.MutedUntil().Before(time.Now()) {
+		t.Fatal("limiter is not muted")
+	}
+	// ICE candidates are neither limited nor muted by this policy
+	if got := limiter.Check(ClassICE); got != Allow {
+		t.Fatalf("Check(ice) while muted = %v, want %v", got, Allow)
+	}
+}
+
+func TestConnectionsShareBudgets(t *testing.T) {
+	tests := []struct {
+		name       string
+		first      string
+		second     string
+		wantSecond Action // First frame of the second connection
+	}{
+		{"same user", UserKey(1), UserKey(1), Warn},
+		{"different users", UserKey(1), UserKey(2), Allow},
+		{"guests", UserKey(0), UserKey(0), Allow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := NewGroup(testPolicy())
+			first := group.Connect(tt.first)
+			defer first.Close()
+			second := group.Connect(tt.second)
+			defer second.Close()
+
+			if got := first.Check(ClassChat); got != Allow {
+				t.Fatalf("first connection: Check = %v, want %v", got, Allow)
+			}
+			if got := second.Check(ClassChat); got != tt.wantSecond {
+				t.Fatalf("second connection: Check = %v, want %v", got, tt.wantSecond)
+			}
+		})
+	}
+}
+
+func TestReconnectingKeepsMute(t *testing.T) {
+	policy := testPolicy()
+	policy.MuteAfter = 2
+	group := NewGroup(policy)
+
+	limiter := group.Connect(UserKey(1))
+	for _, want := range []Action{Allow, Warn, Mute} {
+		if got := limiter.Check(ClassChat); got != want {
+			t.Fatalf("Check(chat) = %v, want %v", got, want)
+		}
+	}
+	limiter.Close()
+
+	limiter = group.Connect(UserKey(1))
+	defer limiter.Close()
+	if limiter.MutedUntil().Before(time.Now()) {
+		t.Fatal("reconnecting lifted the mute")
+	}
+	if got := limiter.Check(ClassChat); got != Drop {
+		t.Fatalf("Check after reconnecting = %v, want %v", got, Drop)
+	}
+}
+
+func TestBucketRefills(t *testing.T) {
+	budget := Budget{Rate: 2, Burst: 2}
+	start := time.Now()
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  bool
+	}{
+		{"full bucket", 0, true},
+		{"second token of the burst", 0, true},
+		{"empty bucket", 0, false},
+		{"refilled a token", 500 * time.Millisecond, true},
+		{"empty again", 500 * time.Millisecond, false},
+		{"refills no more than the burst", time.Hour, true},
+		{"burst token", time.Hour, true},
+		{"past the burst", time.Hour, false},
+	}
+
+	var b bucket
+	for _, tt := range tests {
+		if got := b.take(budget, start.Add(tt.after)); got != tt.want {
+			t.Fatalf("%s: take = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUserKey(t *testing.T) {
+	tests := []struct {
+		userID uint
+		want   string
+	}{
+		{0, ""},
+		{1, "user:1"},
+		{42, "user:42"},
+	}
+	for _, tt := range tests {
+		if got := UserKey(tt.userID); got != tt.want {
+			t.Errorf("UserKey(%d) = %q, want %q", tt.userID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package roomstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps room state in process. It is the default store and is
+// only suitable for a single backend instance.
+type MemoryStore struct {
+	mutex         sync.RWMutex
+	rooms         map[string]RoomInfo
+	members       map[string]map[string]Member // scope channel -> member ID -> member
+	seqs          map[string]uint64            // room ID -> last chat sequence number
+	subscriptions map[string][]*queuedSubscription
+}
+
+// NewMemoryStore creates an empty in-process store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		rooms:         make(map[string]RoomInfo),
+		members:       make(map[string]map[string]Member),
+		seqs:          make(map[string]uint64),
+		subscriptions: make(map[string][]*queuedSubscription),
+	}
+}
+
+func (s *MemoryStore) CreateRoom(ctx context.Context, info RoomInfo) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.rooms[info.ID]; exists {
+		return false, nil
+	}
+	s.rooms[info.ID] = info
+	return true, nil
+}
+
+func (s *MemoryStore) GetRoom(ctx context.Context, roomID string) (*RoomInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	info, exists := s.rooms[roomID]
+	if !exists {
+		return nil, ErrRoomNotFound
+	}
+	return &info, nil
+}
+
+func (s *MemoryStore) UpdateRoom(ctx context.Context, roomID string, update func(info *RoomInfo) error) (*RoomInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info, exists := s.rooms[roomID]
+	if !exists {
+		return nil, ErrRoomNotFound
+	}
+	if err := update(&info); err != nil {
+		return nil, err
+	}
+	s.rooms[roomID] = info
+	return &info, nil
+}
+
+func (s *MemoryStore) DeleteRoom(ctx context.Context, roomID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.rooms, roomID)
+	delete(s.seqs, roomID)
+	for _, scope := range Scopes {
+		delete(s.members, Channel(scope, roomID))
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteRoomIfEmpty(ctx context.Context, roomID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, scope := range Scopes {
+		if len(s.members[Channel(scope, roomID)]) > 0 {
+			return nil
+		}
+	}
+	delete(s.rooms, roomID)
+	delete(s.seqs, roomID)
+	for _, scope := range Scopes {
+		delete(s.members, Channel(scope, roomID))
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListRooms(ctx context.Context) ([]RoomInfo, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rooms := make([]RoomInfo, 0, len(s.rooms))
+	for _, info := range s.rooms {
+		rooms = append(rooms, info)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].CreatedAt.Before(rooms[j].CreatedAt)
+	})
+	return rooms, nil
+}
+
+func (s *MemoryStore) AddMember(ctx context.Context, scope, roomID string, member Member) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := Channel(scope, roomID)
+	if s.members[key] == nil {
+		s.members[key] = make(map[string]Member)
+	}
+	s.members[key][member.ID] = member
+	return nil
+}
+
+func (s *MemoryStore) AddMemberWithin(ctx context.Context, scope, roomID string, member Member, limit int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := Channel(scope, roomID)
+	if s.members[key] == nil {
+		s.members[key] = make(map[string]Member)
+	}
+	if _, exists := s.members[key][member.ID]; !exists && len(s.members[key]) >= limit {
+		return ErrRoomFull
+	}
+	s.members[key][member.ID] = member
+	return nil
+}
+
+func (s *MemoryStore) UpdateMember(ctx context.Context, scope, roomID, memberID string, update func(member *Member)) (*Member, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := Channel(scope, roomID)
+	member, exists := s.members[key][memberID]
+	if !exists {
+		return nil, ErrMemberNotFound
+	}
+	update(&member)
+	s.members[key][memberID] = member
+	return &member, nil
+}
+
+func (s *MemoryStore) RemoveMember(ctx context.Context, scope, roomID, memberID string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := Channel(scope, roomID)
+	delete(s.members[key], memberID)
+	remaining := len(s.members[key])
+	if remaining == 0 {
+		delete(s.members, key)
+	}
+	return remaining, nil
+}
+
+func (s *MemoryStore) Members(ctx context.Context, scope, roomID string) ([]Member, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	members := make([]Member, 0, len(s.members[Channel(scope, roomID)]))
+	for _, member := range s.members[Channel(scope, roomID)] {
+		members = append(members, member)
+	}
+	sortMembers(members)
+	return members, nil
+}
+
+func (s *MemoryStore) NextSeq(ctx context.Context, roomID string, floor uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seq, exists := s.seqs[roomID]
+	if !exists {
+		seq = floor
+	}
+	seq++
+	s.seqs[roomID] = seq
+	return seq, nil
+}
+
+func (s *MemoryStore) Publish(ctx context.Context, channel string, payload []byte) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, sub := range s.subscriptions[channel] {
+		sub.deliver(payload)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Subscribe(ctx context.Context, channel string, handler Handler, overflow Overflow) (Subscription, error) {
+	var sub *queuedSubscription
+	sub = newQueuedSubscription(channel, handler, overflow, func() {
+		s.unsubscribe(sub)
+	})
+
+	s.mutex.Lock()
+	s.subscriptions[channel] = append(s.subscriptions[channel], sub)
+	s.mutex.Unlock()
+
+	return sub, nil
+}
+
+func (s *MemoryStore) Close() error {
+	s.mutex.Lock()
+	subscriptions := s.subscriptions
+	s.subscriptions = make(map[string][]*queuedSubscription)
+	s.mutex.Unlock()
+
+	for _, subs := range subscriptions {
+		for _, sub := range subs {
+			sub.stop()
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) unsubscribe(target *queuedSubscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subs := s.subscriptions[target.channel]
+	for i, sub := range subs {
+		if sub == target {
+			s.subscriptions[target.channel] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(s.subscriptions[target.channel]) == 0 {
+		delete(s.subscriptions, target.channel)
+	}
+}
+
+// sortMembers orders members by join time so rosters are stable
+func sortMembers(members []Member) {
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].JoinedAt.Before(members[j].JoinedAt)
+	})
+}
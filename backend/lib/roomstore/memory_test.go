@@ -0,0 +1,93 @@
+package roomstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOverflowDropsPayloads(t *testing.T) {
+	tests := []struct {
+		name      string
+		extra     []string // Published once the queue is full
+		canMiss   bool     // What overflow answers
+		wantCalls []string
+	}{
+		{"nothing past the queue", nil, true, nil},
+		{"missable payloads", []string{"ice-1", "ice-2"}, true, []string{"ice-1", "ice-2"}},
+		{"needed payload", []string{"join"}, false, []string{"join"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			defer store.Close()
+			ctx := context.Background()
+
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var mutex sync.Mutex
+			var delivered, overflowed []string
+			sub, err := store.Subscribe(ctx, "channel", func(payload []byte) {
+				if string(payload) == "first" {
+					close(started)
+					<-release
+				}
+				mutex.Lock()
+				delivered = append(delivered, string(payload))
+				mutex.Unlock()
+			}, func(payload []byte) bool {
+				overflowed = append(overflowed, string(payload))
+				return tt.canMiss
+			})
+			if err != nil {
+				t.Fatalf("Subscribe: %v", err)
+			}
+			defer sub.Close()
+
+			// Hold the handler on the first payload, then fill its queue
+			store.Publish(ctx, "channel", []byte("first"))
+			select {
+			case <-started:
+			case <-time.After(waitTimeout):
+				t.Fatal("first payload was not delivered")
+			}
+			for i := 0; i < subscriptionQueueSize; i++ {
+				store.Publish(ctx, "channel", []byte(fmt.Sprint(i)))
+			}
+			for _, payload := range tt.extra {
+				store.Publish(ctx, "channel", []byte(payload))
+			}
+
+			if fmt.Sprint(overflowed) != fmt.Sprint(tt.wantCalls) {
+				t.Fatalf("overflow called with %v, want %v", overflowed, tt.wantCalls)
+			}
+
+			// The queued payloads still arrive, without the dropped ones
+			close(release)
+			deadline := time.After(waitTimeout)
+			for {
+				mutex.Lock()
+				count := len(delivered)
+				mutex.Unlock()
+				if count == 1+subscriptionQueueSize {
+					break
+				}
+				select {
+				case <-deadline:
+					t.Fatalf("delivered %d payloads, want %d", count, 1+subscriptionQueueSize)
+				case <-time.After(time.Millisecond):
+				}
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for i, payload := range delivered[1:] {
+				if want := fmt.Sprint(i); payload != want {
+					t.Fatalf("payload %d = %q, want %q", i, payload, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package roomstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// twoNodes opens two stores sharing one server, like two backend instances
+func twoNodes(t *testing.T) (*RedisStore, *RedisStore) {
+	server := miniredis.RunT(t)
+	first, second := newTestRedisStore(t, server), newTestRedisStore(t, server)
+	t.Cleanup(func() {
+		first.Close()
+		second.Close()
+	})
+	return first, second
+}
+
+func TestRedisUpdateRoomRetries(t *testing.T) {
+	node, other := twoNodes(t)
+	ctx := context.Background()
+	node.CreateRoom(ctx, RoomInfo{ID: "room"})
+
+	// The other node bans someone while this one is locking the room
+	calls := 0
+	info, err := node.UpdateRoom(ctx, "room", func(info *RoomInfo) error {
+		calls++
+		if calls == 1 {
+			if _, err := other.UpdateRoom(ctx, "room", func(info *RoomInfo) error {
+				info.BannedUserIDs = append(info.BannedUserIDs, 7)
+				return nil
+			}); err != nil {
+				t.Fatalf("other node's UpdateRoom: %v", err)
+			}
+		}
+		info.Locked = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateRoom: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("update ran %d times, want 2", calls)
+	}
+	if !info.Locked || len(info.BannedUserIDs) != 1 {
+		t.Fatalf("saved %+v, want the room locked with the other node's ban", info)
+	}
+	if saved, _ := node.GetRoom(ctx, "room"); !saved.Locked || len(saved.BannedUserIDs) != 1 {
+		t.Fatalf("stored %+v, want the room locked with the other node's ban", saved)
+	}
+}
+
+func TestRedisUpdateRoomGivesUp(t *testing.T) {
+	node, other := twoNodes(t)
+	ctx := context.Background()
+	node.CreateRoom(ctx, RoomInfo{ID: "room"})
+
+	// Another node changes the room every time this one reads it
+	calls := 0
+	_, err := node.UpdateRoom(ctx, "room", func(info *RoomInfo) error {
+		calls++
+		other.UpdateRoom(ctx, "room", func(info *RoomInfo) error {
+			info.Topic += "x"
+			return nil
+		})
+		info.Locked = true
+		return nil
+	})
+	if err == nil {
+		t.Fatal("UpdateRoom succeeded while the room kept changing")
+	}
+	if calls != maxUpdateAttempts {
+		t.Fatalf("update ran %d times, want %d", calls, maxUpdateAttempts)
+	}
+	if saved, _ := node.GetRoom(ctx, "room"); saved.Locked {
+		t.Fatal("change was saved after giving up")
+	}
+}
+
+func TestRedisUpdateMemberRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		meanwhile  func(ctx context.Context, other *RedisStore)
+		wantErr    error
+		wantStatus string // Of member a afterwards, empty if gone
+	}{
+		{
+			name: "someone else joins",
+			meanwhile: func(ctx context.Context, other *RedisStore) {
+				other.AddMember(ctx, ScopeChat, "room", Member{ID: "b"})
+			},
+			wantStatus: "away",
+		},
+		{
+			name: "the member leaves",
+			meanwhile: func(ctx context.Context, other *RedisStore) {
+				other.RemoveMember(ctx, ScopeChat, "room", "a")
+			},
+			wantErr: ErrMemberNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, other := twoNodes(t)
+			ctx := context.Background()
+			node.AddMember(ctx, ScopeChat, "room", Member{ID: "a", Status: "active"})
+
+			calls := 0
+			_, err := node.UpdateMember(ctx, ScopeChat, "room", "a", func(member *Member) {
+				calls++
+				if calls == 1 {
+					tt.meanwhile(ctx, other)
+				}
+				member.Status = "away"
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpdateMember = %v, want %v", err, tt.wantErr)
+			}
+
+			status := ""
+			members, _ := node.Members(ctx, ScopeChat, "room")
+			for _, member := range members {
+				if member.ID == "a" {
+					status = member.Status
+				}
+			}
+			if status != tt.wantStatus {
+				t.Fatalf("status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRedisMembersExpire(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server)
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := store.AddMemberWithin(ctx, ScopeVideo, "room", Member{ID: "a"}, 2); err != nil {
+		t.Fatalf("AddMemberWithin: %v", err)
+	}
+	if ttl := server.TTL(memberKey(ScopeVideo, "room")); ttl != memberTTL {
+		t.Fatalf("members expire after %v, want %v", ttl, memberTTL)
+	}
+
+	// A node that died without cleaning up does not hold the room forever
+	server.FastForward(memberTTL)
+	if members, _ := store.Members(ctx, ScopeVideo, "room"); len(members) != 0 {
+		t.Fatalf("members after the TTL = %v, want none", members)
+	}
+}
+
+func TestRedisNextSeqKeepsTheFloorOnce(t *testing.T) {
+	node, other := twoNodes(t)
+	ctx := context.Background()
+
+	// Both nodes start the sequence from history; only the first floor counts
+	if seq, _ := node.NextSeq(ctx, "room", 10); seq != 11 {
+		t.Fatalf("first NextSeq = %d, want 11", seq)
+	}
+	if seq, _ := other.NextSeq(ctx, "room", 10); seq != 12 {
+		t.Fatalf("other node's NextSeq = %d, want 12", seq)
+	}
+}
+
+func TestRedisPublishReachesOtherNodes(t *testing.T) {
+	node, other := twoNodes(t)
+	ctx := context.Background()
+	channel := Channel(ScopeVideo, "room")
+
+	var received [2]chan string
+	for i, store := range []*RedisStore{node, other} {
+		received[i] = make(chan string, 1)
+		ch := received[i]
+		sub, err := store.Subscribe(ctx, channel, func(payload []byte) {
+			ch <- string(payload)
+		}, nil)
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		defer sub.Close()
+	}
+
+	if err := node.Publish(ctx, channel, []byte("hello")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for i := range received {
+		if payload := receive(t, received[i]); payload != "hello" {
+			t.Fatalf("node %d received %q, want %q", i, payload, "hello")
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package roomstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes separate the member lists kept for each realtime feature of a room
+const (
+	ScopeVideo = "video"
+	ScopeChat  = "chat"
+	ScopeLobby = "lobby" // People waiting to be admitted to the call
+)
+
+// Scopes lists every member scope; a room is empty when all of them are
+var Scopes = []string{ScopeVideo, ScopeChat, ScopeLobby}
+
+// Privacy modes; these match the values stored in the rooms table
+const (
+	PrivacyOpen    = "open"    // Guests may join
+	PrivacyMembers = "members" // Only signed-in users and invite holders may join
+	PrivacyInvite  = "invite"  // Only the owner and invite holders may join
+)
+
+// ErrRoomNotFound is returned when a room has no record in the store
+var ErrRoomNotFound = errors.New("room not found")
+
+// ErrMemberNotFound is returned when a participant has no member record
+var ErrMemberNotFound = errors.New("member not found")
+
+// ErrRoomFull is returned when a scope of a room holds its member limit
+var ErrRoomFull = errors.New("room is full")
+
+// ErrRoomClosed is returned when opening a room that was deleted or expired
+var ErrRoomClosed = errors.New("room no longer exists")
+
+// NodeID identifies this backend instance in member records
+var NodeID = newNodeID()
+
+// RoomInfo is the cluster-wide record of a room
+type RoomInfo struct {
+	ID              string     `json:"id"`
+	HostUserID      uint       `json:"hostUserId,omitempty"`      // 0 for rooms created anonymously
+	MaxParticipants int        `json:"maxParticipants,omitempty"` // 0 for the default limit
+	PrivacyMode     string     `json:"privacyMode,omitempty"`     // PrivacyOpen when empty
+	Locked          bool       `json:"locked"`
+	WaitingRoom     bool       `json:"waitingRoom,omitempty"` // Joiners wait for a host to admit them
+	BannedUserIDs   []uint     `json:"bannedUserIds,omitempty"`
+	BannedIPs       []string   `json:"bannedIps,omitempty"` // Guests are banned by address
+	SFU             bool       `json:"sfu,omitempty"`       // Media goes through the server's SFU
+	Topic           string     `json:"topic,omitempty"`     // Set in the chat with /topic
+	CreatedAt       time.Time  `json:"createdAt"`
+	ExpiresAt       *time.Time `json:"expiresAt,omitempty"`
+
+	ChatModeration *ChatModeration `json:"chatModeration,omitempty"` // nil for the server's defaults
+}
+
+// ChatModeration is how strictly a room's chat is moderated. Empty fields
+// keep the server's defaults.
+type ChatModeration struct {
+	Disabled        bool     `json:"disabled,omitempty"`        // Turns every check off
+	BlockedWords    []string `json:"blockedWords,omitempty"`    // On top of the server's word list
+	ProfanityAction string   `json:"profanityAction,omitempty"` // "mask", "reject" or "flag"
+	AllowedDomains  []string `json:"allowedDomains,omitempty"`  // If set, links may only point here
+	BlockedDomains  []string `json:"blockedDomains,omitempty"`
+	LinkAction      string   `json:"linkAction,omitempty"` // "mask", "reject" or "flag"
+	MaxLength       int      `json:"maxLength,omitempty"`  // In characters
+	SpamLimit       int      `json:"spamLimit,omitempty"`  // Identical messages someone may send in a row
+}
+
+// Banned reports whether a user or address is banned from the room. Bans
+// last as long as the room's record in the store.
+func (info RoomInfo) Banned(userID uint, ip string) bool {
+	for _, banned := range info.BannedUserIDs {
+		if userID != 0 && banned == userID {
+			return true
+		}
+	}
+	for _, banned := range info.BannedIPs {
+		if ip != "" && banned == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the room is past its expiry time
+func (info RoomInfo) Expired() bool {
+	return info.ExpiresAt != nil && time.Now().After(*info.ExpiresAt)
+}
+
+// Member is a participant connected to a room on some node
+type Member struct {
+	ID       string    `json:"id"`
+	NodeID   string    `json:"nodeId"`
+	UserID   uint      `json:"userId,omitempty"` // 0 for guests
+	IP       string    `json:"ip,omitempty"`     // Client address, used to ban guests
+	Name     string    `json:"name,omitempty"`
+	Avatar   string    `json:"avatar,omitempty"` // Image URL shown in the chat roster
+	Role     string    `json:"role,omitempty"`   // Role in the chat roster
+	Host     bool      `json:"host,omitempty"`
+	Status   string    `json:"status,omitempty"` // Chat presence: active, typing or away
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Handler receives the payloads published on a channel. Each subscription
+// delivers in publish order on its own goroutine, so a slow handler only
+// delays its own channel.
+type Handler func(payload []byte)
+
+// Overflow is called with a payload that is dropped because its subscriber
+// is a whole queue behind. It returns true if the payload can be missed,
+// e.g. an ICE candidate. Otherwise Overflow must make the subscriber catch
+// up, e.g. by telling its clients to reconnect. It runs on the publisher's
+// goroutine and must not block.
+type Overflow func(payload []byte) bool
+
+// Subscription is an active channel subscription
+type Subscription interface {
+	Close() error
+}
+
+// Store holds room state shared by every backend instance and fans messages
+// out between them. Connections stay on the node that accepted them; only
+// membership, room records and relayed frames go through the store.
+type Store interface {
+	// CreateRoom records a new room. It returns false if the ID is taken.
+	CreateRoom(ctx context.Context, info RoomInfo) (bool, error)
+	GetRoom(ctx context.Context, roomID string) (*RoomInfo, error)
+	// UpdateRoom changes a room's record through update, which may run more
+	// than once if another node changes the room meanwhile. It returns the
+	// saved record, ErrRoomNotFound, or the error update returned.
+	UpdateRoom(ctx context.Context, roomID string, update func(info *RoomInfo) error) (*RoomInfo, error)
+	DeleteRoom(ctx context.Context, roomID string) error
+	// DeleteRoomIfEmpty is DeleteRoom for a room nobody is in: it leaves the
+	// room alone if any scope still has members. Checking and deleting are
+	// one step, so a participant joining meanwhile keeps the room.
+	DeleteRoomIfEmpty(ctx context.Context, roomID string) error
+	ListRooms(ctx context.Context) ([]RoomInfo, error)
+
+	// AddMember registers a participant in one scope of a room
+	AddMember(ctx context.Context, scope, roomID string, member Member) error
+	// AddMemberWithin is AddMember for scopes with a limit: it returns
+	// ErrRoomFull instead if the scope already holds limit other members.
+	// Checking and adding are one step, so concurrent joins cannot
+	// overfill the room.
+	AddMemberWithin(ctx context.Context, scope, roomID string, member Member, limit int) error
+	// UpdateMember changes the record of a registered participant through
+	// update, which may run more than once if the scope changes meanwhile.
+	// It returns the saved record, or ErrMemberNotFound once the
+	// participant has left.
+	UpdateMember(ctx context.Context, scope, roomID, memberID string, update func(member *Member)) (*Member, error)
+	// RemoveMember unregisters a participant and returns how many remain
+	RemoveMember(ctx context.Context, scope, roomID, memberID string) (int, error)
+	Members(ctx context.Context, scope, roomID string) ([]Member, error)
+
+	// NextSeq returns the next number of a room's chat message sequence. A
+	// sequence the store does not have yet continues after floor, so numbers
+	// stay increasing when a room comes back. Sequences go with the room.
+	NextSeq(ctx context.Context, roomID string, floor uint64) (uint64, error)
+
+	Publish(ctx context.Context, channel string, payload []byte) error
+	Subscribe(ctx context.Context, channel string, handler Handler, overflow Overflow) (Subscription, error)
+
+	Close() error
+}
+
+// Channel returns the pub/sub channel carrying one scope of a room
+func Channel(scope, roomID string) string {
+	return fmt.Sprintf("seaside:%s:%s", scope, roomID)
+}
+
+// NewFromEnv builds the store selected by ROOM_STORE ("memory" or "redis").
+// The Redis store connects to REDIS_URL.
+func NewFromEnv() (Store, error) {
+	backend := strings.ToLower(os.Getenv("ROOM_STORE"))
+	switch backend {
+	case "", "memory":
+		log.Println("Using in-memory room store")
+		return NewMemoryStore(), nil
+	case "redis":
+		redisURL := os.Getenv("REDIS_URL")
+		if redisURL == "" {
+			return nil, fmt.Errorf("ROOM_STORE=redis requires REDIS_URL to be set")
+		}
+		store, err := NewRedisStore(redisURL)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using Redis room store (node %s)", NodeID)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown ROOM_STORE %q, expected \"memory\" or \"redis\"", backend)
+	}
+}
+
+func newNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "node"
+	}
+	return hostname + "-" + uuid.New().String()[:8]
+}
@@ -0,0 +1,408 @@
+package roomstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// waitTimeout bounds how long a test waits for a subscription to deliver
+const waitTimeout = 2 * time.Second
+
+// forEachStore runs test against every Store implementation. newStore opens
+// an empty store, which is closed when the test ends.
+func forEachStore(t *testing.T, test func(t *testing.T, newStore func() Store)) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) Store
+	}{
+		{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+		{"redis", func(t *testing.T) Store { return newTestRedisStore(t, miniredis.RunT(t)) }},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, func() Store {
+				store := backend.open(t)
+				t.Cleanup(func() { store.Close() })
+				return store
+			})
+		})
+	}
+}
+
+// newTestRedisStore connects a RedisStore to a stand-in server
+func newTestRedisStore(t *testing.T, server *miniredis.Miniredis) *RedisStore {
+	t.Helper()
+	store, err := NewRedisStoreWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatalf("NewRedisStoreWithClient: %v", err)
+	}
+	return store
+}
+
+// receive waits for the next payload on received
+func receive(t *testing.T, received <-chan string) string {
+	t.Helper()
+	select {
+	case payload := <-received:
+		return payload
+	case <-time.After(waitTimeout):
+		t.Fatal("payload was not delivered")
+		return ""
+	}
+}
+
+func TestPublishDeliversInOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{"one", 1},
+		{"several", 10},
+		{"a full queue", subscriptionQueueSize},
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store := newStore()
+				ctx := context.Background()
+
+				received := make(chan string, tt.count)
+				sub, err := store.Subscribe(ctx, "channel", func(payload []byte) {
+					received <- string(payload)
+				}, nil)
+				if err != nil {
+					t.Fatalf("Subscribe: %v", err)
+				}
+				defer sub.Close()
+
+				for i := 0; i < tt.count; i++ {
+					if err := store.Publish(ctx, "channel", []byte(fmt.Sprint(i))); err != nil {
+						t.Fatalf("Publish: %v", err)
+					}
+				}
+				for i := 0; i < tt.count; i++ {
+					if payload, want := receive(t, received), fmt.Sprint(i); payload != want {
+						t.Fatalf("payload %d = %q, want %q", i, payload, want)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestPublishOnlyReachesItsChannel(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		ctx := context.Background()
+
+		received := make(chan string, 1)
+		sub, err := store.Subscribe(ctx, Channel(ScopeChat, "a"), func(payload []byte) {
+			received <- string(payload)
+		}, nil)
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		defer sub.Close()
+
+		store.Publish(ctx, Channel(ScopeChat, "b"), []byte("other room"))
+		store.Publish(ctx, Channel(ScopeVideo, "a"), []byte("other scope"))
+		store.Publish(ctx, Channel(ScopeChat, "a"), []byte("mine"))
+
+		if payload := receive(t, received); payload != "mine" {
+			t.Fatalf("received %q, want %q", payload, "mine")
+		}
+	})
+}
+
+func TestClosedSubscriptionStopsDelivering(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		ctx := context.Background()
+
+		received := make(chan string, 1)
+		sub, err := store.Subscribe(ctx, "channel", func(payload []byte) {
+			received <- string(payload)
+		}, nil)
+		if err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+		sub.Close()
+		store.Publish(ctx, "channel", []byte("late"))
+
+		select {
+		case payload := <-received:
+			t.Fatalf("received %q after closing", payload)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestAddMemberWithin(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		join     string
+		limit    int
+		wantErr  error
+	}{
+		{"empty room", nil, "a", 2, nil},
+		{"room with space", []string{"a"}, "b", 2, nil},
+		{"full room", []string{"a", "b"}, "c", 2, ErrRoomFull},
+		{"rejoining a full room", []string{"a", "b"}, "b", 2, nil},
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store := newStore()
+				ctx := context.Background()
+				for _, id := range tt.existing {
+					if err := store.AddMember(ctx, ScopeVideo, "room", Member{ID: id}); err != nil {
+						t.Fatalf("AddMember: %v", err)
+					}
+				}
+
+				err := store.AddMemberWithin(ctx, ScopeVideo, "room", Member{ID: tt.join, Name: "new"}, tt.limit)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("AddMemberWithin = %v, want %v", err, tt.wantErr)
+				}
+				members, _ := store.Members(ctx, ScopeVideo, "room")
+				if len(members) > tt.limit {
+					t.Fatalf("room holds %d members, limit is %d", len(members), tt.limit)
+				}
+				if tt.wantErr == nil && !hasMember(members, tt.join, "new") {
+					t.Fatalf("members %v, want %s's new record", members, tt.join)
+				}
+			})
+		}
+	})
+}
+
+func hasMember(members []Member, id, name string) bool {
+	for _, member := range members {
+		if member.ID == id && member.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAddMemberWithinIsAtomic(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		ctx := context.Background()
+		const limit = 5
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				store.AddMemberWithin(ctx, ScopeVideo, "room", Member{ID: fmt.Sprint(i)}, limit)
+			}(i)
+		}
+		wg.Wait()
+
+		members, _ := store.Members(ctx, ScopeVideo, "room")
+		if len(members) != limit {
+			t.Fatalf("room holds %d members, want %d", len(members), limit)
+		}
+	})
+}
+
+func TestUpdateMember(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		ctx := context.Background()
+		store.AddMember(ctx, ScopeChat, "room", Member{ID: "a", Status: "active"})
+
+		member, err := store.UpdateMember(ctx, ScopeChat, "room", "a", func(member *Member) {
+			member.Status = "away"
+		})
+		if err != nil || member.Status != "away" {
+			t.Fatalf("UpdateMember = %+v, %v; want status away", member, err)
+		}
+
+		// Someone who left is not written back
+		store.RemoveMember(ctx, ScopeChat, "room", "a")
+		if _, err := store.UpdateMember(ctx, ScopeChat, "room", "a", func(*Member) {}); !errors.Is(err, ErrMemberNotFound) {
+			t.Fatalf("UpdateMember after leaving = %v, want %v", err, ErrMemberNotFound)
+		}
+		if members, _ := store.Members(ctx, ScopeChat, "room"); len(members) != 0 {
+			t.Fatalf("members after leaving = %v, want none", members)
+		}
+	})
+}
+
+func TestUpdateRoom(t *testing.T) {
+	errRefused := errors.New("refused")
+	tests := []struct {
+		name       string
+		roomID     string
+		update     func(info *RoomInfo) error
+		wantErr    error
+		wantLocked bool
+	}{
+		{"change", "room", func(info *RoomInfo) error { info.Locked = true; return nil }, nil, true},
+		{"refused change", "room", func(info *RoomInfo) error { info.Locked = true; return errRefused }, errRefused, false},
+		{"missing room", "other", func(info *RoomInfo) error { return nil }, ErrRoomNotFound, false},
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store := newStore()
+				ctx := context.Background()
+				store.CreateRoom(ctx, RoomInfo{ID: "room"})
+
+				if _, err := store.UpdateRoom(ctx, tt.roomID, tt.update); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("UpdateRoom = %v, want %v", err, tt.wantErr)
+				}
+				info, _ := store.GetRoom(ctx, "room")
+				if info.Locked != tt.wantLocked {
+					t.Fatalf("Locked = %v, want %v", info.Locked, tt.wantLocked)
+				}
+			})
+		}
+	})
+}
+
+func TestConcurrentUpdatesAreKept(t *testing.T) {
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		ctx := context.Background()
+		store.CreateRoom(ctx, RoomInfo{ID: "room"})
+		const updates = 5
+
+		var wg sync.WaitGroup
+		for i := 1; i <= updates; i++ {
+			wg.Add(1)
+			go func(userID uint) {
+				defer wg.Done()
+				_, err := store.UpdateRoom(ctx, "room", func(info *RoomInfo) error {
+					info.BannedUserIDs = append(info.BannedUserIDs, userID)
+					return nil
+				})
+				if err != nil {
+					t.Errorf("UpdateRoom: %v", err)
+				}
+			}(uint(i))
+		}
+		wg.Wait()
+
+		info, _ := store.GetRoom(ctx, "room")
+		if len(info.BannedUserIDs) != updates {
+			t.Fatalf("BannedUserIDs = %v, want %d entries", info.BannedUserIDs, updates)
+		}
+	})
+}
+
+func TestNextSeq(t *testing.T) {
+	steps := []struct {
+		floor uint64
+		want  uint64
+	}{
+		{floor: 41, want: 42}, // A new sequence continues after floor
+		{floor: 0, want: 43},
+		{floor: 100, want: 44}, // An existing one ignores it
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		store := newStore()
+		ctx := context.Background()
+		store.CreateRoom(ctx, RoomInfo{ID: "room"})
+
+		for _, step := range steps {
+			if seq, err := store.NextSeq(ctx, "room", step.floor); err != nil || seq != step.want {
+				t.Fatalf("NextSeq(%d) = %d, %v; want %d", step.floor, seq, err, step.want)
+			}
+		}
+
+		// Sequences go with the room
+		store.DeleteRoom(ctx, "room")
+		if seq, _ := store.NextSeq(ctx, "room", 0); seq != 1 {
+			t.Fatalf("NextSeq after deleting the room = %d, want 1", seq)
+		}
+	})
+}
+
+func TestDeleteRoomIfEmpty(t *testing.T) {
+	tests := []struct {
+		name       string
+		members    []string // Scopes with someone in them
+		wantExists bool
+	}{
+		{"empty room", nil, false},
+		{"someone in the chat", []string{ScopeChat}, true},
+		{"someone waiting in the lobby", []string{ScopeLobby}, true},
+		{"someone in the call", []string{ScopeVideo}, true},
+	}
+
+	forEachStore(t, func(t *testing.T, newStore func() Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				store := newStore()
+				ctx := context.Background()
+				store.CreateRoom(ctx, RoomInfo{ID: "room"})
+				store.NextSeq(ctx, "room", 10)
+				for _, scope := range tt.members {
+					store.AddMember(ctx, scope, "room", Member{ID: "a"})
+				}
+
+				if err := store.DeleteRoomIfEmpty(ctx, "room"); err != nil {
+					t.Fatalf("DeleteRoomIfEmpty: %v", err)
+				}
+				_, err := store.GetRoom(ctx, "room")
+				if exists := err == nil; exists != tt.wantExists {
+					t.Fatalf("room exists = %v, want %v", exists, tt.wantExists)
+				}
+				rooms, _ := store.ListRooms(ctx)
+				if listed := len(rooms) == 1; listed != tt.wantExists {
+					t.Fatalf("rooms listed = %v, want the room listed = %v", rooms, tt.wantExists)
+				}
+
+				// A deleted room starts its sequence over, a kept one does not
+				wantSeq := uint64(1)
+				if tt.wantExists {
+					wantSeq = 12
+				}
+				if seq, _ := store.NextSeq(ctx, "room", 0); seq != wantSeq {
+					t.Fatalf("NextSeq = %d, want %d", seq, wantSeq)
+				}
+			})
+		}
+	})
+}
+
+func TestBanned(t *testing.T) {
+	info := RoomInfo{BannedUserIDs: []uint{7}, BannedIPs: []string{"203.0.113.9"}}
+	tests := []struct {
+		name   string
+		userID uint
+		ip     string
+		want   bool
+	}{
+		{"banned user", 7, "198.51.100.1", true},
+		{"banned guest address", 0, "203.0.113.9", true},
+		{"banned address, other user", 8, "203.0.113.9", true},
+		{"someone else", 8, "198.51.100.1", false},
+		{"guest without an address", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := info.Banned(tt.userID, tt.ip); got != tt.want {
+				t.Fatalf("Banned(%d, %q) = %v, want %v", tt.userID, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package roomstore
+
+import (
+	"log"
+	"sync"
+)
+
+// subscriptionQueueSize bounds the payloads waiting for a slow handler
+const subscriptionQueueSize = 256
+
+// queuedSubscription delivers payloads to its handler on a dedicated
+// goroutine. Payloads arriving while the handler is a whole queue behind are
+// dropped, and Overflow decides whether the subscriber must catch up.
+type queuedSubscription struct {
+	channel  string
+	handler  Handler
+	overflow Overflow
+	queue    chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+	release  func() // Ends the store's side of the subscription
+}
+
+func newQueuedSubscription(channel string, handler Handler, overflow Overflow, release func()) *queuedSubscription {
+	sub := &queuedSubscription{
+		channel:  channel,
+		handler:  handler,
+		overflow: overflow,
+		queue:    make(chan []byte, subscriptionQueueSize),
+		done:     make(chan struct{}),
+		release:  release,
+	}
+	go sub.run()
+	return sub
+}
+
+// deliver queues a payload without blocking the publisher
+func (sub *queuedSubscription) deliver(payload []byte) {
+	select {
+	case <-sub.done:
+		return
+	default:
+	}
+
+	select {
+	case sub.queue <- payload:
+		return
+	default:
+	}
+
+	if sub.overflow != nil && sub.overflow(payload) {
+		log.Printf("Room store subscription for %s is backed up, dropping message", sub.channel)
+		return
+	}
+	log.Printf("Room store subscription for %s is backed up, dropping message its subscriber needed", sub.channel)
+}
+
+func (sub *queuedSubscription) run() {
+	for {
+		select {
+		case payload := <-sub.queue:
+			sub.handler(payload)
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func (sub *queuedSubscription) stop() {
+	sub.stopOnce.Do(func() {
+		close(sub.done)
+	})
+}
+
+func (sub *queuedSubscription) Close() error {
+	sub.stop()
+	sub.release()
+	return nil
+}
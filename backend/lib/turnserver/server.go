@@ -0,0 +1,246 @@
+package turnserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v3"
+)
+
+// Defaults for the embedded relay
+const (
+	defaultPort          = 3478
+	defaultRealm         = "seaside"
+	defaultCredentialTTL = 12 * time.Hour
+)
+
+// Config describes the embedded STUN/TURN service
+type Config struct {
+	ListenAddress string        // Interface to bind, e.g. 0.0.0.0
+	PublicIP      net.IP        // Address handed to peers for the server and its relays
+	Port          int           // Shared by the UDP and TCP listeners
+	Realm         string        // TURN realm peers authenticate against
+	Secret        string        // Shared secret signing time-limited credentials
+	MinRelayPort  uint16        // Relay port range; any free port when unset
+	MaxRelayPort  uint16        //
+	CredentialTTL time.Duration // How long issued credentials stay valid
+
+	// AllowPrivatePeers lets clients relay to loopback, private and
+	// link-local addresses. Only for development: it opens the server's
+	// own network, cloud metadata included, to anyone with credentials.
+	AllowPrivatePeers bool
+}
+
+// ConfigFromEnv reads the relay settings. It returns nil when TURN_ENABLED
+// is not set, in which case no relay should be started.
+//
+// The defaults advertise 127.0.0.1; with TURN_ALLOW_PRIVATE_PEERS set, two
+// browsers on the same machine can then exercise the relay.
+func ConfigFromEnv() (*Config, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("TURN_ENABLED")); !enabled {
+		return nil, nil
+	}
+
+	config := &Config{
+		ListenAddress: "0.0.0.0",
+		PublicIP:      net.IPv4(127, 0, 0, 1),
+		Port:          defaultPort,
+		Realm:         defaultRealm,
+		Secret:        os.Getenv("TURN_SECRET"),
+		CredentialTTL: defaultCredentialTTL,
+	}
+
+	if address := os.Getenv("TURN_LISTEN_ADDRESS"); address != "" {
+		config.ListenAddress = address
+	}
+	if publicIP := os.Getenv("TURN_PUBLIC_IP"); publicIP != "" {
+		config.PublicIP = net.ParseIP(publicIP)
+		if config.PublicIP == nil {
+			return nil, fmt.Errorf("invalid TURN_PUBLIC_IP %q", publicIP)
+		}
+	}
+	if port := os.Getenv("TURN_PORT"); port != "" {
+		value, err := strconv.Atoi(port)
+		if err != nil || value <= 0 || value > 65535 {
+			return nil, fmt.Errorf("invalid TURN_PORT %q", port)
+		}
+		config.Port = value
+	}
+	if realm := os.Getenv("TURN_REALM"); realm != "" {
+		config.Realm = realm
+	}
+	if ttl := os.Getenv("TURN_CREDENTIAL_TTL"); ttl != "" {
+		value, err := time.ParseDuration(ttl)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("invalid TURN_CREDENTIAL_TTL %q", ttl)
+		}
+		config.CredentialTTL = value
+	}
+	if allow := os.Getenv("TURN_ALLOW_PRIVATE_PEERS"); allow != "" {
+		value, err := strconv.ParseBool(allow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TURN_ALLOW_PRIVATE_PEERS %q", allow)
+		}
+		config.AllowPrivatePeers = value
+		if value {
+			log.Println("Warning: TURN_ALLOW_PRIVATE_PEERS is set, clients may relay into private networks")
+		}
+	}
+	if ports := os.Getenv("TURN_RELAY_PORTS"); ports != "" {
+		min, max, found := strings.Cut(ports, "-")
+		minPort, minErr := strconv.ParseUint(min, 10, 16)
+		maxPort, maxErr := strconv.ParseUint(max, 10, 16)
+		if !found || minErr != nil || maxErr != nil || minPort == 0 || minPort > maxPort {
+			return nil, fmt.Errorf("invalid TURN_RELAY_PORTS %q, expected e.g. 49152-65535", ports)
+		}
+		config.MinRelayPort, config.MaxRelayPort = uint16(minPort), uint16(maxPort)
+	}
+
+	// Without a configured secret credentials only survive until a restart
+	// and cannot be shared with other instances
+	if config.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate TURN secret: %w", err)
+		}
+		config.Secret = hex.EncodeToString(secret)
+		log.Println("Warning: TURN_SECRET is not set, using a random secret for this process")
+	}
+
+	return config, nil
+}
+
+// Server is a running STUN/TURN relay listening on UDP and TCP
+type Server struct {
+	config Config
+	server *turn.Server
+}
+
+// Start binds the UDP and TCP listeners and begins serving
+func Start(config Config) (*Server, error) {
+	address := net.JoinHostPort(config.ListenAddress, strconv.Itoa(config.Port))
+
+	udpListener, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on udp %s: %w", address, err)
+	}
+	tcpListener, err := net.Listen("tcp4", address)
+	if err != nil {
+		udpListener.Close()
+		return nil, fmt.Errorf("failed to listen on tcp %s: %w", address, err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       config.Realm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(config.Secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: config.relayAddressGenerator(),
+			PermissionHandler:     config.permissionHandler,
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: config.relayAddressGenerator(),
+			PermissionHandler:     config.permissionHandler,
+		}},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("failed to start TURN server: %w", err)
+	}
+
+	log.Printf("TURN server listening on %s (udp/tcp), advertising %s", address, config.PublicIP)
+	return &Server{config: config, server: server}, nil
+}
+
+// relayAddressGenerator allocates relays on the listen interface and
+// advertises them on the public address
+func (c Config) relayAddressGenerator() turn.RelayAddressGenerator {
+	if c.MinRelayPort != 0 {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: c.PublicIP,
+			Address:      c.ListenAddress,
+			MinPort:      c.MinRelayPort,
+			MaxPort:      c.MaxRelayPort,
+		}
+	}
+	return &turn.RelayAddressGeneratorStatic{
+		RelayAddress: c.PublicIP,
+		Address:      c.ListenAddress,
+	}
+}
+
+// sharedAddressSpace is 100.64.0.0/10, used inside carrier and cloud networks
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// permissionHandler decides which peers clients may relay to. Addresses
+// that only make sense inside the server's own network are refused, so the
+// relay cannot be used to reach the backend, its neighbours or the cloud
+// metadata service.
+func (c Config) permissionHandler(clientAddr net.Addr, peerIP net.IP) bool {
+	if c.AllowPrivatePeers || publicPeer(peerIP) {
+		return true
+	}
+	log.Printf("TURN: refused relay from %s to non-public address %s", clientAddr, peerIP)
+	return false
+}
+
+// publicPeer reports whether an address is reachable on the public internet
+func publicPeer(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if ip4[0] == 0 || sharedAddressSpace.Contains(ip4) {
+			return false
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Close stops the listeners and drops every allocation
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Credentials are short-lived TURN credentials in the TURN REST API format
+type Credentials struct {
+	Username  string
+	Password  string
+	ExpiresAt time.Time
+	URIs      []string
+}
+
+// Credentials issues time-limited credentials for a user. The username
+// carries the expiry and the user, and the password is an HMAC of it, so
+// the relay can check them without keeping any state.
+func (s *Server) Credentials(userID uint) (*Credentials, error) {
+	username, password, err := turn.GenerateLongTermTURNRESTCredentials(s.config.Secret, strconv.FormatUint(uint64(userID), 10), s.config.CredentialTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TURN credentials: %w", err)
+	}
+	return &Credentials{
+		Username:  username,
+		Password:  password,
+		ExpiresAt: time.Now().Add(s.config.CredentialTTL),
+		URIs:      s.URIs(),
+	}, nil
+}
+
+// URIs lists the STUN and TURN URIs peers should use
+func (s *Server) URIs() []string {
+	host := net.JoinHostPort(s.config.PublicIP.String(), strconv.Itoa(s.config.Port))
+	return []string{
+		"stun:" + host,
+		"turn:" + host + "?transport=udp",
+		"turn:" + host + "?transport=tcp",
+	}
+}
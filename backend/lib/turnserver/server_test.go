@@ -0,0 +1,223 @@
+package turnserver
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"seaside/lib/config"
+
+	"github.com/pion/turn/v3"
+)
+
+func TestPermissionHandler(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 50000}
+	tests := []struct {
+		name   string
+		peer   string
+		public bool // Allowed without AllowPrivatePeers
+	}{
+		{"public IPv4", "8.8.8.8", true},
+		{"public IPv6", "2001:4860:4860::8888", true},
+		{"loopback", "127.0.0.1", false},
+		{"IPv6 loopback", "::1", false},
+		{"private 10/8", "10.1.2.3", false},
+		{"private 172.16/12", "172.20.0.1", false},
+		{"private 192.168/16", "192.168.1.10", false},
+		{"cloud metadata", "169.254.169.254", false},
+		{"shared address space", "100.64.0.1", false},
+		{"just outside the shared address space", "100.128.0.1", true},
+		{"this network", "0.1.2.3", false},
+		{"unspecified", "0.0.0.0", false},
+		{"multicast", "224.0.0.1", false},
+		{"IPv6 unique local", "fd00::1", false},
+		{"IPv6 link-local", "fe80::1", false},
+		{"private IPv4 mapped into IPv6", "::ffff:10.0.0.1", false},
+		{"metadata mapped into IPv6", "::ffff:169.254.169.254", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.peer)
+			if ip == nil {
+				t.Fatalf("invalid test address %q", tt.peer)
+			}
+			if got := (Config{}).permissionHandler(client, ip); got != tt.public {
+				t.Errorf("permissionHandler(%s) = %v, want %v", tt.peer, got, tt.public)
+			}
+			// Development servers relay anywhere
+			if !(Config{AllowPrivatePeers: true}).permissionHandler(client, ip) {
+				t.Errorf("permissionHandler(%s) with private peers allowed = false, want true", tt.peer)
+			}
+		})
+	}
+}
+
+// startTestServer runs the relay on a free loopback port
+func startTestServer(t *testing.T, allowPrivatePeers bool) (*Server, string) {
+	t.Helper()
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	server, err := Start(Config{
+		ListenAddress:     "127.0.0.1",
+		PublicIP:          net.IPv4(127, 0, 0, 1),
+		Port:              port,
+		Realm:             defaultRealm,
+		Secret:            "test-secret",
+		CredentialTTL:     time.Hour,
+		AllowPrivatePeers: allowPrivatePeers,
+	})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// newTestClient connects a TURN client to the relay at address
+func newTestClient(t *testing.T, address, username, password string) *turn.Client {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: address,
+		TURNServerAddr: address,
+		Username:       username,
+		Password:       password,
+		Realm:          defaultRealm,
+		Conn:           conn,
+	})
+	if err != nil {
+		conn.Close()
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := client.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return client
+}
+
+// readWithin reads one packet, failing the test if none arrives in time
+func readWithin(t *testing.T, conn net.PacketConn) (string, net.Addr) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 1500)
+	n, from, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	return string(buffer[:n]), from
+}
+
+func TestRelay(t *testing.T) {
+	server, address := startTestServer(t, true)
+
+	// Credentials handed out by /api/turn-credentials are signed by
+	// config.ICEConfig, not by the server itself
+	ice := config.ICEConfig{CredentialTTL: time.Hour}
+	ice.UseEmbeddedRelay("test-secret", server.URIs())
+	servers, _ := ice.Servers("42", true)
+	if len(servers) != 2 || servers[1].Username == "" {
+		t.Fatalf("ICE servers = %+v, want STUN and TURN with credentials", servers)
+	}
+	client := newTestClient(t, address, servers[1].Username, servers[1].Credential)
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	defer relay.Close()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer peer.Close()
+
+	// Client to peer through the relay, and back
+	if _, err := relay.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+		t.Fatalf("relaying to the peer: %v", err)
+	}
+	payload, from := readWithin(t, peer)
+	if payload != "hello" {
+		t.Fatalf("peer received %q, want %q", payload, "hello")
+	}
+	if from.String() != relay.LocalAddr().String() {
+		t.Fatalf("peer heard from %s, want the relay at %s", from, relay.LocalAddr())
+	}
+	if _, err := peer.WriteTo([]byte("hi back"), from); err != nil {
+		t.Fatalf("answering through the relay: %v", err)
+	}
+	if payload, _ := readWithin(t, relay); payload != "hi back" {
+		t.Fatalf("client received %q, want %q", payload, "hi back")
+	}
+
+	// The server's own credentials are accepted as well
+	credentials, err := server.Credentials(42)
+	if err != nil {
+		t.Fatalf("Credentials: %v", err)
+	}
+	other, err := newTestClient(t, address, credentials.Username, credentials.Password).Allocate()
+	if err != nil {
+		t.Fatalf("Allocate with the server's credentials: %v", err)
+	}
+	other.Close()
+}
+
+func TestRelayRefusals(t *testing.T) {
+	tests := []struct {
+		name              string
+		allowPrivatePeers bool
+		secret            string // Signs the client's credentials
+		ttl               time.Duration
+		wantAllocated     bool
+	}{
+		{"wrong secret", true, "other-secret", time.Hour, false},
+		{"expired credentials", true, "test-secret", -time.Minute, false},
+		{"loopback peer", false, "test-secret", time.Hour, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, address := startTestServer(t, tt.allowPrivatePeers)
+			ice := config.ICEConfig{CredentialTTL: tt.ttl}
+			ice.UseEmbeddedRelay(tt.secret, server.URIs())
+			servers, _ := ice.Servers("42", true)
+
+			relay, err := newTestClient(t, address, servers[1].Username, servers[1].Credential).Allocate()
+			if !tt.wantAllocated {
+				if err == nil {
+					relay.Close()
+					t.Fatal("relay was allocated")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Allocate: %v", err)
+			}
+			defer relay.Close()
+
+			// Allocating works, but the server's own network is off limits
+			peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("ListenPacket: %v", err)
+			}
+			defer peer.Close()
+			if _, err := relay.WriteTo([]byte("hello"), peer.LocalAddr()); err == nil {
+				t.Fatal("relaying to a loopback peer was permitted")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Package webm writes video frames into streamable WebM files.
+//
+// Files are written front to back without seeking: the segment and its
+// clusters have unknown sizes and there are no cues, as in live streams.
+// Browsers and ffmpeg play such files; seeking is slower but writing them
+// needs no second pass.
+package webm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Element IDs, from the Matroska specification
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+	idSegment            = 0x18538067
+	idInfo               = 0x1549A966
+	idTimecodeScale      = 0x2AD7B1
+	idMuxingApp          = 0x4D80
+	idWritingApp         = 0x5741
+	idTracks             = 0x1654AE6B
+	idTrackEntry         = 0xAE
+	idTrackNumber        = 0xD7
+	idTrackUID           = 0x73C5
+	idTrackType          = 0x83
+	idCodecID            = 0x86
+	idVideo              = 0xE0
+	idPixelWidth         = 0xB0
+	idPixelHeight        = 0xBA
+	idCluster            = 0x1F43B675
+	idTimecode           = 0xE7
+	idSimpleBlock        = 0xA3
+)
+
+// unknownSize marks an element whose size is not known when it is written
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+const (
+	trackTypeVideo = 1
+
+	// Block timecodes are signed 16 bit offsets from their cluster, in
+	// milliseconds, so clusters cannot span more than this
+	maxClusterDuration = math.MaxInt16 * time.Millisecond
+
+	appName = "seaside"
+)
+
+// ErrNonMonotonic is returned for frames older than the previous one
+var ErrNonMonotonic = errors.New("webm: frame timestamp goes backwards")
+
+// VideoTrack describes the single video track of a file
+type VideoTrack struct {
+	CodecID string // e.g. "V_VP8"
+	Width   int
+	Height  int
+}
+
+// Writer writes the frames of one video track as a WebM file
+type Writer struct {
+	w           io.Writer
+	cluster     time.Duration // Start of the open cluster
+	clusterOpen bool
+	lastFrame   time.Duration
+}
+
+// NewWriter writes the file header for a video track to w
+func NewWriter(w io.Writer, track VideoTrack) (*Writer, error) {
+	header := element(idEBML,
+		uintElement(idEBMLVersion, 1),
+		uintElement(idEBMLReadVersion, 1),
+		uintElement(idEBMLMaxIDLength, 4),
+		uintElement(idEBMLMaxSizeLength, 8),
+		stringElement(idDocType, "webm"),
+		uintElement(idDocTypeVersion, 2),
+		uintElement(idDocTypeReadVersion, 2),
+	)
+
+	segment := append(encodeID(idSegment), unknownSize...)
+	info := element(idInfo,
+		uintElement(idTimecodeScale, uint64(time.Millisecond)),
+		stringElement(idMuxingApp, appName),
+		stringElement(idWritingApp, appName),
+	)
+	tracks := element(idTracks,
+		element(idTrackEntry,
+			uintElement(idTrackNumber, 1),
+			uintElement(idTrackUID, 1),
+			uintElement(idTrackType, trackTypeVideo),
+			stringElement(idCodecID, track.CodecID),
+			element(idVideo,
+				uintElement(idPixelWidth, uint64(track.Width)),
+				uintElement(idPixelHeight, uint64(track.Height)),
+			),
+		),
+	)
+
+	for _, part := range [][]byte{header, segment, info, tracks} {
+		if _, err := w.Write(part); err != nil {
+			return nil, err
+		}
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteFrame appends a frame shown at timestamp, measured from the start of
+// the file. Keyframes start a new cluster so players can seek to them.
+func (w *Writer) WriteFrame(keyframe bool, timestamp time.Duration, frame []byte) error {
+	if w.clusterOpen && timestamp < w.lastFrame {
+		return ErrNonMonotonic
+	}
+
+	if !w.clusterOpen || keyframe || timestamp-w.cluster > maxClusterDuration {
+		cluster := append(encodeID(idCluster), unknownSize...)
+		cluster = append(cluster, uintElement(idTimecode, uint64(timestamp.Milliseconds()))...)
+		if _, err := w.w.Write(cluster); err != nil {
+			return err
+		}
+		w.cluster = timestamp.Truncate(time.Millisecond)
+		w.clusterOpen = true
+	}
+	w.lastFrame = timestamp
+
+	// Track number, timecode relative to the cluster, flags, then the frame
+	block := make([]byte, 4, 4+len(frame))
+	block[0] = 0x81
+	binary.BigEndian.PutUint16(block[1:3], uint16(int16((timestamp - w.cluster).Milliseconds())))
+	if keyframe {
+		block[3] = 0x80
+	}
+	block = append(block, frame...)
+
+	_, err := w.w.Write(element(idSimpleBlock, block))
+	return err
+}
+
+// element encodes an element with the given children or payload
+func element(id uint32, children ...[]byte) []byte {
+	size := 0
+	for _, child := range children {
+		size += len(child)
+	}
+
+	data := encodeID(id)
+	data = append(data, encodeSize(uint64(size))...)
+	for _, child := range children {
+		data = append(data, child...)
+	}
+	return data
+}
+
+func uintElement(id uint32, value uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	i := 0
+	for i < 7 && buf[i] == 0 {
+		i++
+	}
+	return element(id, buf[i:])
+}
+
+func stringElement(id uint32, value string) []byte {
+	return element(id, []byte(value))
+}
+
+// encodeID writes an element ID, whose length is part of its value
+func encodeID(id uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], id)
+	i := 0
+	for i < 3 && buf[i] == 0 {
+		i++
+	}
+	return buf[i:]
+}
+
+// encodeSize writes a size as a variable length integer. A value of all
+// ones is reserved for unknown sizes, so it moves to the next length.
+func encodeSize(size uint64) []byte {
+	length := 1
+	for length < 8 && size >= (1<<(7*length))-1 {
+		length++
+	}
+
+	buf := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		buf[i] = byte(size)
+		size >>= 8
+	}
+	buf[0] |= 0x80 >> (length - 1)
+	return buf
+}
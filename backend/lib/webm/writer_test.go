@@ -0,0 +1,248 @@
+package webm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// parsedElement is an element read back from a file. Elements of unknown
+// size have no data: the elements after them are their children.
+type parsedElement struct {
+	id      uint32
+	data    []byte
+	unknown bool
+}
+
+// readVint reads a variable length integer, with its length marker kept for
+// IDs and dropped for sizes
+func readVint(t *testing.T, data []byte, keepMarker bool) (uint64, int) {
+	t.Helper()
+	if len(data) == 0 || data[0] == 0 {
+		t.Fatalf("invalid variable length integer % x", data)
+	}
+	length := 1
+	for data[0]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	if len(data) < length {
+		t.Fatalf("truncated variable length integer % x", data)
+	}
+
+	value := uint64(data[0])
+	if !keepMarker {
+		value &^= 0x80 >> (length - 1)
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// parseElements reads the elements of data in order
+func parseElements(t *testing.T, data []byte) []parsedElement {
+	t.Helper()
+	var elements []parsedElement
+	for len(data) > 0 {
+		id, idLength := readVint(t, data, true)
+		data = data[idLength:]
+		if bytes.HasPrefix(data, unknownSize) {
+			elements = append(elements, parsedElement{id: uint32(id), unknown: true})
+			data = data[len(unknownSize):]
+			continue
+		}
+
+		size, sizeLength := readVint(t, data, false)
+		data = data[sizeLength:]
+		if uint64(len(data)) < size {
+			t.Fatalf("element %x needs %d bytes, %d left", id, size, len(data))
+		}
+		elements = append(elements, parsedElement{id: uint32(id), data: data[:size]})
+		data = data[size:]
+	}
+	return elements
+}
+
+// children reads the elements of a master element, keyed by ID
+func children(t *testing.T, element parsedElement) map[uint32]parsedElement {
+	t.Helper()
+	found := map[uint32]parsedElement{}
+	for _, child := range parseElements(t, element.data) {
+		found[child.id] = child
+	}
+	return found
+}
+
+func (e parsedElement) uint() uint64 {
+	var value uint64
+	for _, b := range e.data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func TestWriterOutput(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewWriter(&out, VideoTrack{CodecID: "V_VP8", Width: 640, Height: 480})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	frames := []struct {
+		keyframe  bool
+		timestamp time.Duration
+		data      string
+	}{
+		{true, 0, "key-1"},
+		{false, 40 * time.Millisecond, "delta-1"},
+		{true, 1500 * time.Millisecond, "key-2"},
+		{false, 1533*time.Millisecond + 400*time.Microsecond, "delta-2"},
+	}
+	for _, frame := range frames {
+		if err := writer.WriteFrame(frame.keyframe, frame.timestamp, []byte(frame.data)); err != nil {
+			t.Fatalf("WriteFrame(%v): %v", frame.timestamp, err)
+		}
+	}
+
+	elements := parseElements(t, out.Bytes())
+	wantIDs := []uint32{
+		idEBML, idSegment, idInfo, idTracks,
+		idCluster, idTimecode, idSimpleBlock, idSimpleBlock,
+		idCluster, idTimecode, idSimpleBlock, idSimpleBlock,
+	}
+	var ids []uint32
+	for _, element := range elements {
+		ids = append(ids, element.id)
+	}
+	if fmt.Sprintf("%x", ids) != fmt.Sprintf("%x", wantIDs) {
+		t.Fatalf("elements %x, want %x", ids, wantIDs)
+	}
+	if !elements[1].unknown || !elements[4].unknown || !elements[8].unknown {
+		t.Fatal("segment and clusters should have unknown sizes")
+	}
+
+	header := children(t, elements[0])
+	if docType := string(header[idDocType].data); docType != "webm" {
+		t.Errorf("DocType = %q, want webm", docType)
+	}
+	if version := header[idDocTypeReadVersion].uint(); version != 2 {
+		t.Errorf("DocTypeReadVersion = %d, want 2", version)
+	}
+	if size := header[idEBMLMaxSizeLength].uint(); size != 8 {
+		t.Errorf("EBMLMaxSizeLength = %d, want 8", size)
+	}
+
+	info := children(t, elements[2])
+	if scale := info[idTimecodeScale].uint(); scale != uint64(time.Millisecond) {
+		t.Errorf("TimecodeScale = %d, want %d", scale, time.Millisecond)
+	}
+
+	entry := children(t, children(t, elements[3])[idTrackEntry])
+	if codec := string(entry[idCodecID].data); codec != "V_VP8" {
+		t.Errorf("CodecID = %q, want V_VP8", codec)
+	}
+	video := children(t, entry[idVideo])
+	if width, height := video[idPixelWidth].uint(), video[idPixelHeight].uint(); width != 640 || height != 480 {
+		t.Errorf("size = %dx%d, want 640x480", width, height)
+	}
+
+	// Each keyframe opens a cluster; blocks are timed from their cluster
+	blocks := []struct {
+		cluster  uint64
+		block    parsedElement
+		offset   int16
+		keyframe bool
+		data     string
+	}{
+		{0, elements[6], 0, true, "key-1"},
+		{0, elements[7], 40, false, "delta-1"},
+		{1500, elements[10], 0, true, "key-2"},
+		{1500, elements[11], 33, false, "delta-2"},
+	}
+	for i, want := range blocks {
+		cluster := elements[5]
+		if i >= 2 {
+			cluster = elements[9]
+		}
+		if timecode := cluster.uint(); timecode != want.cluster {
+			t.Errorf("block %d: cluster Timecode = %d, want %d", i, timecode, want.cluster)
+		}
+
+		data := want.block.data
+		if data[0] != 0x81 {
+			t.Errorf("block %d: track %x, want 81", i, data[0])
+		}
+		if offset := int16(binary.BigEndian.Uint16(data[1:3])); offset != want.offset {
+			t.Errorf("block %d: timecode %d, want %d", i, offset, want.offset)
+		}
+		if keyframe := data[3]&0x80 != 0; keyframe != want.keyframe {
+			t.Errorf("block %d: keyframe = %v, want %v", i, keyframe, want.keyframe)
+		}
+		if frame := string(data[4:]); frame != want.data {
+			t.Errorf("block %d: frame %q, want %q", i, frame, want.data)
+		}
+	}
+}
+
+func TestWriterStartsClustersBeforeOffsetsOverflow(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewWriter(&out, VideoTrack{CodecID: "V_VP8"})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, timestamp := range []time.Duration{0, maxClusterDuration, maxClusterDuration + time.Millisecond} {
+		if err := writer.WriteFrame(timestamp == 0, timestamp, []byte("frame")); err != nil {
+			t.Fatalf("WriteFrame(%v): %v", timestamp, err)
+		}
+	}
+
+	var timecodes []uint64
+	for _, element := range parseElements(t, out.Bytes()) {
+		if element.id == idTimecode {
+			timecodes = append(timecodes, element.uint())
+		}
+	}
+	want := []uint64{0, uint64(maxClusterDuration.Milliseconds() + 1)}
+	if fmt.Sprint(timecodes) != fmt.Sprint(want) {
+		t.Fatalf("cluster timecodes %v, want %v", timecodes, want)
+	}
+}
+
+func TestWriterRefusesOlderFrames(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewWriter(&out, VideoTrack{CodecID: "V_VP8"})
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := writer.WriteFrame(true, time.Second, []byte("frame")); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	written := out.Len()
+
+	if err := writer.WriteFrame(false, time.Second-time.Millisecond, []byte("late")); !errors.Is(err, ErrNonMonotonic) {
+		t.Fatalf("WriteFrame = %v, want %v", err, ErrNonMonotonic)
+	}
+	if out.Len() != written {
+		t.Fatal("a refused frame was written")
+	}
+}
+
+func TestEncodeSize(t *testing.T) {
+	tests := []struct {
+		size uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xFE}},
+		{127, []byte{0x40, 0x7F}}, // All ones would read as an unknown size
+		{1000, []byte{0x43, 0xE8}},
+		{1 << 14, []byte{0x20, 0x40, 0x00}},
+	}
+	for _, tt := range tests {
+		if got := encodeSize(tt.size); !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeSize(%d) = % x, want % x", tt.size, got, tt.want)
+		}
+	}
+}
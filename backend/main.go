@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"seaside/handlers"
 	"seaside/internals/chat"
 	"seaside/internals/middleware"
+	"seaside/internals/roomsocket"
 	"seaside/internals/video"
 	"seaside/lib/auth"
+	"seaside/lib/blobstore"
+	"seaside/lib/config"
 	"seaside/lib/db"
 	"seaside/lib/monitoring"
+	"seaside/lib/roomstore"
+	"seaside/lib/turnserver"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -20,21 +28,27 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// shutdownTimeout bounds draining connections on shutdown, leaving time to
+// close everything else within a typical termination grace period
+const shutdownTimeout = 20 * time.Second
+
 func loadEnv() {
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Warning: Could not load .env file: %v", err)
 	}
 }
 
-func setupRoutes(app *fiber.App, authHandlers *handlers.AuthHandlers, jwtUtil *auth.JWTUtil) {
-	video.AllRooms.Init()
-
+func setupRoutes(app *fiber.App, authHandlers *handlers.AuthHandlers, roomHandlers *handlers.RoomHandlers, chatHandlers *handlers.ChatHandlers, turnHandlers *handlers.TurnHandlers, jwtUtil *auth.JWTUtil) {
 	// Basic routes
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": "ok", "message": "Seaside API"})
 	})
 	
 	app.Get("/health", func(c *fiber.Ctx) error {
+		// Load balancers stop sending new clients once draining starts
+		if video.AllRooms.Draining() {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "draining"})
+		}
 		return c.JSON(fiber.Map{"status": "healthy"})
 	})
 	
@@ -53,43 +67,169 @@ func setupRoutes(app *fiber.App, authHandlers *handlers.AuthHandlers, jwtUtil *a
 		return fiber.ErrUpgradeRequired
 	}
 
+	// Sockets accept a token but let guests in; rooms decide who may join
+	wsAuth := auth.WebSocketAuthMiddleware(jwtUtil)
+	wsConfig := websocket.Config{Subprotocols: []string{auth.WebSocketProtocol}}
+
 	// Auth routes
-	auth := app.Group("/auth")
-	auth.Post("/register", authHandlers.RegisterHandler)
-	auth.Post("/login", authHandlers.LoginHandler)
-	auth.Post("/refresh", authHandlers.RefreshTokenHandler)
-	auth.Post("/logout", authHandlers.LogoutHandler)
-	auth.Get("/oauth/state/:provider", authHandlers.GenerateOAuth2StateHandler)
-	auth.Post("/oauth/google", authHandlers.GoogleOAuth2Handler)
-	auth.Post("/oauth/github", authHandlers.GitHubOAuth2Handler)
+	authGroup := app.Group("/auth")
+	authGroup.Post("/register", authHandlers.RegisterHandler)
+	authGroup.Post("/login", authHandlers.LoginHandler)
+	authGroup.Post("/refresh", authHandlers.RefreshTokenHandler)
+	authGroup.Post("/logout", authHandlers.LogoutHandler)
+	authGroup.Get("/oauth/state/:provider", authHandlers.GenerateOAuth2StateHandler)
+	authGroup.Post("/oauth/google", authHandlers.GoogleOAuth2Handler)
+	authGroup.Post("/oauth/github", authHandlers.GitHubOAuth2Handler)
 
 	// Protected routes
 	api := app.Group("/api", auth.JWTMiddleware(jwtUtil))
 	api.Get("/me", authHandlers.GetMeHandler)
 
+	// Room management (owner only)
+	api.Post("/rooms", roomHandlers.CreateRoomHandler)
+	api.Get("/rooms", roomHandlers.ListRoomsHandler)
+	api.Get("/rooms/:id", roomHandlers.GetRoomHandler)
+	api.Patch("/rooms/:id", roomHandlers.UpdateRoomHandler)
+	api.Delete("/rooms/:id", roomHandlers.DeleteRoomHandler)
+	api.Post("/rooms/:id/lock", roomHandlers.LockRoomHandler)
+	api.Post("/rooms/:id/invites", roomHandlers.CreateInviteHandler)
+	api.Get("/rooms/:id/recordings", roomHandlers.ListRecordingsHandler)
+	api.Get("/rooms/:id/recordings/:recordingId", roomHandlers.DownloadRecordingHandler)
+
+	// Chat history, for scrolling back past what was replayed on join
+	api.Get("/rooms/:id/messages", chatHandlers.MessagesHandler)
+	api.Get("/rooms/:id/moderation", chatHandlers.ModerationHandler)
+	api.Post("/rooms/:id/attachments", middleware.RequestSizeLimit(handlers.AttachmentRequestLimit), chatHandlers.UploadAttachmentHandler)
+
+	// Relay credentials for peers that cannot connect directly
+	api.Get("/turn-credentials", turnHandlers.CredentialsHandler)
+
 	// Room routes
 	app.Get("/create-room", video.CreateRoomRequestHandler)
-	app.Get("/join-room", wsValidation, websocket.New(video.WebSocketJoinHandler))
-	app.Get("/chat", wsValidation, websocket.New(chat.ChatWebSocketHandler))
+	app.Get("/ice-servers", auth.OptionalJWTMiddleware(jwtUtil), turnHandlers.ICEServersHandler)
+	app.Get("/room", wsValidation, wsAuth, websocket.New(roomsocket.Handler, wsConfig))
+
+	// Signalling and chat on sockets of their own, for older clients
+	app.Get("/join-room", wsValidation, wsAuth, websocket.New(video.WebSocketJoinHandler, wsConfig))
+	app.Get("/chat", wsValidation, wsAuth, websocket.New(chat.ChatWebSocketHandler, wsConfig))
+
+	// Attachment links are unguessable and shown to guests, so they need no token
+	app.Get("/attachments/:attachmentId", chatHandlers.AttachmentHandler)
+	app.Get("/attachments/:attachmentId/thumbnail", chatHandlers.AttachmentThumbnailHandler)
 }
 
 func main() {
 	// Load environment
 	loadEnv()
 
+	// Background work stops once the server is told to shut down
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize database
-	if err := db.InitializeDatabase(); err != nil {
+	if err := db.InitializeDatabase(ctx); err != nil {
 		log.Fatalf("Database connection failed: %v", err)
 	}
+	defer db.CloseDatabase()
 
 	// Setup components
 	userRepo := db.NewUserRepository(db.DB)
+	roomRepo := db.NewRoomRepository(db.DB)
+	recordingRepo := db.NewRecordingRepository(db.DB)
+	chatMessageRepo := db.NewChatMessageRepository(db.DB)
+	chatAttachmentRepo := db.NewChatAttachmentRepository(db.DB)
+	chatModerationRepo := db.NewChatModerationRepository(db.DB)
 	jwtUtil := auth.NewJWTUtil(os.Getenv("JWT_SECRET"))
-	authHandlers := handlers.NewAuthHandlers(userRepo, jwtUtil)
+	authHandlers := handlers.NewAuthHandlers(ctx, userRepo, jwtUtil)
+	roomHandlers := handlers.NewRoomHandlers(&video.AllRooms, roomRepo, recordingRepo, jwtUtil)
+
+	// Chat attachments go to the configured blob store (BLOB_STORE)
+	blobStore, err := blobstore.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Blob store setup failed: %v", err)
+	}
+	chatHandlers := handlers.NewChatHandlers(&video.AllRooms, roomRepo, chatMessageRepo, chatAttachmentRepo, chatModerationRepo, blobStore)
+
+	// Room state is shared through the configured store (ROOM_STORE)
+	roomStore, err := roomstore.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Room store setup failed: %v", err)
+	}
+	defer roomStore.Close()
+
+	video.AllRooms.Init(ctx, roomStore)
+	video.AllRooms.SetLoader(roomHandlers.LoadRoom)
+	video.AllRooms.SetBanSaver(roomHandlers.SaveBan)
+	video.AllRooms.SetInviteSigner(jwtUtil)
+
+	// Rooms that outgrow the mesh move to the server's SFU (SFU_ENABLED)
+	sfuConfig, err := video.SFUConfigFromEnv()
+	if err != nil {
+		log.Fatalf("SFU setup failed: %v", err)
+	}
+	if sfuConfig != nil {
+		if err := video.AllRooms.EnableSFU(*sfuConfig); err != nil {
+			log.Fatalf("SFU setup failed: %v", err)
+		}
+
+		// Hosts can record calls, which the SFU writes to disk
+		recordingDir := os.Getenv("RECORDING_DIR")
+		if recordingDir == "" {
+			recordingDir = "recordings"
+		}
+		if err := video.AllRooms.EnableRecording(recordingDir, roomHandlers.SaveRecording); err != nil {
+			log.Fatalf("Recording setup failed: %v", err)
+		}
+	}
+
+	profileOf := func(userID uint) (chat.Profile, error) {
+		user, err := userRepo.GetUserByID(userID)
+		if err != nil {
+			return chat.Profile{}, err
+		}
+		profile := chat.Profile{Name: user.Username}
+		if user.AvatarURL != nil {
+			profile.Avatar = *user.AvatarURL
+		}
+		return profile, nil
+	}
+	chat.Init(roomStore, video.AllRooms.OpenRoom, chatMessageRepo, profileOf, video.AllRooms.CheckInvite)
+	chat.EnableAttachments(chatAttachmentRepo, blobStore)
+	chat.EnableModerationLog(chatModerationRepo)
+
+	// Expired rooms are deleted hourly and closed wherever they are live;
+	// recording files of retired rooms are removed from this instance
+	roomHandlers.StartExpiryCleanup(ctx, time.Hour)
+
+	// ICE servers handed to clients and trusted proxies, configured per environment
+	deploymentConfig := config.NewDeploymentConfig()
+	iceConfig := deploymentConfig.ICE
+
+	// Optional embedded STUN/TURN relay (TURN_ENABLED)
+	turnConfig, err := turnserver.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("TURN setup failed: %v", err)
+	}
+	var turnServer *turnserver.Server
+	if turnConfig != nil {
+		turnServer, err = turnserver.Start(*turnConfig)
+		if err != nil {
+			log.Fatalf("TURN server failed to start: %v", err)
+		}
+		defer turnServer.Close()
+		iceConfig.UseEmbeddedRelay(turnConfig.Secret, turnServer.URIs())
+	}
+	turnHandlers := handlers.NewTurnHandlers(turnServer, iceConfig)
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		AppName: "Seaside API",
+		// Client addresses, which guest bans go by, are only taken from the
+		// proxy header when one of TRUSTED_PROXIES sent the request
+		ProxyHeader:             deploymentConfig.Proxy.Header,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          deploymentConfig.Proxy.TrustedProxies,
+		EnableIPValidation:      true,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -99,13 +239,16 @@ func main() {
 		},
 	})
 
+	// Bodies are held to Fiber's default limit, except attachment uploads
+	app.Server().HeaderReceived = middleware.RouteBodyLimit(fiber.MethodPost, "/api/rooms/:id/attachments", handlers.AttachmentRequestLimit)
+
 	// Middleware
 	app.Use(recover.New())
 	app.Use(logger.New())
 	app.Use(middleware.CorsConfig())
 
 	// Routes
-	setupRoutes(app, authHandlers, jwtUtil)
+	setupRoutes(app, authHandlers, roomHandlers, chatHandlers, turnHandlers, jwtUtil)
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -114,7 +257,34 @@ func main() {
 	}
 
 	log.Printf("🚀 Seaside API starting on port %s", port)
-	if err := app.Listen(":" + port); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	go func() {
+		if err := app.Listen(":" + port); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop() // A second signal ends the process straight away
+	shutdown(app)
+}
+
+// shutdown stops taking joins, tells everyone connected to reconnect, and
+// waits for them to leave before the server stops. The deferred closes in
+// main then release the TURN server, room store and database.
+func shutdown(app *fiber.App) {
+	log.Println("Shutting down, telling participants to reconnect...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Room sockets hear it on their signal channel before their chat closes
+	if err := video.AllRooms.Drain(ctx); err != nil {
+		log.Printf("Calls did not drain in time: %v", err)
+	}
+	if err := chat.Drain(ctx); err != nil {
+		log.Printf("Chats did not drain in time: %v", err)
+	}
+	if err := app.ShutdownWithContext(ctx); err != nil {
+		log.Printf("Server did not shut down cleanly: %v", err)
 	}
+	log.Println("Server stopped")
 }
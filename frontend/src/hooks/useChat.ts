@@ -1,4 +1,26 @@
-import { useEffect, useRef, useState, useCallback } from "react";
+import { useEffect, useRef, useState, useCallback, useMemo } from "react";
+import { socketProtocols, withInvite } from "../utils/socketAuth";
+import { TokenManager } from "../utils/tokenManager";
+
+const API_BASE_URL = (import.meta.env.VITE_API_BASE_URL || 'http://localhost:8080').replace(/\/$/, '');
+
+export interface ChatAttachment {
+  id: string;
+  name: string;
+  contentType: string;
+  size: number;
+  url: string; // Absolute
+  thumbnailUrl?: string; // Images only
+  width?: number;
+  height?: number;
+}
+
+// Reactor is someone who reacted to a message, told apart by ID because
+// names change: "user:<id>" when signed in, "guest:<participant ID>" if not
+export interface Reactor {
+  id: string;
+  name: string;
+}
 
 export interface ChatMessage {
   id: string;
@@ -6,18 +28,75 @@ export interface ChatMessage {
   from: string;
   fromMe: boolean;
   timestamp: Date;
-  type: 'chat' | 'system' | 'join' | 'leave';
+  type: 'chat' | 'action' | 'attachment' | 'direct' | 'system' | 'join' | 'leave' | 'nick' | 'topic';
+  to?: string; // Recipient of a direct message
+  fromId?: string; // Sender's participant ID, to reply to a direct message
+  seq?: number; // Position in the room, used to edit, delete and react
+  edited?: boolean;
+  deleted?: boolean;
+  reactions?: Record<string, Reactor[]>; // Emoji -> who reacted
+  attachment?: ChatAttachment; // The text is its caption
+}
+
+// applyChange returns a message as it is after an edit, deletion or reaction
+function applyChange(message: ChatMessage, change: any): ChatMessage {
+  switch (change.type) {
+    case 'edit':
+      return { ...message, text: change.text, edited: true };
+    case 'delete':
+      return { ...message, text: "", deleted: true, reactions: undefined, attachment: undefined };
+    case 'react': {
+      const reactions = { ...(message.reactions || {}) };
+      const id = change.userId ? `user:${change.userId}` : `guest:${change.fromId}`;
+      const reactors = (reactions[change.emoji] || []).filter(r => r.id !== id);
+      if (!change.removed) reactors.push({ id, name: change.from });
+      if (reactors.length > 0) {
+        reactions[change.emoji] = reactors;
+      } else {
+        delete reactions[change.emoji];
+      }
+      return { ...message, reactions };
+    }
+    default:
+      return message;
+  }
+}
+
+export interface ChatParticipant {
+  id: string; // Addresses direct messages
+  name: string;
+  userId?: number;
+  avatar?: string;
+  role: 'host' | 'co-host' | 'member' | 'guest';
+  host?: boolean;
+  joinedAt: string;
+  status: 'active' | 'typing' | 'away';
+}
+
+// applyPresence returns the roster after a "presence" diff
+function applyPresence(participants: ChatParticipant[], diff: any): ChatParticipant[] {
+  const left = new Set<string>(diff.left || []);
+  const changed = new Map<string, ChatParticipant>();
+  for (const p of [...(diff.joined || []), ...(diff.updated || [])]) changed.set(p.id, p);
+
+  const roster = participants
+    .filter(p => !left.has(p.id))
+    .map(p => changed.get(p.id) || p);
+  for (const p of diff.joined || []) {
+    if (!roster.some(r => r.id === p.id)) roster.push(p);
+  }
+  return roster;
 }
 
 export interface ChatStats {
   totalMessages: number;
-  participants: string[];
+  participants: ChatParticipant[];
   isConnected: boolean;
 }
 
 export function useChat(roomId: string, userName: string) {
   const [messages, setMessages] = useState<ChatMessage[]>([]);
-  const [isTyping, setIsTyping] = useState<string[]>([]);
+  const [topic, setTopic] = useState<string>("");
   const [chatStats, setChatStats] = useState<ChatStats>({
     totalMessages: 0,
     participants: [],
@@ -26,8 +105,16 @@ export function useChat(roomId: string, userName: string) {
   
   const wsRef = useRef<WebSocket | null>(null);
   const typingTimeoutRef = useRef<NodeJS.Timeout | null>(null);
+  const typingSentRef = useRef(false);
   const reconnectTimeoutRef = useRef<NodeJS.Timeout | null>(null);
+  // Delay the server asked for before it restarted
+  const restartDelayRef = useRef<number | null>(null);
   const messageIdsRef = useRef<Set<string>>(new Set());
+  // Latest sequence number seen, so a reconnect can ask for what it missed
+  const lastSeqRef = useRef<number>(0);
+  const ackTimeoutRef = useRef<NodeJS.Timeout | null>(null);
+  // Our own participant ID, from the roster snapshot
+  const selfIdRef = useRef<string>("");
   
   // Generate a unique username to prevent conflicts, but keep original for display
   const uniqueUserName = useRef<string>(`${userName}_${Math.random().toString(36).substr(2, 6)}`);
@@ -46,12 +133,20 @@ export function useChat(roomId: string, userName: string) {
     console.log("[Chat] Using unique username:", uniqueUserName.current);
     console.log("[Chat] Display username:", displayUserName.current);
     
-    const ws = new WebSocket(wsUrl);
+    const ws = new WebSocket(withInvite(wsUrl), socketProtocols());
     wsRef.current = ws;
 
     ws.onopen = () => {
       console.log("[Chat] WebSocket connected successfully");
       setChatStats(prev => ({ ...prev, isConnected: true }));
+
+      // Pick up where the dropped connection left off
+      if (lastSeqRef.current > 0) {
+        ws.send(JSON.stringify({ type: "resume", seq: lastSeqRef.current }));
+      }
+      if (document.hidden) {
+        ws.send(JSON.stringify({ type: "status", status: "away" }));
+      }
     };
 
     ws.onmessage = (event) => {
@@ -68,10 +163,12 @@ export function useChat(roomId: string, userName: string) {
       console.log("[Chat] WebSocket closed:", event.code, event.reason);
       setChatStats(prev => ({ ...prev, isConnected: false }));
       
-      // Auto-reconnect (simple version)
-      if (event.code !== 1000) {
-        console.log("[Chat] Attempting to reconnect in 3 seconds...");
-        reconnectTimeoutRef.current = setTimeout(connectChat, 3000);
+      // Auto-reconnect (simple version), unless the server dropped us for flooding
+      if (event.code !== 1000 && event.code !== 1008) {
+        const delay = restartDelayRef.current ?? 3000;
+        restartDelayRef.current = null;
+        console.log(`[Chat] Attempting to reconnect in ${delay} ms...`);
+        reconnectTimeoutRef.current = setTimeout(connectChat, delay);
       }
     };
 
@@ -80,10 +177,53 @@ export function useChat(roomId: string, userName: string) {
     };
   }, [roomId, userName]);
 
+  // Acknowledge what has arrived, batched so a burst sends one ack
+  const scheduleAck = useCallback(() => {
+    if (ackTimeoutRef.current) return;
+    ackTimeoutRef.current = setTimeout(() => {
+      ackTimeoutRef.current = null;
+      if (wsRef.current?.readyState === WebSocket.OPEN) {
+        wsRef.current.send(JSON.stringify({ type: "ack", seq: lastSeqRef.current }));
+      }
+    }, 1000);
+  }, []);
+
   const handleMessage = useCallback((data: any) => {
     console.log("[Chat] Processing message:", data);
+
+    // The server has replayed what we missed; a lower sequence number means
+    // the room started over and old numbers will be reused
+    if (data.type === 'resume') {
+      if ((data.seq || 0) < lastSeqRef.current) {
+        lastSeqRef.current = data.seq || 0;
+        messageIdsRef.current.clear();
+      }
+      if (data.truncated) {
+        console.log("[Chat] Missed too much to replay, older messages were skipped");
+      }
+      return;
+    }
+
+    // The server closes the socket next; reconnect when it says
+    if (data.type === 'server_restarting') {
+      restartDelayRef.current = data.retryAfter ?? null;
+    }
+
+    // The roster arrives whole on connecting, then as diffs
+    if (data.type === 'participants') {
+      selfIdRef.current = data.self || "";
+      setChatStats(prev => ({ ...prev, participants: data.participants || [] }));
+      return;
+    }
+    if (data.type === 'presence') {
+      setChatStats(prev => ({ ...prev, participants: applyPresence(prev.participants, data.presence || {}) }));
+      return;
+    }
     
-    const messageId = data.id || `${Date.now()}-${Math.random()}`;
+    // Numbered messages are recognised when a reconnect replays them
+    const messageId = data.seq
+      ? `seq-${data.seq}`
+      : data.id ? String(data.id) : `${Date.now()}-${Math.random()}`;
     
     // Simple duplicate prevention
     if (messageIdsRef.current.has(messageId)) {
@@ -92,34 +232,37 @@ export function useChat(roomId: string, userName: string) {
     }
     messageIdsRef.current.add(messageId);
 
-    if (data.type === 'typing') {
-      console.log("[Chat] Handling typing message:", data);
-      // Simple typing indicators
-      if (data.text && data.from !== uniqueUserName.current) {
-        setIsTyping(prev => [...prev.filter(p => p !== data.from), data.from]);
-        setTimeout(() => {
-          setIsTyping(prev => prev.filter(p => p !== data.from));
-        }, 3000);
-      } else {
-        setIsTyping(prev => prev.filter(p => p !== data.from));
-      }
+    if (data.seq > lastSeqRef.current) {
+      lastSeqRef.current = data.seq;
+      scheduleAck();
+    }
+
+    // Changes to an earlier message update it in place
+    if (data.type === 'edit' || data.type === 'delete' || data.type === 'react') {
+      setMessages(prev => prev.map(m => m.seq === data.target ? applyChange(m, data) : m));
       return;
     }
 
-    // Handle system messages (like clear)
-    if (data.type === 'system') {
-      console.log("[Chat] Handling system message:", data);
-      if (data.text === 'Chat cleared') {
-        console.log("[Chat] Clearing messages");
-        setMessages([]);
-        messageIdsRef.current.clear();
-        setChatStats(prev => ({ ...prev, totalMessages: 0 }));
-        return;
-      }
+    // A host cleared the chat; nothing sent before it is replayed
+    if (data.type === 'clear') {
+      console.log("[Chat] Clearing messages");
+      setMessages([]);
+      messageIdsRef.current.clear();
+      setChatStats(prev => ({ ...prev, totalMessages: 0 }));
+      return;
+    }
+
+    if (data.type === 'topic') {
+      setTopic(data.text || "");
+    }
+
+    // After /nick our messages arrive under the new name
+    if (data.type === 'nick' && data.from === uniqueUserName.current && data.name) {
+      uniqueUserName.current = data.name;
     }
 
     // Handle join/leave messages - these are system messages, not from the current user
-    const isFromMe = data.type === 'chat' && data.from === uniqueUserName.current;
+    const isFromMe = (data.type === 'chat' || data.type === 'action' || data.type === 'attachment' || data.type === 'direct') && data.from === uniqueUserName.current;
     
     const message: ChatMessage = {
       id: messageId,
@@ -127,29 +270,33 @@ export function useChat(roomId: string, userName: string) {
       from: data.from || "system",
       fromMe: isFromMe,
       timestamp: new Date(data.timestamp || Date.now()),
-      type: data.type || "chat",
+      type: data.type === 'warning' || data.type === 'server_restarting' ? 'system' : data.type || "chat", // Rate limit warnings and restarts show as system messages
+      to: data.to,
+      fromId: data.fromId,
+      seq: data.seq,
+      edited: data.edited,
+      deleted: data.deleted,
+      reactions: data.reactions,
+      attachment: data.attachment && {
+        ...data.attachment,
+        url: API_BASE_URL + data.attachment.url,
+        thumbnailUrl: data.attachment.thumbnailUrl && API_BASE_URL + data.attachment.thumbnailUrl,
+      },
     };
 
     console.log("[Chat] Adding message to state:", message);
     console.log("[Chat] Current userName:", userName, "Unique userName:", uniqueUserName.current, "Message from:", data.from, "fromMe:", isFromMe);
     setMessages(prev => [...prev, message]);
     setChatStats(prev => ({ ...prev, totalMessages: prev.totalMessages + 1 }));
+  }, [userName, scheduleAck]);
 
-    // Simple participant tracking
-    if (data.type === 'join') {
-      setChatStats(prev => ({
-        ...prev,
-        participants: [...new Set([...prev.participants, data.from])]
-      }));
-    } else if (data.type === 'leave') {
-      setChatStats(prev => ({
-        ...prev,
-        participants: prev.participants.filter(p => p !== data.from)
-      }));
-    } else if (data.participants) {
-      setChatStats(prev => ({ ...prev, participants: data.participants }));
-    }
-  }, [userName]);
+  // Everyone else whose status is typing
+  const isTyping = useMemo(
+    () => chatStats.participants
+      .filter(p => p.status === 'typing' && p.id !== selfIdRef.current)
+      .map(p => p.name),
+    [chatStats.participants]
+  );
 
   const sendMessage = useCallback((text: string) => {
     if (!text.trim() || wsRef.current?.readyState !== WebSocket.OPEN) {
@@ -167,13 +314,17 @@ export function useChat(roomId: string, userName: string) {
     wsRef.current.send(messageData);
   }, []);
 
-  // Simple typing indicator
+  // Simple typing indicator; only changes are sent, the server limits how often
   const handleTyping = useCallback(() => {
     if (wsRef.current?.readyState === WebSocket.OPEN) {
-      wsRef.current.send(JSON.stringify({ type: "typing", isTyping: true }));
+      if (!typingSentRef.current) {
+        wsRef.current.send(JSON.stringify({ type: "typing", isTyping: true }));
+        typingSentRef.current = true;
+      }
       
       if (typingTimeoutRef.current) clearTimeout(typingTimeoutRef.current);
       typingTimeoutRef.current = setTimeout(() => {
+        typingSentRef.current = false;
         if (wsRef.current?.readyState === WebSocket.OPEN) {
           wsRef.current.send(JSON.stringify({ type: "typing", isTyping: false }));
         }
@@ -181,10 +332,53 @@ export function useChat(roomId: string, userName: string) {
     }
   }, []);
 
+  // Direct messages reach only the participant with this ID, and us
+  const sendDirectMessage = useCallback((to: string, text: string) => {
+    if (!text.trim() || wsRef.current?.readyState !== WebSocket.OPEN) return;
+    wsRef.current.send(JSON.stringify({ type: "direct", to, text: text.trim() }));
+  }, []);
+
+  // Uploads an image or PDF, then shares it in the chat. Only signed-in
+  // users can upload.
+  const sendAttachment = useCallback(async (file: File, caption = "") => {
+    const token = TokenManager.getAccessToken();
+    if (!token || wsRef.current?.readyState !== WebSocket.OPEN) return;
+
+    const form = new FormData();
+    form.append("file", file);
+    const response = await fetch(`${API_BASE_URL}/api/rooms/${roomId}/attachments`, {
+      method: "POST",
+      headers: { Authorization: `Bearer ${token}` },
+      body: form,
+    });
+    const data = await response.json();
+    if (!response.ok) {
+      throw new Error(data.error || "Upload failed");
+    }
+    wsRef.current?.send(JSON.stringify({ type: "attachment", attachment: data.attachment.id, text: caption.trim() }));
+  }, [roomId]);
+
+  // Only your own messages can be edited or deleted, unless you host the room
+  const editMessage = useCallback((seq: number, text: string) => {
+    if (!text.trim() || wsRef.current?.readyState !== WebSocket.OPEN) return;
+    wsRef.current.send(JSON.stringify({ type: "edit", target: seq, text: text.trim() }));
+  }, []);
+
+  const deleteMessage = useCallback((seq: number) => {
+    if (wsRef.current?.readyState !== WebSocket.OPEN) return;
+    wsRef.current.send(JSON.stringify({ type: "delete", target: seq }));
+  }, []);
+
+  // Reacting again with the same emoji takes the reaction back
+  const reactToMessage = useCallback((seq: number, emoji: string) => {
+    if (wsRef.current?.readyState !== WebSocket.OPEN) return;
+    wsRef.current.send(JSON.stringify({ type: "react", target: seq, emoji }));
+  }, []);
+
   const clearMessages = useCallback(() => {
     if (wsRef.current?.readyState === WebSocket.OPEN) {
       console.log("[Chat] Sending clear command");
-      wsRef.current.send(JSON.stringify({ type: "chat", text: "clear" }));
+      wsRef.current.send(JSON.stringify({ type: "chat", text: "/clear" }));
     } else {
       console.log("[Chat] Clearing messages locally");
       setMessages([]);
@@ -193,6 +387,17 @@ export function useChat(roomId: string, userName: string) {
     }
   }, []);
 
+  // Show as away while the page is hidden
+  useEffect(() => {
+    const onVisibilityChange = () => {
+      if (wsRef.current?.readyState === WebSocket.OPEN) {
+        wsRef.current.send(JSON.stringify({ type: "status", status: document.hidden ? "away" : "active" }));
+      }
+    };
+    document.addEventListener("visibilitychange", onVisibilityChange);
+    return () => document.removeEventListener("visibilitychange", onVisibilityChange);
+  }, []);
+
   useEffect(() => {
     if (!roomId || !userName) return;
     
@@ -201,6 +406,8 @@ export function useChat(roomId: string, userName: string) {
     return () => {
       if (reconnectTimeoutRef.current) clearTimeout(reconnectTimeoutRef.current);
       if (typingTimeoutRef.current) clearTimeout(typingTimeoutRef.current);
+      if (ackTimeoutRef.current) clearTimeout(ackTimeoutRef.current);
+      ackTimeoutRef.current = null;
       wsRef.current?.close();
     };
   }, [roomId, userName, connectChat]);
@@ -208,10 +415,16 @@ export function useChat(roomId: string, userName: string) {
   return {
     messages,
     isTyping,
+    topic,
     chatStats,
     isConnected: chatStats.isConnected,
     sendMessage,
+    sendDirectMessage,
+    sendAttachment,
     handleTyping,
+    editMessage,
+    deleteMessage,
+    reactToMessage,
     clearMessages,
     connectChat,
   };
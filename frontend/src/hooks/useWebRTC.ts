@@ -1,4 +1,19 @@
 import { useEffect, useRef, useState, useCallback } from "react";
+import { socketProtocols, withInvite } from "../utils/socketAuth";
+import { DEFAULT_ICE_SERVERS, fetchIceServers } from "../utils/iceServers";
+
+// Must match video.ProtocolVersion on the backend
+const SIGNAL_PROTOCOL_VERSION = 1;
+
+// Must match video.SFUPeerID; in SFU rooms media is negotiated with the server
+const SFU_PEER_ID = 'sfu';
+
+// Someone in the waiting room, as announced in knock frames
+export interface Knock {
+    id: string;
+    userId?: number;
+    name?: string;
+}
 
 interface ConnectionStats {
     bytesReceived: number;
@@ -26,6 +41,8 @@ export function useWebRTC(
     const dataChannelRef = useRef<RTCDataChannel | null>(null);
     const onMessageRef = useRef<((msg: string) => void) | undefined>();
     const reconnectTimeoutRef = useRef<ReturnType<typeof setTimeout> | null>(null);
+    // Delay the server asked for before it restarted, used instead of the backoff
+    const restartDelayRef = useRef<number | null>(null);
     const heartbeatIntervalRef = useRef<ReturnType<typeof setInterval> | null>(null);
     const statsIntervalRef = useRef<ReturnType<typeof setInterval> | null>(null);
     const initialSetupRef = useRef(false);
@@ -35,6 +52,17 @@ export function useWebRTC(
     const [iceConnectionState, setIceConnectionState] = useState<RTCIceConnectionState>('new');
     const [isReconnecting, setIsReconnecting] = useState(false);
     const [connectionStats, setConnectionStats] = useState<ConnectionStats | null>(null);
+    const [isWaiting, setIsWaiting] = useState(false);
+    const [knocks, setKnocks] = useState<Knock[]>([]);
+    const [muteRequest, setMuteRequest] = useState<'audio' | 'video' | null>(null);
+
+    // Large rooms move from the mesh to the server's SFU, which sends every
+    // participant's media over our single connection, keyed by participant ID
+    const sfuModeRef = useRef(false);
+    const [remoteStreams, setRemoteStreams] = useState<Record<string, MediaStream>>({});
+
+    // Whether the server is recording the call
+    const [isRecording, setIsRecording] = useState(false);
 
     // Host = impolite, Guest = polite
     const isPolite = !isHost;
@@ -42,22 +70,8 @@ export function useWebRTC(
     // Detect mobile device
     const isMobile = /Android|webOS|iPhone|iPad|iPod|BlackBerry|IEMobile|Opera Mini/i.test(navigator.userAgent);
 
-    // Enhanced ICE servers with mobile-optimized configuration
-    const iceServers = [
-        { urls: "stun:stun.l.google.com:19302" },
-        { urls: "stun:stun1.l.google.com:19302" },
-        { urls: "stun:stun2.l.google.com:19302" },
-        {
-            urls: "turn:openrelay.metered.ca:443",
-            username: "openrelayproject",
-            credential: "openrelayproject"
-        },
-        {
-            urls: "turn:openrelay.metered.ca:443?transport=tcp",
-            username: "openrelayproject",
-            credential: "openrelayproject"
-        }
-    ];
+    // ICE servers come from the backend so relays can change without a redeploy
+    const iceServersRef = useRef<RTCIceServer[]>(DEFAULT_ICE_SERVERS);
 
     // Buffer messages until WS is open
     const wsSendBuffer = useRef<any[]>([]);
@@ -70,6 +84,13 @@ export function useWebRTC(
         }
     }, []);
 
+    // Wrap a payload in the versioned signalling envelope expected by the backend
+    const signalSeqRef = useRef(0);
+    const sendSignal = useCallback((type: string, payload?: any, to?: string) => {
+        signalSeqRef.current += 1;
+        safeWSSend({ v: SIGNAL_PROTOCOL_VERSION, type, to, seq: signalSeqRef.current, payload });
+    }, [safeWSSend]);
+
     // Get initial media constraints (always request both audio and video)
     const getInitialConstraints = useCallback(() => {
         if (isMobile) {
@@ -224,7 +245,7 @@ export function useWebRTC(
 
         // Mobile-optimized peer connection configuration
         const pcConfig = {
-            iceServers,
+            iceServers: iceServersRef.current,
             iceCandidatePoolSize: isMobile ? 5 : 10,
             bundlePolicy: 'max-bundle' as RTCBundlePolicy,
             rtcpMuxPolicy: 'require' as RTCRtcpMuxPolicy,
@@ -262,8 +283,10 @@ export function useWebRTC(
             }
         };
 
-        // Data channel setup 
-        if (isHost) {
+        // Data channel setup; the SFU only forwards media
+        if (sfuModeRef.current) {
+            console.log("[WebRTC] SFU mode, no data channel");
+        } else if (isHost) {
             console.log("[WebRTC] Host creating data channel");
             // Create data channel AFTER peer connection is created but BEFORE adding tracks
             const dc = pc.createDataChannel("chat", {
@@ -282,6 +305,10 @@ export function useWebRTC(
 
         // Enhanced negotiation handling with mobile considerations
         pc.onnegotiationneeded = async () => {
+            // The SFU makes every offer itself
+            if (sfuModeRef.current) {
+                return;
+            }
             try {
                 console.log("[WebRTC] Negotiation needed - signaling state:", pc.signalingState);
                 console.log("[WebRTC] Local tracks:", localStreamRef.current?.getTracks().length || 0);
@@ -299,7 +326,7 @@ export function useWebRTC(
                     const offer = await pc.createOffer(offerOptions);
                     await pc.setLocalDescription(offer);
                     console.log("[WebRTC] Created and set local offer, sending to peer");
-                    safeWSSend({ offer });
+                    sendSignal('offer', { type: offer.type, sdp: offer.sdp });
                 } else {
                     console.log("[WebRTC] Skipping offer creation - signaling state not stable:", pc.signalingState);
                 }
@@ -313,7 +340,7 @@ export function useWebRTC(
         pc.onicecandidate = (event) => {
             if (event.candidate) {
                 console.log("[WebRTC] Sending ICE candidate");
-                safeWSSend({ iceCandidate: event.candidate });
+                sendSignal('ice-candidate', event.candidate.toJSON(), sfuModeRef.current ? SFU_PEER_ID : undefined);
             } else {
                 console.log("[WebRTC] ICE gathering complete");
             }
@@ -321,6 +348,16 @@ export function useWebRTC(
 
         pc.ontrack = (event) => {
             console.log("[WebRTC] Remote track received");
+            if (sfuModeRef.current) {
+                // Forwarded streams are named after the participant sending them
+                const stream = event.streams[0];
+                if (!stream) return;
+                setRemoteStreams(prev => ({ ...prev, [stream.id]: stream }));
+                if (remoteVideoRef.current) {
+                    remoteVideoRef.current.srcObject = stream;
+                }
+                return;
+            }
             const remoteStream = new MediaStream();
             event.streams[0].getTracks().forEach((track) => {
                 remoteStream.addTrack(track);
@@ -339,7 +376,7 @@ export function useWebRTC(
 
         peerRef.current = pc;
         return pc;
-    }, [isHost, safeWSSend, remoteVideoRef, setupDataChannel, isMobile]);
+    }, [isHost, sendSignal, remoteVideoRef, setupDataChannel, isMobile]);
 
     // Enhanced WebSocket connection with retry logic
     const connectWebSocket = useCallback(() => {
@@ -350,14 +387,12 @@ export function useWebRTC(
             ? "wss://seaside-backend-pw1v.onrender.com"
             : `${wsProtocol}://${window.location.hostname}:8080`;
 
-        const ws = new WebSocket(`${wsBase}/join-room?roomID=${roomId}`);
+        const ws = new WebSocket(withInvite(`${wsBase}/join-room?roomID=${roomId}&name=${encodeURIComponent(userName)}`), socketProtocols());
         wsRef.current = ws;
 
         ws.onopen = () => {
             console.log("[WebSocket] Connected");
             setIsReconnecting(false);
-            ws.send(JSON.stringify({ join: true, userName }));
-
             // Send buffered messages
             while (wsSendBuffer.current.length > 0) {
                 ws.send(JSON.stringify(wsSendBuffer.current.shift()));
@@ -405,7 +440,100 @@ export function useWebRTC(
                 return;
             }
 
-            if (message.offer) {
+            if (message.type === 'error') {
+                console.warn("[WebSocket] Signalling frame rejected:", message.payload);
+                return;
+            }
+
+            if (message.type === 'lobby-waiting') {
+                console.log("[WebSocket] Waiting for a host to admit us");
+                setIsWaiting(true);
+                return;
+            }
+
+            if (message.type === 'knock') {
+                setKnocks(prev => [...prev.filter(k => k.id !== message.payload.id), message.payload]);
+                return;
+            }
+
+            if (message.type === 'lobby-left') {
+                setKnocks(prev => prev.filter(k => k.id !== message.from));
+                return;
+            }
+
+            if (message.type === 'roster') {
+                setIsWaiting(false);
+                if (message.payload?.waiting) {
+                    setKnocks(message.payload.waiting);
+                }
+                if (message.payload?.mode === 'sfu') {
+                    await switchToSFU();
+                    return;
+                }
+            }
+
+            if (message.type === 'mode') {
+                if (message.payload?.mode === 'sfu') {
+                    await switchToSFU();
+                }
+                return;
+            }
+
+            if (message.type === 'mute-request') {
+                console.log("[WebSocket] Host asked us to mute", message.payload?.kind);
+                setMuteRequest(message.payload?.kind ?? 'audio');
+                return;
+            }
+
+            if (message.type === 'kicked') {
+                console.log("[WebSocket] Removed from the room by the host", message.payload);
+                handlePeerDisconnection();
+                // A normal closure stops the reconnection logic
+                wsRef.current?.close(1000, "kicked");
+                return;
+            }
+
+            if (message.type === 'recording') {
+                console.log("[WebSocket] Recording", message.payload?.active ? "started" : "stopped");
+                setIsRecording(!!message.payload?.active);
+                return;
+            }
+
+            if (message.type === 'room-locked') {
+                console.log("[WebSocket] Room lock changed:", message.payload?.locked);
+                return;
+            }
+
+            if (message.type === 'server_restarting') {
+                // The server closes the socket next; reconnect when it says
+                console.log("[WebSocket] Server is restarting, reconnecting in", message.payload?.retryAfter, "ms");
+                restartDelayRef.current = message.payload?.retryAfter ?? null;
+                return;
+            }
+
+            if (message.type === 'room-closed') {
+                console.log("[WebSocket] Room was closed by the host");
+                handlePeerDisconnection();
+                // A normal closure stops the reconnection logic
+                wsRef.current?.close(1000, "room closed");
+                return;
+            }
+
+            if (message.type === 'offer' && message.from === SFU_PEER_ID) {
+                // The server is always the offerer, so there are no collisions
+                const sfuPeer = peerRef.current!;
+                await sfuPeer.setRemoteDescription(new RTCSessionDescription(message.payload));
+                while (iceQueueRef.current.length > 0) {
+                    const candidate = iceQueueRef.current.shift();
+                    if (candidate) {
+                        await sfuPeer.addIceCandidate(candidate);
+                    }
+                }
+                const answer = await sfuPeer.createAnswer();
+                await sfuPeer.setLocalDescription(answer);
+                console.log("[WebRTC] Sending answer to the SFU");
+                sendSignal('answer', { type: answer.type, sdp: answer.sdp }, SFU_PEER_ID);
+            } else if (message.type === 'offer') {
                 console.log("[WebRTC] Received offer");
                 const offerCollision = makingOfferRef.current || pc.signalingState !== "stable";
                 ignoreOfferRef.current = !isPolite && offerCollision;
@@ -420,7 +548,7 @@ export function useWebRTC(
                     await pc.setLocalDescription({ type: "rollback" });
                 }
 
-                await pc.setRemoteDescription(new RTCSessionDescription(message.offer));
+                await pc.setRemoteDescription(new RTCSessionDescription(message.payload));
                 console.log("[WebRTC] Remote description set");
 
                 // Process queued ICE candidates
@@ -439,23 +567,36 @@ export function useWebRTC(
                     const answer = await pc.createAnswer(answerOptions);
                     await pc.setLocalDescription(answer);
                     console.log("[WebRTC] Sending answer");
-                    safeWSSend({ answer });
+                    sendSignal('answer', { type: answer.type, sdp: answer.sdp });
                 }
-            } else if (message.answer) {
+            } else if (message.type === 'answer') {
                 console.log("[WebRTC] Received answer");
                 if (pc.signalingState === "have-local-offer") {
-                    await pc.setRemoteDescription(new RTCSessionDescription(message.answer));
+                    await pc.setRemoteDescription(new RTCSessionDescription(message.payload));
                     console.log("[WebRTC] Answer processed");
                 }
-            } else if (message.iceCandidate) {
+            } else if (message.type === 'ice-candidate') {
                 console.log("[WebRTC] Received ICE candidate");
                 if (pc.remoteDescription && pc.remoteDescription.type) {
-                    await pc.addIceCandidate(new RTCIceCandidate(message.iceCandidate));
+                    await pc.addIceCandidate(new RTCIceCandidate(message.payload));
                 } else {
                     console.log("[WebRTC] Queueing ICE candidate");
-                    iceQueueRef.current.push(message.iceCandidate);
+                    iceQueueRef.current.push(message.payload);
                 }
-            } else if (message.join) {
+            } else if (sfuModeRef.current && message.type === 'leave') {
+                console.log("[WebRTC] Participant left the SFU room");
+                if ((remoteVideoRef.current?.srcObject as MediaStream | null)?.id === message.from) {
+                    remoteVideoRef.current!.srcObject = null;
+                }
+                setRemoteStreams(prev => {
+                    const next = { ...prev };
+                    delete next[message.from];
+                    return next;
+                });
+            } else if (sfuModeRef.current && message.type === 'join') {
+                // The SFU offers us the newcomer's tracks once it publishes them
+                return;
+            } else if (message.type === 'join' || (message.type === 'roster' && message.payload?.peers?.length > 0)) {
                 console.log("[WebRTC] Join message received, both peers should be ready");
                 // Both peers should ensure they have tracks and are ready
                 await addTracksIfNeeded(pc);
@@ -467,14 +608,14 @@ export function useWebRTC(
                 } else {
                     console.log("[WebRTC] Impolite peer ready for negotiation");
                 }
-            } else if (message.leave) {
+            } else if (message.type === 'leave') {
                 console.log("[WebRTC] Peer left");
                 handlePeerDisconnection();
             }
         } catch (error) {
             console.error("[WebRTC] Error handling signaling message:", error);
         }
-    }, [isPolite, safeWSSend, isMobile]);
+    }, [isPolite, sendSignal, isMobile]);
 
     // Heartbeat mechanism to detect connection issues
     const startHeartbeat = useCallback(() => {
@@ -482,10 +623,10 @@ export function useWebRTC(
         const heartbeatInterval = isMobile ? 45000 : 30000; // Longer interval for mobile
         heartbeatIntervalRef.current = setInterval(() => {
             if (wsRef.current?.readyState === WebSocket.OPEN) {
-                safeWSSend({ type: 'ping' });
+                sendSignal('ping');
             }
         }, heartbeatInterval);
-    }, [safeWSSend, isMobile]);
+    }, [sendSignal, isMobile]);
 
     const stopHeartbeat = useCallback(() => {
         if (heartbeatIntervalRef.current) {
@@ -500,7 +641,8 @@ export function useWebRTC(
 
         setIsReconnecting(true);
         const baseDelay = isMobile ? 2000 : 1000;
-        const delay = Math.min(baseDelay * Math.pow(2, Math.random()), 10000);
+        const delay = restartDelayRef.current ?? Math.min(baseDelay * Math.pow(2, Math.random()), 10000);
+        restartDelayRef.current = null;
 
         reconnectTimeoutRef.current = setTimeout(() => {
             console.log("[WebSocket] Attempting reconnection...");
@@ -510,6 +652,13 @@ export function useWebRTC(
 
     // Connection failure handler with restart capability
     const handleConnectionFailure = useCallback(async () => {
+        if (sfuModeRef.current) {
+            // The server drops our session, reconnecting the socket gets a new one
+            console.log("[WebRTC] SFU connection failed, reconnecting");
+            wsRef.current?.close(4000, "sfu connection failed");
+            return;
+        }
+
         console.log("[WebRTC] Connection failure detected, attempting restart");
         setIsReconnecting(true);
         setDataChannelOpen(false);
@@ -529,6 +678,8 @@ export function useWebRTC(
         const restartDelay = isMobile ? 3000 : 2000;
         setTimeout(async () => {
             try {
+                // TURN credentials are short-lived, so take fresh ones
+                iceServersRef.current = await fetchIceServers();
                 const newPeer = createPeer();
                 await addTracksIfNeeded(newPeer);
                 if (isPolite) {
@@ -561,6 +712,24 @@ export function useWebRTC(
         }
     }, []);
 
+    // Replace the mesh connection with one to the SFU, which will offer it
+    // everyone's tracks
+    const switchToSFU = useCallback(async () => {
+        console.log("[WebRTC] Room uses the SFU");
+        sfuModeRef.current = true;
+
+        peerRef.current?.close();
+        peerRef.current = null;
+        tracksAddedRef.current = false;
+        iceQueueRef.current = [];
+        dataChannelRef.current = null;
+        setDataChannelOpen(false);
+        setRemoteStreams({});
+
+        const peer = createPeer();
+        await addTracksIfNeeded(peer);
+    }, [createPeer, addTracksIfNeeded]);
+
     // Call initiation
     const callUser = useCallback(async () => {
         console.log("[WebRTC] Initiating call");
@@ -641,7 +810,8 @@ export function useWebRTC(
                 localStreamRef.current = localStream;
                 console.log("[Setup] Local media acquired successfully");
 
-                // Create peer connection first
+                // Create peer connection first, with this user's ICE servers
+                iceServersRef.current = await fetchIceServers();
                 const peer = createPeer();
 
                 // Add tracks to peer connection
@@ -699,6 +869,7 @@ export function useWebRTC(
             dataChannelRef.current = null;
             tracksAddedRef.current = false;
             iceQueueRef.current = [];
+            sfuModeRef.current = false;
             makingOfferRef.current = false;
             ignoreOfferRef.current = false;
             wsSendBuffer.current = [];
@@ -709,6 +880,8 @@ export function useWebRTC(
             setConnectionState('new');
             setIceConnectionState('new');
             setIsReconnecting(false);
+            setRemoteStreams({});
+            setIsRecording(false);
         };
     }, [roomId, userName]); // Removed micActive and videoActive from dependencies
 
@@ -770,10 +943,37 @@ export function useWebRTC(
         }
     }, [handleConnectionFailure, isReconnecting]);
 
+    // Hosts answer knocks from the waiting room
+    const admit = useCallback((id: string) => sendSignal('admit', undefined, id), [sendSignal]);
+    const deny = useCallback((id: string) => sendSignal('deny', undefined, id), [sendSignal]);
+
+    // Host moderation
+    const kick = useCallback((id: string) => sendSignal('kick', undefined, id), [sendSignal]);
+    const ban = useCallback((id: string) => sendSignal('ban', undefined, id), [sendSignal]);
+    const requestMute = useCallback((id: string, kind: 'audio' | 'video' = 'audio') => sendSignal('mute-request', { kind }, id), [sendSignal]);
+    const clearMuteRequest = useCallback(() => setMuteRequest(null), []);
+
+    // Hosts record the call on the server; recordings are listed under the room
+    const startRecording = useCallback(() => sendSignal('record-start'), [sendSignal]);
+    const stopRecording = useCallback(() => sendSignal('record-stop'), [sendSignal]);
+
     return {
         sendMessage,
         onMessage,
+        isWaiting,
+        knocks,
+        admit,
+        deny,
+        kick,
+        ban,
+        requestMute,
+        muteRequest,
+        clearMuteRequest,
+        isRecording,
+        startRecording,
+        stopRecording,
         dataChannelOpen,
+        remoteStreams,
         connectionState,
         iceConnectionState,
         isReconnecting,
@@ -0,0 +1,41 @@
+import { TokenManager } from './tokenManager';
+
+const API_BASE_URL = (import.meta.env.VITE_API_BASE_URL || 'http://localhost:8080').replace(/\/$/, '');
+
+/**
+ * Public STUN servers used until the backend's list arrives, or when it
+ * cannot be reached. They do not relay, so peers behind strict NATs still
+ * need the TURN servers the backend hands out.
+ */
+export const DEFAULT_ICE_SERVERS: RTCIceServer[] = [
+  { urls: 'stun:stun.l.google.com:19302' },
+  { urls: 'stun:stun1.l.google.com:19302' },
+  { urls: 'stun:stun2.l.google.com:19302' },
+];
+
+interface IceServersResponse {
+  ice_servers: RTCIceServer[];
+  ttl: number;
+  expires_at: string;
+}
+
+/**
+ * Fetches the ICE servers for this user from the backend. TURN entries carry
+ * short-lived credentials, so fetch again before opening a new call.
+ */
+export const fetchIceServers = async (): Promise<RTCIceServer[]> => {
+  const token = TokenManager.getAccessToken();
+  try {
+    const response = await fetch(`${API_BASE_URL}/ice-servers`, {
+      headers: token ? { Authorization: `Bearer ${token}` } : {},
+    });
+    if (!response.ok) {
+      return DEFAULT_ICE_SERVERS;
+    }
+    const data: IceServersResponse = await response.json();
+    return data.ice_servers?.length ? data.ice_servers : DEFAULT_ICE_SERVERS;
+  } catch (error) {
+    console.warn('[WebRTC] Could not load ICE servers, using defaults:', error);
+    return DEFAULT_ICE_SERVERS;
+  }
+};
@@ -0,0 +1,24 @@
+import { TokenManager } from './tokenManager';
+
+// Must match auth.WebSocketProtocol and auth.WebSocketTokenPrefix on the backend
+const SOCKET_PROTOCOL = 'seaside';
+const SOCKET_TOKEN_PREFIX = 'access_token.';
+
+/**
+ * Subprotocols to open a room socket with. Browsers cannot set headers on
+ * WebSocket requests, so the access token travels in Sec-WebSocket-Protocol.
+ * Guests send no token and join as guests.
+ */
+export const socketProtocols = (): string[] => {
+  const token = TokenManager.getAccessToken();
+  return token ? [SOCKET_PROTOCOL, SOCKET_TOKEN_PREFIX + token] : [SOCKET_PROTOCOL];
+};
+
+/**
+ * Appends the invite token from the page URL (?invite=...) to a room socket
+ * URL so invite links admit guests to invite-only rooms.
+ */
+export const withInvite = (url: string): string => {
+  const invite = new URLSearchParams(window.location.search).get('invite');
+  return invite ? `${url}&invite=${encodeURIComponent(invite)}` : url;
+};